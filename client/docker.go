@@ -3,24 +3,48 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"registry-factory/logger"
+	"registry-factory/metrics"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-
-	"log"
 )
 
 const (
 	dockerCmd = "docker"
 )
 
+//ErrNoSuchContainer is returned when the container is not existing in the docker daemon
+var ErrNoSuchContainer = errors.New("no such container")
+
+var metricCommandErrors = metrics.NewCounter("chameleon_docker_command_errors_total",
+	"Failed docker commands by the subcommand.", "command")
+
 //DockerClient : Run docker commands
 type DockerClient struct {
 	//The host sock of docker listening: unix:///var/docker
 	Host string
+	//Location of the client config files (e.g: registry credentials), docker default if it's empty
+	ConfigDir string
+	//ID of the request which runs the commands, attached to the logs of commands
+	RequestID string
+}
+
+//WithRequest returns the copy of client whose command logs carry the request ID
+func (dc *DockerClient) WithRequest(requestID string) *DockerClient {
+	c := *dc
+	c.RequestID = requestID
+
+	return &c
 }
 
 //Status : Check if docker daemon is there
@@ -71,13 +95,14 @@ func (dc *DockerClient) Login(userName, password string, uri string) error {
 		return errors.New("Invalid credential")
 	}
 
-	args := []string{"login", "-u", userName, "-p", password, uri}
+	//Keep the password out of the process list and logs
+	args := []string{"login", "-u", userName, "--password-stdin", uri}
 
-	return dc.runCommandWithOutputs(dockerCmd, dc.arguments(args))
+	return dc.runCommandWithInput(dockerCmd, dc.arguments(args), strings.NewReader(password))
 }
 
 //Run containers
-func (dc *DockerClient) Run(image, name, cmd string, isInteractive, asDaemon bool, bindPorts []string, env map[string]string) (string, error) {
+func (dc *DockerClient) Run(image, name, cmd string, isInteractive, asDaemon bool, bindPorts []string, env map[string]string, labels map[string]string) (string, error) {
 	if len(strings.TrimSpace(image)) == 0 {
 		return "", errors.New("image must be specified")
 	}
@@ -103,10 +128,18 @@ func (dc *DockerClient) Run(image, name, cmd string, isInteractive, asDaemon boo
 		args = append(args, "-d")
 	}
 
-	for k, v := range env {
-		//TODO: not support escaping quotes.
-		envStr := fmt.Sprintf(`%s=%s`, k, v)
-		args = append(args, "-e", envStr)
+	//In the file rather than the arguments which are logged and seen by ps
+	if len(env) > 0 {
+		envFile, err := writeEnvFile(env)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(envFile)
+		args = append(args, "--env-file", envFile)
+	}
+
+	for k, v := range labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", k, v))
 	}
 
 	args = append(args, image)
@@ -117,6 +150,148 @@ func (dc *DockerClient) Run(image, name, cmd string, isInteractive, asDaemon boo
 	return dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
 }
 
+//writeEnvFile writes the env vars to the temp file only readable by the owner
+func writeEnvFile(env map[string]string) (string, error) {
+	names := make([]string, 0, len(env))
+	for k, v := range env {
+		if strings.ContainsAny(k, "=\n") || strings.Contains(v, "\n") {
+			return "", fmt.Errorf("invalid env var %s: '=' in name or newline is not supported", k)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	//Created with 0600
+	f, err := ioutil.TempFile("", "docker-env-")
+	if err != nil {
+		return "", err
+	}
+	for _, k := range names {
+		fmt.Fprintf(f, "%s=%s\n", k, env[k])
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+//Port returns the host port which the container port is published to
+func (dc *DockerClient) Port(container string, containerPort int) (int, error) {
+	if len(strings.TrimSpace(container)) == 0 {
+		return 0, errors.New("empty container")
+	}
+
+	args := []string{"port", container, fmt.Sprintf("%d/tcp", containerPort)}
+	output, err := dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
+	if err != nil {
+		return 0, err
+	}
+
+	//e.g: 0.0.0.0:32768
+	//     [::]:32768
+	mapping := strings.TrimSpace(strings.Split(output, "\n")[0])
+	idx := strings.LastIndex(mapping, ":")
+	if idx < 0 {
+		return 0, fmt.Errorf("unexpected port mapping: %s", mapping)
+	}
+
+	return strconv.Atoi(mapping[idx+1:])
+}
+
+//Exec runs the command in the container
+func (dc *DockerClient) Exec(container string, command []string) error {
+	if len(strings.TrimSpace(container)) == 0 {
+		return errors.New("empty container")
+	}
+
+	if len(command) == 0 {
+		return errors.New("empty command")
+	}
+
+	args := []string{"exec", container}
+	args = append(args, command...)
+
+	return dc.runCommand(dockerCmd, dc.arguments(args))
+}
+
+//IsRunning checks whether the container is still running
+func (dc *DockerClient) IsRunning(container string) (bool, error) {
+	if len(strings.TrimSpace(container)) == 0 {
+		return false, errors.New("empty container")
+	}
+
+	args := []string{"inspect", "-f", "{{.State.Running}}", container}
+	output, err := dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(output) == "true", nil
+}
+
+//Events streams the IDs of the containers which have the specified events, e.g: die.
+//The channel is closed when the context is done or the stream is broken.
+func (dc *DockerClient) Events(ctx context.Context, events ...string) (<-chan string, error) {
+	args := []string{"events", "--filter", "type=container", "--format", "{{.ID}}"}
+	for _, event := range events {
+		args = append(args, "--filter", fmt.Sprintf("event=%s", event))
+	}
+
+	cmd := exec.CommandContext(ctx, dockerCmd, dc.arguments(args)...)
+	dc.log().Command(cmd.Args)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, commandFailed(cmd.Args, err)
+	}
+
+	ids := make(chan string)
+	go func() {
+		defer close(ids)
+		defer cmd.Wait()
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case ids <- strings.TrimSpace(scanner.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ids, nil
+}
+
+//MemoryUsage returns the total memory usage (percent) of the running containers
+func (dc *DockerClient) MemoryUsage() (float64, error) {
+	args := []string{"stats", "--no-stream", "--format", "{{.MemPerc}}"}
+	output, err := dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0.0
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), "%")
+		if len(line) == 0 {
+			continue
+		}
+		perc, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected memory usage: %s", line)
+		}
+		total += perc
+	}
+
+	return total, nil
+}
+
 //Destroy container
 func (dc *DockerClient) Destroy(container string) error {
 	if len(strings.TrimSpace(container)) == 0 {
@@ -124,11 +299,23 @@ func (dc *DockerClient) Destroy(container string) error {
 	}
 
 	args := []string{"rm", "-f", container}
-	return dc.runCommandWithOutputs(dockerCmd, dc.arguments(args))
+	cmd := exec.Command(dockerCmd, dc.arguments(args)...)
+	dc.log().Command(cmd.Args)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	//Already gone, e.g: removed by hand or by the daemon
+	if strings.Contains(strings.ToLower(string(output)), "no such container") {
+		return ErrNoSuchContainer
+	}
+	dc.log().Warnf("[%s] ERROR: %s", dockerCmd, output)
+
+	return commandFailed(cmd.Args, err)
 }
 
 //Commit ...
-func (dc *DockerClient) Commit(container string, image, tag string) error {
+func (dc *DockerClient) Commit(container string, image, tag string, labels map[string]string) error {
 	if len(strings.TrimSpace(container)) == 0 {
 		return errors.New("empty container")
 	}
@@ -143,11 +330,187 @@ func (dc *DockerClient) Commit(container string, image, tag string) error {
 	}
 
 	fullNS := fmt.Sprintf("%s:%s", image, tag)
-	args := []string{"commit", container, fullNS}
+	args := []string{"commit"}
+	for k, v := range labels {
+		args = append(args, "--change", fmt.Sprintf("LABEL %s=%s", k, v))
+	}
+	args = append(args, container, fullNS)
 
 	return dc.runCommandWithOutputs(dockerCmd, dc.arguments(args))
 }
 
+//CopyFrom streams the file or directory in the container as a tar archive,
+//the caller should close it and the error of copy is returned on closing.
+func (dc *DockerClient) CopyFrom(container, srcPath string) (io.ReadCloser, error) {
+	if len(strings.TrimSpace(container)) == 0 {
+		return nil, errors.New("empty container")
+	}
+
+	args := []string{"cp", fmt.Sprintf("%s:%s", container, srcPath), "-"}
+	cmd := exec.Command(dockerCmd, dc.arguments(args)...)
+	dc.log().Command(cmd.Args)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, commandFailed(cmd.Args, err)
+	}
+
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+//commandReader reads the stdout of command and waits it on closing
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+//Close ...
+func (cr *commandReader) Close() error {
+	//Drain the output to let the command exit
+	io.Copy(ioutil.Discard, cr.ReadCloser)
+	if err := commandFailed(cr.cmd.Args, cr.cmd.Wait()); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(cr.stderr.String()))
+	}
+
+	return nil
+}
+
+//Container is the brief info of container
+type Container struct {
+	ID      string
+	Image   string
+	Running bool
+	Labels  map[string]string
+	//Host ports of the container ports, e.g: 80 -> 30001
+	Ports map[int]int
+}
+
+//ListContainers lists all the containers having the label (k=v or k)
+func (dc *DockerClient) ListContainers(label string) ([]Container, error) {
+	args := []string{"ps", "-a", "--no-trunc", "--filter", fmt.Sprintf("label=%s", label), "--format", "{{json .}}"}
+	output, err := dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]Container, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		item := struct {
+			ID     string `json:"ID"`
+			Image  string `json:"Image"`
+			State  string `json:"State"`
+			Labels string `json:"Labels"`
+			Ports  string `json:"Ports"`
+		}{}
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return nil, err
+		}
+
+		containers = append(containers, Container{
+			ID:      item.ID,
+			Image:   item.Image,
+			Running: item.State == "running",
+			Labels:  parseLabels(item.Labels),
+			Ports:   parsePorts(item.Ports),
+		})
+	}
+
+	return containers, nil
+}
+
+//ImageInfo is the brief info of image
+type ImageInfo struct {
+	Repository string
+	Tag        string
+	Created    time.Time
+}
+
+//ListImages lists all the images having the label (k=v or k)
+func (dc *DockerClient) ListImages(label string) ([]ImageInfo, error) {
+	args := []string{"images", "--filter", fmt.Sprintf("label=%s", label), "--format", "{{json .}}"}
+	output, err := dc.runCommandWithOutput2(dockerCmd, dc.arguments(args))
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]ImageInfo, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		item := struct {
+			Repository string `json:"Repository"`
+			Tag        string `json:"Tag"`
+			CreatedAt  string `json:"CreatedAt"`
+		}{}
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return nil, err
+		}
+
+		//e.g: 2018-04-02 10:01:02 +0800 CST
+		created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", item.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, ImageInfo{
+			Repository: item.Repository,
+			Tag:        item.Tag,
+			Created:    created,
+		})
+	}
+
+	return images, nil
+}
+
+//parseLabels parses labels like "k1=v1,k2=v2"
+func parseLabels(raw string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			labels[kv[0]] = kv[1]
+		}
+	}
+
+	return labels
+}
+
+//parsePorts parses ports like "0.0.0.0:30001->80/tcp, :::30001->80/tcp"
+func parsePorts(raw string) map[int]int {
+	ports := make(map[int]int)
+	for _, mapping := range strings.Split(raw, ",") {
+		parts := strings.Split(strings.TrimSpace(mapping), "->")
+		if len(parts) != 2 {
+			continue
+		}
+
+		idx := strings.LastIndex(parts[0], ":")
+		hostPort, err := strconv.Atoi(parts[0][idx+1:])
+		if err != nil {
+			continue
+		}
+		containerPort, err := strconv.Atoi(strings.Split(parts[1], "/")[0])
+		if err != nil {
+			continue
+		}
+		ports[containerPort] = hostPort
+	}
+
+	return ports
+}
+
 //RMImage ...
 func (dc *DockerClient) RMImage(image string) error {
 	if len(strings.TrimSpace(image)) == 0 {
@@ -158,12 +521,17 @@ func (dc *DockerClient) RMImage(image string) error {
 	return dc.runCommandWithOutputs(dockerCmd, dc.arguments(args))
 }
 
+//log returns the logger with the request ID of client
+func (dc *DockerClient) log() *logger.Entry {
+	return logger.WithRequest(dc.RequestID)
+}
+
 func (dc *DockerClient) runCommandWithOutput2(cmdName string, args []string) (string, error) {
 	cmd := exec.Command(cmdName, args...)
-	log.Printf("command: %s\n", cmd.Args)
+	dc.log().Command(cmd.Args)
 	cmdOutput := &bytes.Buffer{}
 	cmd.Stdout = cmdOutput
-	if err := cmd.Run(); err != nil {
+	if err := commandFailed(cmd.Args, cmd.Run()); err != nil {
 		return "", err
 	}
 
@@ -174,12 +542,14 @@ func (dc *DockerClient) runCommandWithOutput2(cmdName string, args []string) (st
 }
 
 func (dc *DockerClient) runCommand(cmdName string, args []string) error {
-	return exec.Command(cmdName, args...).Run()
+	cmd := exec.Command(cmdName, args...)
+
+	return commandFailed(cmd.Args, cmd.Run())
 }
 
 func (dc *DockerClient) runCommandWithOutput(cmdName string, args []string) error {
 	cmd := exec.Command(cmdName, args...)
-	log.Printf("command: %s\n", cmd.Args)
+	dc.log().Command(cmd.Args)
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -188,20 +558,26 @@ func (dc *DockerClient) runCommandWithOutput(cmdName string, args []string) erro
 	scanner := bufio.NewScanner(cmdReader)
 	go func() {
 		for scanner.Scan() {
-			log.Printf("%s out | %s\n", cmdName, scanner.Text())
+			dc.log().Infof("%s out | %s", cmdName, scanner.Text())
 		}
 	}()
 
 	if err = cmd.Start(); err != nil {
-		return err
+		return commandFailed(cmd.Args, err)
 	}
 
-	return cmd.Wait()
+	return commandFailed(cmd.Args, cmd.Wait())
 }
 
 func (dc *DockerClient) runCommandWithOutputs(cmdName string, args []string) error {
+	return dc.runCommandWithInput(cmdName, args, nil)
+}
+
+//runCommandWithInput runs the command with the stdin and logs the outputs
+func (dc *DockerClient) runCommandWithInput(cmdName string, args []string, stdin io.Reader) error {
 	cmd := exec.Command(cmdName, args...)
-	log.Printf("command: %s\n", cmd.Args)
+	cmd.Stdin = stdin
+	dc.log().Command(cmd.Args)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -213,7 +589,7 @@ func (dc *DockerClient) runCommandWithOutputs(cmdName string, args []string) err
 	}
 
 	if err = cmd.Start(); err != nil {
-		return err
+		return commandFailed(cmd.Args, err)
 	}
 
 	output, err := ioutil.ReadAll(stdout)
@@ -221,23 +597,49 @@ func (dc *DockerClient) runCommandWithOutputs(cmdName string, args []string) err
 		return err
 	}
 	if len(output) > 0 {
-		log.Printf("[%s] OUT: %s", cmdName, output)
+		dc.log().Infof("[%s] OUT: %s", cmdName, output)
 	}
 
 	errData, _ := ioutil.ReadAll(stderr)
 	if len(errData) > 0 {
-		log.Printf("[%s] ERROR: %s", cmdName, errData)
+		dc.log().Warnf("[%s] ERROR: %s", cmdName, errData)
 	}
 
 	if err = cmd.Wait(); err != nil {
-		return err
+		return commandFailed(cmd.Args, err)
 	}
 
 	return nil
 }
 
+//commandFailed counts the error of the docker command by its subcommand and returns it
+func commandFailed(argv []string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	subcommand := ""
+	for i := 1; i < len(argv); i++ {
+		if argv[i] == "--config" {
+			//Skip the value
+			i++
+			continue
+		}
+		if !strings.HasPrefix(argv[i], "-") {
+			subcommand = argv[i]
+			break
+		}
+	}
+	metricCommandErrors.Inc(subcommand)
+
+	return err
+}
+
 func (dc *DockerClient) arguments(args []string) []string {
 	argList := []string{}
+	if len(strings.TrimSpace(dc.ConfigDir)) > 0 {
+		argList = append(argList, "--config", dc.ConfigDir)
+	}
 	if len(strings.TrimSpace(dc.Host)) > 0 {
 		argList = append(argList, fmt.Sprintf("-H %s", dc.Host))
 	}
@@ -0,0 +1,232 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//Types of artifact
+const (
+	ArtifactTypeImage   = "IMAGE"
+	ArtifactTypeUnknown = "UNKNOWN"
+)
+
+//Artifact of harbor, an image in the v1 API is an artifact with one tag
+type Artifact struct {
+	ID     int64  `json:"id"`
+	Digest string `json:"digest"`
+	Type   string `json:"type"`
+	//Media type of the config
+	MediaType         string            `json:"media_type"`
+	ManifestMediaType string            `json:"manifest_media_type"`
+	Size              int64             `json:"size"`
+	PushTime          time.Time         `json:"push_time"`
+	Tags              []*Tag            `json:"tags"`
+	Labels            []*Label          `json:"labels"`
+	Annotations       map[string]string `json:"annotations"`
+}
+
+//Tag of artifact
+type Tag struct {
+	ID       int64     `json:"id"`
+	Name     string    `json:"name"`
+	PushTime time.Time `json:"push_time"`
+}
+
+//v1Tag is the image of the v1 API
+type v1Tag struct {
+	Digest  string    `json:"digest"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Labels  []*Label  `json:"labels"`
+}
+
+func (t *v1Tag) artifact() *Artifact {
+	return &Artifact{
+		Digest:   t.Digest,
+		Type:     ArtifactTypeImage,
+		Size:     t.Size,
+		PushTime: t.Created,
+		Tags:     []*Tag{{Name: t.Name, PushTime: t.Created}},
+		Labels:   t.Labels,
+	}
+}
+
+//GetArtifact gets the artifact by the reference (tag or digest)
+func (c *Client) GetArtifact(project, repo, reference string) (*Artifact, error) {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	v2, _ := c.isV2()
+	if !v2 {
+		tag := &v1Tag{}
+		if _, err := c.do(http.MethodGet, fmt.Sprintf("%s/tags/%s", apiPath, url.PathEscape(reference)), nil, nil, tag); err != nil {
+			return nil, err
+		}
+		return tag.artifact(), nil
+	}
+
+	query := url.Values{}
+	query.Set("with_tag", "true")
+	query.Set("with_label", "true")
+	artifact := &Artifact{}
+	if _, err := c.do(http.MethodGet, fmt.Sprintf("%s/artifacts/%s", apiPath, url.PathEscape(reference)), query, nil, artifact); err != nil {
+		return nil, err
+	}
+
+	return artifact, nil
+}
+
+//ArtifactExists checks whether the artifact is existing
+func (c *Client) ArtifactExists(project, repo, reference string) (bool, error) {
+	_, err := c.GetArtifact(project, repo, reference)
+	if IsNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+//ListArtifacts lists the artifacts of the repository
+func (c *Client) ListArtifacts(project, repo string) ([]*Artifact, error) {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	v2, _ := c.isV2()
+	if !v2 {
+		//Not paginated
+		tags := make([]*v1Tag, 0)
+		if _, err := c.do(http.MethodGet, apiPath+"/tags", nil, nil, &tags); err != nil {
+			return nil, err
+		}
+		artifacts := make([]*Artifact, 0, len(tags))
+		for _, t := range tags {
+			artifacts = append(artifacts, t.artifact())
+		}
+		return artifacts, nil
+	}
+
+	query := url.Values{}
+	query.Set("with_tag", "true")
+	query.Set("with_label", "true")
+	artifacts := make([]*Artifact, 0)
+	err = c.list(apiPath+"/artifacts", query, func(data []byte) (int, error) {
+		page := make([]*Artifact, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		artifacts = append(artifacts, page...)
+
+		return len(page), nil
+	})
+
+	return artifacts, err
+}
+
+//DeleteArtifact deletes the artifact by reference, only the tag is deleted in the v1 API
+func (c *Client) DeleteArtifact(project, repo, reference string) error {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return err
+	}
+
+	resource := "artifacts"
+	if v2, _ := c.isV2(); !v2 {
+		resource = "tags"
+	}
+
+	_, err = c.do(http.MethodDelete, fmt.Sprintf("%s/%s/%s", apiPath, resource, url.PathEscape(reference)), nil, nil, nil)
+	return err
+}
+
+//ListTags lists the tags of the artifact
+func (c *Client) ListTags(project, repo, reference string) ([]*Tag, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return nil, err
+	}
+
+	if !v2 {
+		//Tags of the same digest
+		artifact, err := c.GetArtifact(project, repo, reference)
+		if err != nil {
+			return nil, err
+		}
+		all, err := c.ListArtifacts(project, repo)
+		if err != nil {
+			return nil, err
+		}
+		tags := make([]*Tag, 0)
+		for _, a := range all {
+			if a.Digest == artifact.Digest {
+				tags = append(tags, a.Tags...)
+			}
+		}
+		return tags, nil
+	}
+
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]*Tag, 0)
+	err = c.list(fmt.Sprintf("%s/artifacts/%s/tags", apiPath, url.PathEscape(reference)), nil, func(data []byte) (int, error) {
+		page := make([]*Tag, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		tags = append(tags, page...)
+
+		return len(page), nil
+	})
+
+	return tags, err
+}
+
+//CreateTag adds the tag to the artifact
+func (c *Client) CreateTag(project, repo, reference, tag string) error {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return err
+	}
+
+	if v2, _ := c.isV2(); !v2 {
+		//Retag
+		_, err = c.do(http.MethodPost, apiPath+"/tags", nil, map[string]interface{}{
+			"tag":       tag,
+			"src_image": fmt.Sprintf("%s/%s:%s", project, repo, reference),
+			"override":  true,
+		}, nil)
+		return err
+	}
+
+	_, err = c.do(http.MethodPost, fmt.Sprintf("%s/artifacts/%s/tags", apiPath, url.PathEscape(reference)), nil, map[string]string{
+		"name": tag,
+	}, nil)
+	return err
+}
+
+//DeleteTag removes the tag from the artifact
+func (c *Client) DeleteTag(project, repo, reference, tag string) error {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return err
+	}
+
+	if v2, _ := c.isV2(); !v2 {
+		_, err = c.do(http.MethodDelete, fmt.Sprintf("%s/tags/%s", apiPath, url.PathEscape(tag)), nil, nil, nil)
+		return err
+	}
+
+	_, err = c.do(http.MethodDelete, fmt.Sprintf("%s/artifacts/%s/tags/%s", apiPath, url.PathEscape(reference), url.PathEscape(tag)), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,282 @@
+package harbor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//API versions of harbor
+const (
+	APIVersion1 = "v1"
+	APIVersion2 = "v2"
+
+	apiPrefixV1 = "/api"
+	apiPrefixV2 = "/api/v2.0"
+
+	defaultPageSize = 100
+	defaultTimeout  = 30 * time.Second
+)
+
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+//Options of the client
+type Options struct {
+	//v1 or v2, detected with the systeminfo API if it's empty
+	APIVersion string
+	//Skip verifying the certificate of harbor
+	Insecure bool
+	//Credential overrides the username and password if it's set, e.g: rotated robot account
+	Credential func() (string, string)
+	PageSize   int
+	Timeout    time.Duration
+}
+
+//Client calls the harbor API with the basic auth
+type Client struct {
+	endpoint   string
+	username   string
+	password   string
+	credential func() (string, string)
+	pageSize   int
+	httpClient *http.Client
+
+	lock    *sync.Mutex
+	version string
+}
+
+//NewClient creates the client of harbor at the endpoint (e.g: https://harbor.local)
+func NewClient(endpoint, username, password string, opts *Options) *Client {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		username:   username,
+		password:   password,
+		credential: opts.Credential,
+		pageSize:   pageSize,
+		httpClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: opts.Insecure,
+				},
+			},
+		},
+		lock:    new(sync.Mutex),
+		version: opts.APIVersion,
+	}
+}
+
+//Endpoint of harbor
+func (c *Client) Endpoint() string {
+	return c.endpoint
+}
+
+//Version returns the API version of harbor, it's detected on the 1st call
+func (c *Client) Version() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.version) > 0 {
+		return c.version, nil
+	}
+
+	for _, candidate := range []struct{ version, prefix string }{
+		{APIVersion2, apiPrefixV2},
+		{APIVersion1, apiPrefixV1},
+	} {
+		req, err := http.NewRequest(http.MethodGet, c.endpoint+candidate.prefix+"/systeminfo", nil)
+		if err != nil {
+			return "", err
+		}
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusOK {
+			c.version = candidate.version
+			return c.version, nil
+		}
+	}
+
+	return "", fmt.Errorf("no harbor API found at %s", c.endpoint)
+}
+
+//isV2 reports whether the v2 API is used
+func (c *Client) isV2() (bool, error) {
+	version, err := c.Version()
+	if err != nil {
+		return false, err
+	}
+
+	return version == APIVersion2, nil
+}
+
+//api returns the URL of the API path
+func (c *Client) api(path string, query url.Values) (string, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return "", err
+	}
+
+	prefix := apiPrefixV1
+	if v2 {
+		prefix = apiPrefixV2
+	}
+
+	u := c.endpoint + prefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	return u, nil
+}
+
+//do the request to the API path, the response is decoded into out if it's not nil
+func (c *Client) do(method, path string, query url.Values, in, out interface{}) (*http.Response, error) {
+	u, err := c.api(path, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doURL(method, u, in, out)
+}
+
+func (c *Client) doURL(method, u string, in, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	username, password := c.username, c.password
+	if c.credential != nil {
+		username, password = c.credential()
+	}
+	if len(username) > 0 {
+		req.SetBasicAuth(username, password)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res, newError(res)
+	}
+
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil && err != io.EOF {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+//list all the pages of the API path, each page is decoded by the page func
+func (c *Client) list(path string, query url.Values, page func(data []byte) (int, error)) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("page", "1")
+	query.Set("page_size", strconv.Itoa(c.pageSize))
+
+	u, err := c.api(path, query)
+	if err != nil {
+		return err
+	}
+
+	for len(u) > 0 {
+		raw := json.RawMessage{}
+		res, err := c.doURL(http.MethodGet, u, nil, &raw)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		if len(raw) > 0 && string(raw) != "null" {
+			if n, err = page(raw); err != nil {
+				return err
+			}
+		}
+
+		u = ""
+		if m := linkNext.FindStringSubmatch(res.Header.Get("Link")); len(m) == 2 {
+			next, err := url.Parse(c.endpoint)
+			if err != nil {
+				return err
+			}
+			if next, err = next.Parse(m[1]); err != nil {
+				return err
+			}
+			u = next.String()
+		} else if len(res.Header.Get("Link")) == 0 && len(res.Header.Get("X-Total-Count")) == 0 && n == c.pageSize {
+			//Old harbor without pagination headers, try next page until a short one
+			query.Set("page", strconv.Itoa(pageOf(query)+1))
+			if u, err = c.api(path, query); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func pageOf(query url.Values) int {
+	page, _ := strconv.Atoi(query.Get("page"))
+	return page
+}
+
+//escapeRepo escapes the repository name in path of the v2 API, slashes must be double escaped
+func escapeRepo(repo string) string {
+	return url.PathEscape(url.PathEscape(repo))
+}
+
+//escapeV1Repo escapes the repository name in path of the v1 API, the slashes are kept as the v1 routes match them
+func escapeV1Repo(repo string) string {
+	segments := strings.Split(repo, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,176 @@
+package harbor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+//fakeHarbor serves the systeminfo API of the versions and the pages of the projects
+type fakeHarbor struct {
+	lock     sync.Mutex
+	versions map[string]bool
+	projects []string
+	//Link: the v2 API, total: only X-Total-Count, none: old harbor without pagination headers
+	pagination   string
+	systemInfos  int
+	requestPaths []string
+}
+
+func newFakeHarbor(t *testing.T, versions ...string) (*fakeHarbor, *httptest.Server) {
+	fh := &fakeHarbor{versions: make(map[string]bool), pagination: "link"}
+	for _, v := range versions {
+		fh.versions[v] = true
+	}
+	server := httptest.NewServer(fh)
+	t.Cleanup(server.Close)
+
+	return fh, server
+}
+
+func (fh *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+
+	fh.requestPaths = append(fh.requestPaths, r.URL.EscapedPath())
+	prefixes := map[string]string{APIVersion2: apiPrefixV2, APIVersion1: apiPrefixV1}
+	for version, prefix := range prefixes {
+		if !fh.versions[version] {
+			continue
+		}
+		switch r.URL.Path {
+		case prefix + "/systeminfo":
+			fh.systemInfos++
+			fmt.Fprint(w, `{"harbor_version":"`+version+`"}`)
+			return
+		case prefix + "/projects":
+			fh.projectsPage(w, r, prefix)
+			return
+		}
+	}
+
+	if fh.versions[APIVersion2] {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":"NOT_FOUND","message":"`+r.URL.Path+` not found"}]}`)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (fh *fakeHarbor) projectsPage(w http.ResponseWriter, r *http.Request, prefix string) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if page < 1 || size < 1 {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+
+	start, end := (page-1)*size, page*size
+	if start > len(fh.projects) {
+		start = len(fh.projects)
+	}
+	if end > len(fh.projects) {
+		end = len(fh.projects)
+	}
+	switch fh.pagination {
+	case "link":
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(fh.projects)))
+		if end < len(fh.projects) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/projects?page=%d&page_size=%d>; rel="next"`, prefix, page+1, size))
+		}
+	case "total":
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(fh.projects)))
+	}
+
+	fmt.Fprint(w, "[")
+	for i, name := range fh.projects[start:end] {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"project_id":%d,"name":"%s"}`, start+i+1, name)
+	}
+	fmt.Fprint(w, "]")
+}
+
+func TestVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		versions []string
+		version  string
+		wantErr  bool
+	}{
+		{"v2", []string{APIVersion2}, APIVersion2, false},
+		{"v1", []string{APIVersion1}, APIVersion1, false},
+		{"both", []string{APIVersion1, APIVersion2}, APIVersion2, false},
+		{"none", nil, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh, server := newFakeHarbor(t, tc.versions...)
+			c := NewClient(server.URL, "admin", "Harbor12345", nil)
+
+			version, err := c.Version()
+			if (err != nil) != tc.wantErr || version != tc.version {
+				t.Fatalf("Version() = %s, %v, want %s", version, err, tc.version)
+			}
+			if tc.wantErr {
+				return
+			}
+			//Detected once
+			c.Version()
+			if fh.systemInfos != 1 {
+				t.Errorf("systeminfo is called %d times, want 1", fh.systemInfos)
+			}
+		})
+	}
+
+	//Not detected if it's configured
+	fh, server := newFakeHarbor(t, APIVersion1, APIVersion2)
+	c := NewClient(server.URL, "admin", "Harbor12345", &Options{APIVersion: APIVersion1})
+	if version, err := c.Version(); err != nil || version != APIVersion1 || fh.systemInfos != 0 {
+		t.Errorf("Version() = %s, %v with %d systeminfo calls, want the configured one", version, err, fh.systemInfos)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	names := []string{"npm", "pip", "team", "ops", "dev"}
+	for _, tc := range []struct {
+		name       string
+		version    string
+		pagination string
+		pageSize   int
+		projects   int
+		requests   int
+	}{
+		{"link header", APIVersion2, "link", 2, 5, 3},
+		{"link header of full pages", APIVersion2, "link", 5, 5, 1},
+		{"total count only", APIVersion1, "total", 2, 2, 1},
+		{"no headers", APIVersion1, "none", 2, 5, 3},
+		{"no headers of full pages", APIVersion1, "none", 5, 5, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh, server := newFakeHarbor(t, tc.version)
+			fh.projects = names
+			fh.pagination = tc.pagination
+			c := NewClient(server.URL, "admin", "Harbor12345", &Options{APIVersion: tc.version, PageSize: tc.pageSize})
+
+			projects, err := c.ListProjects("")
+			if err != nil {
+				t.Fatalf("ListProjects() error = %v", err)
+			}
+			if len(projects) != tc.projects {
+				t.Errorf("%d projects listed, want %d", len(projects), tc.projects)
+			}
+			for i, p := range projects {
+				if p.Name != names[i] || p.ID != int64(i+1) {
+					t.Errorf("project %d = %+v", i, p)
+				}
+			}
+			if len(fh.requestPaths) != tc.requests {
+				t.Errorf("%d pages requested, want %d", len(fh.requestPaths), tc.requests)
+			}
+		})
+	}
+}
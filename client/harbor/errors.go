@@ -0,0 +1,92 @@
+package harbor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Errors mapped from the status codes, check with errors.Is
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnsupported  = errors.New("not supported by the harbor API version")
+)
+
+//Error is returned when harbor responds with a non 2xx status
+type Error struct {
+	StatusCode int
+	//Error code of the v2 API, e.g: NOT_FOUND
+	Code    string
+	Message string
+}
+
+//Error ...
+func (e *Error) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("harbor: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("harbor: %d: %s", e.StatusCode, e.Message)
+}
+
+//Is maps the status code to the sentinel errors
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	}
+
+	return false
+}
+
+//newError reads the error of v2 API: {"errors":[{"code":"NOT_FOUND","message":"..."}]},
+//or the plain text of v1 API.
+func newError(res *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+	}
+
+	v2 := struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(data, &v2); err == nil && len(v2.Errors) > 0 {
+		e.Code = v2.Errors[0].Code
+		e.Message = v2.Errors[0].Message
+	}
+	if len(e.Message) == 0 {
+		e.Message = http.StatusText(res.StatusCode)
+	}
+
+	return e
+}
+
+//IsNotFound ...
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+//IsConflict ...
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
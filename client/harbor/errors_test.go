@@ -0,0 +1,83 @@
+package harbor
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	sentinels := []error{ErrBadRequest, ErrUnauthorized, ErrForbidden, ErrNotFound, ErrConflict}
+	for _, tc := range []struct {
+		status int
+		want   error
+	}{
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusInternalServerError, nil},
+	} {
+		err := error(&Error{StatusCode: tc.status})
+		for _, sentinel := range sentinels {
+			if errors.Is(err, sentinel) != (sentinel == tc.want) {
+				t.Errorf("errors.Is(%d, %s) = %v", tc.status, sentinel, !(sentinel == tc.want))
+			}
+		}
+	}
+
+	if !IsNotFound(&Error{StatusCode: http.StatusNotFound}) || IsNotFound(errors.New("not found")) {
+		t.Error("IsNotFound() is not mapped by the status code")
+	}
+	if !IsConflict(&Error{StatusCode: http.StatusConflict}) || IsConflict(nil) {
+		t.Error("IsConflict() is not mapped by the status code")
+	}
+}
+
+func TestNewError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		code    string
+		message string
+	}{
+		{"v2", http.StatusNotFound, `{"errors":[{"code":"NOT_FOUND","message":"project npm not found"}]}`, "NOT_FOUND", "project npm not found"},
+		{"v1", http.StatusConflict, "project npm already exists\n", "", "project npm already exists"},
+		{"empty", http.StatusForbidden, "", "", http.StatusText(http.StatusForbidden)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			w.WriteHeader(tc.status)
+			w.WriteString(tc.body)
+
+			err := newError(w.Result())
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("newError() = %T, want *Error", err)
+			}
+			if e.StatusCode != tc.status || e.Code != tc.code || e.Message != tc.message {
+				t.Errorf("newError() = %+v", e)
+			}
+			if !strings.Contains(e.Error(), tc.message) {
+				t.Errorf("Error() = %s", e.Error())
+			}
+		})
+	}
+}
+
+func TestClientError(t *testing.T) {
+	_, server := newFakeHarbor(t, APIVersion2)
+	c := NewClient(server.URL, "admin", "Harbor12345", nil)
+
+	_, err := c.do(http.MethodGet, "/missing", nil, nil, nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("do() error = %v, want %v", err, ErrNotFound)
+	}
+	if e := err.(*Error); e.Code != "NOT_FOUND" {
+		t.Errorf("error code = %s, want NOT_FOUND", e.Code)
+	}
+}
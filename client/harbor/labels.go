@@ -0,0 +1,100 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//Scopes of label
+const (
+	LabelScopeGlobal  = "g"
+	LabelScopeProject = "p"
+)
+
+//Label of harbor
+type Label struct {
+	ID          int64  `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Color       string `json:"color,omitempty"`
+	Scope       string `json:"scope"`
+	ProjectID   int64  `json:"project_id,omitempty"`
+}
+
+//ListLabels lists the labels of the project, the global ones if projectID is 0
+func (c *Client) ListLabels(projectID int64) ([]*Label, error) {
+	query := url.Values{}
+	query.Set("scope", LabelScopeGlobal)
+	if projectID > 0 {
+		query.Set("scope", LabelScopeProject)
+		query.Set("project_id", strconv.FormatInt(projectID, 10))
+	}
+
+	labels := make([]*Label, 0)
+	err := c.list("/labels", query, func(data []byte) (int, error) {
+		page := make([]*Label, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		labels = append(labels, page...)
+
+		return len(page), nil
+	})
+
+	return labels, err
+}
+
+//CreateLabel creates the label and returns its ID
+func (c *Client) CreateLabel(label *Label) (int64, error) {
+	res, err := c.do(http.MethodPost, "/labels", nil, label, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return idFromLocation(res)
+}
+
+//DeleteLabel ...
+func (c *Client) DeleteLabel(ID int64) error {
+	_, err := c.do(http.MethodDelete, fmt.Sprintf("/labels/%d", ID), nil, nil, nil)
+	return err
+}
+
+//AddArtifactLabel attaches the label to the artifact
+func (c *Client) AddArtifactLabel(project, repo, reference string, labelID int64) error {
+	apiPath, err := c.artifactLabelsPath(project, repo, reference)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodPost, apiPath, nil, map[string]int64{"id": labelID}, nil)
+	return err
+}
+
+//RemoveArtifactLabel detaches the label from the artifact
+func (c *Client) RemoveArtifactLabel(project, repo, reference string, labelID int64) error {
+	apiPath, err := c.artifactLabelsPath(project, repo, reference)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodDelete, fmt.Sprintf("%s/%d", apiPath, labelID), nil, nil, nil)
+	return err
+}
+
+func (c *Client) artifactLabelsPath(project, repo, reference string) (string, error) {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return "", err
+	}
+
+	resource := "artifacts"
+	if v2, _ := c.isV2(); !v2 {
+		resource = "tags"
+	}
+
+	return fmt.Sprintf("%s/%s/%s/labels", apiPath, resource, url.PathEscape(reference)), nil
+}
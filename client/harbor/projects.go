@@ -0,0 +1,117 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+//Project of harbor
+type Project struct {
+	ID           int64             `json:"project_id"`
+	Name         string            `json:"name"`
+	RepoCount    int64             `json:"repo_count"`
+	Metadata     map[string]string `json:"metadata"`
+	CreationTime time.Time         `json:"creation_time"`
+}
+
+//IsPublic reports whether the project can be pulled anonymously
+func (p *Project) IsPublic() bool {
+	return p.Metadata["public"] == "true"
+}
+
+//ProjectReq is the request of creating project
+type ProjectReq struct {
+	Name     string            `json:"project_name"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	//Bytes, -1 is unlimited
+	StorageLimit *int64 `json:"storage_limit,omitempty"`
+}
+
+//ListProjects lists the projects, filtered by the name if it's not empty
+func (c *Client) ListProjects(name string) ([]*Project, error) {
+	query := url.Values{}
+	if len(name) > 0 {
+		query.Set("name", name)
+	}
+
+	projects := make([]*Project, 0)
+	err := c.list("/projects", query, func(data []byte) (int, error) {
+		page := make([]*Project, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		projects = append(projects, page...)
+
+		return len(page), nil
+	})
+
+	return projects, err
+}
+
+//GetProject gets the project by name
+func (c *Client) GetProject(name string) (*Project, error) {
+	projects, err := c.ListProjects(name)
+	if err != nil {
+		return nil, err
+	}
+
+	//The name filter is fuzzy
+	for _, p := range projects {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+
+	return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("project %s not found", name)}
+}
+
+//ProjectExists checks whether the project is existing
+func (c *Client) ProjectExists(name string) (bool, error) {
+	_, err := c.GetProject(name)
+	if IsNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+//CreateProject creates the project and returns its ID
+func (c *Client) CreateProject(req *ProjectReq) (int64, error) {
+	res, err := c.do(http.MethodPost, "/projects", nil, req, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return idFromLocation(res)
+}
+
+//DeleteProject deletes the project by name
+func (c *Client) DeleteProject(name string) error {
+	p, err := c.GetProject(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodDelete, fmt.Sprintf("/projects/%d", p.ID), nil, nil, nil)
+	return err
+}
+
+//idFromLocation parses the ID of created resource from the location header
+func idFromLocation(res *http.Response) (int64, error) {
+	location := res.Header.Get("Location")
+	if len(location) == 0 {
+		return 0, nil
+	}
+
+	ID, err := strconv.ParseInt(path.Base(location), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid location of created resource: %s", location)
+	}
+
+	return ID, nil
+}
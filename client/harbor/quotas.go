@@ -0,0 +1,63 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//Resources of quota
+const (
+	ResourceStorage = "storage"
+	ResourceCount   = "count"
+)
+
+//ResourceList is the amount per resource, -1 is unlimited
+type ResourceList map[string]int64
+
+//Quota of project
+type Quota struct {
+	ID   int64        `json:"id"`
+	Hard ResourceList `json:"hard"`
+	Used ResourceList `json:"used"`
+}
+
+//GetProjectQuota gets the quota of project, harbor v1.9+ is required
+func (c *Client) GetProjectQuota(project string) (*Quota, error) {
+	p, err := c.GetProject(project)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("reference", "project")
+	query.Set("reference_id", strconv.FormatInt(p.ID, 10))
+
+	quotas := make([]*Quota, 0)
+	err = c.list("/quotas", query, func(data []byte) (int, error) {
+		page := make([]*Quota, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		quotas = append(quotas, page...)
+
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(quotas) == 0 {
+		return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("quota of project %s not found", project)}
+	}
+
+	return quotas[0], nil
+}
+
+//UpdateQuota updates the hard limits of quota
+func (c *Client) UpdateQuota(ID int64, hard ResourceList) error {
+	_, err := c.do(http.MethodPut, fmt.Sprintf("/quotas/%d", ID), nil, map[string]ResourceList{"hard": hard}, nil)
+	return err
+}
@@ -0,0 +1,95 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//Repository of harbor, the name is prefixed with the project
+type Repository struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	ProjectID     int64     `json:"project_id"`
+	ArtifactCount int64     `json:"artifact_count"`
+	PullCount     int64     `json:"pull_count"`
+	UpdateTime    time.Time `json:"update_time"`
+}
+
+//ListRepositories lists the repositories of the project
+func (c *Client) ListRepositories(project string) ([]*Repository, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return nil, err
+	}
+
+	apiPath := fmt.Sprintf("/projects/%s/repositories", url.PathEscape(project))
+	query := url.Values{}
+	if !v2 {
+		p, err := c.GetProject(project)
+		if err != nil {
+			return nil, err
+		}
+		apiPath = "/repositories"
+		query.Set("project_id", strconv.FormatInt(p.ID, 10))
+	}
+
+	repos := make([]*Repository, 0)
+	err = c.list(apiPath, query, func(data []byte) (int, error) {
+		page := make([]*v1Repository, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		for _, r := range page {
+			repos = append(repos, r.repository())
+		}
+
+		return len(page), nil
+	})
+
+	return repos, err
+}
+
+//DeleteRepository deletes the repository (without the project prefix) and all its artifacts
+func (c *Client) DeleteRepository(project, repo string) error {
+	apiPath, err := c.repoPath(project, repo)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodDelete, apiPath, nil, nil, nil)
+	return err
+}
+
+//repoPath returns the API path of the repository
+func (c *Client) repoPath(project, repo string) (string, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return "", err
+	}
+
+	if v2 {
+		return fmt.Sprintf("/projects/%s/repositories/%s", url.PathEscape(project), escapeRepo(repo)), nil
+	}
+
+	return fmt.Sprintf("/repositories/%s/%s", url.PathEscape(project), escapeV1Repo(repo)), nil
+}
+
+//v1Repository is the repository of both API versions, v1 counts the tags instead of artifacts
+type v1Repository struct {
+	Repository
+	TagsCount    int64     `json:"tags_count"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+func (r *v1Repository) repository() *Repository {
+	repo := r.Repository
+	if repo.ArtifactCount == 0 {
+		repo.ArtifactCount = r.TagsCount
+	}
+
+	return &repo
+}
@@ -0,0 +1,32 @@
+package harbor
+
+import (
+	"testing"
+)
+
+func TestRepoPath(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		repo    string
+		path    string
+	}{
+		{APIVersion2, "lodash", "/api/v2.0/projects/npm/repositories/lodash"},
+		{APIVersion2, "team/lodash", "/api/v2.0/projects/npm/repositories/team%252Flodash"},
+		{APIVersion2, "lodash?tag", "/api/v2.0/projects/npm/repositories/lodash%253Ftag"},
+		{APIVersion1, "lodash", "/api/repositories/npm/lodash"},
+		{APIVersion1, "team/lodash", "/api/repositories/npm/team/lodash"},
+		{APIVersion1, "lodash?tag", "/api/repositories/npm/lodash%3Ftag"},
+		{APIVersion1, "lodash#1/x y", "/api/repositories/npm/lodash%231/x%20y"},
+	} {
+		t.Run(tc.version+" "+tc.repo, func(t *testing.T) {
+			fh, server := newFakeHarbor(t, tc.version)
+			c := NewClient(server.URL, "admin", "Harbor12345", &Options{APIVersion: tc.version})
+
+			//Not found by the fake
+			c.DeleteRepository("npm", tc.repo)
+			if len(fh.requestPaths) != 1 || fh.requestPaths[0] != tc.path {
+				t.Errorf("requested paths = %v, want [%s]", fh.requestPaths, tc.path)
+			}
+		})
+	}
+}
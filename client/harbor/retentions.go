@@ -0,0 +1,60 @@
+package harbor
+
+import (
+	"net/http"
+)
+
+//RetentionReq is the request of the retention policy keeping the latest pushed artifacts
+type RetentionReq struct {
+	ProjectID int64
+	//Latest pushed artifacts kept in each repository
+	KeepLatest int
+	//Cron with seconds, e.g: 0 0 0 * * *
+	Schedule string
+}
+
+//CreateRetention creates the retention policy of project and returns its ID, only for v2 API
+func (c *Client) CreateRetention(req *RetentionReq) (int64, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return 0, err
+	}
+	if !v2 {
+		return 0, ErrUnsupported
+	}
+
+	doublestar := func(decoration string) map[string]string {
+		return map[string]string{"kind": "doublestar", "decoration": decoration, "pattern": "**"}
+	}
+	policy := map[string]interface{}{
+		"algorithm": "or",
+		"rules": []map[string]interface{}{{
+			"action":   "retain",
+			"template": "latestPushedK",
+			"params": map[string]interface{}{
+				"latestPushedK": req.KeepLatest,
+			},
+			"tag_selectors": []map[string]string{doublestar("matches")},
+			"scope_selectors": map[string]interface{}{
+				"repository": []map[string]string{doublestar("repoMatches")},
+			},
+		}},
+		"trigger": map[string]interface{}{
+			"kind": "Schedule",
+			"settings": map[string]string{
+				"cron": req.Schedule,
+			},
+		},
+		"scope": map[string]interface{}{
+			"level": "project",
+			"ref":   req.ProjectID,
+		},
+	}
+
+	res, err := c.do(http.MethodPost, "/retentions", nil, policy, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return idFromLocation(res)
+}
@@ -0,0 +1,177 @@
+package harbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//Resources and actions of robot access
+const (
+	ResourceRepository = "repository"
+	ResourceArtifact   = "artifact"
+	ResourceTag        = "tag"
+
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionRead   = "read"
+	ActionList   = "list"
+	ActionCreate = "create"
+)
+
+//RobotAccess is the permission of robot account in the project
+type RobotAccess struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+}
+
+//Robot account of project
+type Robot struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	//Only returned on creating or refreshing
+	Secret string `json:"secret,omitempty"`
+	//Unix seconds, -1 is never
+	ExpiresAt    int64     `json:"expires_at"`
+	Disabled     bool      `json:"disable"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+//RobotReq is the request of creating robot account
+type RobotReq struct {
+	Name        string
+	Description string
+	//Days, -1 is never expired
+	Duration int64
+	//Only the repository access is supported by the v1 API
+	Access []RobotAccess
+}
+
+//CreateRobot creates the robot account of project, the secret is in the returned robot.
+//Harbor v2.2+ is required for the v2 API.
+func (c *Client) CreateRobot(project string, req *RobotReq) (*Robot, error) {
+	p, err := c.GetProject(project)
+	if err != nil {
+		return nil, err
+	}
+
+	v2, _ := c.isV2()
+	if !v2 {
+		access := make([]RobotAccess, 0, len(req.Access))
+		for _, a := range req.Access {
+			if a.Resource == ResourceRepository {
+				access = append(access, RobotAccess{
+					Resource: fmt.Sprintf("/project/%d/repository", p.ID),
+					Action:   a.Action,
+				})
+			}
+		}
+		body := map[string]interface{}{
+			"name":        req.Name,
+			"description": req.Description,
+			"access":      access,
+		}
+		if req.Duration > 0 {
+			body["expires_at"] = time.Now().Add(time.Duration(req.Duration) * 24 * time.Hour).Unix()
+		}
+
+		created := struct {
+			Name  string `json:"name"`
+			Token string `json:"token"`
+		}{}
+		res, err := c.do(http.MethodPost, fmt.Sprintf("/projects/%d/robots", p.ID), nil, body, &created)
+		if err != nil {
+			return nil, err
+		}
+		ID, err := idFromLocation(res)
+		if err != nil {
+			return nil, err
+		}
+		return &Robot{ID: ID, Name: created.Name, Description: req.Description, Secret: created.Token}, nil
+	}
+
+	robot := &Robot{}
+	if _, err := c.do(http.MethodPost, "/robots", nil, map[string]interface{}{
+		"name":        req.Name,
+		"description": req.Description,
+		"duration":    req.Duration,
+		"level":       "project",
+		"permissions": []map[string]interface{}{{
+			"kind":      "project",
+			"namespace": project,
+			"access":    req.Access,
+		}},
+	}, robot); err != nil {
+		return nil, err
+	}
+	robot.Description = req.Description
+
+	return robot, nil
+}
+
+//ListRobots lists the robot accounts of project
+func (c *Client) ListRobots(project string) ([]*Robot, error) {
+	p, err := c.GetProject(project)
+	if err != nil {
+		return nil, err
+	}
+
+	apiPath := fmt.Sprintf("/projects/%d/robots", p.ID)
+	query := url.Values{}
+	if v2, _ := c.isV2(); v2 {
+		apiPath = "/robots"
+		query.Set("q", fmt.Sprintf("Level=project,ProjectID=%d", p.ID))
+	}
+
+	robots := make([]*Robot, 0)
+	err = c.list(apiPath, query, func(data []byte) (int, error) {
+		page := make([]*Robot, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		robots = append(robots, page...)
+
+		return len(page), nil
+	})
+
+	return robots, err
+}
+
+//DeleteRobot deletes the robot account of project
+func (c *Client) DeleteRobot(project string, ID int64) error {
+	if v2, _ := c.isV2(); v2 {
+		_, err := c.do(http.MethodDelete, fmt.Sprintf("/robots/%d", ID), nil, nil, nil)
+		return err
+	}
+
+	p, err := c.GetProject(project)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodDelete, fmt.Sprintf("/projects/%d/robots/%d", p.ID, ID), nil, nil, nil)
+	return err
+}
+
+//RefreshRobotSecret lets harbor generate a new secret of the robot account, only for v2 API
+func (c *Client) RefreshRobotSecret(ID int64) (string, error) {
+	v2, err := c.isV2()
+	if err != nil {
+		return "", err
+	}
+	if !v2 {
+		return "", ErrUnsupported
+	}
+
+	refreshed := struct {
+		Secret string `json:"secret"`
+	}{}
+	if _, err := c.do(http.MethodPatch, fmt.Sprintf("/robots/%d", ID), nil, map[string]string{}, &refreshed); err != nil {
+		return "", err
+	}
+
+	return refreshed.Secret, nil
+}
@@ -0,0 +1,423 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//Media types of the manifests
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+//ErrNotFound is returned when the manifest or blob does not exist
+var ErrNotFound = errors.New("not found in registry")
+
+//RegistryClient talks to the docker registry with the Registry v2 API
+type RegistryClient struct {
+	//e.g: https://registry-1.docker.io
+	Endpoint string
+	Username string
+	Password string
+	//Credential of the repository, it overrides the username and password if it's set
+	Credential func(repo string) (string, string)
+
+	httpClient *http.Client
+	lock       *sync.Mutex
+	//Authorization header per repository
+	auths map[string]string
+}
+
+//NewRegistryClient ...
+func NewRegistryClient(endpoint, username, password string, insecure bool) *RegistryClient {
+	return &RegistryClient{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Username: username,
+		Password: password,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: insecure,
+				},
+			},
+		},
+		lock:  new(sync.Mutex),
+		auths: make(map[string]string),
+	}
+}
+
+//GetManifest returns the manifest and its media type
+func (rc *RegistryClient) GetManifest(repo, reference string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, rc.url("/v2/%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		MediaTypeOCIIndex,
+		MediaTypeOCIManifest,
+		MediaTypeDockerManifestList,
+		MediaTypeDockerManifest,
+	}, ", "))
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, res.Header.Get("Content-Type"), nil
+}
+
+//PutManifest uploads the manifest with the reference (tag or digest)
+func (rc *RegistryClient) PutManifest(repo, reference, mediaType string, manifest []byte) error {
+	req, err := http.NewRequest(http.MethodPut, rc.url("/v2/%s/manifests/%s", repo, reference), strings.NewReader(string(manifest)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkStatus(res, http.StatusCreated)
+}
+
+//BlobExists checks whether the blob is existing in the repository
+func (rc *RegistryClient) BlobExists(repo, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, rc.url("/v2/%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//GetBlob returns the content of blob, the caller should close it
+func (rc *RegistryClient) GetBlob(repo, digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, rc.url("/v2/%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+//MountBlob mounts the blob from another repository of the same registry,
+//returns false if the registry does not mount it.
+func (rc *RegistryClient) MountBlob(repo, fromRepo, digest string) (bool, error) {
+	query := url.Values{}
+	query.Set("mount", digest)
+	query.Set("from", fromRepo)
+	req, err := http.NewRequest(http.MethodPost, rc.url("/v2/%s/blobs/uploads/?%s", repo, query.Encode()), nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		//An upload session is started instead, cancel it
+		if location, err := rc.location(res); err == nil {
+			if cancel, err := http.NewRequest(http.MethodDelete, location, nil); err == nil {
+				if res, err := rc.do(cancel, repo); err == nil {
+					res.Body.Close()
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, checkStatus(res, http.StatusCreated)
+}
+
+//PushBlob uploads the blob with a monolithic upload
+func (rc *RegistryClient) PushBlob(repo, digest string, size int64, content io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, rc.url("/v2/%s/blobs/uploads/", repo), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := rc.do(req, repo)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if err := checkStatus(res, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	location, err := rc.location(res)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	//The body can't be replayed, the authorization is got by the above request
+	req, err = http.NewRequest(http.MethodPut, u.String(), content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err = rc.do(req, repo)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkStatus(res, http.StatusCreated)
+}
+
+func (rc *RegistryClient) url(format string, args ...interface{}) string {
+	return rc.Endpoint + fmt.Sprintf(format, args...)
+}
+
+//location resolves the location header of upload against the endpoint
+func (rc *RegistryClient) location(res *http.Response) (string, error) {
+	location := res.Header.Get("Location")
+	if len(location) == 0 {
+		return "", errors.New("no upload location returned")
+	}
+
+	base, err := url.Parse(rc.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(location)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+//do the request with the cached authorization of repository,
+//the request is authorized again and retried once if it's rejected.
+func (rc *RegistryClient) do(req *http.Request, repo string) (*http.Response, error) {
+	rc.lock.Lock()
+	auth := rc.auths[repo]
+	rc.lock.Unlock()
+
+	if len(auth) > 0 {
+		req.Header.Set("Authorization", auth)
+	}
+
+	res, err := rc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+
+	auth, err = rc.authorize(challenge, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.lock.Lock()
+	rc.auths[repo] = auth
+	rc.lock.Unlock()
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("%s %s is unauthorized", req.Method, req.URL.Path)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", auth)
+
+	return rc.httpClient.Do(retry)
+}
+
+//authorize gets the authorization header by the challenge
+func (rc *RegistryClient) authorize(challenge, repo string) (string, error) {
+	username, password := rc.Username, rc.Password
+	if rc.Credential != nil {
+		username, password = rc.Credential(repo)
+	}
+
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if len(username) == 0 {
+			return "", errors.New("registry requires credential")
+		}
+		req, _ := http.NewRequest(http.MethodGet, rc.Endpoint, nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge '%s'", challenge)
+	}
+
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return "", errors.New("no realm in registry auth challenge")
+	}
+
+	actions := "pull"
+	if len(username) > 0 {
+		actions = "pull,push"
+	}
+	query := url.Values{}
+	if service := params["service"]; len(service) > 0 {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:%s", repo, actions))
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s?%s", realm, query.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(username) > 0 {
+		req.SetBasicAuth(username, password)
+	}
+
+	res, err := rc.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if len(token.Token) == 0 {
+		token.Token = token.AccessToken
+	}
+	if len(token.Token) == 0 {
+		return "", errors.New("empty registry token")
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+//parseChallenge parses: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
+
+func checkStatus(res *http.Response, expected int) error {
+	if res.StatusCode == expected {
+		return nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("registry: %s %s: unexpected status %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRuntimes  = 50
+	defaultQueueSize    = 100
+	defaultQueueTimeout = 30 //seconds
+)
+
+//ErrAdmissionRejected is returned when the admission queue is full
+var ErrAdmissionRejected = errors.New("admission queue is full")
+
+//ErrAdmissionTimeout is returned when the request waits too long in the queue
+var ErrAdmissionTimeout = errors.New("admission wait timeout")
+
+//BusyError tells the caller the scheduler is over capacity and when to retry
+type BusyError struct {
+	Cause      error
+	RetryAfter int //seconds
+}
+
+//Error implements error interface
+func (be *BusyError) Error() string {
+	return fmt.Sprintf("scheduler busy: %s", be.Cause)
+}
+
+//AdmissionStats reports the state of the admission queue
+type AdmissionStats struct {
+	Live          int            `json:"live"`
+	LiveByType    map[string]int `json:"live_by_type"`
+	QueueDepth    int            `json:"queue_depth"`
+	Admitted      uint64         `json:"admitted"`
+	Queued        uint64         `json:"queued"`
+	Rejected      uint64         `json:"rejected"`
+	TimedOut      uint64         `json:"timed_out"`
+	Waited        uint64         `json:"waited"`
+	TotalWaitMs   int64          `json:"total_wait_ms"`
+	MaxWaitMs     int64          `json:"max_wait_ms"`
+	AverageWaitMs int64          `json:"average_wait_ms"`
+}
+
+//AdmissionController caps the live runtimes globally and per registry type,
+//requests over the cap wait in a bounded FIFO queue
+type AdmissionController struct {
+	lock        *sync.Mutex
+	maxTotal    int
+	maxPerType  map[string]int
+	live        int
+	liveByType  map[string]int
+	queue       *list.List
+	queueSize   int
+	waitTimeout time.Duration
+	stats       AdmissionStats
+	//reclaim evicts an idle runtime of the registry type (any type if it's empty) to free a slot
+	reclaim func(registryType string) bool
+}
+
+type admissionTicket struct {
+	registryType string
+	enqueued     time.Time
+	granted      bool
+	ready        chan struct{}
+}
+
+//NewAdmissionController ...
+func NewAdmissionController(maxTotal int, maxPerType map[string]int, queueSize int, waitTimeout time.Duration) *AdmissionController {
+	perType := make(map[string]int)
+	for k, v := range maxPerType {
+		perType[k] = v
+	}
+
+	return &AdmissionController{
+		lock:        new(sync.Mutex),
+		maxTotal:    maxTotal,
+		maxPerType:  perType,
+		liveByType:  make(map[string]int),
+		queue:       list.New(),
+		queueSize:   queueSize,
+		waitTimeout: waitTimeout,
+	}
+}
+
+//SetReclaimer sets the func evicting an idle runtime of the registry type when the cap is reached,
+//it returns false if there is no runtime to evict.
+func (ac *AdmissionController) SetReclaimer(reclaim func(registryType string) bool) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ac.reclaim = reclaim
+}
+
+//Acquire a runtime slot for the registry type, wait in the queue if no slot is free
+func (ac *AdmissionController) Acquire(ctx context.Context, registryType string) error {
+	ac.lock.Lock()
+	if ac.admit(registryType) {
+		ac.lock.Unlock()
+		return nil
+	}
+
+	//The slots may be held by the idle runtimes, evict one of them before queueing
+	if reclaim := ac.reclaim; reclaim != nil {
+		scope := ac.blockedBy(registryType)
+		ac.lock.Unlock()
+		reclaimed := reclaim(scope)
+		ac.lock.Lock()
+		if reclaimed && ac.admit(registryType) {
+			ac.lock.Unlock()
+			return nil
+		}
+	}
+
+	if ac.queue.Len() >= ac.queueSize {
+		ac.stats.Rejected++
+		ac.lock.Unlock()
+		return &BusyError{Cause: ErrAdmissionRejected, RetryAfter: ac.retryAfter()}
+	}
+
+	ticket := &admissionTicket{
+		registryType: registryType,
+		enqueued:     time.Now(),
+		ready:        make(chan struct{}),
+	}
+	elem := ac.queue.PushBack(ticket)
+	ac.stats.Queued++
+	ac.lock.Unlock()
+
+	timer := time.NewTimer(ac.waitTimeout)
+	defer timer.Stop()
+
+	var cause error
+	select {
+	case <-ticket.ready:
+		return nil
+	case <-timer.C:
+		cause = ErrAdmissionTimeout
+	case <-ctx.Done():
+		cause = ctx.Err()
+	}
+
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if ticket.granted {
+		//Granted while we were giving up
+		return nil
+	}
+	ac.queue.Remove(elem)
+	ac.recordWait(ticket)
+	ac.stats.TimedOut++
+
+	return &BusyError{Cause: cause, RetryAfter: ac.retryAfter()}
+}
+
+//Occupy a slot for the runtime restored from the state store, the cap is not checked
+func (ac *AdmissionController) Occupy(registryType string) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	ac.take(registryType)
+}
+
+//Release the slot held by a runtime of the registry type
+func (ac *AdmissionController) Release(registryType string) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if ac.live > 0 {
+		ac.live--
+	}
+	if ac.liveByType[registryType] > 0 {
+		ac.liveByType[registryType]--
+	}
+
+	ac.dispatch()
+}
+
+//Stats of the admission controller
+func (ac *AdmissionController) Stats() AdmissionStats {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	stats := ac.stats
+	stats.Live = ac.live
+	stats.QueueDepth = ac.queue.Len()
+	stats.LiveByType = make(map[string]int)
+	for k, v := range ac.liveByType {
+		stats.LiveByType[k] = v
+	}
+	if stats.Waited > 0 {
+		stats.AverageWaitMs = stats.TotalWaitMs / int64(stats.Waited)
+	}
+
+	return stats
+}
+
+//dispatch grants the waiting tickets in FIFO order as long as there is capacity.
+//A ticket blocked by its per type cap does not block tickets of other types.
+func (ac *AdmissionController) dispatch() {
+	for e := ac.queue.Front(); e != nil; {
+		if ac.maxTotal > 0 && ac.live >= ac.maxTotal {
+			return
+		}
+
+		next := e.Next()
+		ticket := e.Value.(*admissionTicket)
+		if ac.hasCapacity(ticket.registryType) {
+			ac.queue.Remove(e)
+			ac.take(ticket.registryType)
+			ac.recordWait(ticket)
+			ac.stats.Admitted++
+			ticket.granted = true
+			close(ticket.ready)
+		}
+		e = next
+	}
+}
+
+//admit takes the slot at once if the registry type has capacity and none of its requests is waiting.
+//The waiting requests of other types are blocked by their own per type caps, so they're not overtaken.
+func (ac *AdmissionController) admit(registryType string) bool {
+	if !ac.hasCapacity(registryType) {
+		return false
+	}
+	for e := ac.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(*admissionTicket).registryType == registryType {
+			return false
+		}
+	}
+
+	ac.take(registryType)
+	ac.stats.Admitted++
+
+	return true
+}
+
+//blockedBy returns the registry type whose cap blocks the request, empty if it's the global cap
+func (ac *AdmissionController) blockedBy(registryType string) string {
+	if ac.maxTotal > 0 && ac.live >= ac.maxTotal {
+		return ""
+	}
+
+	return registryType
+}
+
+func (ac *AdmissionController) hasCapacity(registryType string) bool {
+	if ac.maxTotal > 0 && ac.live >= ac.maxTotal {
+		return false
+	}
+
+	if max, ok := ac.maxPerType[registryType]; ok && max > 0 {
+		return ac.liveByType[registryType] < max
+	}
+
+	return true
+}
+
+func (ac *AdmissionController) take(registryType string) {
+	ac.live++
+	ac.liveByType[registryType]++
+}
+
+func (ac *AdmissionController) recordWait(ticket *admissionTicket) {
+	waited := time.Since(ticket.enqueued).Nanoseconds() / int64(time.Millisecond)
+	ac.stats.Waited++
+	ac.stats.TotalWaitMs += waited
+	if waited > ac.stats.MaxWaitMs {
+		ac.stats.MaxWaitMs = waited
+	}
+}
+
+func (ac *AdmissionController) retryAfter() int {
+	seconds := int(ac.waitTimeout / time.Second)
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	return seconds
+}
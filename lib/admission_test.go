@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//waitQueued waits until the number of requests are in the queue
+func waitQueued(t *testing.T, ac *AdmissionController, depth int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for ac.Stats().QueueDepth != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth = %d, want %d", ac.Stats().QueueDepth, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func busyCause(err error) error {
+	if be, ok := err.(*BusyError); ok {
+		return be.Cause
+	}
+
+	return nil
+}
+
+func TestAdmissionCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxTotal   int
+		maxPerType map[string]int
+		acquire    []string
+		//Admitted or rejected at once, nothing is queued
+		admitted []bool
+	}{
+		{"global cap", 2, nil,
+			[]string{registryTypeNpm, registryTypePip, registryTypeNpm},
+			[]bool{true, true, false}},
+		{"per type cap", 0, map[string]int{registryTypeNpm: 1},
+			[]string{registryTypeNpm, registryTypeNpm, registryTypePip, registryTypePip},
+			[]bool{true, false, true, true}},
+		{"both caps", 3, map[string]int{registryTypeNpm: 2},
+			[]string{registryTypeNpm, registryTypeNpm, registryTypeNpm, registryTypePip, registryTypePip},
+			[]bool{true, true, false, true, false}},
+		{"no cap", 0, map[string]int{registryTypeNpm: 0},
+			[]string{registryTypeNpm, registryTypeNpm, registryTypeNpm},
+			[]bool{true, true, true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ac := NewAdmissionController(tc.maxTotal, tc.maxPerType, 0, time.Second)
+			want := map[string]int{}
+			for i, registryType := range tc.acquire {
+				err := ac.Acquire(context.Background(), registryType)
+				if tc.admitted[i] {
+					if err != nil {
+						t.Fatalf("#%d Acquire(%s) error = %v", i, registryType, err)
+					}
+					want[registryType]++
+					continue
+				}
+				if busyCause(err) != ErrAdmissionRejected {
+					t.Fatalf("#%d Acquire(%s) error = %v, want rejected", i, registryType, err)
+				}
+			}
+
+			stats := ac.Stats()
+			for registryType, live := range want {
+				if stats.LiveByType[registryType] != live {
+					t.Errorf("live %s = %d, want %d", registryType, stats.LiveByType[registryType], live)
+				}
+			}
+			if stats.Live != want[registryTypeNpm]+want[registryTypePip] {
+				t.Errorf("live = %d, want %v", stats.Live, want)
+			}
+		})
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	ac := NewAdmissionController(0, map[string]int{registryTypeNpm: 1}, 1, 5*time.Second)
+	if err := ac.Acquire(context.Background(), registryTypeNpm); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan error)
+	go func() { granted <- ac.Acquire(context.Background(), registryTypeNpm) }()
+	waitQueued(t, ac, 1)
+
+	//The waiting npm request doesn't block pip
+	if err := ac.Acquire(context.Background(), registryTypePip); err != nil {
+		t.Errorf("Acquire(pip) error = %v", err)
+	}
+	//Queue is full
+	if err := ac.Acquire(context.Background(), registryTypeNpm); busyCause(err) != ErrAdmissionRejected {
+		t.Errorf("Acquire() error = %v, want rejected", err)
+	}
+
+	ac.Release(registryTypeNpm)
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Errorf("waiting Acquire() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("released slot is not granted to the waiting request")
+	}
+
+	stats := ac.Stats()
+	if stats.LiveByType[registryTypeNpm] != 1 || stats.QueueDepth != 0 {
+		t.Errorf("stats = %+v, want the slot taken by the waiting request", stats)
+	}
+	if stats.Queued != 1 || stats.Rejected != 1 || stats.Waited != 1 || stats.Admitted != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestAdmissionGiveUp(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		cause   error
+		retry   int
+	}{
+		{"timeout", 50 * time.Millisecond, false, ErrAdmissionTimeout, 1},
+		{"canceled", time.Minute, true, context.Canceled, 60},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ac := NewAdmissionController(1, nil, 10, tc.timeout)
+			if err := ac.Acquire(context.Background(), registryTypeNpm); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() { done <- ac.Acquire(ctx, registryTypeNpm) }()
+			waitQueued(t, ac, 1)
+			if tc.cancel {
+				cancel()
+			}
+
+			err := <-done
+			be, ok := err.(*BusyError)
+			if !ok || be.Cause != tc.cause || be.RetryAfter != tc.retry {
+				t.Errorf("Acquire() error = %#v, want %v", err, tc.cause)
+			}
+			stats := ac.Stats()
+			if stats.TimedOut != 1 || stats.QueueDepth != 0 || stats.Live != 1 {
+				t.Errorf("stats = %+v, want the given up request out of the queue", stats)
+			}
+
+			//The released slot is not granted to the given up request
+			ac.Release(registryTypeNpm)
+			if live := ac.Stats().Live; live != 0 {
+				t.Errorf("%d live after release, want 0", live)
+			}
+			if err := ac.Acquire(context.Background(), registryTypeNpm); err != nil {
+				t.Errorf("Acquire() error = %v after release", err)
+			}
+		})
+	}
+}
+
+func TestAdmissionReclaim(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxTotal   int
+		maxPerType map[string]int
+		reclaimed  bool
+		scope      string
+	}{
+		{"per type cap", 0, map[string]int{registryTypeNpm: 1}, true, registryTypeNpm},
+		{"global cap", 1, nil, true, ""},
+		{"nothing to reclaim", 1, nil, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ac := NewAdmissionController(tc.maxTotal, tc.maxPerType, 0, time.Second)
+			scopes := make([]string, 0)
+			ac.SetReclaimer(func(registryType string) bool {
+				scopes = append(scopes, registryType)
+				if tc.reclaimed {
+					ac.Release(registryTypeNpm)
+				}
+				return tc.reclaimed
+			})
+			if err := ac.Acquire(context.Background(), registryTypeNpm); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ac.Acquire(context.Background(), registryTypeNpm)
+			if len(scopes) != 1 || scopes[0] != tc.scope {
+				t.Errorf("reclaimed %v, want scope %q", scopes, tc.scope)
+			}
+			if tc.reclaimed && err != nil {
+				t.Errorf("Acquire() error = %v with the slot reclaimed", err)
+			}
+			if !tc.reclaimed && busyCause(err) != ErrAdmissionRejected {
+				t.Errorf("Acquire() error = %v, want rejected", err)
+			}
+		})
+	}
+}
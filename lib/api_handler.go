@@ -1,31 +1,68 @@
 package lib
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"registry-factory/logger"
+	"registry-factory/metrics"
+	"strconv"
 	"strings"
 )
 
 const (
 	managementAPIStats = "/api/v1"
+
+	defaultRuntimesPageSize = 100
+	maxRuntimesPageSize     = 1000
 )
 
 //APIHandler provides API for the management requests
 type APIHandler struct {
 	scheduler   *Scheduler
 	commandList *CommandList
+	buildQueue  *BuildQueue
+	webhook     *HarborWebhook
+	auth        *Authenticator
+	audit       *AuditTrail
 }
 
 //ServeHTTP serve http requests
 func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+
+	//Routed by the path, the query string is not part of it
 	var err error
-	apiPath := strings.TrimPrefix(r.RequestURI, managementAPIStats)
-	switch apiPath {
-	case "/stats":
-		h.handlePoolStatsRequest(w, r)
-	case "/commands":
-		err = h.handleGetCommands(w, r)
+	apiPath := strings.TrimPrefix(r.URL.Path, managementAPIStats)
+	switch {
+	case apiPath == "/stats":
+		err = h.handleStats(w, r, h.handlePoolStatsRequest)
+	case apiPath == "/stats/admission":
+		err = h.handleStats(w, r, h.handleAdmissionStatsRequest)
+	case apiPath == "/stats/crashes":
+		err = h.handleStats(w, r, h.handleCrashStatsRequest)
+	case apiPath == "/commands":
+		err = h.handleStats(w, r, h.handleGetCommands)
+	case apiPath == "/webhooks/harbor":
+		err = h.handleHarborWebhook(w, r)
+	case hasPathPrefix(apiPath, "/runtimes"):
+		err = h.handleRuntimes(w, r)
+	case hasPathPrefix(apiPath, "/builds"):
+		err = h.handleBuilds(w, r)
+	case hasPathPrefix(apiPath, "/users"):
+		err = h.handleUsers(w, r)
+	case hasPathPrefix(apiPath, "/rbac/bindings"):
+		err = h.handleBindings(w, r)
+	case hasPathPrefix(apiPath, "/audit"):
+		err = h.handleAudit(w, r)
+	default:
+		h.notFound(w)
 	}
 
 	if err != nil {
@@ -33,37 +70,476 @@ func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//ServeMetrics serves the metrics to the maintainers as the stats API if auth is enabled
+func (h *APIHandler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+//handleStats serves the read-only stats with the handler
+func (h *APIHandler) handleStats(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request) error) error {
+	if r.Method != http.MethodGet {
+		h.methodNotAllowed(w, http.MethodGet)
+		return nil
+	}
+
+	return handler(w, r)
+}
+
 //HandlePoolStatsRequest handle pool stats request
 func (h *APIHandler) handlePoolStatsRequest(w http.ResponseWriter, r *http.Request) error {
-	runtimes := h.scheduler.GetRuntimes()
-	data, err := json.Marshal(&runtimes)
+	return h.writeJSON(w, h.scheduler.GetRuntimes())
+}
+
+func (h *APIHandler) handleAdmissionStatsRequest(w http.ResponseWriter, r *http.Request) error {
+	return h.writeJSON(w, h.scheduler.GetAdmissionStats())
+}
+
+func (h *APIHandler) handleCrashStatsRequest(w http.ResponseWriter, r *http.Request) error {
+	return h.writeJSON(w, h.scheduler.GetCrashes())
+}
+
+func (h *APIHandler) handleGetCommands(w http.ResponseWriter, r *http.Request) error {
+	return h.writeJSON(w, h.commandList.Commands())
+}
+
+//handleRuntimes serves:
+//GET    /api/v1/runtimes?status=&registry_type=&image=&offset=&limit=
+//GET    /api/v1/runtimes/{id}
+//DELETE /api/v1/runtimes/{id}
+//POST   /api/v1/runtimes/{id}/pin
+//DELETE /api/v1/runtimes/{id}/pin
+//POST   /api/v1/runtimes/gc
+func (h *APIHandler) handleRuntimes(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, managementAPIStats+"/runtimes"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		return h.handleQueryRuntimes(w, r)
+	case len(rest) == 0:
+		h.methodNotAllowed(w, http.MethodGet)
+		return nil
+	case rest == "gc" && r.Method == http.MethodPost:
+		return h.writeJSON(w, map[string][]string{"destroyed": h.scheduler.CollectGarbages()})
+	case rest == "gc":
+		h.methodNotAllowed(w, http.MethodPost)
+		return nil
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		runtime, err := h.scheduler.GetRuntime(parts[0])
+		if err == ErrRuntimeNotFound {
+			h.writeError(w, http.StatusNotFound, err)
+			return nil
+		}
+		return h.writeJSON(w, runtime)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err := h.scheduler.DestroyRuntime(parts[0])
+		if err == ErrRuntimeNotFound {
+			h.writeError(w, http.StatusNotFound, err)
+			return nil
+		}
+		if err != nil {
+			//The container is still there, so is the runtime
+			h.writeError(w, http.StatusBadGateway, err)
+			return nil
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case len(parts) == 1:
+		h.methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return nil
+	case len(parts) == 2 && parts[1] == "pin" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		runtime, err := h.scheduler.PinRuntime(parts[0], r.Method == http.MethodPost)
+		if err == ErrRuntimeNotFound {
+			h.writeError(w, http.StatusNotFound, err)
+			return nil
+		}
+		return h.writeJSON(w, runtime)
+	case len(parts) == 2 && parts[1] == "pin":
+		h.methodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return nil
+	}
+
+	h.notFound(w)
+
+	return nil
+}
+
+//handleQueryRuntimes lists the page of the runtimes matched by the query
+func (h *APIHandler) handleQueryRuntimes(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	filter := &RuntimeFilter{
+		Status:       query.Get("status"),
+		RegistryType: query.Get("registry_type"),
+		Image:        query.Get("image"),
+		Limit:        defaultRuntimesPageSize,
+	}
+	numbers := map[string]*int{"offset": &filter.Offset, "limit": &filter.Limit}
+	for name, v := range numbers {
+		if raw := query.Get(name); len(raw) > 0 {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				h.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s '%s'", name, raw))
+				return nil
+			}
+			*v = n
+		}
+	}
+	if filter.Limit == 0 {
+		//An empty page is useless, take it as not given
+		filter.Limit = defaultRuntimesPageSize
+	}
+	if filter.Limit > maxRuntimesPageSize {
+		filter.Limit = maxRuntimesPageSize
+	}
+
+	runtimes, total := h.scheduler.QueryRuntimes(filter)
+
+	return h.writeJSON(w, &RuntimePage{
+		Total:    total,
+		Offset:   filter.Offset,
+		Limit:    filter.Limit,
+		Runtimes: runtimes,
+	})
+}
+
+//handleBuilds serves:
+//GET  /api/v1/builds?status=<status>
+//GET  /api/v1/builds/{registry_type/namespace/image:tag}
+//POST /api/v1/builds/{registry_type/namespace/image:tag}/retry
+func (h *APIHandler) handleBuilds(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), managementAPIStats+"/builds"), "/")
+	if len(rest) == 0 {
+		if r.Method != http.MethodGet {
+			h.methodNotAllowed(w, http.MethodGet)
+			return nil
+		}
+		return h.writeJSON(w, h.buildQueue.List(r.URL.Query().Get("status")))
+	}
+
+	parts := strings.Split(rest, "/")
+	//The job ID (registry_type/namespace/image:tag) contains '/' so it should be escaped
+	ID, err := url.PathUnescape(parts[0])
 	if err != nil {
-		return err
+		h.writeError(w, http.StatusBadRequest, err)
+		return nil
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+
+	var job *BuildJob
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		job, err = h.buildQueue.Get(ID)
+	case len(parts) == 2 && parts[1] == "retry" && r.Method == http.MethodPost:
+		job, err = h.buildQueue.Retry(ID)
+	case len(parts) == 1:
+		h.methodNotAllowed(w, http.MethodGet)
+		return nil
+	case len(parts) == 2 && parts[1] == "retry":
+		h.methodNotAllowed(w, http.MethodPost)
+		return nil
+	default:
+		h.notFound(w)
+		return nil
+	}
+
+	if err == ErrBuildNotFound {
+		h.writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err != nil {
+		h.writeError(w, http.StatusConflict, err)
+		return nil
+	}
+
+	return h.writeJSON(w, job)
+}
+
+//handleUsers serves:
+//GET    /api/v1/users
+//POST   /api/v1/users
+//GET    /api/v1/users/{name}
+//DELETE /api/v1/users/{name}
+func (h *APIHandler) handleUsers(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, managementAPIStats+"/users"), "/")
+	parts := strings.Split(rest, "/")
+
+	var (
+		user *User
+		err  error
+	)
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		return h.writeJSON(w, h.auth.Users())
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		req := &struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Email    string `json:"email"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			h.writeError(w, http.StatusBadRequest, err)
+			return nil
+		}
+		user, err = h.auth.AddUser(req.Username, req.Password, req.Email)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		user, err = h.auth.GetUser(parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err = h.auth.DeleteUser(parts[0]); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case len(rest) == 0:
+		h.methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return nil
+	case len(parts) == 1:
+		h.methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return nil
+	default:
+		h.notFound(w)
+		return nil
+	}
+
+	if err == ErrUserNotFound {
+		h.writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err == ErrUserExisting {
+		h.writeError(w, http.StatusConflict, err)
+		return nil
+	}
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+
+	return h.writeJSON(w, user)
+}
+
+//handleBindings serves:
+//GET    /api/v1/rbac/bindings?user=<name>&group=<name>
+//POST   /api/v1/rbac/bindings
+//DELETE /api/v1/rbac/bindings/{id}
+func (h *APIHandler) handleBindings(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, managementAPIStats+"/rbac/bindings"), "/")
+	rbac := h.auth.RBAC()
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		return h.writeJSON(w, rbac.Bindings(r.URL.Query().Get("user"), r.URL.Query().Get("group")))
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		binding := &RoleBinding{}
+		if err := json.NewDecoder(r.Body).Decode(binding); err != nil {
+			h.writeError(w, http.StatusBadRequest, err)
+			return nil
+		}
+		binding, err := rbac.AddBinding(binding)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, err)
+			return nil
+		}
+		return h.writeJSON(w, binding)
+	case len(rest) == 0:
+		h.methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return nil
+	case strings.Contains(rest, "/"):
+		h.notFound(w)
+		return nil
+	case r.Method != http.MethodDelete:
+		h.methodNotAllowed(w, http.MethodDelete)
+		return nil
+	}
+
+	err := rbac.DeleteBinding(rest)
+	if err == ErrBindingNotFound {
+		h.writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err != nil {
+		h.writeError(w, http.StatusConflict, err)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
 
 	return nil
 }
 
-func (h *APIHandler) handleGetCommands(w http.ResponseWriter, r *http.Request) error {
-	commands := h.commandList.Commands()
-	data, err := json.Marshal(&commands)
+//handleAudit serves:
+//GET /api/v1/audit?username=&registry_type=&namespace=&command=&package=&outcome=&since=&until=&before=&limit=
+//GET /api/v1/audit/verify
+func (h *APIHandler) handleAudit(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, managementAPIStats+"/audit"), "/")
+	if rest != "" && rest != "verify" {
+		h.notFound(w)
+		return nil
+	}
+	if r.Method != http.MethodGet {
+		h.methodNotAllowed(w, http.MethodGet)
+		return nil
+	}
+
+	if rest == "verify" {
+		verification, err := h.audit.Verify()
+		if err != nil {
+			return err
+		}
+		return h.writeJSON(w, verification)
+	}
+
+	query := r.URL.Query()
+	filter := &AuditFilter{
+		Username:     query.Get("username"),
+		RegistryType: query.Get("registry_type"),
+		Namespace:    query.Get("namespace"),
+		Command:      query.Get("command"),
+		Package:      query.Get("package"),
+		Outcome:      query.Get("outcome"),
+	}
+	numbers := map[string]*int64{"since": &filter.Since, "until": &filter.Until}
+	limit, before := int64(0), int64(0)
+	numbers["limit"] = &limit
+	numbers["before"] = &before
+	for name, v := range numbers {
+		if raw := query.Get(name); len(raw) > 0 {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				h.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s '%s'", name, raw))
+				return nil
+			}
+			*v = n
+		}
+	}
+	filter.Limit = int(limit)
+	filter.Before = uint64(before)
+
+	events, err := h.audit.Query(filter)
+	if err != nil {
+		return err
+	}
+
+	return h.writeJSON(w, events)
+}
+
+//handleHarborWebhook serves:
+//POST /api/v1/webhooks/harbor
+//GET  /api/v1/webhooks/harbor?type=<push|delete|scan_completed|replication>
+func (h *APIHandler) handleHarborWebhook(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return h.writeJSON(w, h.webhook.Events(r.URL.Query().Get("type")))
+	case http.MethodPost:
+	default:
+		h.methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return nil
+	}
+
+	//Harbor sends the auth header configured in the webhook policy
+	if secret := Config.Harbor.WebhookSecret; len(secret) > 0 &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(secret)) != 1 {
+		h.writeError(w, http.StatusUnauthorized, errors.New("invalid webhook secret"))
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
 	}
+
+	event, err := h.webhook.Receive(data)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	if event == nil {
+		//Not handled
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	return h.writeJSON(w, event)
+}
+
+func (h *APIHandler) writeJSON(w http.ResponseWriter, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 
 	return nil
 }
 
+//authorize checks the role of the caller when auth is enabled, maintainer reads the management API
+//and admin changes it or reads the users, role bindings and audit trail.
+//The harbor webhook is authenticated with its own secret, or as admin if the secret is not set.
+func (h *APIHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !Config.Auth.Enabled {
+		return true
+	}
+	if r.URL.Path == managementAPIStats+"/webhooks/harbor" && r.Method == http.MethodPost &&
+		len(Config.Harbor.WebhookSecret) > 0 {
+		return true
+	}
+
+	role := roleMaintainer
+	if r.Method != http.MethodGet ||
+		strings.HasPrefix(r.URL.Path, managementAPIStats+"/users") ||
+		strings.HasPrefix(r.URL.Path, managementAPIStats+"/rbac") ||
+		strings.HasPrefix(r.URL.Path, managementAPIStats+"/audit") {
+		role = roleAdmin
+	}
+
+	principal, err := h.auth.Authenticate(r)
+	if err == nil {
+		err = h.auth.Authorize(principal, role, Resource{})
+	}
+	if err == nil {
+		return true
+	}
+
+	logger.Errorf("Deny %s %s: %s", r.Method, r.URL.Path, err)
+	h.audit.Deny(r, principal, role, Resource{}, err)
+	authErr := &AuthError{Cause: err}
+	if authErr.StatusCode() == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chameleon"`)
+	}
+	h.writeError(w, authErr.StatusCode(), err)
+
+	return false
+}
+
 //IsMatchedRequests check if the requests are management requests
 func (h *APIHandler) IsMatchedRequests(r *http.Request) bool {
-	return r != nil && strings.Contains(r.RequestURI, managementAPIStats)
+	return r != nil && hasPathPrefix(r.URL.Path, managementAPIStats)
+}
+
+//writeError writes the error as the JSON body {"error": "..."} with the status
+func (h *APIHandler) writeError(w http.ResponseWriter, status int, err error) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (h *APIHandler) notFound(w http.ResponseWriter) {
+	h.writeError(w, http.StatusNotFound, errors.New("not found"))
+}
+
+//methodNotAllowed lists the allowed methods of the resource in the Allow header
+func (h *APIHandler) methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	h.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
 }
 
 func (h *APIHandler) internalError(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(fmt.Sprintf("error: %s", err.Error())))
+	h.writeError(w, http.StatusInternalServerError, err)
+}
+
+//hasPathPrefix checks if the path is the prefix or under it
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
 }
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"registry-factory/client"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func serveAPI(h *APIHandler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, managementAPIStats+path, nil))
+
+	return w
+}
+
+func TestDestroyRuntimeFailure(t *testing.T) {
+	h := newTestAPIHandler(t)
+	s := h.scheduler
+	//No daemon listening, docker rm fails
+	s.executor = &Executor{
+		docker: &client.DockerClient{Host: "tcp://127.0.0.1:1"},
+		leases: make(map[string][]int),
+		logins: make(map[string]bool),
+		lock:   new(sync.Mutex),
+	}
+	if err := s.admission.Acquire(context.Background(), registryTypeNpm); err != nil {
+		t.Fatal(err)
+	}
+	s.pool.Put("npm:session-1", &Runtime{ID: "runtime-1", RegistryType: registryTypeNpm})
+
+	if w := serveAPI(h, http.MethodDelete, "/runtimes/runtime-1"); w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+	//Kept to be destroyed again
+	if _, ok := s.pool.Live()["npm:session-1"]; !ok {
+		t.Error("runtime is removed from pool with the container left")
+	}
+	if live := s.admission.Stats().Live; live != 1 {
+		t.Errorf("%d live runtimes admitted, want the slot kept", live)
+	}
+	runtimes, total := s.QueryRuntimes(&RuntimeFilter{ID: "runtime-1", Limit: 10})
+	if total != 1 || runtimes[0].Status != statusServing {
+		t.Errorf("runtimes = %+v, want the serving one only", runtimes)
+	}
+
+	//Another runtime took the key meanwhile, the container is left to the reconciler
+	key, r, _ := s.pool.DestroyByID("runtime-1")
+	s.pool.Put(key, &Runtime{ID: "runtime-3", RegistryType: registryTypeNpm})
+	s.restore(key, r)
+	if live := s.pool.Live(); live[key].ID != "runtime-3" {
+		t.Errorf("new runtime is replaced by the restored one: %+v", live[key])
+	}
+	if live := s.admission.Stats().Live; live != 0 {
+		t.Errorf("%d live runtimes admitted, want the slot of the left one released", live)
+	}
+
+	if w := serveAPI(h, http.MethodDelete, "/runtimes/runtime-2"); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d of unknown runtime, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCollectGarbagesFailure(t *testing.T) {
+	h := newTestAPIHandler(t)
+	s := h.scheduler
+	s.executor = &Executor{
+		docker: &client.DockerClient{Host: "tcp://127.0.0.1:1"},
+		leases: make(map[string][]int),
+		logins: make(map[string]bool),
+		lock:   new(sync.Mutex),
+	}
+	s.admission.Occupy(registryTypeNpm)
+	//Idle long enough
+	s.pool.Adopt("npm:session-1", &Runtime{ID: "runtime-1", RegistryType: registryTypeNpm})
+
+	w := serveAPI(h, http.MethodPost, "/runtimes/gc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	destroyed := map[string][]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &destroyed); err != nil || len(destroyed["destroyed"]) != 0 {
+		t.Errorf("destroyed = %s, want none", w.Body.String())
+	}
+	if r, ok := s.pool.Live()["npm:session-1"]; !ok || r.Status != statusIdle {
+		t.Errorf("runtime is not kept idle in pool with the container left: %+v", r)
+	}
+	if live := s.admission.Stats().Live; live != 1 {
+		t.Errorf("%d live runtimes admitted, want the slot kept", live)
+	}
+}
+
+func TestQueryRuntimesLimit(t *testing.T) {
+	h := newTestAPIHandler(t)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+		limit  int
+	}{
+		{"", http.StatusOK, defaultRuntimesPageSize},
+		{"?limit=0", http.StatusOK, defaultRuntimesPageSize},
+		{"?limit=10", http.StatusOK, 10},
+		{"?limit=5000", http.StatusOK, maxRuntimesPageSize},
+		{"?limit=-1", http.StatusBadRequest, 0},
+		{"?offset=x", http.StatusBadRequest, 0},
+	} {
+		w := serveAPI(h, http.MethodGet, "/runtimes"+tc.query)
+		if w.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.query, w.Code, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		page := &RuntimePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), page); err != nil {
+			t.Fatalf("invalid page %q: %s", w.Body.String(), err)
+		}
+		if page.Limit != tc.limit {
+			t.Errorf("%s: limit = %d, want %d", tc.query, page.Limit, tc.limit)
+		}
+	}
+}
+
+func TestServeMetricsAuth(t *testing.T) {
+	h := newTestAPIHandler(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("passw0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Auth.Users = []*UserConfig{
+		{Username: "bob", PasswordHash: string(hash)},
+		{Username: "mia", PasswordHash: string(hash)},
+	}
+	Config.RBAC.Bindings = []*RoleBindingConfig{
+		{Role: rolePublisher, User: "bob"},
+		{Role: roleMaintainer, User: "mia"},
+	}
+	if err := h.auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		user    string
+		status  int
+	}{
+		{"auth disabled", false, "", http.StatusOK},
+		{"anonymous", true, "", http.StatusUnauthorized},
+		{"publisher", true, "bob", http.StatusForbidden},
+		{"maintainer", true, "mia", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			Config.Auth.Enabled = tc.enabled
+			r := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+			if len(tc.user) > 0 {
+				r.SetBasicAuth(tc.user, "passw0rd")
+			}
+			w := httptest.NewRecorder()
+			h.ServeMetrics(w, r)
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body.String())
+			}
+			if tc.status == http.StatusOK && !strings.Contains(w.Body.String(), "chameleon_") {
+				t.Errorf("metrics are not served: %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"registry-factory/client"
+	"registry-factory/client/harbor"
+	"registry-factory/logger"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	packageModeImage    = "image"
+	packageModeArtifact = "artifact"
+
+	packageKindImage    = "image"
+	packageKindArtifact = "artifact"
+
+	annotationTitle          = "org.opencontainers.image.title"
+	annotationPackageName    = "io.chameleon.package.name"
+	annotationPackageVersion = "io.chameleon.package.version"
+	annotationPackageFormat  = "io.chameleon.package.format"
+
+	//All the packages of the registry are served by one shared artifact server
+	artifactServerIdentity = "artifact-server"
+)
+
+//packageFormat tells how the package of the registry type is stored as OCI artifact
+type packageFormat struct {
+	//Config media type, it's also the artifact type
+	configMediaType string
+	layerMediaType  string
+	//The metadata file next to the package files, empty if none
+	metadataFile string
+	//match checks whether the file is the package file of name@version
+	match func(file, name, version string) bool
+}
+
+var packageFormats = map[string]*packageFormat{
+	registryTypeNpm: {
+		configMediaType: "application/vnd.chameleon.npm.config.v1+json",
+		layerMediaType:  "application/vnd.chameleon.npm.package.v1.tar+gzip",
+		metadataFile:    "package.json",
+		match: func(file, name, version string) bool {
+			//Tarball of scoped package is named without the scope
+			return file == fmt.Sprintf("%s-%s.tgz", path.Base(name), version)
+		},
+	},
+	registryTypePip: {
+		configMediaType: "application/vnd.chameleon.pip.config.v1+json",
+		layerMediaType:  "application/vnd.chameleon.pip.package.v1",
+		match: func(file, name, version string) bool {
+			normalize := strings.NewReplacer("-", "_", ".", "_").Replace
+			return strings.HasPrefix(normalize(strings.ToLower(file)), normalize(strings.ToLower(name+"-"+version))+"_")
+		},
+	},
+}
+
+//packageConfig is the config blob of package artifact
+type packageConfig struct {
+	Format  string          `json:"format"`
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Files   []packageFile   `json:"files"`
+	Meta    json.RawMessage `json:"metadata,omitempty"`
+}
+
+type packageFile struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+//artifactManifest is the OCI manifest of the package artifact
+type artifactManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	ArtifactType  string               `json:"artifactType"`
+	Config        ociDescriptor        `json:"config"`
+	Layers        []artifactDescriptor `json:"layers"`
+	Annotations   map[string]string    `json:"annotations"`
+}
+
+type artifactDescriptor struct {
+	ociDescriptor
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+//ArtifactBuilder pushes the raw package files as an OCI artifact instead of a runnable image,
+//the packages are served by the shared artifact server which fetches them on demand.
+type ArtifactBuilder struct {
+	docker     *client.DockerClient
+	harborHost string
+	harbor     *client.RegistryClient
+}
+
+//NewArtifactBuilder ...
+func NewArtifactBuilder(docker *client.DockerClient, harborHost string, harbor *client.RegistryClient) *ArtifactBuilder {
+	return &ArtifactBuilder{
+		docker:     docker,
+		harborHost: harborHost,
+		harbor:     harbor,
+	}
+}
+
+//Build the artifact namespace/image:tag in harbor with the package files in the base container,
+//the logs carry the ID of the publishing request.
+func (ab *ArtifactBuilder) Build(ctx context.Context, baseContainer, registryType, namespace, image, tag, requestID string) (err error) {
+	_, span := startSpan(ctx, "ArtifactBuilder.Build", attribute.String("image", image), attribute.String("tag", tag))
+	defer func() { endSpan(span, err) }()
+
+	log := logger.WithRequest(requestID)
+	format, ok := packageFormats[registryType]
+	registry := registryConfigOf(registryType)
+	if !ok || registry == nil {
+		return fmt.Errorf("unknown registry type '%s'", registryType)
+	}
+
+	artifactPath := path.Clean(strings.Replace(registry.ArtifactPath, artifactPackagePlaceholder, image, -1))
+	archive, err := ab.docker.WithRequest(requestID).CopyFrom(baseContainer, artifactPath)
+	if err != nil {
+		return err
+	}
+	files, metadata, err := readPackageFiles(archive, format, image, tag, log)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("read package files in %s error: %s", artifactPath, err)
+	}
+
+	repo := fmt.Sprintf("%s/%s", namespace, image)
+	config := &packageConfig{
+		Format:  registryType,
+		Name:    image,
+		Version: tag,
+		Files:   make([]packageFile, 0, len(files)),
+		Meta:    metadata,
+	}
+	layers := make([]artifactDescriptor, 0, len(files))
+	for _, name := range sortedKeys(files) {
+		data := files[name]
+		digest := digestOf(data)
+		if err := pushBlob(ab.harbor, repo, digest, data); err != nil {
+			return err
+		}
+		config.Files = append(config.Files, packageFile{Name: name, Digest: digest, Size: int64(len(data))})
+		layers = append(layers, artifactDescriptor{
+			ociDescriptor: ociDescriptor{
+				MediaType: format.layerMediaType,
+				Digest:    digest,
+				Size:      int64(len(data)),
+			},
+			Annotations: map[string]string{annotationTitle: name},
+		})
+	}
+
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configDigest := digestOf(configData)
+	if err := pushBlob(ab.harbor, repo, configDigest, configData); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(&artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     client.MediaTypeOCIManifest,
+		ArtifactType:  format.configMediaType,
+		Config: ociDescriptor{
+			MediaType: format.configMediaType,
+			Digest:    configDigest,
+			Size:      int64(len(configData)),
+		},
+		Layers: layers,
+		Annotations: map[string]string{
+			annotationPackageName:    image,
+			annotationPackageVersion: tag,
+			annotationPackageFormat:  registryType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ab.harbor.PutManifest(repo, tag, client.MediaTypeOCIManifest, manifest); err != nil {
+		return err
+	}
+
+	log.Infof("Artifact %s/%s:%s (%s) is pushed with %d package files", ab.harborHost, repo, tag, digestOf(manifest), len(layers))
+
+	return nil
+}
+
+//readPackageFiles reads the package files of name@version and the metadata from the tar archive
+func readPackageFiles(archive io.Reader, format *packageFormat, name, version string, log *logger.Entry) (map[string][]byte, json.RawMessage, error) {
+	files := make(map[string][]byte)
+	var metadata json.RawMessage
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		file := path.Base(hdr.Name)
+		switch {
+		case format.match(file, name, version):
+		case len(format.metadataFile) > 0 && file == format.metadataFile:
+		default:
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if file != format.metadataFile {
+			files[file] = data
+			continue
+		}
+
+		if metadata, err = versionMetadata(data, version); err != nil {
+			log.Infof("Skip the invalid metadata %s of %s@%s: %s", hdr.Name, name, version, err)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no package file of %s@%s", name, version)
+	}
+
+	return files, metadata, nil
+}
+
+//versionMetadata picks the metadata of the version from the document of all versions
+func versionMetadata(doc []byte, version string) (json.RawMessage, error) {
+	versions := struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}{}
+	if err := json.Unmarshal(doc, &versions); err != nil {
+		return nil, err
+	}
+
+	meta, ok := versions.Versions[version]
+	if !ok {
+		return nil, errors.New("version is not found")
+	}
+
+	return meta, nil
+}
+
+//checkImageExisting returns the kind (image or artifact) of the package in harbor,
+//empty if the package is not existing. definitive is false if harbor failed to answer.
+func checkImageExisting(ctx context.Context, harborAPI *harbor.Client, registryNamespace, image, tag string) (kind string, definitive bool) {
+	_, span := startSpan(ctx, "checkImageExisting",
+		attribute.String("namespace", registryNamespace),
+		attribute.String("image", image),
+		attribute.String("tag", tag),
+	)
+	defer span.End()
+
+	artifact, err := harborAPI.GetArtifact(registryNamespace, image, tag)
+	if err != nil {
+		if harbor.IsNotFound(err) {
+			logger.Infof("Image %s:%s not existing", image, tag)
+			return "", true
+		}
+		logger.Warnf("Failed to Check image %s:%s existing: %s", image, tag, err)
+		span.RecordError(err)
+		return "", false
+	}
+
+	//The media type of artifact is the one of its config
+	kind = packageKindImage
+	for _, format := range packageFormats {
+		if artifact.MediaType == format.configMediaType {
+			kind = packageKindArtifact
+			break
+		}
+	}
+
+	logger.Infof("Image %s:%s existing as %s", image, tag, kind)
+	span.SetAttributes(attribute.String("kind", kind))
+
+	return kind, true
+}
+
+//useArtifactServer lets the policy serve the packages with the shared artifact server,
+//false is returned if the registry has no artifact server.
+func useArtifactServer(policy *SchedulePolicy, registryType string) bool {
+	registry := registryConfigOf(registryType)
+	if registry == nil || len(registry.ArtifactServerImage) == 0 {
+		logger.Infof("No artifact server of %s registry", registryType)
+		return false
+	}
+
+	policy.Image = registry.ArtifactServerImage
+	policy.Tag = registry.ArtifactServerTag
+	policy.UseHub = true
+	policy.ReuseIdentity = artifactServerIdentity
+	if policy.EnvVars == nil {
+		policy.EnvVars = make(map[string]string)
+	}
+	//Where to fetch the artifacts on demand
+	policy.EnvVars["ARTIFACT_REGISTRY"] = fmt.Sprintf("%s://%s", Config.Harbor.Protocol, Config.Harbor.Host)
+	policy.EnvVars["ARTIFACT_NAMESPACE"] = policy.Namespace
+	policy.EnvVars["ARTIFACT_TYPE"] = packageFormats[registryType].configMediaType
+
+	return true
+}
+
+//withArtifactCredential gives the artifact server the robot account of namespace to fetch the artifacts
+//from the private projects. The admin credential is never given, the server pulls anonymously without robot.
+func (s *Scheduler) withArtifactCredential(policy *SchedulePolicy) {
+	if policy == nil || policy.ReuseIdentity != artifactServerIdentity {
+		return
+	}
+
+	username, password, ok := s.harbor.RobotCredential(policy.Namespace)
+	if !ok {
+		return
+	}
+	policy.EnvVars["ARTIFACT_USERNAME"] = username
+	policy.EnvVars["ARTIFACT_PASSWORD"] = password
+}
+
+//recycleArtifactServers recycles the artifact servers of namespace once its credential is changed
+func (s *Scheduler) recycleArtifactServers(namespace string) []string {
+	expired := s.pool.Expire(func(r *Runtime) bool {
+		registry := registryConfigOf(r.RegistryType)
+		if registry == nil || registry.Namespace != namespace || len(registry.ArtifactServerImage) == 0 {
+			return false
+		}
+		return r.Image == fmt.Sprintf("%s:%s", registry.ArtifactServerImage, registry.ArtifactServerTag)
+	})
+
+	return s.recycleOutdated(expired)
+}
+
+func pushBlob(registry *client.RegistryClient, repo, digest string, data []byte) error {
+	existing, err := registry.BlobExists(repo, digest)
+	if err != nil {
+		return err
+	}
+	if existing {
+		return nil
+	}
+
+	return registry.PushBlob(repo, digest, int64(len(data)), bytes.NewReader(data))
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
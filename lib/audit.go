@@ -0,0 +1,514 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"registry-factory/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+	defaultSyslogTag       = "chameleon"
+	//Entries chained but not persisted yet, Append blocks when the writer is behind by all of them
+	auditQueueSize = 1024
+
+	auditOutcomeDenied    = "denied"
+	auditOutcomeSucceeded = "succeeded"
+	auditOutcomeFailed    = "failed"
+
+	auditCommandBuild = "build"
+	auditCommandPush  = "push"
+)
+
+//AuditEvent is the entry of the audit log, it's chained to the previous one with the hash
+type AuditEvent struct {
+	Sequence uint64 `json:"sequence"`
+	Time     int64  `json:"time"`
+	//Empty for anonymous
+	Username   string `json:"username"`
+	RemoteAddr string `json:"remote_addr"`
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+	//Required role of the request
+	Role         string `json:"role,omitempty"`
+	RegistryType string `json:"registry_type,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	Command      string `json:"command,omitempty"`
+	Package      string `json:"package,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Outcome      string `json:"outcome"`
+	//Status code of the response
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	//Digest of the image pushed to harbor
+	Digest   string `json:"digest,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+//AuditFilter selects the audit entries, the empty fields match anything
+type AuditFilter struct {
+	Username     string
+	RegistryType string
+	Namespace    string
+	Command      string
+	Package      string
+	Outcome      string
+	//Unix time range
+	Since int64
+	Until int64
+	//Only the entries before the sequence, to page back from the oldest returned one
+	Before uint64
+	//The latest entries are returned, default is 100
+	Limit int
+}
+
+//AuditVerification is the result of verifying the hash chain
+type AuditVerification struct {
+	Valid   bool   `json:"valid"`
+	Entries uint64 `json:"entries"`
+	//Sequence of the first broken entry
+	BrokenAt uint64 `json:"broken_at"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+//AuditExporter ships the appended entries out of the proxy
+type AuditExporter interface {
+	//Export the entry
+	Export(event *AuditEvent) error
+
+	//Close the exporter
+	Close() error
+}
+
+//AuditTrail is the append-only audit log of package operations and denials,
+//every entry carries the hash of the previous one so the tampering is detected by Verify.
+//The entries are chained in the order of Append, and persisted and exported by the writer
+//in the same order, so a slow disk or syslog server doesn't stall the requests.
+type AuditTrail struct {
+	lock      *sync.Mutex
+	store     StateStore
+	exporters []AuditExporter
+	//Sequence and hash of the next entry to append
+	next     uint64
+	lastHash string
+	//Chained entries to the writer
+	queue   chan auditItem
+	closed  bool
+	stopped chan struct{}
+}
+
+//auditItem is the entry to write, or the marker closed when the entries before it are written
+type auditItem struct {
+	event   *AuditEvent
+	flushed chan struct{}
+}
+
+//NewAuditTrail ...
+func NewAuditTrail(store StateStore) *AuditTrail {
+	at := &AuditTrail{
+		lock:      new(sync.Mutex),
+		store:     store,
+		exporters: make([]AuditExporter, 0),
+		queue:     make(chan auditItem, auditQueueSize),
+		stopped:   make(chan struct{}),
+	}
+	go at.run()
+
+	return at
+}
+
+//Load the head of the chain from the state store and open the exporters by the config
+func (at *AuditTrail) Load() error {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+
+	err := at.store.List(bucketAudit, func(key string, data []byte) error {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return err
+		}
+		at.next = event.Sequence + 1
+		at.lastHash = event.Hash
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(Config.Audit.File) > 0 {
+		exporter, err := newFileAuditExporter(Config.Audit.File)
+		if err != nil {
+			return err
+		}
+		at.exporters = append(at.exporters, exporter)
+	}
+	if Config.Audit.Syslog.Enabled {
+		exporter, err := newSyslogAuditExporter(Config.Audit.Syslog)
+		if err != nil {
+			return err
+		}
+		at.exporters = append(at.exporters, exporter)
+	}
+
+	return nil
+}
+
+//Append the entry to the chain, it's persisted and exported by the writer
+func (at *AuditTrail) Append(event *AuditEvent) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	event.Sequence = at.next
+	event.PrevHash = at.lastHash
+	event.Hash = event.chainHash()
+	at.next++
+	at.lastHash = event.Hash
+
+	if at.closed {
+		//Appended while stopping, nothing left to export to
+		at.write(event, nil)
+		return
+	}
+	at.queue <- auditItem{event: event}
+}
+
+//run is the writer persisting and exporting the chained entries
+func (at *AuditTrail) run() {
+	defer close(at.stopped)
+
+	for item := range at.queue {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+
+		at.lock.Lock()
+		exporters := at.exporters
+		at.lock.Unlock()
+		at.write(item.event, exporters)
+	}
+}
+
+func (at *AuditTrail) write(event *AuditEvent, exporters []AuditExporter) {
+	if err := at.store.Put(bucketAudit, sequenceKey(event.Sequence), event); err != nil {
+		//The chain is broken at it, reported by Verify
+		logger.Errorf("Failed to persist audit event %d: %s", event.Sequence, err)
+	}
+
+	for _, e := range exporters {
+		if err := e.Export(event); err != nil {
+			logger.Errorf("Failed to export audit event %d: %s", event.Sequence, err)
+		}
+	}
+}
+
+//flush waits until the entries appended so far are written and returns the sequence of the next one
+func (at *AuditTrail) flush() uint64 {
+	at.lock.Lock()
+	next := at.next
+	if at.closed {
+		at.lock.Unlock()
+		return next
+	}
+	flushed := make(chan struct{})
+	at.queue <- auditItem{flushed: flushed}
+	at.lock.Unlock()
+
+	<-flushed
+
+	return next
+}
+
+//Deny appends the denied request
+func (at *AuditTrail) Deny(req *http.Request, principal *Principal, role string, res Resource, cause error) {
+	event := &AuditEvent{
+		RemoteAddr:   req.RemoteAddr,
+		Method:       req.Method,
+		Path:         req.URL.Path,
+		Role:         role,
+		RegistryType: res.RegistryType,
+		Namespace:    res.Namespace,
+		Package:      res.Package,
+		Outcome:      auditOutcomeDenied,
+		Reason:       cause.Error(),
+	}
+	if principal != nil {
+		event.Username = principal.Username
+	} else if username, _, ok := req.BasicAuth(); ok {
+		//The failed login
+		event.Username = username
+	}
+
+	at.Append(event)
+}
+
+//Query returns the latest entries matched by the filter in the order of sequence
+func (at *AuditTrail) Query(filter *AuditFilter) ([]*AuditEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditQueryLimit
+	}
+	if limit > maxAuditQueryLimit {
+		limit = maxAuditQueryLimit
+	}
+
+	//Read the own writes
+	at.flush()
+
+	before := ""
+	if filter.Before > 0 {
+		before = sequenceKey(filter.Before)
+	}
+	events := make([]*AuditEvent, 0)
+	err := at.store.ListReverse(bucketAudit, before, func(key string, data []byte) error {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return err
+		}
+		if !filter.matches(event) {
+			return nil
+		}
+		events = append(events, event)
+		if len(events) == limit {
+			return errStopListing
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
+
+//Verify walks the chain from the first entry, the removed, changed or reordered entries break it.
+//The entries rewritten with the recomputed hashes are only detected against the exported copies.
+func (at *AuditTrail) Verify() (*AuditVerification, error) {
+	//Appended entries while walking are fine
+	next := at.flush()
+
+	result := &AuditVerification{Valid: true}
+	prevHash := ""
+	err := at.store.List(bucketAudit, func(key string, data []byte) error {
+		if !result.Valid {
+			return nil
+		}
+
+		event := &AuditEvent{}
+		reason := ""
+		switch err := json.Unmarshal(data, event); {
+		case err != nil:
+			reason = fmt.Sprintf("invalid entry: %s", err)
+		case event.Sequence != result.Entries || key != sequenceKey(event.Sequence):
+			reason = "sequence is not continuous"
+		case event.PrevHash != prevHash:
+			reason = "previous hash mismatched"
+		case event.Hash != event.chainHash():
+			reason = "hash mismatched"
+		}
+		if len(reason) > 0 {
+			result.Valid = false
+			result.BrokenAt = result.Entries
+			result.Reason = reason
+			return nil
+		}
+
+		prevHash = event.Hash
+		result.Entries++
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Valid && result.Entries < next {
+		result.Valid = false
+		result.BrokenAt = result.Entries
+		result.Reason = "entries are removed from the tail"
+	}
+
+	return result, nil
+}
+
+//Close waits the writer and closes the exporters
+func (at *AuditTrail) Close() {
+	at.lock.Lock()
+	if at.closed {
+		at.lock.Unlock()
+		return
+	}
+	at.closed = true
+	close(at.queue)
+	at.lock.Unlock()
+
+	<-at.stopped
+
+	at.lock.Lock()
+	defer at.lock.Unlock()
+
+	for _, e := range at.exporters {
+		if err := e.Close(); err != nil {
+			logger.Errorf("Failed to close audit exporter: %s", err)
+		}
+	}
+	at.exporters = make([]AuditExporter, 0)
+}
+
+//chainHash is the sha256 of the entry without its own hash, the previous hash is included
+func (e *AuditEvent) chainHash() string {
+	entry := *e
+	entry.Hash = ""
+	data, _ := json.Marshal(&entry)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *AuditFilter) matches(e *AuditEvent) bool {
+	return (len(f.Username) == 0 || e.Username == f.Username) &&
+		(len(f.RegistryType) == 0 || e.RegistryType == f.RegistryType) &&
+		(len(f.Namespace) == 0 || e.Namespace == f.Namespace) &&
+		(len(f.Command) == 0 || e.Command == f.Command) &&
+		(len(f.Package) == 0 || e.Package == f.Package) &&
+		(len(f.Outcome) == 0 || e.Outcome == f.Outcome) &&
+		(f.Since == 0 || e.Time >= f.Since) &&
+		(f.Until == 0 || e.Time <= f.Until)
+}
+
+//versionOf returns the version of the published or downloaded package if it's known
+func versionOf(meta RequestMeta) string {
+	if meta.RegistryType != registryTypeNpm {
+		return ""
+	}
+	if meta.Metadata["command"] == "publish" {
+		//Latest dist-tag of the published document
+		return meta.Metadata["extra"]
+	}
+
+	//Tarball: /name/-/name-1.0.0.tgz
+	p := strings.SplitN(meta.Metadata["path"], "?", 2)[0]
+	if !strings.Contains(p, "/-/") || !strings.HasSuffix(p, ".tgz") {
+		return ""
+	}
+	file := strings.TrimSuffix(p[strings.LastIndex(p, "/")+1:], ".tgz")
+	name := npmPackageOf(p)
+	name = name[strings.LastIndex(name, "/")+1:]
+
+	return strings.TrimPrefix(file, name+"-")
+}
+
+//fileAuditExporter appends the entries to the file as JSON lines
+type fileAuditExporter struct {
+	file *os.File
+}
+
+func newFileAuditExporter(path string) (*fileAuditExporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditExporter{file: file}, nil
+}
+
+//Export ...
+func (fe *fileAuditExporter) Export(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fe.file.Write(append(data, '\n'))
+
+	return err
+}
+
+//Close ...
+func (fe *fileAuditExporter) Close() error {
+	return fe.file.Close()
+}
+
+//syslogAuditExporter sends the entries as JSON to syslog
+type syslogAuditExporter struct {
+	writer *syslog.Writer
+}
+
+func newSyslogAuditExporter(config *SyslogConfig) (*syslogAuditExporter, error) {
+	writer, err := syslog.Dial(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_AUTH, config.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogAuditExporter{writer: writer}, nil
+}
+
+//Export ...
+func (se *syslogAuditExporter) Export(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return se.writer.Info(string(data))
+}
+
+//Close ...
+func (se *syslogAuditExporter) Close() error {
+	return se.writer.Close()
+}
+
+//chainAuditEvents chains the denials recorded before the audit log is hash chained (schema 2)
+func chainAuditEvents(store StateStore) error {
+	keys := make([]string, 0)
+	events := make([]*AuditEvent, 0)
+	err := store.List(bucketAudit, func(key string, data []byte) error {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		events = append(events, event)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := store.Delete(bucketAudit, key); err != nil {
+			return err
+		}
+	}
+	prevHash := ""
+	for i, event := range events {
+		event.Sequence = uint64(i)
+		event.PrevHash = prevHash
+		event.Hash = event.chainHash()
+		if err := store.Put(bucketAudit, sequenceKey(event.Sequence), event); err != nil {
+			return err
+		}
+		prevHash = event.Hash
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func appendAuditEvents(at *AuditTrail, n int) {
+	for i := 0; i < n; i++ {
+		outcome := auditOutcomeSucceeded
+		if i%2 == 1 {
+			outcome = auditOutcomeDenied
+		}
+		at.Append(&AuditEvent{Username: "alice", RegistryType: registryTypeNpm, Package: "lodash", Outcome: outcome})
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		tamper   func(store StateStore) error
+		brokenAt uint64
+		reason   string
+	}{
+		{"intact", func(store StateStore) error { return nil }, 0, ""},
+		{"modified", func(store StateStore) error {
+			event := &AuditEvent{}
+			err := store.List(bucketAudit, func(key string, data []byte) error {
+				if key == sequenceKey(1) {
+					return json.Unmarshal(data, event)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			event.Outcome = auditOutcomeSucceeded
+			return store.Put(bucketAudit, sequenceKey(1), event)
+		}, 1, "hash mismatched"},
+		{"removed", func(store StateStore) error {
+			return store.Delete(bucketAudit, sequenceKey(1))
+		}, 1, "sequence is not continuous"},
+		{"removed from tail", func(store StateStore) error {
+			return store.Delete(bucketAudit, sequenceKey(2))
+		}, 2, "entries are removed from the tail"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewMemoryStateStore()
+			at := NewAuditTrail(store)
+			defer at.Close()
+			appendAuditEvents(at, 3)
+			at.flush()
+
+			if err := tc.tamper(store); err != nil {
+				t.Fatal(err)
+			}
+			result, err := at.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.reason) == 0 {
+				if !result.Valid || result.Entries != 3 {
+					t.Errorf("Verify() = %+v, want 3 valid entries", result)
+				}
+				return
+			}
+			if result.Valid || result.BrokenAt != tc.brokenAt || result.Reason != tc.reason {
+				t.Errorf("Verify() = %+v, want broken at %d: %s", result, tc.brokenAt, tc.reason)
+			}
+		})
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	bolt, err := NewBoltStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, store := range map[string]StateStore{"memory": NewMemoryStateStore(), "bolt": bolt} {
+		t.Run(name, func(t *testing.T) {
+			at := NewAuditTrail(store)
+			defer at.Close()
+			appendAuditEvents(at, 5)
+
+			for _, tc := range []struct {
+				filter    AuditFilter
+				sequences []uint64
+			}{
+				{AuditFilter{}, []uint64{0, 1, 2, 3, 4}},
+				{AuditFilter{Limit: 2}, []uint64{3, 4}},
+				{AuditFilter{Before: 3, Limit: 2}, []uint64{1, 2}},
+				{AuditFilter{Before: 1, Limit: 2}, []uint64{0}},
+				{AuditFilter{Before: 10}, []uint64{0, 1, 2, 3, 4}},
+				{AuditFilter{Outcome: auditOutcomeDenied}, []uint64{1, 3}},
+				{AuditFilter{Outcome: auditOutcomeSucceeded, Before: 4, Limit: 1}, []uint64{2}},
+				{AuditFilter{Username: "bob"}, []uint64{}},
+			} {
+				events, err := at.Query(&tc.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sequences := make([]uint64, 0, len(events))
+				for _, e := range events {
+					sequences = append(sequences, e.Sequence)
+				}
+				if len(sequences) != len(tc.sequences) {
+					t.Errorf("Query(%+v) = %v, want %v", tc.filter, sequences, tc.sequences)
+					continue
+				}
+				for i := range sequences {
+					if sequences[i] != tc.sequences[i] {
+						t.Errorf("Query(%+v) = %v, want %v", tc.filter, sequences, tc.sequences)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuditClose(t *testing.T) {
+	store := NewMemoryStateStore()
+	at := NewAuditTrail(store)
+	appendAuditEvents(at, 2)
+	at.Close()
+	//Written synchronously while stopping
+	appendAuditEvents(at, 1)
+	at.Close()
+
+	result, err := at.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Entries != 3 {
+		t.Errorf("Verify() = %+v, want 3 valid entries", result)
+	}
+}
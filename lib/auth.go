@@ -0,0 +1,589 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"registry-factory/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	bucketUsers  = "users"
+	bucketTokens = "tokens"
+
+	tokenPrefix = "chm_"
+)
+
+var (
+	//ErrUnauthenticated is returned when the credential is missing or wrong
+	ErrUnauthenticated = errors.New("authentication required")
+	//ErrForbidden is returned when the user has no permission
+	ErrForbidden = errors.New("permission denied")
+	//ErrUserNotFound is returned when the user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	//ErrUserExisting is returned when creating the existing user
+	ErrUserExisting = errors.New("user existing")
+	//ErrTokenNotFound is returned when the token does not exist
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+//AuthError tells the client to authenticate or that it's not permitted
+type AuthError struct {
+	Cause        error
+	RegistryType string
+}
+
+//Error implements error interface
+func (ae *AuthError) Error() string {
+	return ae.Cause.Error()
+}
+
+//StatusCode of the response
+func (ae *AuthError) StatusCode() int {
+	if ae.Cause == ErrForbidden {
+		return http.StatusForbidden
+	}
+
+	return http.StatusUnauthorized
+}
+
+//User of the registries
+type User struct {
+	Username     string `json:"username"`
+	Email        string `json:"email,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	//Identity provider of the user, empty for the local one
+	Provider string `json:"provider,omitempty"`
+	//Groups from the identity provider, updated on every login
+	Groups []string `json:"groups,omitempty"`
+	//Bootstrapped from the config
+	FromConfig  bool  `json:"from_config"`
+	CreatedTime int64 `json:"created_time"`
+}
+
+//Token is the registry token of user, only the hash of it is kept
+type Token struct {
+	//sha256 of the token
+	Key string `json:"key"`
+	//Masked token for display
+	Masked        string   `json:"token"`
+	Username      string   `json:"username"`
+	Readonly      bool     `json:"readonly"`
+	CIDRWhitelist []string `json:"cidr_whitelist"`
+	CreatedTime   int64    `json:"created_time"`
+	//0 is never expired
+	ExpireTime int64 `json:"expire_time"`
+}
+
+//Principal is the authenticated caller
+type Principal struct {
+	Username string
+	//Set if it's authenticated with a token
+	Token *Token
+}
+
+//Authenticator keeps the users and tokens, authenticates the registry clients
+//and checks their roles on the resources.
+//The passwords of the users not found locally are verified with the identity providers.
+type Authenticator struct {
+	lock      *sync.RWMutex
+	users     map[string]*User
+	tokens    map[string]*Token
+	store     StateStore
+	providers []IdentityProvider
+	logins    *loginCache
+	rbac      *RBAC
+	//nil if OIDC is not enabled
+	oidc *OIDCProvider
+}
+
+//NewAuthenticator ...
+func NewAuthenticator(store StateStore) *Authenticator {
+	a := &Authenticator{
+		lock:      new(sync.RWMutex),
+		users:     make(map[string]*User),
+		tokens:    make(map[string]*Token),
+		store:     store,
+		providers: identityProviders(),
+		logins:    newLoginCache(),
+		rbac:      NewRBAC(store),
+	}
+	if Config.Identity.OIDC.Enabled {
+		a.oidc = NewOIDCProvider(Config.Identity.OIDC)
+	}
+
+	return a
+}
+
+//Load the users, tokens and role bindings from the state store, the users in config are bootstrapped
+func (a *Authenticator) Load() error {
+	if err := a.rbac.Load(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	err := a.store.List(bucketUsers, func(key string, data []byte) error {
+		user := &User{}
+		if err := json.Unmarshal(data, user); err != nil {
+			return err
+		}
+		a.users[key] = user
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = a.store.List(bucketTokens, func(key string, data []byte) error {
+		token := &Token{}
+		if err := json.Unmarshal(data, token); err != nil {
+			return err
+		}
+		a.tokens[key] = token
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Config is the source of truth of the bootstrapped users
+	for _, u := range Config.Auth.Users {
+		user, ok := a.users[u.Username]
+		if !ok {
+			user = &User{
+				Username:    u.Username,
+				CreatedTime: time.Now().Unix(),
+			}
+			a.users[u.Username] = user
+		}
+		user.Email = u.Email
+		user.PasswordHash = u.PasswordHash
+		user.FromConfig = true
+		a.persistUser(user)
+	}
+
+	return nil
+}
+
+//AddUser creates the user with the password
+func (a *Authenticator) AddUser(username, password, email string) (*User, error) {
+	if len(username) == 0 || strings.ContainsAny(username, ":/") {
+		return nil, fmt.Errorf("invalid username '%s'", username)
+	}
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.users[username]; ok {
+		return nil, ErrUserExisting
+	}
+
+	user := &User{
+		Username:     username,
+		Email:        email,
+		PasswordHash: string(hash),
+		CreatedTime:  time.Now().Unix(),
+	}
+	a.users[username] = user
+	a.persistUser(user)
+
+	return user.public(), nil
+}
+
+//GetUser gets the user without the password hash
+func (a *Authenticator) GetUser(username string) (*User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	user, ok := a.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	return user.public(), nil
+}
+
+//Users lists the users without the password hashes
+func (a *Authenticator) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	users := make([]*User, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u.public())
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users
+}
+
+//DeleteUser deletes the user and revokes all the tokens of it
+func (a *Authenticator) DeleteUser(username string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.users[username]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(a.users, username)
+	a.rbac.DeleteUserBindings(username)
+	a.logins.Forget()
+	if err := a.store.Delete(bucketUsers, username); err != nil {
+		logger.Errorf("Failed to delete user %s from state store: %s", username, err)
+	}
+
+	for key, t := range a.tokens {
+		if t.Username == username {
+			a.deleteToken(key)
+		}
+	}
+
+	return nil
+}
+
+//Login verifies the password with the local user first, then the identity providers in order,
+//the user authenticated by the provider is kept with its groups.
+func (a *Authenticator) Login(username, password string) (*User, error) {
+	if len(username) == 0 || len(password) == 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	a.lock.RLock()
+	user, ok := a.users[username]
+	a.lock.RUnlock()
+	if ok && a.logins.Hit(username, password) {
+		return user.public(), nil
+	}
+
+	if ok && len(user.Provider) == 0 {
+		verified, err := a.Verify(username, password)
+		if err != nil {
+			return nil, err
+		}
+		//bcrypt is slow on purpose, don't run it on every request
+		a.logins.Put(username, password)
+
+		return verified, nil
+	}
+
+	for _, p := range a.providers {
+		identity, err := p.Authenticate(username, password)
+		if err != nil {
+			if err != ErrUnauthenticated {
+				logger.Errorf("Failed to authenticate %s with %s: %s", username, p.Name(), err)
+			}
+			continue
+		}
+
+		user, err := a.Provision(identity)
+		if err != nil {
+			return nil, err
+		}
+		a.logins.Put(username, password)
+
+		return user, nil
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+//Provision keeps the user authenticated by the identity provider,
+//the local user with the same name is never taken over.
+func (a *Authenticator) Provision(identity *Identity) (*User, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user, ok := a.users[identity.Username]
+	if ok && user.Provider != identity.Provider {
+		logger.Errorf("User %s of %s conflicts with the existing one", identity.Username, identity.Provider)
+		return nil, ErrUnauthenticated
+	}
+	if !ok {
+		user = &User{
+			Username:    identity.Username,
+			Provider:    identity.Provider,
+			CreatedTime: time.Now().Unix(),
+		}
+		a.users[user.Username] = user
+	}
+	user.Email = identity.Email
+	user.Groups = identity.Groups
+	a.persistUser(user)
+
+	return user.public(), nil
+}
+
+//OIDC returns the OIDC provider, nil if it's not enabled
+func (a *Authenticator) OIDC() *OIDCProvider {
+	return a.oidc
+}
+
+//Verify the password of the local user
+func (a *Authenticator) Verify(username, password string) (*User, error) {
+	a.lock.RLock()
+	user, ok := a.users[username]
+	a.lock.RUnlock()
+	if !ok || len(user.Provider) > 0 || len(user.PasswordHash) == 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	return user.public(), nil
+}
+
+//CreateToken issues a token of user, the token itself is only returned here
+func (a *Authenticator) CreateToken(username string, readonly bool, cidrWhitelist []string) (string, *Token, error) {
+	for _, cidr := range cidrWhitelist {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "", nil, fmt.Errorf("invalid cidr '%s'", cidr)
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(buf)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.users[username]; !ok {
+		return "", nil, ErrUserNotFound
+	}
+
+	if cidrWhitelist == nil {
+		cidrWhitelist = make([]string, 0)
+	}
+	now := time.Now().Unix()
+	token := &Token{
+		Key:           tokenKey(secret),
+		Masked:        secret[:len(tokenPrefix)+6] + "...",
+		Username:      username,
+		Readonly:      readonly,
+		CIDRWhitelist: cidrWhitelist,
+		CreatedTime:   now,
+	}
+	if Config.Auth.TokenTTL > 0 {
+		token.ExpireTime = now + int64(Config.Auth.TokenTTL)
+	}
+	a.tokens[token.Key] = token
+	if err := a.store.Put(bucketTokens, token.Key, token); err != nil {
+		logger.Errorf("Failed to persist token of %s: %s", username, err)
+	}
+
+	return secret, token, nil
+}
+
+//Tokens lists the tokens of user
+func (a *Authenticator) Tokens(username string) []*Token {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	tokens := make([]*Token, 0)
+	for _, t := range a.tokens {
+		if t.Username == username {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedTime < tokens[j].CreatedTime
+	})
+
+	return tokens
+}
+
+//RevokeToken revokes the token of user with the key
+func (a *Authenticator) RevokeToken(username, key string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	token, ok := a.tokens[key]
+	if !ok || token.Username != username {
+		return ErrTokenNotFound
+	}
+	a.deleteToken(key)
+
+	return nil
+}
+
+//Authenticate the request with the bearer token or the basic auth (password or token),
+//nil principal is returned if the request has no credential.
+func (a *Authenticator) Authenticate(req *http.Request) (*Principal, error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return nil, nil
+	}
+
+	scheme := strings.SplitN(auth, " ", 2)
+	if len(scheme) != 2 {
+		return nil, ErrUnauthenticated
+	}
+	credential := strings.TrimSpace(scheme[1])
+
+	switch strings.ToLower(scheme[0]) {
+	case "bearer":
+		return a.authenticateToken(credential, req.RemoteAddr)
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credential)
+		if err != nil {
+			return nil, ErrUnauthenticated
+		}
+		pair := strings.SplitN(string(decoded), ":", 2)
+		if len(pair) != 2 {
+			return nil, ErrUnauthenticated
+		}
+		//Token can be used as the password
+		if strings.HasPrefix(pair[1], tokenPrefix) {
+			principal, err := a.authenticateToken(pair[1], req.RemoteAddr)
+			if err != nil || principal.Username != pair[0] {
+				return nil, ErrUnauthenticated
+			}
+			return principal, nil
+		}
+		user, err := a.Login(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{Username: user.Username}, nil
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+//Authorize checks whether the principal (nil is anonymous) has the role on the resource
+func (a *Authenticator) Authorize(principal *Principal, role string, res Resource) error {
+	if principal == nil {
+		//The management API is never anonymous
+		if role == roleReader && len(res.Namespace) > 0 && Config.Auth.AnonymousRead {
+			return nil
+		}
+		return ErrUnauthenticated
+	}
+
+	if role != roleReader && principal.Token != nil && principal.Token.Readonly {
+		return ErrForbidden
+	}
+
+	a.lock.RLock()
+	user, ok := a.users[principal.Username]
+	var groups []string
+	if ok {
+		groups = user.Groups
+	}
+	a.lock.RUnlock()
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	if roleRanks[a.rbac.Role(principal.Username, groups, res)] >= roleRanks[role] {
+		return nil
+	}
+
+	return ErrForbidden
+}
+
+//RBAC returns the role bindings
+func (a *Authenticator) RBAC() *RBAC {
+	return a.rbac
+}
+
+func (a *Authenticator) authenticateToken(secret, remoteAddr string) (*Principal, error) {
+	key := tokenKey(secret)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	token, ok := a.tokens[key]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	if token.ExpireTime > 0 && time.Now().Unix() >= token.ExpireTime {
+		a.deleteToken(key)
+		return nil, ErrUnauthenticated
+	}
+	if !allowedAddr(token.CIDRWhitelist, remoteAddr) {
+		return nil, ErrUnauthenticated
+	}
+
+	return &Principal{Username: token.Username, Token: token}, nil
+}
+
+func (a *Authenticator) deleteToken(key string) {
+	delete(a.tokens, key)
+	if err := a.store.Delete(bucketTokens, key); err != nil {
+		logger.Errorf("Failed to delete token from state store: %s", err)
+	}
+}
+
+func (a *Authenticator) persistUser(user *User) {
+	if err := a.store.Put(bucketUsers, user.Username, user); err != nil {
+		logger.Errorf("Failed to persist user %s: %s", user.Username, err)
+	}
+}
+
+//public returns the copy of user without the password hash
+func (u *User) public() *User {
+	user := *u
+	user.PasswordHash = ""
+	user.Groups = append([]string(nil), u.Groups...)
+
+	return &user
+}
+
+func tokenKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func allowedAddr(cidrWhitelist []string, remoteAddr string) bool {
+	if len(cidrWhitelist) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrWhitelist {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
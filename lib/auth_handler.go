@@ -0,0 +1,411 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"registry-factory/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	npmUserPath   = "/-/user/org.couchdb.user:"
+	npmLogoutPath = "/-/user/token/"
+	npmWhoamiPath = "/-/whoami"
+	npmTokensPath = "/-/npm/v1/tokens"
+	npmWebLogin   = "/-/v1/login"
+	npmWebDone    = "/-/v1/done"
+)
+
+//AuthHandler serves the login and token requests of the registry clients,
+//they're answered by the proxy itself instead of the runtimes.
+type AuthHandler struct {
+	auth *Authenticator
+}
+
+//npmTokenObject is the token in the npm token API
+type npmTokenObject struct {
+	Token         string   `json:"token"`
+	Key           string   `json:"key"`
+	CIDRWhitelist []string `json:"cidr_whitelist"`
+	Readonly      bool     `json:"readonly"`
+	Created       string   `json:"created"`
+	Updated       string   `json:"updated"`
+}
+
+//IsMatchedRequests check if the requests are login or token requests
+func (ah *AuthHandler) IsMatchedRequests(r *http.Request) bool {
+	if r == nil || !Config.Auth.Enabled {
+		return false
+	}
+
+	p := r.URL.Path
+	return strings.HasPrefix(p, npmUserPath) ||
+		strings.HasPrefix(p, npmLogoutPath) ||
+		p == npmWhoamiPath ||
+		strings.HasPrefix(p, npmTokensPath) ||
+		strings.HasPrefix(p, npmWebLogin) ||
+		p == npmWebDone
+}
+
+//ServeHTTP serve http requests
+func (ah *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, npmUserPath):
+		ah.handleNpmLogin(w, r)
+	case strings.HasPrefix(p, npmLogoutPath):
+		ah.handleNpmLogout(w, r)
+	case strings.HasPrefix(p, npmWebLogin):
+		ah.handleWebLogin(w, r)
+	case p == npmWebDone:
+		ah.handleWebLoginDone(w, r)
+	case p == npmWhoamiPath:
+		principal, ok := ah.authenticate(w, r)
+		if ok {
+			npmJSON(w, http.StatusOK, map[string]string{"username": principal.Username})
+		}
+	default:
+		ah.handleNpmTokens(w, r)
+	}
+}
+
+//handleNpmLogin serves:
+//PUT /-/user/org.couchdb.user:{name}
+//GET /-/user/org.couchdb.user:{name}
+func (ah *AuthHandler) handleNpmLogin(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimPrefix(r.URL.Path, npmUserPath)
+
+	if r.Method == http.MethodGet {
+		principal, ok := ah.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if principal.Username != username {
+			npmError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		user, err := ah.auth.GetUser(username)
+		if err != nil {
+			npmError(w, http.StatusNotFound, err)
+			return
+		}
+		npmJSON(w, http.StatusOK, map[string]string{
+			"_id":   "org.couchdb.user:" + user.Username,
+			"name":  user.Username,
+			"email": user.Email,
+		})
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	login := &struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, login)
+	}
+	if err != nil || login.Name != username {
+		npmError(w, http.StatusBadRequest, fmt.Errorf("invalid login of %s", username))
+		return
+	}
+
+	user, err := ah.auth.Login(login.Name, login.Password)
+	if err != nil {
+		if _, getErr := ah.auth.GetUser(login.Name); getErr != ErrUserNotFound || !Config.Auth.AllowSignup {
+			logger.Errorf("Failed to login user %s: %s", login.Name, err)
+			npmError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		user, err = ah.auth.AddUser(login.Name, login.Password, login.Email)
+		if err != nil {
+			npmError(w, http.StatusBadRequest, err)
+			return
+		}
+		//Bind the default role on the registry namespaces
+		if len(Config.Auth.DefaultRole) > 0 {
+			for _, registryType := range []string{registryTypeNpm, registryTypePip} {
+				_, err := ah.auth.RBAC().AddBinding(&RoleBinding{
+					Role:         Config.Auth.DefaultRole,
+					User:         user.Username,
+					RegistryType: registryType,
+					Namespace:    registryConfigOf(registryType).Namespace,
+				})
+				if err != nil {
+					logger.Errorf("Failed to bind role %s to user %s: %s", Config.Auth.DefaultRole, user.Username, err)
+				}
+			}
+		}
+		logger.Infof("User %s is signed up", user.Username)
+	}
+
+	secret, _, err := ah.auth.CreateToken(user.Username, false, nil)
+	if err != nil {
+		npmError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	npmJSON(w, http.StatusCreated, map[string]interface{}{
+		"ok":    true,
+		"id":    "org.couchdb.user:" + user.Username,
+		"rev":   "1",
+		"token": secret,
+	})
+}
+
+//handleNpmLogout serves:
+//DELETE /-/user/token/{token}
+func (ah *AuthHandler) handleNpmLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, ok := ah.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	key := tokenKey(strings.TrimPrefix(r.URL.Path, npmLogoutPath))
+	if err := ah.auth.RevokeToken(principal.Username, key); err != nil {
+		npmError(w, http.StatusNotFound, err)
+		return
+	}
+
+	npmJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+//handleNpmTokens serves:
+//GET    /-/npm/v1/tokens
+//POST   /-/npm/v1/tokens
+//DELETE /-/npm/v1/tokens/token/{key}
+func (ah *AuthHandler) handleNpmTokens(w http.ResponseWriter, r *http.Request) {
+	principal, ok := ah.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, npmTokensPath), "/")
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		tokens := ah.auth.Tokens(principal.Username)
+		objects := make([]*npmTokenObject, 0, len(tokens))
+		for _, t := range tokens {
+			objects = append(objects, npmToken(t, t.Masked))
+		}
+		npmJSON(w, http.StatusOK, map[string]interface{}{
+			"objects": objects,
+			"total":   len(objects),
+			"urls":    map[string]string{},
+		})
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		req := &struct {
+			Password      string   `json:"password"`
+			Readonly      bool     `json:"readonly"`
+			CIDRWhitelist []string `json:"cidr_whitelist"`
+		}{}
+		data, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(data, req)
+		}
+		if err != nil {
+			npmError(w, http.StatusBadRequest, err)
+			return
+		}
+		//Password is required as the token may be stolen
+		if _, err := ah.auth.Login(principal.Username, req.Password); err != nil {
+			npmError(w, http.StatusUnauthorized, err)
+			return
+		}
+		secret, token, err := ah.auth.CreateToken(principal.Username, req.Readonly, req.CIDRWhitelist)
+		if err != nil {
+			npmError(w, http.StatusBadRequest, err)
+			return
+		}
+		npmJSON(w, http.StatusOK, npmToken(token, secret))
+	case strings.HasPrefix(rest, "token/") && r.Method == http.MethodDelete:
+		if err := ah.auth.RevokeToken(principal.Username, strings.TrimPrefix(rest, "token/")); err != nil {
+			npmError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//handleWebLogin serves:
+//POST /-/v1/login
+//GET  /-/v1/login/{id}
+//The login is done with the device code flow of the OIDC issuer, e.g: npm login --auth-type=web
+func (ah *AuthHandler) handleWebLogin(w http.ResponseWriter, r *http.Request) {
+	oidc := ah.auth.OIDC()
+	if oidc == nil {
+		//npm falls back to the legacy login
+		npmError(w, http.StatusNotFound, errors.New("web login is not enabled"))
+		return
+	}
+
+	ID := strings.Trim(strings.TrimPrefix(r.URL.Path, npmWebLogin), "/")
+	if len(ID) > 0 && r.Method == http.MethodGet {
+		//Where to enter the user code if the issuer can't complete it
+		login, err := oidc.GetLogin(ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "<html><body><p>Enter the code <b>%s</b> at <a href=\"%s\">%s</a> to login.</p></body></html>",
+			html.EscapeString(login.UserCode), html.EscapeString(login.VerificationURI), html.EscapeString(login.VerificationURI))
+		return
+	}
+
+	if len(ID) > 0 || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := oidc.StartLogin()
+	if err != nil {
+		logger.Errorf("Failed to start oidc login: %s", err)
+		npmError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	base := fmt.Sprintf("%s://%s", requestScheme(r), r.Host)
+	loginURL := login.VerificationURIComplete
+	if len(loginURL) == 0 {
+		loginURL = fmt.Sprintf("%s%s/%s", base, npmWebLogin, login.ID)
+	}
+	npmJSON(w, http.StatusOK, map[string]string{
+		"loginUrl": loginURL,
+		"doneUrl":  fmt.Sprintf("%s%s?sessionId=%s", base, npmWebDone, url.QueryEscape(login.ID)),
+	})
+}
+
+//handleWebLoginDone serves:
+//GET /-/v1/done?sessionId={id}
+//202 is returned until the user finishes the login, then the registry token is issued.
+func (ah *AuthHandler) handleWebLoginDone(w http.ResponseWriter, r *http.Request) {
+	oidc := ah.auth.OIDC()
+	if oidc == nil {
+		npmError(w, http.StatusNotFound, errors.New("web login is not enabled"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, retryAfter, err := oidc.PollLogin(r.URL.Query().Get("sessionId"))
+	switch {
+	case err == ErrLoginPending:
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		npmJSON(w, http.StatusAccepted, map[string]string{})
+		return
+	case err == ErrLoginNotFound:
+		npmError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		logger.Errorf("Failed to finish oidc login: %s", err)
+		npmError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	user, err := ah.auth.Provision(identity)
+	if err != nil {
+		npmError(w, http.StatusUnauthorized, err)
+		return
+	}
+	secret, _, err := ah.auth.CreateToken(user.Username, false, nil)
+	if err != nil {
+		npmError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Infof("OIDC user %s is logged in with groups %v", user.Username, user.Groups)
+
+	npmJSON(w, http.StatusOK, map[string]string{"token": secret})
+}
+
+//authenticate the request, the error is written if it's failed
+func (ah *AuthHandler) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, err := ah.auth.Authenticate(r)
+	if err == nil && principal == nil {
+		err = ErrUnauthenticated
+	}
+	if err != nil {
+		npmError(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+
+	return principal, true
+}
+
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); len(proto) > 0 {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+func npmToken(t *Token, token string) *npmTokenObject {
+	created := time.Unix(t.CreatedTime, 0).UTC().Format(time.RFC3339)
+	return &npmTokenObject{
+		Token:         token,
+		Key:           t.Key,
+		CIDRWhitelist: t.CIDRWhitelist,
+		Readonly:      t.Readonly,
+		Created:       created,
+		Updated:       created,
+	}
+}
+
+func npmJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+//npmError writes the error the npm client can show
+func npmError(w http.ResponseWriter, status int, err error) {
+	npmJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+//writeAuthError writes the authentication or authorization failure to the registry client
+func writeAuthError(w http.ResponseWriter, err *AuthError) {
+	status := err.StatusCode()
+	if status == http.StatusUnauthorized {
+		//Let pip prompt for the credential
+		w.Header().Set("WWW-Authenticate", `Basic realm="chameleon"`)
+	}
+
+	if err.RegistryType == registryTypeNpm {
+		npmError(w, status, err)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
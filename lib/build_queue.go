@@ -0,0 +1,365 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"registry-factory/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	bucketBuilds = "builds"
+
+	buildStatusPending   = "pending"
+	buildStatusRunning   = "running"
+	buildStatusSucceeded = "succeeded"
+	buildStatusDead      = "dead"
+
+	defaultBuildWorkers     = 2
+	defaultBuildMaxAttempts = 5
+	defaultBuildBackoff     = 10  //seconds
+	defaultBuildMaxBackoff  = 600 //seconds
+	maxSucceededBuilds      = 200
+)
+
+//ErrBuildNotFound is returned when the build job does not exist
+var ErrBuildNotFound = errors.New("build job not found")
+
+//BuildJob is a rebuild of package image in the queue
+type BuildJob struct {
+	//Idempotency key: registry_type/namespace/image:tag
+	ID          string       `json:"id"`
+	Policy      *BuildPolicy `json:"policy"`
+	Status      string       `json:"status"`
+	Attempts    int          `json:"attempts"`
+	LastError   string       `json:"last_error,omitempty"`
+	NextRun     int64        `json:"next_run"`
+	CreatedTime int64        `json:"created_time"`
+	UpdatedTime int64        `json:"updated_time"`
+}
+
+//BuildQueue runs the build jobs with bounded workers and retries the failed ones
+//with exponential backoff, the jobs run out of attempts go to the dead letters.
+//Jobs are persisted in the state store and resumed after restart.
+type BuildQueue struct {
+	lock        *sync.Mutex
+	jobs        map[string]*BuildJob
+	store       StateStore
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	build       func(policy *BuildPolicy) error
+	hold        func(instanceKey string)
+	release     func(instanceKey string)
+	running     *taskTracker
+	wake        chan struct{}
+	exit        chan struct{}
+}
+
+//NewBuildQueue ...
+//hold and release keep the base container of job alive until the job finishes.
+func NewBuildQueue(store StateStore, build func(policy *BuildPolicy) error, hold, release func(instanceKey string)) *BuildQueue {
+	return &BuildQueue{
+		lock:        new(sync.Mutex),
+		jobs:        make(map[string]*BuildJob),
+		store:       store,
+		workers:     Config.Build.Workers,
+		maxAttempts: Config.Build.MaxAttempts,
+		backoff:     time.Duration(Config.Build.Backoff) * time.Second,
+		maxBackoff:  time.Duration(Config.Build.MaxBackoff) * time.Second,
+		build:       build,
+		hold:        hold,
+		release:     release,
+		running:     newTaskTracker(),
+		wake:        make(chan struct{}, 1),
+		exit:        make(chan struct{}),
+	}
+}
+
+//Start loads the unfinished jobs and starts the workers
+func (bq *BuildQueue) Start() error {
+	bq.lock.Lock()
+	err := bq.store.List(bucketBuilds, func(key string, data []byte) error {
+		job := &BuildJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return err
+		}
+
+		//Interrupted by the last shutdown
+		if job.Status == buildStatusRunning {
+			job.Status = buildStatusPending
+		}
+		if job.Status == buildStatusPending {
+			bq.holdBase(job)
+		}
+		bq.jobs[job.ID] = job
+
+		return nil
+	})
+	bq.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < bq.workers; i++ {
+		go bq.work()
+	}
+
+	logger.Infof("Build queue is started with %d workers", bq.workers)
+
+	return nil
+}
+
+//Stop the workers and wait the running jobs until the timeout, returns the unfinished ones.
+//The pending jobs are kept in the store for the next start.
+func (bq *BuildQueue) Stop(timeout time.Duration) []string {
+	close(bq.exit)
+	unfinished := bq.running.Wait(timeout)
+
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	for _, job := range bq.jobs {
+		if job.Status == buildStatusPending {
+			unfinished = append(unfinished, job.ID)
+		}
+	}
+
+	return unfinished
+}
+
+//Enqueue the build, it's ignored if the same package version of the namespace is pending or running
+func (bq *BuildQueue) Enqueue(policy *BuildPolicy) (*BuildJob, error) {
+	if policy == nil {
+		return nil, errors.New("nil build policy")
+	}
+
+	ID := buildJobID(policy)
+
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	if job, ok := bq.jobs[ID]; ok && (job.Status == buildStatusPending || job.Status == buildStatusRunning) {
+		return job, nil
+	}
+
+	now := time.Now().Unix()
+	job := &BuildJob{
+		ID:          ID,
+		Policy:      policy,
+		Status:      buildStatusPending,
+		NextRun:     now,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	bq.jobs[ID] = job
+	bq.holdBase(job)
+	bq.persist(job)
+	bq.notify()
+
+	return job, nil
+}
+
+//buildJobID identifies the build of the package version published to the namespace
+func buildJobID(policy *BuildPolicy) string {
+	return fmt.Sprintf("%s/%s/%s:%s", policy.RegistryType, policy.Namespace, policy.Image, policy.Tag)
+}
+
+//Retry the dead job right now
+func (bq *BuildQueue) Retry(ID string) (*BuildJob, error) {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	job, ok := bq.jobs[ID]
+	if !ok {
+		return nil, ErrBuildNotFound
+	}
+
+	if job.Status != buildStatusDead {
+		return nil, fmt.Errorf("build job %s is %s, only dead ones can be retried", ID, job.Status)
+	}
+
+	job.Status = buildStatusPending
+	job.Attempts = 0
+	job.NextRun = time.Now().Unix()
+	job.UpdatedTime = job.NextRun
+	bq.holdBase(job)
+	bq.persist(job)
+	bq.notify()
+
+	return job, nil
+}
+
+//Get the job by ID
+func (bq *BuildQueue) Get(ID string) (*BuildJob, error) {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	job, ok := bq.jobs[ID]
+	if !ok {
+		return nil, ErrBuildNotFound
+	}
+	copied := *job
+
+	return &copied, nil
+}
+
+//List the jobs with the status, all jobs are returned if status is empty
+func (bq *BuildQueue) List(status string) []*BuildJob {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	jobs := make([]*BuildJob, 0)
+	for _, job := range bq.jobs {
+		if len(status) == 0 || job.Status == status {
+			copied := *job
+			jobs = append(jobs, &copied)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedTime < jobs[j].CreatedTime
+	})
+
+	return jobs
+}
+
+func (bq *BuildQueue) work() {
+	tk := time.NewTicker(1 * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-bq.exit:
+			return
+		default:
+		}
+
+		if job := bq.next(); job != nil {
+			bq.run(job)
+			continue
+		}
+
+		select {
+		case <-tk.C:
+		case <-bq.wake:
+		case <-bq.exit:
+			return
+		}
+	}
+}
+
+//next picks the earliest due pending job and marks it running
+func (bq *BuildQueue) next() *BuildJob {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	now := time.Now().Unix()
+	var picked *BuildJob
+	for _, job := range bq.jobs {
+		if job.Status != buildStatusPending || job.NextRun > now {
+			continue
+		}
+		if picked == nil || job.NextRun < picked.NextRun {
+			picked = job
+		}
+	}
+
+	if picked != nil {
+		picked.Status = buildStatusRunning
+		picked.Attempts++
+		picked.UpdatedTime = now
+		bq.persist(picked)
+	}
+
+	return picked
+}
+
+func (bq *BuildQueue) run(job *BuildJob) {
+	done := bq.running.Start(job.ID)
+	defer done()
+
+	//The job is logged with the ID of the publishing request
+	log := logger.WithRequest(job.Policy.RequestID)
+	log.Infof("Run build job %s (attempt %d/%d)", job.ID, job.Attempts, bq.maxAttempts)
+	err := bq.build(job.Policy)
+
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+
+	job.UpdatedTime = time.Now().Unix()
+	switch {
+	case err == nil:
+		job.Status = buildStatusSucceeded
+		job.LastError = ""
+		bq.releaseBase(job)
+		bq.prune()
+	case job.Attempts >= bq.maxAttempts:
+		job.Status = buildStatusDead
+		job.LastError = err.Error()
+		bq.releaseBase(job)
+		log.Errorf("Build job %s is dead after %d attempts: %s", job.ID, job.Attempts, err)
+	default:
+		job.Status = buildStatusPending
+		job.LastError = err.Error()
+		delay := bq.backoff << uint(job.Attempts-1)
+		if delay > bq.maxBackoff || delay <= 0 {
+			delay = bq.maxBackoff
+		}
+		job.NextRun = time.Now().Add(delay).Unix()
+		log.Warnf("Build job %s failed, retry in %s: %s", job.ID, delay, err)
+	}
+	bq.persist(job)
+}
+
+//prune the oldest succeeded jobs
+func (bq *BuildQueue) prune() {
+	succeeded := make([]*BuildJob, 0)
+	for _, job := range bq.jobs {
+		if job.Status == buildStatusSucceeded {
+			succeeded = append(succeeded, job)
+		}
+	}
+
+	if len(succeeded) <= maxSucceededBuilds {
+		return
+	}
+
+	sort.Slice(succeeded, func(i, j int) bool {
+		return succeeded[i].UpdatedTime < succeeded[j].UpdatedTime
+	})
+	for _, job := range succeeded[:len(succeeded)-maxSucceededBuilds] {
+		delete(bq.jobs, job.ID)
+		if err := bq.store.Delete(bucketBuilds, job.ID); err != nil {
+			logger.Errorf("Failed to delete build job %s from state store: %s", job.ID, err)
+		}
+	}
+}
+
+func (bq *BuildQueue) holdBase(job *BuildJob) {
+	if len(job.Policy.InstanceKey) > 0 {
+		bq.hold(job.Policy.InstanceKey)
+	}
+}
+
+func (bq *BuildQueue) releaseBase(job *BuildJob) {
+	if len(job.Policy.InstanceKey) > 0 {
+		bq.release(job.Policy.InstanceKey)
+	}
+}
+
+func (bq *BuildQueue) persist(job *BuildJob) {
+	if err := bq.store.Put(bucketBuilds, job.ID, job); err != nil {
+		logger.Errorf("Failed to persist build job %s: %s", job.ID, err)
+	}
+}
+
+func (bq *BuildQueue) notify() {
+	select {
+	case bq.wake <- struct{}{}:
+	default:
+	}
+}
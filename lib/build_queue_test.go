@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+//baseHolder counts the holds of the base containers
+type baseHolder struct {
+	lock  *sync.Mutex
+	holds map[string]int
+}
+
+func (bh *baseHolder) hold(key string) {
+	bh.lock.Lock()
+	defer bh.lock.Unlock()
+	bh.holds[key]++
+}
+
+func (bh *baseHolder) release(key string) {
+	bh.lock.Lock()
+	defer bh.lock.Unlock()
+	bh.holds[key]--
+}
+
+func (bh *baseHolder) held(key string) int {
+	bh.lock.Lock()
+	defer bh.lock.Unlock()
+	return bh.holds[key]
+}
+
+func newTestBuildQueue(store StateStore, build func(policy *BuildPolicy) error) (*BuildQueue, *baseHolder) {
+	Config = &Configuration{Build: &BuildConfig{Workers: 0, MaxAttempts: 3, Backoff: 10, MaxBackoff: 15}}
+	holder := &baseHolder{lock: new(sync.Mutex), holds: make(map[string]int)}
+
+	return NewBuildQueue(store, build, holder.hold, holder.release), holder
+}
+
+func lodashBuild(tag string) *BuildPolicy {
+	return &BuildPolicy{RegistryType: registryTypeNpm, Namespace: "npm", Image: "lodash", Tag: tag, InstanceKey: "npm:session-1"}
+}
+
+//runDue runs the next job as if its backoff is over
+func runDue(t *testing.T, bq *BuildQueue, ID string) *BuildJob {
+	bq.lock.Lock()
+	bq.jobs[ID].NextRun = 0
+	bq.lock.Unlock()
+
+	job := bq.next()
+	if job == nil || job.ID != ID {
+		t.Fatalf("next() = %+v, want job %s", job, ID)
+	}
+	bq.run(job)
+
+	return job
+}
+
+func TestBuildQueueDedup(t *testing.T) {
+	bq, holder := newTestBuildQueue(NewMemoryStateStore(), func(policy *BuildPolicy) error { return nil })
+
+	job, err := bq.Enqueue(lodashBuild("4.17.21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "npm/npm/lodash:4.17.21" || job.Status != buildStatusPending {
+		t.Errorf("job = %+v", job)
+	}
+	//Published again while pending
+	again, err := bq.Enqueue(lodashBuild("4.17.21"))
+	if err != nil || again != job {
+		t.Errorf("Enqueue() = %+v, %v, want the pending job", again, err)
+	}
+	if _, err := bq.Enqueue(lodashBuild("4.17.20")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bq.List(buildStatusPending)); n != 2 {
+		t.Errorf("%d pending jobs, want 2", n)
+	}
+	if held := holder.held("npm:session-1"); held != 2 {
+		t.Errorf("base is held %d times, want once per job", held)
+	}
+
+	runDue(t, bq, job.ID)
+	if got, _ := bq.Get(job.ID); got.Status != buildStatusSucceeded || got.Attempts != 1 {
+		t.Errorf("job = %+v, want succeeded", got)
+	}
+	if held := holder.held("npm:session-1"); held != 1 {
+		t.Errorf("base is held %d times, want it released by the succeeded job", held)
+	}
+
+	//A new build of the finished one
+	rebuilt, err := bq.Enqueue(lodashBuild("4.17.21"))
+	if err != nil || rebuilt == job || rebuilt.Status != buildStatusPending {
+		t.Errorf("Enqueue() = %+v, %v, want a new pending job", rebuilt, err)
+	}
+
+	if _, err := bq.Enqueue(nil); err == nil {
+		t.Error("nil policy is enqueued")
+	}
+}
+
+func TestBuildQueueRetry(t *testing.T) {
+	store := NewMemoryStateStore()
+	failed := errors.New("push denied")
+	bq, holder := newTestBuildQueue(store, func(policy *BuildPolicy) error { return failed })
+	job, err := bq.Enqueue(lodashBuild("4.17.21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		status string
+		delay  int64
+	}{
+		{buildStatusPending, 10},
+		//Doubled and capped
+		{buildStatusPending, 15},
+		{buildStatusDead, 0},
+	} {
+		runDue(t, bq, job.ID)
+		got, _ := bq.Get(job.ID)
+		if got.Status != tc.status || got.LastError != failed.Error() {
+			t.Fatalf("attempt %d: job = %+v, want %s", got.Attempts, got, tc.status)
+		}
+		if tc.status == buildStatusPending {
+			if delay := got.NextRun - time.Now().Unix(); delay < tc.delay-1 || delay > tc.delay {
+				t.Errorf("attempt %d: retry in %ds, want %ds", got.Attempts, delay, tc.delay)
+			}
+			//Not due yet
+			if next := bq.next(); next != nil {
+				t.Errorf("job %s runs before the backoff", next.ID)
+			}
+		}
+	}
+	if dead := bq.List(buildStatusDead); len(dead) != 1 || dead[0].Attempts != 3 {
+		t.Errorf("dead letters = %+v", dead)
+	}
+	if held := holder.held("npm:session-1"); held != 0 {
+		t.Errorf("base is held %d times by the dead job", held)
+	}
+
+	//Persisted for the next start
+	restarted, restartedHolder := newTestBuildQueue(store, func(policy *BuildPolicy) error { return nil })
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop(time.Second)
+	if got, err := restarted.Get(job.ID); err != nil || got.Status != buildStatusDead {
+		t.Fatalf("Get() = %+v, %v, want the dead job loaded", got, err)
+	}
+
+	retried, err := restarted.Retry(job.ID)
+	if err != nil || retried.Status != buildStatusPending || retried.Attempts != 0 {
+		t.Fatalf("Retry() = %+v, %v", retried, err)
+	}
+	if held := restartedHolder.held("npm:session-1"); held != 1 {
+		t.Errorf("base is held %d times by the retried job, want 1", held)
+	}
+	if _, err := restarted.Retry(job.ID); err == nil {
+		t.Error("pending job is retried")
+	}
+	if _, err := restarted.Retry("npm/npm/lodash:0.0.1"); err != ErrBuildNotFound {
+		t.Errorf("Retry() error = %v, want %v", err, ErrBuildNotFound)
+	}
+
+	runDue(t, restarted, job.ID)
+	if got, _ := restarted.Get(job.ID); got.Status != buildStatusSucceeded {
+		t.Errorf("job = %+v, want succeeded", got)
+	}
+	if held := restartedHolder.held("npm:session-1"); held != 0 {
+		t.Errorf("base is held %d times after the retry succeeded", held)
+	}
+}
+
+func TestBuildQueueResume(t *testing.T) {
+	store := NewMemoryStateStore()
+	bq, _ := newTestBuildQueue(store, func(policy *BuildPolicy) error { return nil })
+	pending, _ := bq.Enqueue(lodashBuild("4.17.20"))
+	running, _ := bq.Enqueue(lodashBuild("4.17.21"))
+	//Interrupted while running
+	bq.lock.Lock()
+	bq.jobs[running.ID].Status = buildStatusRunning
+	bq.persist(bq.jobs[running.ID])
+	bq.lock.Unlock()
+
+	done := make(chan string, 2)
+	resumed, holder := newTestBuildQueue(store, func(policy *BuildPolicy) error {
+		done <- buildJobID(policy)
+		return nil
+	})
+	if err := resumed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(resumed.List(buildStatusPending)); n != 2 {
+		t.Errorf("%d pending jobs resumed, want 2", n)
+	}
+	if held := holder.held("npm:session-1"); held != 2 {
+		t.Errorf("base is held %d times, want once per resumed job", held)
+	}
+	if unfinished := resumed.Stop(time.Second); len(unfinished) != 2 {
+		t.Errorf("Stop() = %v, want %s and %s", unfinished, pending.ID, running.ID)
+	}
+
+	//Run by the workers
+	worked, _ := newTestBuildQueue(store, func(policy *BuildPolicy) error {
+		done <- buildJobID(policy)
+		return nil
+	})
+	worked.workers = 1
+	if err := worked.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer worked.Stop(time.Second)
+	built := map[string]bool{}
+	for len(built) < 2 {
+		select {
+		case ID := <-done:
+			built[ID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("built %v, want the resumed jobs", built)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"encoding/json"
+	"registry-factory/logger"
 	"sync"
 )
 
@@ -12,16 +14,53 @@ const (
 type CommandList struct {
 	commands []string
 	lock     *sync.RWMutex
+	store    StateStore
+	//Sequence of the first and next command in store
+	first uint64
+	next  uint64
 }
 
 //NewCommandList ...
-func NewCommandList() *CommandList {
+func NewCommandList(store StateStore) *CommandList {
 	return &CommandList{
 		commands: make([]string, 0),
 		lock:     new(sync.RWMutex),
+		store:    store,
 	}
 }
 
+//Load the command history from the state store
+func (cl *CommandList) Load() error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	seqs := make([]string, 0)
+	commands := make([]string, 0)
+	err := cl.store.List(bucketCommands, func(key string, data []byte) error {
+		var command string
+		if err := json.Unmarshal(data, &command); err != nil {
+			return err
+		}
+		seqs = append(seqs, key)
+		commands = append(commands, command)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Keys are sorted by sequence
+	cl.commands = commands
+	cl.first, cl.next = 0, 0
+	if len(seqs) > 0 {
+		cl.first = parseSequenceKey(seqs[0])
+		cl.next = parseSequenceKey(seqs[len(seqs)-1]) + 1
+	}
+
+	return nil
+}
+
 //Log the executed command
 func (cl *CommandList) Log(command string) {
 	cl.lock.Lock()
@@ -35,7 +74,17 @@ func (cl *CommandList) Log(command string) {
 			newList = append(newList, cl.commands[1:]...)
 			newList = append(newList, command)
 			cl.commands = newList
+
+			if err := cl.store.Delete(bucketCommands, sequenceKey(cl.first)); err != nil {
+				logger.Errorf("Failed to delete command from state store: %s", err)
+			}
+			cl.first++
+		}
+
+		if err := cl.store.Put(bucketCommands, sequenceKey(cl.next), command); err != nil {
+			logger.Errorf("Failed to persist command: %s", err)
 		}
+		cl.next++
 	}
 }
 
@@ -4,7 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"registry-factory/client/harbor"
+	"registry-factory/logger"
 
+	"golang.org/x/crypto/bcrypt"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -13,12 +18,24 @@ var Config = &Configuration{}
 
 //Configuration keep the related configuration options
 type Configuration struct {
-	Host        string          `yaml:"host"`
-	Port        uint            `yaml:"port"`
-	Dockerd     *DockerdConfig  `yaml:"dockerd"`
-	Harbor      *HarborConfig   `yaml:"harbor"`
-	NpmRegistry *RegistryConfig `yaml:"npm_registry"`
-	PipRegistry *RegistryConfig `yaml:"pip_registry"`
+	Host        string           `yaml:"host"`
+	Port        uint             `yaml:"port"`
+	Dockerd     *DockerdConfig   `yaml:"dockerd"`
+	Harbor      *HarborConfig    `yaml:"harbor"`
+	NpmRegistry *RegistryConfig  `yaml:"npm_registry"`
+	PipRegistry *RegistryConfig  `yaml:"pip_registry"`
+	Scheduler   *SchedulerConfig `yaml:"scheduler"`
+	Eviction    *EvictionConfig  `yaml:"eviction"`
+	Shutdown    *ShutdownConfig  `yaml:"shutdown"`
+	State       *StateConfig     `yaml:"state"`
+	Reconcile   *ReconcileConfig `yaml:"reconcile"`
+	Build       *BuildConfig     `yaml:"build"`
+	Auth        *AuthConfig      `yaml:"auth"`
+	Identity    *IdentityConfig  `yaml:"identity"`
+	RBAC        *RBACConfig      `yaml:"rbac"`
+	Audit       *AuditConfig     `yaml:"audit"`
+	Logging     *LoggingConfig   `yaml:"logging"`
+	Tracing     *TracingConfig   `yaml:"tracing"`
 }
 
 //DockerdConfig is for dockerd
@@ -27,19 +44,276 @@ type DockerdConfig struct {
 	Port     uint   `yaml:"port"`
 	Admin    string `yaml:"admin"`
 	Password string `yaml:"password"`
+	//Host port range for the runtimes
+	PortMin int `yaml:"port_min"`
+	PortMax int `yaml:"port_max"`
+	//Let the daemon assign the host ports instead of the port range
+	EphemeralPorts bool `yaml:"ephemeral_ports"`
 }
 
 //HarborConfig is for harbor
 type HarborConfig struct {
 	Host     string `yaml:"host"`
 	Protocol string `yaml:"protocol"`
+	//Credential of harbor, the dockerd admin is used if it's empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	//v1 or v2, detected if it's empty
+	APIVersion string `yaml:"api_version"`
+	//Skip verifying the certificate of harbor
+	Insecure  bool             `yaml:"insecure"`
+	Provision *ProvisionConfig `yaml:"provision"`
+	Robot     *RobotConfig     `yaml:"robot"`
+	//Seconds to cache the existence of packages, -1 is no cache
+	ExistenceTTL int `yaml:"existence_ttl"`
+	//Auth header expected from the harbor webhook, not checked if it's empty
+	WebhookSecret string `yaml:"webhook_secret"`
+}
+
+//ProvisionConfig is for creating the missing harbor projects
+type ProvisionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Public  bool `yaml:"public"`
+	//Bytes, -1 is unlimited and 0 is the harbor default
+	StorageLimit int64 `yaml:"storage_limit"`
+	//Keep the latest pushed artifacts of each repository, 0 means no retention
+	RetainLatest int `yaml:"retain_latest"`
+	//Cron with seconds
+	RetentionSchedule string `yaml:"retention_schedule"`
+}
+
+//RobotConfig is for the robot accounts of namespaces
+type RobotConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//Days, -1 is never expired
+	Duration       int64 `yaml:"duration"`
+	RotateInterval int   `yaml:"rotate_interval"` //seconds
+	//Docker config dirs of the robot logins
+	DockerConfigDir string `yaml:"docker_config_dir"`
 }
 
 //RegistryConfig is for npm registries
 type RegistryConfig struct {
+	Namespace    string       `yaml:"namespace"`
+	BaseImage    string       `yaml:"base_image"`
+	BaseImageTag string       `yaml:"base_image_tag"`
+	MaxRuntimes  int          `yaml:"max_runtimes"`
+	Readiness    *ProbeConfig `yaml:"readiness"`
+	//Max lifetime of the idle runtimes, 0 means no limit
+	TTL int `yaml:"ttl"` //seconds
+	//Push the package image before returning success of publishing
+	SyncPublish bool `yaml:"sync_publish"`
+	//Where the published artifacts are stored in the runtime, '{package}' is replaced by the package name
+	ArtifactPath string `yaml:"artifact_path"`
+	//The shared server fetching the package artifacts on demand in the artifact mode
+	ArtifactServerImage string `yaml:"artifact_server_image"`
+	ArtifactServerTag   string `yaml:"artifact_server_tag"`
+	//Authorization header of a user in the base image, sent to the runtimes for publishing if auth is enabled
+	PublishAuth string `yaml:"publish_auth"`
+}
+
+//SchedulerConfig is for the admission control of scheduler
+type SchedulerConfig struct {
+	MaxRuntimes  int `yaml:"max_runtimes"`
+	QueueSize    int `yaml:"queue_size"`
+	QueueTimeout int `yaml:"queue_timeout"` //seconds
+	//Interval of checking the liveness of runtimes
+	LivenessPeriod int `yaml:"liveness_period"` //seconds
+	//Idle runtimes are removed after the threshold
+	IdleThreshold int `yaml:"idle_threshold"` //seconds
+}
+
+//EvictionConfig is for the runtime eviction
+type EvictionConfig struct {
+	//lru or lfu
+	Policy        string `yaml:"policy"`
+	SweepInterval int    `yaml:"sweep_interval"` //seconds
+	//Evict idle runtimes when the runtimes are more than it, 0 means disabled
+	MaxRuntimes int `yaml:"max_runtimes"`
+	//Evict idle runtimes when the memory usage (percent) is higher than it, 0 means disabled
+	MemoryWatermark float64  `yaml:"memory_watermark"`
+	PinnedImages    []string `yaml:"pinned_images"`
+}
+
+//ShutdownConfig is for the graceful shutdown
+type ShutdownConfig struct {
+	//Deadline of waiting the in-flight requests and builds
+	DrainTimeout int `yaml:"drain_timeout"` //seconds
+	//Keep the runtimes on docker daemon after shutdown
+	KeepRuntimes bool `yaml:"keep_runtimes"`
+}
+
+//StateConfig is for the state store
+type StateConfig struct {
+	//memory or bolt
+	Driver string `yaml:"driver"`
+	//File path of the bolt db
+	Path string `yaml:"path"`
+}
+
+//ReconcileConfig is for reconciling the labelled objects on docker daemon
+type ReconcileConfig struct {
+	Interval int `yaml:"interval"` //seconds
+	//Committed images older than it are removed if not in use
+	StaleImageAge int `yaml:"stale_image_age"` //seconds
+}
+
+//BuildConfig is for the build queue
+type BuildConfig struct {
+	//image or artifact
+	Mode string `yaml:"mode"`
+	//layer or commit
+	Builder     string `yaml:"builder"`
+	Workers     int    `yaml:"workers"`
+	MaxAttempts int    `yaml:"max_attempts"`
+	//Base and max delay of retrying the failed builds
+	Backoff    int `yaml:"backoff"`     //seconds
+	MaxBackoff int `yaml:"max_backoff"` //seconds
+}
+
+//AuthConfig is for authenticating the registry clients
+type AuthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//Install and view the packages without credential
+	AnonymousRead bool `yaml:"anonymous_read"`
+	//Create the user on npm adduser
+	AllowSignup bool `yaml:"allow_signup"`
+	//Bound on the registry namespaces to the signed up users, reader or publisher
+	DefaultRole string `yaml:"default_role"`
+	//Lifetime of the issued tokens, 0 is never expired
+	TokenTTL int           `yaml:"token_ttl"` //seconds
+	Users    []*UserConfig `yaml:"users"`
+}
+
+//UserConfig is the user bootstrapped from the config
+type UserConfig struct {
+	Username string `yaml:"username"`
+	Email    string `yaml:"email"`
+	//bcrypt hash of the password
+	PasswordHash string `yaml:"password_hash"`
+}
+
+//IdentityConfig is for the external identity providers of users
+type IdentityConfig struct {
+	LDAP *LDAPConfig `yaml:"ldap"`
+	OIDC *OIDCConfig `yaml:"oidc"`
+}
+
+//LDAPConfig is for verifying the passwords with LDAP bind
+type LDAPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//ldap://host:389 or ldaps://host:636
+	URL      string `yaml:"url"`
+	StartTLS bool   `yaml:"start_tls"`
+	Insecure bool   `yaml:"insecure"`
+	//Service account of searching, anonymous if it's empty
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	BaseDN       string `yaml:"base_dn"`
+	//%s is the username
+	UserFilter     string `yaml:"user_filter"`
+	EmailAttribute string `yaml:"email_attribute"`
+	GroupBaseDN    string `yaml:"group_base_dn"`
+	//%s is the DN of user
+	GroupFilter    string `yaml:"group_filter"`
+	GroupAttribute string `yaml:"group_attribute"`
+	Timeout        int    `yaml:"timeout"` //seconds
+}
+
+//OIDCConfig is for the device code flow of OIDC issuer
+type OIDCConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	//Claims of the userinfo
+	UsernameClaim string `yaml:"username_claim"`
+	GroupsClaim   string `yaml:"groups_claim"`
+	Insecure      bool   `yaml:"insecure"`
+}
+
+//RBACConfig is for the role bindings of users and groups
+type RBACConfig struct {
+	//Bootstrapped role bindings
+	Bindings []*RoleBindingConfig `yaml:"bindings"`
+}
+
+//RoleBindingConfig grants the role to the user or group in the scope, the empty scope matches anything
+type RoleBindingConfig struct {
+	//reader, publisher, maintainer or admin
+	Role  string `yaml:"role"`
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+	//npm or pip
+	RegistryType string `yaml:"registry_type"`
 	Namespace    string `yaml:"namespace"`
-	BaseImage    string `yaml:"base_image"`
-	BaseImageTag string `yaml:"base_image_tag"`
+	//Glob of the package names, e.g: @team/*
+	Package string `yaml:"package"`
+}
+
+//AuditConfig is for exporting the audit log
+type AuditConfig struct {
+	//Append the entries as JSON lines to the file
+	File   string        `yaml:"file"`
+	Syslog *SyslogConfig `yaml:"syslog"`
+}
+
+//SyslogConfig is for sending the audit log to syslog
+type SyslogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//udp or tcp, the local syslog is used if it's empty
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+//LoggingConfig is for logging the requests and commands
+type LoggingConfig struct {
+	//debug, info, warn or error
+	Level string `yaml:"level"`
+	//text, logfmt or json
+	Format string `yaml:"format"`
+	//Redacted in addition to the built-in rules
+	Redact *RedactConfig `yaml:"redact"`
+}
+
+//TracingConfig is for exporting the spans of requests and builds over OTLP/HTTP
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//host:port of the collector
+	Endpoint string `yaml:"endpoint"`
+	//Default is /v1/traces
+	URLPath  string `yaml:"url_path"`
+	Insecure bool   `yaml:"insecure"`
+	//Sent with the exported spans, e.g: the auth header of collector
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"`
+	//Ratio of the traced requests, the sampling of the client's trace is followed
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+//RedactConfig tells the secrets redacted from the logs, the names are case insensitive
+type RedactConfig struct {
+	Headers     []string `yaml:"headers"`
+	QueryParams []string `yaml:"query_params"`
+	//Command flags whose values are redacted, e.g: --password
+	Args []string `yaml:"args"`
+	//JSON field names at any depth
+	BodyFields []string `yaml:"body_fields"`
+	//Parts of the env var names given to the containers, e.g: PASSWORD
+	EnvVars []string `yaml:"env_vars"`
+}
+
+func (rc *RoleBindingConfig) binding() *RoleBinding {
+	return &RoleBinding{
+		Role:         rc.Role,
+		User:         rc.User,
+		Group:        rc.Group,
+		RegistryType: rc.RegistryType,
+		Namespace:    rc.Namespace,
+		Package:      rc.Package,
+	}
 }
 
 //Load configurations from yaml file
@@ -97,7 +371,111 @@ func (c *Configuration) validate() error {
 		return errors.New("pip registry is not configured")
 	}
 
-	return c.validatePipRegistry()
+	if err := c.validatePipRegistry(); err != nil {
+		return err
+	}
+
+	if c.Scheduler == nil {
+		c.Scheduler = &SchedulerConfig{}
+	}
+
+	if err := c.validateScheduler(); err != nil {
+		return err
+	}
+
+	if c.Eviction == nil {
+		c.Eviction = &EvictionConfig{}
+	}
+
+	if err := c.validateEviction(); err != nil {
+		return err
+	}
+
+	if c.Shutdown == nil {
+		c.Shutdown = &ShutdownConfig{}
+	}
+
+	if c.Shutdown.DrainTimeout <= 0 {
+		c.Shutdown.DrainTimeout = defaultDrainTimeout
+	}
+
+	if c.State == nil {
+		c.State = &StateConfig{}
+	}
+
+	if err := c.validateState(); err != nil {
+		return err
+	}
+
+	if c.Reconcile == nil {
+		c.Reconcile = &ReconcileConfig{}
+	}
+
+	if c.Reconcile.Interval <= 0 {
+		c.Reconcile.Interval = defaultReconcileInterval
+	}
+
+	if c.Reconcile.StaleImageAge <= 0 {
+		c.Reconcile.StaleImageAge = defaultStaleImageAge
+	}
+
+	if c.Build == nil {
+		c.Build = &BuildConfig{}
+	}
+
+	if err := c.validateBuild(); err != nil {
+		return err
+	}
+
+	if c.Auth == nil {
+		c.Auth = &AuthConfig{}
+	}
+
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+
+	if c.Identity == nil {
+		c.Identity = &IdentityConfig{}
+	}
+
+	if err := c.validateIdentity(); err != nil {
+		return err
+	}
+
+	if c.RBAC == nil {
+		c.RBAC = &RBACConfig{}
+	}
+
+	if err := c.validateRBAC(); err != nil {
+		return err
+	}
+
+	if c.Audit == nil {
+		c.Audit = &AuditConfig{}
+	}
+
+	if err := c.validateAudit(); err != nil {
+		return err
+	}
+
+	if c.Logging == nil {
+		c.Logging = &LoggingConfig{}
+	}
+
+	if err := c.validateLogging(); err != nil {
+		return err
+	}
+
+	if c.Tracing == nil {
+		c.Tracing = &TracingConfig{}
+	}
+
+	if err := c.validateTracing(); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func (c *Configuration) validateDockerd() error {
@@ -109,6 +487,18 @@ func (c *Configuration) validateDockerd() error {
 		return errors.New("dockerd port is not configured")
 	}
 
+	if c.Dockerd.PortMin == 0 {
+		c.Dockerd.PortMin = defaultPortMin
+	}
+
+	if c.Dockerd.PortMax == 0 {
+		c.Dockerd.PortMax = defaultPortMax
+	}
+
+	if c.Dockerd.PortMin > c.Dockerd.PortMax || c.Dockerd.PortMax > 65535 {
+		return fmt.Errorf("invalid runtime port range %d-%d", c.Dockerd.PortMin, c.Dockerd.PortMax)
+	}
+
 	return nil
 }
 
@@ -121,6 +511,52 @@ func (c *Configuration) validateHarbor() error {
 		return fmt.Errorf("harbor protocol is only supporting 'http' or 'https'")
 	}
 
+	if len(c.Harbor.Username) == 0 {
+		c.Harbor.Username = c.Dockerd.Admin
+		c.Harbor.Password = c.Dockerd.Password
+	}
+
+	if c.Harbor.APIVersion != "" && c.Harbor.APIVersion != harbor.APIVersion1 && c.Harbor.APIVersion != harbor.APIVersion2 {
+		return fmt.Errorf("harbor API version '%s' is not supported", c.Harbor.APIVersion)
+	}
+
+	if c.Harbor.ExistenceTTL == 0 {
+		c.Harbor.ExistenceTTL = defaultExistenceTTL
+	}
+
+	if c.Harbor.Provision == nil {
+		c.Harbor.Provision = &ProvisionConfig{}
+	}
+
+	if c.Harbor.Provision.RetainLatest < 0 {
+		return fmt.Errorf("invalid harbor retention %d", c.Harbor.Provision.RetainLatest)
+	}
+
+	if len(c.Harbor.Provision.RetentionSchedule) == 0 {
+		c.Harbor.Provision.RetentionSchedule = defaultRetentionSchedule
+	}
+
+	if c.Harbor.Robot == nil {
+		c.Harbor.Robot = &RobotConfig{}
+	}
+
+	if c.Harbor.Robot.Duration == 0 {
+		c.Harbor.Robot.Duration = defaultRobotDuration
+	}
+
+	if c.Harbor.Robot.RotateInterval <= 0 {
+		c.Harbor.Robot.RotateInterval = defaultRobotRotateInterval
+	}
+
+	//Rotate before the secret expires
+	if c.Harbor.Robot.Duration > 0 && int64(c.Harbor.Robot.RotateInterval) >= c.Harbor.Robot.Duration*86400 {
+		return fmt.Errorf("robot rotate interval %ds is not less than the duration %d days", c.Harbor.Robot.RotateInterval, c.Harbor.Robot.Duration)
+	}
+
+	if len(c.Harbor.Robot.DockerConfigDir) == 0 {
+		c.Harbor.Robot.DockerConfigDir = filepath.Join(os.TempDir(), "chameleon", "docker")
+	}
+
 	return nil
 }
 
@@ -137,7 +573,19 @@ func (c *Configuration) validateNpmRegistry() error {
 		return errors.New("no namespace is specified for npm registry")
 	}
 
-	return nil
+	if len(c.NpmRegistry.ArtifactServerImage) > 0 && len(c.NpmRegistry.ArtifactServerTag) == 0 {
+		c.NpmRegistry.ArtifactServerTag = "latest"
+	}
+
+	if len(c.NpmRegistry.ArtifactPath) == 0 {
+		c.NpmRegistry.ArtifactPath = defaultNpmArtifactPath
+	}
+
+	if c.NpmRegistry.Readiness == nil {
+		c.NpmRegistry.Readiness = &ProbeConfig{}
+	}
+
+	return c.NpmRegistry.Readiness.Validate("/")
 }
 
 func (c *Configuration) validatePipRegistry() error {
@@ -145,5 +593,317 @@ func (c *Configuration) validatePipRegistry() error {
 		return errors.New("no namespace is specified for pip registry")
 	}
 
+	if len(c.PipRegistry.ArtifactServerImage) > 0 && len(c.PipRegistry.ArtifactServerTag) == 0 {
+		c.PipRegistry.ArtifactServerTag = "latest"
+	}
+
+	if len(c.PipRegistry.ArtifactPath) == 0 {
+		c.PipRegistry.ArtifactPath = defaultPipArtifactPath
+	}
+
+	if c.PipRegistry.Readiness == nil {
+		c.PipRegistry.Readiness = &ProbeConfig{}
+	}
+
+	//pip images serve the index under /simple/
+	return c.PipRegistry.Readiness.Validate("/simple/")
+}
+
+func (c *Configuration) validateScheduler() error {
+	if c.Scheduler.MaxRuntimes < 0 || c.NpmRegistry.MaxRuntimes < 0 || c.PipRegistry.MaxRuntimes < 0 {
+		return errors.New("max runtimes should not be negative")
+	}
+
+	if c.Scheduler.MaxRuntimes == 0 {
+		c.Scheduler.MaxRuntimes = defaultMaxRuntimes
+	}
+
+	if c.Scheduler.QueueSize < 0 {
+		return errors.New("scheduler queue size should not be negative")
+	}
+
+	if c.Scheduler.QueueSize == 0 {
+		c.Scheduler.QueueSize = defaultQueueSize
+	}
+
+	if c.Scheduler.QueueTimeout <= 0 {
+		c.Scheduler.QueueTimeout = defaultQueueTimeout
+	}
+
+	if c.Scheduler.LivenessPeriod <= 0 {
+		c.Scheduler.LivenessPeriod = defaultLivenessPeriod
+	}
+
+	if c.Scheduler.IdleThreshold <= 0 {
+		c.Scheduler.IdleThreshold = defaultIdleThreshold
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateEviction() error {
+	if _, err := NewEvictionPolicy(c.Eviction.Policy); err != nil {
+		return err
+	}
+
+	if c.Eviction.SweepInterval <= 0 {
+		c.Eviction.SweepInterval = defaultSweepInterval
+	}
+
+	if c.Eviction.MaxRuntimes < 0 {
+		return errors.New("eviction max runtimes should not be negative")
+	}
+
+	if c.Eviction.MemoryWatermark < 0 || c.Eviction.MemoryWatermark > 100 {
+		return fmt.Errorf("eviction memory watermark should be in 0-100, but got %v", c.Eviction.MemoryWatermark)
+	}
+
+	if c.NpmRegistry.TTL < 0 || c.PipRegistry.TTL < 0 {
+		return errors.New("runtime ttl should not be negative")
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateState() error {
+	switch c.State.Driver {
+	case "":
+		c.State.Driver = stateDriverMemory
+	case stateDriverMemory:
+	case stateDriverBolt:
+		if len(c.State.Path) == 0 {
+			return errors.New("state path is required by bolt driver")
+		}
+	default:
+		return fmt.Errorf("state driver '%s' is not supported", c.State.Driver)
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateBuild() error {
+	switch c.Build.Mode {
+	case "":
+		c.Build.Mode = packageModeImage
+	case packageModeImage:
+	case packageModeArtifact:
+		if len(c.NpmRegistry.ArtifactServerImage) == 0 {
+			return errors.New("npm artifact server image is required in artifact mode")
+		}
+		if len(c.PipRegistry.ArtifactServerImage) == 0 {
+			return errors.New("pip artifact server image is required in artifact mode")
+		}
+	default:
+		return fmt.Errorf("package mode '%s' is not supported", c.Build.Mode)
+	}
+
+	switch c.Build.Builder {
+	case "":
+		//The existing deployments keep committing the runtimes
+		c.Build.Builder = builderCommit
+	case builderLayer, builderCommit:
+	default:
+		return fmt.Errorf("image builder '%s' is not supported", c.Build.Builder)
+	}
+
+	if c.Build.Workers <= 0 {
+		c.Build.Workers = defaultBuildWorkers
+	}
+
+	if c.Build.MaxAttempts <= 0 {
+		c.Build.MaxAttempts = defaultBuildMaxAttempts
+	}
+
+	if c.Build.Backoff <= 0 {
+		c.Build.Backoff = defaultBuildBackoff
+	}
+
+	if c.Build.MaxBackoff <= 0 {
+		c.Build.MaxBackoff = defaultBuildMaxBackoff
+	}
+
+	if c.Build.MaxBackoff < c.Build.Backoff {
+		return fmt.Errorf("build max backoff %d is less than the backoff %d", c.Build.MaxBackoff, c.Build.Backoff)
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateAuth() error {
+	if c.Auth.TokenTTL < 0 {
+		return errors.New("token ttl should not be negative")
+	}
+
+	switch c.Auth.DefaultRole {
+	case "", roleReader, rolePublisher:
+	default:
+		return fmt.Errorf("default role should be reader or publisher, but got '%s'", c.Auth.DefaultRole)
+	}
+
+	usernames := make(map[string]bool)
+	for _, u := range c.Auth.Users {
+		if len(u.Username) == 0 {
+			return errors.New("empty username in auth users")
+		}
+		if usernames[u.Username] {
+			return fmt.Errorf("duplicated user %s", u.Username)
+		}
+		usernames[u.Username] = true
+
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return fmt.Errorf("invalid password hash of user %s: %s", u.Username, err)
+		}
+	}
+
+	//The runtimes know nothing about the users of proxy
+	if c.Auth.Enabled && len(c.NpmRegistry.PublishAuth) == 0 {
+		return errors.New("npm publish auth is required if auth is enabled")
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateIdentity() error {
+	if c.Identity.LDAP == nil {
+		c.Identity.LDAP = &LDAPConfig{}
+	}
+
+	if c.Identity.OIDC == nil {
+		c.Identity.OIDC = &OIDCConfig{}
+	}
+
+	ldapConfig := c.Identity.LDAP
+	if ldapConfig.Enabled {
+		if len(ldapConfig.URL) == 0 || len(ldapConfig.BaseDN) == 0 {
+			return errors.New("ldap url and base dn are required")
+		}
+		if len(ldapConfig.UserFilter) == 0 {
+			ldapConfig.UserFilter = defaultLDAPUserFilter
+		}
+		if len(ldapConfig.EmailAttribute) == 0 {
+			ldapConfig.EmailAttribute = defaultLDAPEmailAttribute
+		}
+		if len(ldapConfig.GroupBaseDN) == 0 {
+			ldapConfig.GroupBaseDN = ldapConfig.BaseDN
+		}
+		if len(ldapConfig.GroupFilter) == 0 {
+			ldapConfig.GroupFilter = defaultLDAPGroupFilter
+		}
+		if len(ldapConfig.GroupAttribute) == 0 {
+			ldapConfig.GroupAttribute = defaultLDAPGroupAttribute
+		}
+		if ldapConfig.Timeout <= 0 {
+			ldapConfig.Timeout = defaultLDAPTimeout
+		}
+	}
+
+	oidcConfig := c.Identity.OIDC
+	if oidcConfig.Enabled {
+		if len(oidcConfig.Issuer) == 0 || len(oidcConfig.ClientID) == 0 {
+			return errors.New("oidc issuer and client id are required")
+		}
+		if len(oidcConfig.Scopes) == 0 {
+			oidcConfig.Scopes = []string{"openid", "profile", "email", "groups"}
+		}
+		if len(oidcConfig.UsernameClaim) == 0 {
+			oidcConfig.UsernameClaim = defaultOIDCUsernameClaim
+		}
+		if len(oidcConfig.GroupsClaim) == 0 {
+			oidcConfig.GroupsClaim = defaultOIDCGroupsClaim
+		}
+	}
+
+	//Local users could take the names of the directory users
+	if c.Auth.AllowSignup && (ldapConfig.Enabled || oidcConfig.Enabled) {
+		return errors.New("auth signup can't be allowed with the identity providers")
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateRBAC() error {
+	for i, b := range c.RBAC.Bindings {
+		if err := validateBinding(b.binding()); err != nil {
+			return fmt.Errorf("rbac binding %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateAudit() error {
+	if c.Audit.Syslog == nil {
+		c.Audit.Syslog = &SyslogConfig{}
+	}
+
+	syslogConfig := c.Audit.Syslog
+	switch syslogConfig.Network {
+	case "":
+	case "udp", "tcp":
+		if len(syslogConfig.Address) == 0 {
+			return fmt.Errorf("syslog address is required by network %s", syslogConfig.Network)
+		}
+	default:
+		return fmt.Errorf("syslog network '%s' is not supported", syslogConfig.Network)
+	}
+
+	if len(syslogConfig.Tag) == 0 {
+		syslogConfig.Tag = defaultSyslogTag
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateLogging() error {
+	if c.Logging.Redact == nil {
+		c.Logging.Redact = &RedactConfig{}
+	}
+
+	if len(c.Logging.Level) == 0 {
+		c.Logging.Level = "info"
+	}
+	if _, err := logger.ParseLevel(c.Logging.Level); err != nil {
+		return err
+	}
+
+	switch c.Logging.Format {
+	case "":
+		c.Logging.Format = logger.FormatText
+	case logger.FormatText, logger.FormatLogfmt, logger.FormatJSON:
+	default:
+		return fmt.Errorf("log format '%s' is not supported", c.Logging.Format)
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateTracing() error {
+	if len(c.Tracing.Endpoint) == 0 {
+		c.Tracing.Endpoint = defaultTracingEndpoint
+	}
+
+	if len(c.Tracing.ServiceName) == 0 {
+		c.Tracing.ServiceName = defaultTracingServiceName
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio %v is not in [0, 1]", c.Tracing.SampleRatio)
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+
+	return nil
+}
+
+//registryConfigOf returns the config of the registry type
+func registryConfigOf(registryType string) *RegistryConfig {
+	switch registryType {
+	case registryTypeNpm:
+		return Config.NpmRegistry
+	case registryTypePip:
+		return Config.PipRegistry
+	}
+
 	return nil
 }
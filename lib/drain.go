@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 //seconds
+)
+
+//ShutdownReport tells what was done and left behind on shutdown
+type ShutdownReport struct {
+	//Some in-flight requests were cut off by the drain deadline
+	RequestsAborted bool `json:"requests_aborted"`
+	//Builds not finished when the deadline was reached
+	PendingBuilds []string `json:"pending_builds"`
+	//Runtimes removed from the docker daemon
+	DestroyedRuntimes []string `json:"destroyed_runtimes"`
+	//Runtimes intentionally left on the docker daemon
+	KeptRuntimes []string `json:"kept_runtimes"`
+	//Runtimes failed to be removed
+	FailedRuntimes []string `json:"failed_runtimes"`
+}
+
+//String ...
+func (sr *ShutdownReport) String() string {
+	return fmt.Sprintf("requests aborted: %v, pending builds: [%s], destroyed runtimes: [%s], kept runtimes: [%s], failed runtimes: [%s]",
+		sr.RequestsAborted,
+		strings.Join(sr.PendingBuilds, ", "),
+		strings.Join(sr.DestroyedRuntimes, ", "),
+		strings.Join(sr.KeptRuntimes, ", "),
+		strings.Join(sr.FailedRuntimes, ", "),
+	)
+}
+
+//taskTracker tracks the background tasks to wait for them on shutdown
+type taskTracker struct {
+	lock  *sync.Mutex
+	wg    *sync.WaitGroup
+	tasks map[string]int
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{
+		lock:  new(sync.Mutex),
+		wg:    new(sync.WaitGroup),
+		tasks: make(map[string]int),
+	}
+}
+
+//Start tracking the task, call the returned func when it's done
+func (tt *taskTracker) Start(name string) func() {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.wg.Add(1)
+	tt.tasks[name]++
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			tt.lock.Lock()
+			defer tt.lock.Unlock()
+
+			if tt.tasks[name]--; tt.tasks[name] <= 0 {
+				delete(tt.tasks, name)
+			}
+			tt.wg.Done()
+		})
+	}
+}
+
+//Wait for the tasks until the timeout, returns the pending ones
+func (tt *taskTracker) Wait(timeout time.Duration) []string {
+	done := make(chan struct{})
+	go func() {
+		tt.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	pending := make([]string, 0, len(tt.tasks))
+	for name := range tt.tasks {
+		pending = append(pending, name)
+	}
+
+	return pending
+}
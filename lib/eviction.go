@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"fmt"
+)
+
+const (
+	evictionPolicyLRU = "lru"
+	evictionPolicyLFU = "lfu"
+
+	defaultSweepInterval = 30 //seconds
+)
+
+//EvictionPolicy decides which idle runtimes are evicted first under pressure
+type EvictionPolicy interface {
+	//Name of the policy
+	Name() string
+
+	//Before reports whether runtime a should be evicted before runtime b
+	Before(a, b *Runtime) bool
+}
+
+//NewEvictionPolicy creates the eviction policy by name
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case evictionPolicyLRU, "":
+		return &lruPolicy{}, nil
+	case evictionPolicyLFU:
+		return &lfuPolicy{}, nil
+	}
+
+	return nil, fmt.Errorf("eviction policy '%s' is not supported", name)
+}
+
+//lruPolicy evicts the least recently used runtimes first
+type lruPolicy struct{}
+
+//Name ...
+func (p *lruPolicy) Name() string {
+	return evictionPolicyLRU
+}
+
+//Before ...
+func (p *lruPolicy) Before(a, b *Runtime) bool {
+	return a.ActiveTime < b.ActiveTime
+}
+
+//lfuPolicy evicts the least frequently used runtimes first
+type lfuPolicy struct{}
+
+//Name ...
+func (p *lfuPolicy) Name() string {
+	return evictionPolicyLFU
+}
+
+//Before ...
+func (p *lfuPolicy) Before(a, b *Runtime) bool {
+	if a.Hits == b.Hits {
+		return a.ActiveTime < b.ActiveTime
+	}
+
+	return a.Hits < b.Hits
+}
@@ -1,13 +1,18 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
+	"net"
+	"os"
 	"registry-factory/client"
+	"registry-factory/logger"
+	"strconv"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //Executor ...
@@ -15,7 +20,12 @@ type Executor struct {
 	hostOn    string
 	docker    *client.DockerClient
 	harbor    string
-	namespace string
+	ports     *PortAllocator
+	ephemeral bool
+	leases    map[string][]int
+	//Namespaces logged in harbor with the robot accounts
+	logins map[string]bool
+	lock   *sync.Mutex
 }
 
 //Environment ...
@@ -35,19 +45,60 @@ func NewExecutor(dockerdHost string, hPort uint, harbor string) *Executor {
 		docker: &client.DockerClient{
 			Host: dHost,
 		},
-		harbor:    harbor,
+		harbor: harbor,
+		ports:  NewPortAllocator(Config.Dockerd.PortMin, Config.Dockerd.PortMax),
+		//Let the docker daemon assign the host ports
+		ephemeral: Config.Dockerd.EphemeralPorts,
+		leases:    make(map[string][]int),
+		logins:    make(map[string]bool),
+		lock:      new(sync.Mutex),
 	}
 }
 
-//SetNamespace ...
-func (e *Executor) SetNamespace(ns string){
-	if len(ns) > 0 {
-		e.namespace = ns
+//Login harbor with the robot account of namespace, the images of namespace can't be run until it's logged in
+func (e *Executor) Login(namespace, username, password string) error {
+	configDir := robotDockerConfig(namespace)
+	err := os.MkdirAll(configDir, 0700)
+	if err == nil {
+		docker := &client.DockerClient{
+			Host:      e.docker.Host,
+			ConfigDir: configDir,
+		}
+		err = docker.Login(username, password, e.harbor)
 	}
+
+	e.lock.Lock()
+	e.logins[namespace] = err == nil
+	e.lock.Unlock()
+
+	return err
+}
+
+//DockerOf returns the docker client logged in harbor with the robot account of namespace,
+//error if the robot account is not minted or failed to login.
+func (e *Executor) DockerOf(namespace string) (*client.DockerClient, error) {
+	if !Config.Harbor.Robot.Enabled || len(namespace) == 0 {
+		return e.docker, nil
+	}
+
+	e.lock.Lock()
+	loggedIn := e.logins[namespace]
+	e.lock.Unlock()
+	if !loggedIn {
+		return nil, fmt.Errorf("harbor is not logged in with the robot account of namespace %s", namespace)
+	}
+
+	return &client.DockerClient{
+		Host:      e.docker.Host,
+		ConfigDir: robotDockerConfig(namespace),
+	}, nil
 }
 
 //Exec ...
-func (e *Executor) Exec(policy *SchedulePolicy) (Environment, error) {
+func (e *Executor) Exec(ctx context.Context, policy *SchedulePolicy) (_ Environment, err error) {
+	ctx, span := startSpan(ctx, "Executor.Exec", attribute.String("image", policy.Image), attribute.String("tag", policy.Tag))
+	defer func() { endSpan(span, err) }()
+
 	if len(policy.Image) == 0 {
 		return Environment{}, errors.New("empty image")
 	}
@@ -58,58 +109,130 @@ func (e *Executor) Exec(policy *SchedulePolicy) (Environment, error) {
 
 	//Only keep the 1st port as target port
 	bindPorts := []string{}
+	leased := []int{}
 	targetPort := 0
 	for _, port := range policy.BoundPorts {
-		portOnHost := giveMePort()
+		if e.ephemeral {
+			bindPorts = append(bindPorts, fmt.Sprintf("%d", port))
+			continue
+		}
+
+		portOnHost, err := e.ports.Lease(e.hostOn)
+		if err != nil {
+			e.ports.Release(e.hostOn, leased...)
+			return Environment{}, err
+		}
+		leased = append(leased, portOnHost)
 		if targetPort == 0 {
-			targetPort = (int)(portOnHost)
+			targetPort = portOnHost
 		}
 		boundPort := fmt.Sprintf("%d:%d", portOnHost, port)
 		bindPorts = append(bindPorts, boundPort)
 	}
 
 	image := fmt.Sprintf("%s:%s", policy.Image, policy.Tag)
+	runner := e.docker
 	if !policy.UseHub {
-		image = fmt.Sprintf("%s/%s/%s", e.harbor, e.namespace, image)
+		image = fmt.Sprintf("%s/%s/%s", e.harbor, policy.Namespace, image)
+		if runner, err = e.DockerOf(policy.Namespace); err != nil {
+			e.ports.Release(e.hostOn, leased...)
+			return Environment{}, err
+		}
 	}
 
-	runID, err := e.docker.Run(image, "", "", true, true, bindPorts, policy.EnvVars)
+	//The command logs carry the ID of the request scheduling the runtime
+	docker := e.docker.WithRequest(policy.RequestID)
+	log := logger.WithRequest(policy.RequestID)
+	registryType := policy.Labels[labelRegistryType]
+	started := time.Now()
+	runID := ""
+	err = traceStep(ctx, "docker run", func() (runErr error) {
+		runID, runErr = runner.WithRequest(policy.RequestID).Run(image, "", "", true, true, bindPorts, policy.EnvVars, policy.Labels)
+		return runErr
+	})
 	if err != nil {
+		e.ports.Release(e.hostOn, leased...)
 		return Environment{}, err
 	}
 
-	//Check connection available
-	done := make(chan bool)
-	errCh := make(chan error)
-	go func() {
-		t := time.Tick(1 * time.Second)
-		for {
-			select {
-			case <-t:
-				if res, err := http.Get(fmt.Sprintf("http://%s:%d", e.hostOn, targetPort)); err == nil {
-					log.Printf("Checking connection of http://%s:%d: %s\n", e.hostOn, targetPort, res.Status)
-					if res.StatusCode == http.StatusOK {
-						time.Sleep(2 * time.Second)
-						done <- true
-						return
-					}
-				}
-			case <-time.After(10 * time.Second):
-				errCh <- fmt.Errorf("Check connection %s:%d timeout", e.hostOn, targetPort)
-				return
-			}
+	if e.ephemeral && len(policy.BoundPorts) > 0 {
+		//Read back the port assigned by the daemon
+		targetPort, err = docker.Port(runID, policy.BoundPorts[0])
+		if err != nil {
+			docker.Destroy(runID)
+			return Environment{}, err
+		}
+	}
+
+	e.lock.Lock()
+	e.leases[runID] = leased
+	e.lock.Unlock()
+
+	//Check the runtime is ready
+	probeConfig := policy.Readiness
+	if probeConfig == nil {
+		probeConfig = &ProbeConfig{}
+		probeConfig.Validate("/")
+	}
+	metricRuntimeStart.Observe(time.Since(started).Seconds(), registryType)
+	started = time.Now()
+	err = traceStep(ctx, "readiness probe", func() error {
+		return NewProber(probeConfig, docker).WaitReady(ctx, runID, e.hostOn, targetPort)
+	})
+	if err != nil {
+		metricRuntimeReadiness.Observe(time.Since(started).Seconds(), registryType, "false")
+		//Never ready, clean it up
+		if destroyErr := e.Destroy(runID); destroyErr != nil {
+			log.Errorf("Failed to destroy unready runtime %s: %s", runID, destroyErr)
+		} else {
+			metricRuntimesDestroyed.Inc(registryType, destroyReasonUnready)
 		}
-	}()
-
-	select {
-	case <-done:
-		return Environment{
-			Target:    (ProxyTarget)(fmt.Sprintf("%s:%d", e.hostOn, targetPort)),
-			RuntimeID: runID,
-		}, nil
-	case err := <-errCh:
 		return Environment{}, err
 	}
+	metricRuntimeReadiness.Observe(time.Since(started).Seconds(), registryType, "true")
+	log.Infof("Runtime %s is ready at %s:%d", runID, e.hostOn, targetPort)
+
+	return Environment{
+		Target:    (ProxyTarget)(fmt.Sprintf("%s:%d", e.hostOn, targetPort)),
+		RuntimeID: runID,
+	}, nil
+}
+
+//Adopt the runtime restored from the state store to keep its port leased
+func (e *Executor) Adopt(runtimeID string, target ProxyTarget) error {
+	host, portStr, err := net.SplitHostPort(string(target))
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	if !e.ephemeral {
+		e.ports.Reserve(host, port)
+		e.lock.Lock()
+		e.leases[runtimeID] = []int{port}
+		e.lock.Unlock()
+	}
+
+	return nil
+}
+
+//IsAlive checks whether the runtime is still running
+func (e *Executor) IsAlive(runtimeID string) (bool, error) {
+	return e.docker.IsRunning(runtimeID)
+}
+
+//Deaths streams the IDs of the runtimes which are dead
+func (e *Executor) Deaths(ctx context.Context) (<-chan string, error) {
+	return e.docker.Events(ctx, "die", "oom")
+}
+
+//MemoryUsage returns the memory usage (percent) of the runtimes on host
+func (e *Executor) MemoryUsage() (float64, error) {
+	return e.docker.MemoryUsage()
 }
 
 //Destroy ...
@@ -118,10 +241,17 @@ func (e *Executor) Destroy(runtimeID string) error {
 		return errors.New("nil runtime ID")
 	}
 
-	return e.docker.Destroy(runtimeID)
-}
+	//The ports are given back if the container is gone anyway
+	if err := e.docker.Destroy(runtimeID); err != nil && err != client.ErrNoSuchContainer {
+		return err
+	}
+
+	//Give back the ports
+	e.lock.Lock()
+	leased := e.leases[runtimeID]
+	delete(e.leases, runtimeID)
+	e.lock.Unlock()
+	e.ports.Release(e.hostOn, leased...)
 
-func giveMePort() int32 {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return 30000 + r.Int31n(35530)
+	return nil
 }
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"registry-factory/client/harbor"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExistenceTTL = 60 //seconds
+)
+
+//ExistenceCache caches the kinds of packages looked up in harbor,
+//the entries are expired with the TTL or invalidated by the harbor webhook events.
+type ExistenceCache struct {
+	lock    *sync.RWMutex
+	ttl     int64
+	entries map[string]*existenceEntry
+}
+
+type existenceEntry struct {
+	//Empty if the package is not existing
+	kind       string
+	expireTime int64
+}
+
+//NewExistenceCache ...
+//Nothing is cached if ttl is not positive.
+func NewExistenceCache(ttl int64) *ExistenceCache {
+	return &ExistenceCache{
+		lock:    new(sync.RWMutex),
+		ttl:     ttl,
+		entries: make(map[string]*existenceEntry),
+	}
+}
+
+//Lookup returns the kind (image or artifact) of the package, harbor is checked if it's not cached
+func (ec *ExistenceCache) Lookup(ctx context.Context, harborAPI *harbor.Client, namespace, image, tag string) string {
+	if ec.ttl <= 0 {
+		kind, _ := checkImageExisting(ctx, harborAPI, namespace, image, tag)
+		return kind
+	}
+
+	key := existenceKey(namespace, image, tag)
+	now := time.Now().Unix()
+	ec.lock.RLock()
+	entry, ok := ec.entries[key]
+	ec.lock.RUnlock()
+	if ok && now < entry.expireTime {
+		return entry.kind
+	}
+
+	kind, definitive := checkImageExisting(ctx, harborAPI, namespace, image, tag)
+	if !definitive {
+		//Harbor may be back soon, don't take the failure as not existing for the whole TTL
+		return kind
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.entries[key] = &existenceEntry{
+		kind:       kind,
+		expireTime: now + ec.ttl,
+	}
+	//Drop the expired ones along the way
+	for k, v := range ec.entries {
+		if now >= v.expireTime {
+			delete(ec.entries, k)
+		}
+	}
+
+	return kind
+}
+
+//Invalidate the cached packages, all the tags of the image are invalidated if tag is empty,
+//and all the images of namespace if image is empty. Returns the number of invalidated ones.
+func (ec *ExistenceCache) Invalidate(namespace, image, tag string) int {
+	prefix := namespace + "/"
+	if len(image) > 0 {
+		//Tag has no ':' so it's unambiguous
+		prefix = existenceKey(namespace, image, tag)
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+
+	count := 0
+	for k := range ec.entries {
+		if k == prefix || (len(tag) == 0 && strings.HasPrefix(k, prefix)) {
+			delete(ec.entries, k)
+			count++
+		}
+	}
+
+	return count
+}
+
+func existenceKey(namespace, image, tag string) string {
+	return fmt.Sprintf("%s/%s:%s", namespace, image, tag)
+}
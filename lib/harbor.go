@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"registry-factory/client"
+	"registry-factory/client/harbor"
+	"registry-factory/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRobotDuration       = 30    //days
+	defaultRobotRotateInterval = 86400 //seconds
+	defaultRetentionSchedule   = "0 0 0 * * *"
+
+	robotNamePrefix = "chameleon-"
+)
+
+//harborEndpoint returns the endpoint of the configured harbor
+func harborEndpoint() string {
+	return fmt.Sprintf("%s://%s", Config.Harbor.Protocol, Config.Harbor.Host)
+}
+
+//newHarborClient creates the client of harbor API, the admin credential is used if credential is nil
+func newHarborClient(credential func() (string, string)) *harbor.Client {
+	return harbor.NewClient(harborEndpoint(), Config.Harbor.Username, Config.Harbor.Password, &harbor.Options{
+		APIVersion: Config.Harbor.APIVersion,
+		Insecure:   Config.Harbor.Insecure,
+		Credential: credential,
+	})
+}
+
+//newHarborRegistry creates the client of the registry v2 API in harbor
+func newHarborRegistry(credential func(repo string) (string, string)) *client.RegistryClient {
+	registry := client.NewRegistryClient(harborEndpoint(), Config.Harbor.Username, Config.Harbor.Password, Config.Harbor.Insecure)
+	registry.Credential = credential
+
+	return registry
+}
+
+//robotDockerConfig is the docker config dir keeping the login of the namespace robot account,
+//each namespace has its own one as docker keeps only one credential per registry host.
+func robotDockerConfig(namespace string) string {
+	return filepath.Join(Config.Harbor.Robot.DockerConfigDir, namespace)
+}
+
+//robotCredential is the robot account minted for the namespace
+type robotCredential struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Secret      string `json:"secret"`
+	RotatedTime int64  `json:"rotated_time"`
+}
+
+//HarborProvisioner creates the missing projects and mints the robot accounts of namespaces
+//with the admin credential. Pushing and pulling use the robot accounts afterwards,
+//and their secrets are rotated on schedule.
+type HarborProvisioner struct {
+	admin    *harbor.Client
+	lock     *sync.RWMutex
+	robots   map[string]*robotCredential
+	projects map[string]bool
+	//Keeps the robot accounts, they're not minted again on restart
+	store StateStore
+	//Called when the credential of namespace is minted or rotated
+	onCredential func(namespace, username, password string)
+}
+
+//NewHarborProvisioner ...
+func NewHarborProvisioner(store StateStore, onCredential func(namespace, username, password string)) *HarborProvisioner {
+	return &HarborProvisioner{
+		admin:        newHarborClient(nil),
+		lock:         new(sync.RWMutex),
+		robots:       make(map[string]*robotCredential),
+		projects:     make(map[string]bool),
+		store:        store,
+		onCredential: onCredential,
+	}
+}
+
+//Load the robot accounts from the state store, their credentials are notified as minted
+func (hp *HarborProvisioner) Load() error {
+	loaded := make(map[string]*robotCredential)
+	err := hp.store.List(bucketRobots, func(key string, data []byte) error {
+		robot := &robotCredential{}
+		if err := json.Unmarshal(data, robot); err != nil {
+			return err
+		}
+		loaded[key] = robot
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hp.lock.Lock()
+	for ns, robot := range loaded {
+		hp.robots[ns] = robot
+	}
+	hp.lock.Unlock()
+
+	for ns, robot := range loaded {
+		hp.notify(ns, robot.Name, robot.Secret)
+	}
+
+	return nil
+}
+
+//Bootstrap provisions the namespaces, the failed ones are provisioned again on the first publish
+func (hp *HarborProvisioner) Bootstrap(namespaces ...string) {
+	for _, ns := range namespaces {
+		if err := hp.EnsureNamespace(ns); err != nil {
+			logger.Errorf("Failed to provision harbor namespace %s: %s", ns, err)
+		}
+	}
+}
+
+//EnsureNamespace creates the project if it's missing and mints the robot account of it
+func (hp *HarborProvisioner) EnsureNamespace(namespace string) error {
+	if len(namespace) == 0 {
+		return nil
+	}
+
+	if err := hp.ensureProject(namespace); err != nil {
+		return err
+	}
+
+	if !Config.Harbor.Robot.Enabled {
+		return nil
+	}
+
+	hp.lock.RLock()
+	_, minted := hp.robots[namespace]
+	hp.lock.RUnlock()
+	if minted {
+		return nil
+	}
+
+	return hp.mintRobot(namespace)
+}
+
+//RobotCredential returns the robot account of the namespace, false if it has none
+func (hp *HarborProvisioner) RobotCredential(namespace string) (string, string, bool) {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+
+	robot, ok := hp.robots[namespace]
+	if !ok {
+		return "", "", false
+	}
+
+	return robot.Name, robot.Secret, true
+}
+
+//Credential returns the credential of the namespace, the admin one if the namespace has no robot account
+func (hp *HarborProvisioner) Credential(namespace string) (string, string) {
+	hp.lock.RLock()
+	defer hp.lock.RUnlock()
+
+	if robot, ok := hp.robots[namespace]; ok {
+		return robot.Name, robot.Secret
+	}
+
+	return Config.Harbor.Username, Config.Harbor.Password
+}
+
+//RepositoryCredential returns the credential of the namespace which the repository belongs to
+func (hp *HarborProvisioner) RepositoryCredential(repo string) (string, string) {
+	return hp.Credential(strings.SplitN(repo, "/", 2)[0])
+}
+
+//Rotate the secrets of the robot accounts
+func (hp *HarborProvisioner) Rotate() {
+	hp.lock.RLock()
+	namespaces := make(map[string]int64)
+	for ns, robot := range hp.robots {
+		namespaces[ns] = robot.ID
+	}
+	hp.lock.RUnlock()
+
+	for ns, ID := range namespaces {
+		secret, err := hp.admin.RefreshRobotSecret(ID)
+		if err == harbor.ErrUnsupported {
+			//v1 API can't refresh the secret, mint a new one
+			err = hp.mintRobot(ns)
+		} else if err == nil {
+			hp.lock.Lock()
+			robot := hp.robots[ns]
+			robot.Secret = secret
+			robot.RotatedTime = time.Now().Unix()
+			rotated := *robot
+			hp.lock.Unlock()
+			hp.persist(ns, rotated)
+			hp.notify(ns, rotated.Name, secret)
+		}
+
+		if err != nil {
+			logger.Errorf("Failed to rotate the robot account of namespace %s: %s", ns, err)
+			continue
+		}
+		logger.Infof("Robot account of namespace %s is rotated", ns)
+	}
+}
+
+func (hp *HarborProvisioner) ensureProject(namespace string) error {
+	hp.lock.RLock()
+	known := hp.projects[namespace]
+	hp.lock.RUnlock()
+	if known {
+		return nil
+	}
+
+	existing, err := hp.admin.ProjectExists(namespace)
+	if err != nil {
+		return err
+	}
+
+	if !existing {
+		if err := hp.createProject(namespace); err != nil {
+			return err
+		}
+	}
+
+	hp.lock.Lock()
+	hp.projects[namespace] = true
+	hp.lock.Unlock()
+
+	return nil
+}
+
+func (hp *HarborProvisioner) createProject(namespace string) error {
+	provision := Config.Harbor.Provision
+	if !provision.Enabled {
+		return fmt.Errorf("harbor project %s does not exist", namespace)
+	}
+
+	req := &harbor.ProjectReq{
+		Name: namespace,
+		Metadata: map[string]string{
+			"public": fmt.Sprintf("%v", provision.Public),
+		},
+	}
+	if provision.StorageLimit != 0 {
+		req.StorageLimit = &provision.StorageLimit
+	}
+
+	ID, err := hp.admin.CreateProject(req)
+	if err != nil && !harbor.IsConflict(err) {
+		return err
+	}
+	if harbor.IsConflict(err) {
+		//Created by others just now
+		return nil
+	}
+	logger.Infof("Harbor project %s is created", namespace)
+
+	if provision.RetainLatest <= 0 {
+		return nil
+	}
+
+	if ID == 0 {
+		p, err := hp.admin.GetProject(namespace)
+		if err != nil {
+			return err
+		}
+		ID = p.ID
+	}
+	if _, err := hp.admin.CreateRetention(&harbor.RetentionReq{
+		ProjectID:  ID,
+		KeepLatest: provision.RetainLatest,
+		Schedule:   provision.RetentionSchedule,
+	}); err != nil {
+		//The project is usable without retention
+		logger.Errorf("Failed to create retention policy of harbor project %s: %s", namespace, err)
+	}
+
+	return nil
+}
+
+//mintRobot creates the robot account of namespace, the existing one with the same name is replaced
+func (hp *HarborProvisioner) mintRobot(namespace string) error {
+	name := robotNamePrefix + namespace
+	robots, err := hp.admin.ListRobots(namespace)
+	if err != nil {
+		return err
+	}
+	for _, r := range robots {
+		//robot$<name> or robot$<project>+<name>
+		if strings.HasSuffix(r.Name, "$"+name) || strings.HasSuffix(r.Name, "+"+name) {
+			if err := hp.admin.DeleteRobot(namespace, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	robot, err := hp.admin.CreateRobot(namespace, &harbor.RobotReq{
+		Name:        name,
+		Description: "minted by chameleon for pushing and pulling packages",
+		Duration:    Config.Harbor.Robot.Duration,
+		Access: []harbor.RobotAccess{
+			{Resource: harbor.ResourceRepository, Action: harbor.ActionPull},
+			{Resource: harbor.ResourceRepository, Action: harbor.ActionPush},
+			{Resource: harbor.ResourceArtifact, Action: harbor.ActionRead},
+			{Resource: harbor.ResourceArtifact, Action: harbor.ActionList},
+			{Resource: harbor.ResourceTag, Action: harbor.ActionList},
+			{Resource: harbor.ResourceTag, Action: harbor.ActionCreate},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	minted := robotCredential{
+		ID:          robot.ID,
+		Name:        robot.Name,
+		Secret:      robot.Secret,
+		RotatedTime: time.Now().Unix(),
+	}
+	stored := minted
+	hp.lock.Lock()
+	hp.robots[namespace] = &stored
+	hp.lock.Unlock()
+	hp.persist(namespace, minted)
+
+	logger.Infof("Robot account %s of namespace %s is minted", robot.Name, namespace)
+	hp.notify(namespace, robot.Name, robot.Secret)
+
+	return nil
+}
+
+//persist the robot account, it's minted again on restart if it's failed
+func (hp *HarborProvisioner) persist(namespace string, robot robotCredential) {
+	if err := hp.store.Put(bucketRobots, namespace, robot); err != nil {
+		logger.Errorf("Failed to persist the robot account of namespace %s: %s", namespace, err)
+	}
+}
+
+func (hp *HarborProvisioner) notify(namespace, username, password string) {
+	if hp.onCredential != nil {
+		hp.onCredential(namespace, username, password)
+	}
+}
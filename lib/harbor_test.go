@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeHarbor serves the v2 API of projects and robots used by the provisioner
+type fakeHarbor struct {
+	lock     sync.Mutex
+	projects map[string]int64
+	robots   map[int64]string
+	nextID   int64
+	//Status answered to creating a project or a robot, 201 if it's 0
+	createProjectStatus int
+	createRobotStatus   int
+	deletedRobots       []int64
+	createdProjects     []string
+}
+
+func newFakeHarbor(t *testing.T) (*fakeHarbor, *httptest.Server) {
+	fh := &fakeHarbor{
+		projects: make(map[string]int64),
+		robots:   make(map[int64]string),
+		nextID:   100,
+	}
+	server := httptest.NewServer(fh)
+	t.Cleanup(server.Close)
+
+	Config = &Configuration{
+		Harbor: &HarborConfig{
+			Host:       strings.TrimPrefix(server.URL, "http://"),
+			Protocol:   "http",
+			Username:   "admin",
+			Password:   "Harbor12345",
+			APIVersion: "v2",
+			Provision:  &ProvisionConfig{Enabled: true},
+			Robot:      &RobotConfig{Enabled: true, Duration: 30},
+		},
+	}
+
+	return fh, server
+}
+
+func (fh *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "Harbor12345" {
+		http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`, http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2.0")
+	switch {
+	case r.Method == http.MethodGet && path == "/projects":
+		projects := []map[string]interface{}{}
+		for name, ID := range fh.projects {
+			if strings.Contains(name, r.URL.Query().Get("name")) {
+				projects = append(projects, map[string]interface{}{"project_id": ID, "name": name})
+			}
+		}
+		json.NewEncoder(w).Encode(projects)
+	case r.Method == http.MethodPost && path == "/projects":
+		req := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		name, _ := req["project_name"].(string)
+		fh.createdProjects = append(fh.createdProjects, name)
+		switch fh.createProjectStatus {
+		case 0, http.StatusCreated:
+			fh.nextID++
+			fh.projects[name] = fh.nextID
+			w.Header().Set("Location", "/api/v2.0/projects/"+strconv.FormatInt(fh.nextID, 10))
+			w.WriteHeader(http.StatusCreated)
+		case http.StatusConflict:
+			//Created by another replica just now
+			fh.nextID++
+			fh.projects[name] = fh.nextID
+			http.Error(w, `{"errors":[{"code":"CONFLICT","message":"project already exists"}]}`, http.StatusConflict)
+		default:
+			http.Error(w, `{"errors":[{"code":"UNKNOWN","message":"internal error"}]}`, fh.createProjectStatus)
+		}
+	case r.Method == http.MethodGet && path == "/robots":
+		robots := []map[string]interface{}{}
+		for ID, name := range fh.robots {
+			robots = append(robots, map[string]interface{}{"id": ID, "name": name})
+		}
+		json.NewEncoder(w).Encode(robots)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/robots/"):
+		for ID := range fh.robots {
+			if "/robots/"+strconv.FormatInt(ID, 10) == path {
+				delete(fh.robots, ID)
+				fh.deletedRobots = append(fh.deletedRobots, ID)
+			}
+		}
+	case r.Method == http.MethodPost && path == "/robots":
+		if status := fh.createRobotStatus; status != 0 && status != http.StatusCreated {
+			http.Error(w, `{"errors":[{"code":"UNKNOWN","message":"internal error"}]}`, status)
+			return
+		}
+		req := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		fh.nextID++
+		name := "robot$" + req["name"].(string)
+		fh.robots[fh.nextID] = name
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": fh.nextID, "name": name, "secret": "s3cret"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEnsureNamespaceCreatesProject(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"created", http.StatusCreated, false},
+		{"conflict", http.StatusConflict, false},
+		{"server error", http.StatusInternalServerError, true},
+		{"unavailable", http.StatusServiceUnavailable, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh, _ := newFakeHarbor(t)
+			fh.createProjectStatus = tc.status
+			Config.Harbor.Robot.Enabled = false
+
+			hp := NewHarborProvisioner(NewMemoryStateStore(), nil)
+			err := hp.EnsureNamespace("team")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("EnsureNamespace() error = %v, want error %v", err, tc.wantErr)
+			}
+			if len(fh.createdProjects) != 1 || fh.createdProjects[0] != "team" {
+				t.Fatalf("created projects = %v, want [team]", fh.createdProjects)
+			}
+
+			//The project is known once provisioned, retried on the next call if it failed
+			err = hp.EnsureNamespace("team")
+			if tc.wantErr {
+				if len(fh.createdProjects) != 2 {
+					t.Errorf("failed project is not retried, created projects = %v", fh.createdProjects)
+				}
+			} else if err != nil || len(fh.createdProjects) != 1 {
+				t.Errorf("provisioned project is created again, err = %v, created projects = %v", err, fh.createdProjects)
+			}
+		})
+	}
+}
+
+func TestEnsureNamespaceKeepsExistingProject(t *testing.T) {
+	fh, _ := newFakeHarbor(t)
+	fh.projects["team"] = 1
+	Config.Harbor.Provision.Enabled = false
+	Config.Harbor.Robot.Enabled = false
+
+	if err := NewHarborProvisioner(NewMemoryStateStore(), nil).EnsureNamespace("team"); err != nil {
+		t.Fatalf("EnsureNamespace() error = %v", err)
+	}
+	if len(fh.createdProjects) != 0 {
+		t.Errorf("existing project is created again: %v", fh.createdProjects)
+	}
+
+	if err := NewHarborProvisioner(NewMemoryStateStore(), nil).EnsureNamespace("missing"); err == nil {
+		t.Error("missing project is not reported with provision disabled")
+	}
+}
+
+func TestEnsureNamespaceMintsRobot(t *testing.T) {
+	fh, _ := newFakeHarbor(t)
+	fh.projects["team"] = 1
+	//Left by the previous run
+	fh.robots[7] = "robot$team+chameleon-team"
+
+	notified := map[string]string{}
+	hp := NewHarborProvisioner(NewMemoryStateStore(), func(namespace, username, password string) {
+		notified[namespace] = username + ":" + password
+	})
+	if err := hp.EnsureNamespace("team"); err != nil {
+		t.Fatalf("EnsureNamespace() error = %v", err)
+	}
+
+	if len(fh.deletedRobots) != 1 || fh.deletedRobots[0] != 7 {
+		t.Errorf("deleted robots = %v, want [7]", fh.deletedRobots)
+	}
+	username, password := hp.Credential("team")
+	if username != "robot$chameleon-team" || password != "s3cret" {
+		t.Errorf("Credential() = %s, %s, want the minted robot", username, password)
+	}
+	if notified["team"] != "robot$chameleon-team:s3cret" {
+		t.Errorf("minted credential is not notified: %v", notified)
+	}
+
+	//Minted only once
+	if err := hp.EnsureNamespace("team"); err != nil || len(fh.robots) != 1 {
+		t.Errorf("robot is minted again, err = %v, robots = %v", err, fh.robots)
+	}
+}
+
+func TestEnsureNamespaceRobotFailure(t *testing.T) {
+	fh, _ := newFakeHarbor(t)
+	fh.projects["team"] = 1
+	fh.createRobotStatus = http.StatusInternalServerError
+
+	hp := NewHarborProvisioner(NewMemoryStateStore(), nil)
+	if err := hp.EnsureNamespace("team"); err == nil {
+		t.Fatal("EnsureNamespace() succeeded with robot creation failed")
+	}
+
+	//Fall back to the admin credential
+	if username, password := hp.Credential("team"); username != "admin" || password != "Harbor12345" {
+		t.Errorf("Credential() = %s, %s, want the admin one", username, password)
+	}
+
+	fh.createRobotStatus = 0
+	if err := hp.EnsureNamespace("team"); err != nil {
+		t.Fatalf("EnsureNamespace() error = %v on retry", err)
+	}
+	if username, _ := hp.Credential("team"); username != "robot$chameleon-team" {
+		t.Errorf("Credential() username = %s after retry", username)
+	}
+}
+
+func TestArtifactCredential(t *testing.T) {
+	fh, _ := newFakeHarbor(t)
+	fh.projects["npm"] = 1
+	Config.NpmRegistry = &RegistryConfig{Namespace: "npm", ArtifactServerImage: "chameleon/npm-artifacts", ArtifactServerTag: "1.0"}
+
+	s := &Scheduler{harbor: NewHarborProvisioner(NewMemoryStateStore(), nil)}
+	policy := &SchedulePolicy{Namespace: "npm"}
+	useArtifactServer(policy, registryTypeNpm)
+	s.withArtifactCredential(policy)
+	//No robot yet, the admin credential is never given
+	if _, ok := policy.EnvVars["ARTIFACT_USERNAME"]; ok {
+		t.Errorf("artifact server is given %s", policy.EnvVars["ARTIFACT_USERNAME"])
+	}
+	if _, ok := policy.EnvVars["ARTIFACT_PASSWORD"]; ok {
+		t.Error("artifact server is given the admin password")
+	}
+
+	if err := s.harbor.EnsureNamespace("npm"); err != nil {
+		t.Fatal(err)
+	}
+	s.withArtifactCredential(policy)
+	if policy.EnvVars["ARTIFACT_USERNAME"] != "robot$chameleon-npm" || policy.EnvVars["ARTIFACT_PASSWORD"] != "s3cret" {
+		t.Errorf("artifact server is not given the robot account: %v", policy.EnvVars)
+	}
+}
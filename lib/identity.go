@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	identityProviderLocal = "local"
+	identityProviderLDAP  = "ldap"
+	identityProviderOIDC  = "oidc"
+
+	//Successful logins of the identity providers are cached for the pip requests
+	loginCacheTTL = 60 //seconds
+)
+
+//Identity is the user authenticated by the identity provider
+type Identity struct {
+	Provider string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+//IdentityProvider verifies the username and password with the external directory
+type IdentityProvider interface {
+	//Name of the provider
+	Name() string
+
+	//Authenticate returns the identity with its groups, ErrUnauthenticated if the password is wrong
+	Authenticate(username, password string) (*Identity, error)
+}
+
+//identityProviders creates the enabled password providers by the config
+func identityProviders() []IdentityProvider {
+	providers := make([]IdentityProvider, 0)
+	if Config.Identity.LDAP.Enabled {
+		providers = append(providers, NewLDAPProvider(Config.Identity.LDAP))
+	}
+
+	return providers
+}
+
+//loginCache keeps the successful logins of local users and identity providers for a while,
+//so the basic auth of every pip request doesn't run bcrypt or hit the directory.
+type loginCache struct {
+	lock   *sync.Mutex
+	logins map[string]int64
+}
+
+func newLoginCache() *loginCache {
+	return &loginCache{
+		lock:   new(sync.Mutex),
+		logins: make(map[string]int64),
+	}
+}
+
+//Hit checks whether the login is cached and not expired
+func (lc *loginCache) Hit(username, password string) bool {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	key := loginKey(username, password)
+	expireTime, ok := lc.logins[key]
+	if ok && time.Now().Unix() >= expireTime {
+		delete(lc.logins, key)
+		return false
+	}
+
+	return ok
+}
+
+//Put the successful login
+func (lc *loginCache) Put(username, password string) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	now := time.Now().Unix()
+	for k, v := range lc.logins {
+		if now >= v {
+			delete(lc.logins, k)
+		}
+	}
+	lc.logins[loginKey(username, password)] = now + loginCacheTTL
+}
+
+//Forget all the cached logins, e.g: the user is deleted
+func (lc *loginCache) Forget() {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	lc.logins = make(map[string]int64)
+}
+
+func loginKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"encoding/json"
 	"fmt"
+	"registry-factory/logger"
 	"sync"
 	"time"
 )
@@ -14,6 +16,7 @@ const (
 type ImageStore struct {
 	lock   *sync.RWMutex
 	images map[string]*Image
+	store  StateStore
 }
 
 //Image ...
@@ -24,36 +27,62 @@ type Image struct {
 }
 
 //NewImageStore ...
-func NewImageStore() *ImageStore {
+func NewImageStore(store StateStore) *ImageStore {
 	return &ImageStore{
 		lock:   new(sync.RWMutex),
 		images: make(map[string]*Image),
+		store:  store,
 	}
 }
 
+//Load the images from the state store
+func (is *ImageStore) Load() error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	return is.store.List(bucketImages, func(key string, data []byte) error {
+		image := &Image{}
+		if err := json.Unmarshal(data, image); err != nil {
+			return err
+		}
+		is.images[key] = image
+
+		return nil
+	})
+}
+
 //Put image in with the key
 func (is *ImageStore) Put(img, tag string) {
 	if len(img) == 0 || len(tag) == 0 {
 		return
 	}
 
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
 	key := fmt.Sprintf("%s:%s", img, tag)
-	if image, ok := is.images[key]; ok {
+	image, ok := is.images[key]
+	if ok {
 		image.ActiveTime = time.Now().Unix()
-		return
+	} else {
+		image = &Image{
+			Name:       img,
+			Tag:        tag,
+			ActiveTime: time.Now().Unix(),
+		}
+		is.images[key] = image
 	}
 
-	image := &Image{
-		Name:       img,
-		Tag:        tag,
-		ActiveTime: time.Now().Unix(),
+	if err := is.store.Put(bucketImages, key, image); err != nil {
+		logger.Errorf("Failed to persist image %s: %s", key, err)
 	}
-
-	is.images[key] = image
 }
 
 //Get what you want
 func (is *ImageStore) Get(key string) (*Image, bool) {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
 	img, ok := is.images[key]
 	if ok {
 		img.ActiveTime += 5 //for safe calling
@@ -61,14 +90,28 @@ func (is *ImageStore) Get(key string) (*Image, bool) {
 	return img, ok
 }
 
+//Size returns the number of images in the store
+func (is *ImageStore) Size() int {
+	is.lock.RLock()
+	defer is.lock.RUnlock()
+
+	return len(is.images)
+}
+
 //Garbage collection
 func (is *ImageStore) Garbage() []*Image {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
 	outdatedOnes := make([]*Image, 0)
 	now := time.Now().Unix()
 	for k, v := range is.images {
 		if now > v.ActiveTime+outdatedTime {
 			outdatedOnes = append(outdatedOnes, v)
 			delete(is.images, k)
+			if err := is.store.Delete(bucketImages, k); err != nil {
+				logger.Errorf("Failed to delete image %s from state store: %s", k, err)
+			}
 		}
 	}
 
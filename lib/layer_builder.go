@@ -0,0 +1,502 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"registry-factory/client"
+	"registry-factory/logger"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	builderLayer  = "layer"
+	builderCommit = "commit"
+
+	mediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCIForeignLayer    = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	dockerHubHost     = "docker.io"
+	dockerHubEndpoint = "https://registry-1.docker.io"
+	defaultPlatform   = "linux/amd64"
+
+	//Placeholder of the package name in the artifact path
+	artifactPackagePlaceholder = "{package}"
+	defaultNpmArtifactPath     = "/verdaccio/storage/{package}"
+	defaultPipArtifactPath     = "/pypi"
+)
+
+//All the entries of the layer have the same time to make the digest reproducible
+var layerEpoch = time.Unix(0, 0).UTC()
+
+//ociDescriptor describes the blob or manifest
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	URLs      []string     `json:"urls,omitempty"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+//ociManifest is the image manifest, the docker schema2 manifest has the same layout
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+//ociIndex is the image index or docker manifest list
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+//artifactLayer is the gzipped tar layer of the published artifacts
+type artifactLayer struct {
+	Data []byte
+	//sha256 of the compressed data
+	Digest string
+	//sha256 of the uncompressed tar
+	DiffID string
+}
+
+//LayerBuilder builds the package image by adding a layer of the published artifacts
+//on the base image. The layer is made in process and pushed through the Registry v2 API,
+//so identical artifacts on the same base always give the identical image digest.
+type LayerBuilder struct {
+	docker     *client.DockerClient
+	harborHost string
+	harbor     *client.RegistryClient
+}
+
+//NewLayerBuilder ...
+func NewLayerBuilder(docker *client.DockerClient, harborHost string, harbor *client.RegistryClient) *LayerBuilder {
+	return &LayerBuilder{
+		docker:     docker,
+		harborHost: harborHost,
+		harbor:     harbor,
+	}
+}
+
+//Build the image namespace/image:tag in harbor with the artifacts in the base container,
+//the logs carry the ID of the publishing request.
+func (lb *LayerBuilder) Build(ctx context.Context, baseContainer, registryType, namespace, image, tag string, labels map[string]string, requestID string) (err error) {
+	_, span := startSpan(ctx, "LayerBuilder.Build", attribute.String("image", image), attribute.String("tag", tag))
+	defer func() { endSpan(span, err) }()
+
+	log := logger.WithRequest(requestID)
+	registry := registryConfigOf(registryType)
+	if registry == nil {
+		return fmt.Errorf("unknown registry type '%s'", registryType)
+	}
+	if len(registry.ArtifactPath) == 0 {
+		return fmt.Errorf("no artifact path of %s registry", registryType)
+	}
+
+	artifactPath := path.Clean(strings.Replace(registry.ArtifactPath, artifactPackagePlaceholder, image, -1))
+	archive, err := lb.docker.WithRequest(requestID).CopyFrom(baseContainer, artifactPath)
+	if err != nil {
+		return err
+	}
+	layer, err := newArtifactLayer(archive, artifactPath, log)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("build layer of %s error: %s", artifactPath, err)
+	}
+
+	baseRegistry, baseRepo := lb.registryOf(registry.BaseImage)
+	manifest, config, err := resolveBaseImage(baseRegistry, baseRepo, registry.BaseImageTag)
+	if err != nil {
+		return fmt.Errorf("resolve base image %s:%s error: %s", registry.BaseImage, registry.BaseImageTag, err)
+	}
+
+	repo := fmt.Sprintf("%s/%s", namespace, image)
+	layers := make([]ociDescriptor, 0, len(manifest.Layers)+1)
+	for _, base := range manifest.Layers {
+		base.MediaType = ociLayerMediaType(base.MediaType)
+		if len(base.URLs) == 0 {
+			if err := lb.copyBlob(baseRegistry, baseRepo, repo, base); err != nil {
+				return fmt.Errorf("copy base layer %s error: %s", base.Digest, err)
+			}
+		}
+		layers = append(layers, base)
+	}
+
+	if err := pushBlob(lb.harbor, repo, layer.Digest, layer.Data); err != nil {
+		return err
+	}
+	layers = append(layers, ociDescriptor{
+		MediaType: mediaTypeOCILayer,
+		Digest:    layer.Digest,
+		Size:      int64(len(layer.Data)),
+	})
+
+	imageConfig, err := appendLayerToConfig(config, layer.DiffID, artifactPath, reproducibleLabels(labels))
+	if err != nil {
+		return err
+	}
+	configDigest := digestOf(imageConfig)
+	if err := pushBlob(lb.harbor, repo, configDigest, imageConfig); err != nil {
+		return err
+	}
+
+	newManifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     client.MediaTypeOCIManifest,
+		Config: ociDescriptor{
+			MediaType: mediaTypeOCIConfig,
+			Digest:    configDigest,
+			Size:      int64(len(imageConfig)),
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := lb.harbor.PutManifest(repo, tag, client.MediaTypeOCIManifest, newManifest); err != nil {
+		return err
+	}
+
+	log.Infof("Image %s/%s:%s (%s) is built with layer %s", lb.harborHost, repo, tag, digestOf(newManifest), layer.Digest)
+
+	return nil
+}
+
+//registryOf returns the registry client and repository of the image reference
+func (lb *LayerBuilder) registryOf(image string) (*client.RegistryClient, string) {
+	host, repo := dockerHubHost, image
+	if i := strings.Index(image, "/"); i > 0 {
+		first := image[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, repo = first, image[i+1:]
+		}
+	}
+
+	if host == lb.harborHost {
+		return lb.harbor, repo
+	}
+
+	if host == dockerHubHost {
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+		return client.NewRegistryClient(dockerHubEndpoint, "", "", false), repo
+	}
+
+	return client.NewRegistryClient("https://"+host, "", "", false), repo
+}
+
+//copyBlob copies the blob of the base image into the target repository of harbor
+func (lb *LayerBuilder) copyBlob(from *client.RegistryClient, fromRepo, repo string, blob ociDescriptor) error {
+	existing, err := lb.harbor.BlobExists(repo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if existing {
+		return nil
+	}
+
+	if from == lb.harbor {
+		mounted, err := lb.harbor.MountBlob(repo, fromRepo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			return nil
+		}
+	}
+
+	content, err := from.GetBlob(fromRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return lb.harbor.PushBlob(repo, blob.Digest, blob.Size, content)
+}
+
+//resolveBaseImage returns the manifest and config of the base image,
+//the manifest of the default platform is picked if it's a multi-platform image.
+func resolveBaseImage(registry *client.RegistryClient, repo, tag string) (*ociManifest, []byte, error) {
+	data, mediaType, err := registry.GetManifest(repo, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mediaType == client.MediaTypeOCIIndex || mediaType == client.MediaTypeDockerManifestList {
+		index := &ociIndex{}
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, nil, err
+		}
+
+		digest := ""
+		for _, m := range index.Manifests {
+			if m.Platform != nil && fmt.Sprintf("%s/%s", m.Platform.OS, m.Platform.Architecture) == defaultPlatform {
+				digest = m.Digest
+				break
+			}
+		}
+		if len(digest) == 0 {
+			return nil, nil, fmt.Errorf("no %s manifest", defaultPlatform)
+		}
+
+		if data, mediaType, err = registry.GetManifest(repo, digest); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if mediaType != client.MediaTypeOCIManifest && mediaType != client.MediaTypeDockerManifest {
+		return nil, nil, fmt.Errorf("unsupported manifest type '%s'", mediaType)
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, nil, err
+	}
+
+	content, err := registry.GetBlob(repo, manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer content.Close()
+
+	config, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if digestOf(config) != manifest.Config.Digest {
+		return nil, nil, errors.New("digest of base image config is mismatched")
+	}
+
+	return manifest, config, nil
+}
+
+//reproducibleLabels keeps the labels of the same value for every build of the registry type,
+//the creation time and anything else the caller passes would change the image digest
+func reproducibleLabels(labels map[string]string) map[string]string {
+	kept := make(map[string]string)
+	for _, k := range []string{labelOwner, labelRegistryType} {
+		if v, ok := labels[k]; ok {
+			kept[k] = v
+		}
+	}
+
+	return kept
+}
+
+//appendLayerToConfig adds the layer, its history and the labels into the image config.
+//Unknown fields of the base config are kept as they are. The labels go into the config digest,
+//so only the ones filtered by reproducibleLabels are passed.
+func appendLayerToConfig(config []byte, diffID, artifactPath string, labels map[string]string) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return nil, err
+	}
+
+	//Container config
+	containerConfig := make(map[string]json.RawMessage)
+	if raw, ok := fields["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &containerConfig); err != nil {
+			return nil, err
+		}
+	}
+	allLabels := make(map[string]string)
+	if raw, ok := containerConfig["Labels"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &allLabels); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range labels {
+		allLabels[k] = v
+	}
+	if err := setJSONField(containerConfig, "Labels", allLabels); err != nil {
+		return nil, err
+	}
+	if err := setJSONField(fields, "config", containerConfig); err != nil {
+		return nil, err
+	}
+
+	//Layers
+	rootfs := struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}{}
+	if err := json.Unmarshal(fields["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("invalid rootfs of base image config: %s", err)
+	}
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	if err := setJSONField(fields, "rootfs", rootfs); err != nil {
+		return nil, err
+	}
+
+	history := make([]json.RawMessage, 0)
+	if raw, ok := fields["history"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, err
+		}
+	}
+	entry, err := json.Marshal(map[string]string{
+		"created":    layerEpoch.Format(time.RFC3339),
+		"created_by": fmt.Sprintf("chameleon: add %s", artifactPath),
+	})
+	if err != nil {
+		return nil, err
+	}
+	history = append(history, entry)
+	if err := setJSONField(fields, "history", history); err != nil {
+		return nil, err
+	}
+
+	//Keys of map are sorted by encoding/json
+	return json.Marshal(fields)
+}
+
+func setJSONField(fields map[string]json.RawMessage, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	fields[key] = raw
+
+	return nil
+}
+
+//newArtifactLayer makes a deterministic layer from the tar archive of `docker cp`.
+//The entries are placed under the artifact path and sorted by name, the owner and
+//times are reset and only the directories, regular files and symlinks are kept.
+func newArtifactLayer(archive io.Reader, artifactPath string, log *logger.Entry) (*artifactLayer, error) {
+	type entry struct {
+		header *tar.Header
+		data   []byte
+	}
+
+	parent := strings.TrimPrefix(path.Dir(artifactPath), "/")
+	entries := make([]*entry, 0)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		//Nothing out of the parent of the artifact path
+		cleaned := path.Clean(hdr.Name)
+		if cleaned == ".." || strings.HasPrefix(cleaned, "../") || path.IsAbs(cleaned) {
+			return nil, fmt.Errorf("invalid entry '%s' in archive", hdr.Name)
+		}
+		name := path.Join(parent, cleaned)
+
+		normalized := &tar.Header{
+			Name:    name,
+			Mode:    hdr.Mode & 0777,
+			ModTime: layerEpoch,
+		}
+		e := &entry{header: normalized}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			normalized.Typeflag = tar.TypeDir
+			normalized.Name += "/"
+		case tar.TypeReg:
+			normalized.Typeflag = tar.TypeReg
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			normalized.Size = int64(len(data))
+			e.data = data
+		case tar.TypeSymlink:
+			normalized.Typeflag = tar.TypeSymlink
+			normalized.Linkname = hdr.Linkname
+		default:
+			log.Infof("Skip the entry %s of type '%c' in artifact layer", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("no artifacts found")
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].header.Name < entries[j].header.Name
+	})
+
+	tarData := &bytes.Buffer{}
+	tw := tar.NewWriter(tarData)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			return nil, err
+		}
+		if len(e.data) > 0 {
+			if _, err := tw.Write(e.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	//No name and time in the gzip header
+	gzData := &bytes.Buffer{}
+	gw, err := gzip.NewWriterLevel(gzData, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gw.Write(tarData.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &artifactLayer{
+		Data:   gzData.Bytes(),
+		Digest: digestOf(gzData.Bytes()),
+		DiffID: digestOf(tarData.Bytes()),
+	}, nil
+}
+
+//ociLayerMediaType maps the docker layer media types to the OCI ones
+func ociLayerMediaType(mediaType string) string {
+	switch mediaType {
+	case mediaTypeDockerLayer:
+		return mediaTypeOCILayer
+	case mediaTypeDockerForeignLayer:
+		return mediaTypeOCIForeignLayer
+	}
+
+	return mediaType
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"registry-factory/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+//tarOf makes the archive of the entries as `docker cp` does, the file content is the body
+func tarOf(t *testing.T, headers []*tar.Header, bodies map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		body := bodies[hdr.Name]
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+func TestArtifactLayerReproducible(t *testing.T) {
+	bodies := map[string]string{
+		"lodash/package.json":           `{"name":"lodash"}`,
+		"lodash/lodash-4.17.21.tgz":     "tarball",
+		"lodash/../lodash/package.json": `{"name":"lodash"}`,
+	}
+	now := time.Now()
+	entries := func(modTime time.Time, uid int, uname string) []*tar.Header {
+		return []*tar.Header{
+			{Name: "lodash/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime, Uid: uid, Gid: uid, Uname: uname},
+			{Name: "lodash/package.json", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime, Uid: uid, Gid: uid, Uname: uname},
+			{Name: "lodash/lodash-4.17.21.tgz", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime, Uid: uid, Gid: uid, Uname: uname},
+			{Name: "lodash/latest.tgz", Typeflag: tar.TypeSymlink, Linkname: "lodash-4.17.21.tgz", ModTime: modTime, Uid: uid},
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"reordered", func() []*tar.Header {
+			h := entries(now, 0, "root")
+			return []*tar.Header{h[3], h[2], h[0], h[1]}
+		}()},
+		{"other times", entries(now.Add(-time.Hour), 0, "root")},
+		{"other owners", entries(now, 1000, "verdaccio")},
+		{"other access times", func() []*tar.Header {
+			h := entries(now, 0, "root")
+			for _, hdr := range h {
+				hdr.AccessTime = now.Add(time.Minute)
+				hdr.ChangeTime = now.Add(time.Minute)
+				hdr.Format = tar.FormatPAX
+			}
+			return h
+		}()},
+		{"setuid and fifo", append(func() []*tar.Header {
+			h := entries(now, 0, "root")
+			h[1].Mode |= 04000
+			return h
+		}(), &tar.Header{Name: "lodash/.fifo", Typeflag: tar.TypeFifo, ModTime: now})},
+		{"unclean names", func() []*tar.Header {
+			h := entries(now, 0, "root")
+			h[1].Name = "lodash/../lodash/package.json"
+			return h
+		}()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := newArtifactLayer(tarOf(t, entries(time.Unix(1600000000, 0), 0, "root"), bodies), defaultNpmArtifactPath, logger.WithRequest(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := newArtifactLayer(tarOf(t, tc.headers, bodies), defaultNpmArtifactPath, logger.WithRequest(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Digest != want.Digest || got.DiffID != want.DiffID {
+				t.Errorf("layer = %s (%s), want %s (%s)", got.Digest, got.DiffID, want.Digest, want.DiffID)
+			}
+			if !bytes.Equal(got.Data, want.Data) {
+				t.Error("layer data is not identical")
+			}
+		})
+	}
+
+	//The content is in the digest
+	changed := map[string]string{"lodash/package.json": `{"name":"lodash","version":"4.17.21"}`}
+	layer, err := newArtifactLayer(tarOf(t, entries(now, 0, "root")[:2], changed), defaultNpmArtifactPath, logger.WithRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := newArtifactLayer(tarOf(t, entries(now, 0, "root")[:2], bodies), defaultNpmArtifactPath, logger.WithRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Digest == same.Digest {
+		t.Error("changed artifact gives the same digest")
+	}
+}
+
+func TestArtifactLayerEntries(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "lodash/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "lodash/package.json", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	layer, err := newArtifactLayer(tarOf(t, headers, map[string]string{"lodash/package.json": "{}"}), "/verdaccio/storage/lodash", logger.WithRequest(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(layer.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if !hdr.ModTime.Equal(layerEpoch) || hdr.Uid != 0 || hdr.Uname != "" {
+			t.Errorf("entry %s is not normalized: %+v", hdr.Name, hdr)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "verdaccio/storage/lodash/,verdaccio/storage/lodash/package.json" {
+		t.Errorf("entries = %v, want them under the artifact path", names)
+	}
+
+	for _, name := range []string{"../etc/passwd", "lodash/../../etc/passwd", "..", "/etc/passwd"} {
+		archive := tarOf(t, []*tar.Header{{Name: name, Typeflag: tar.TypeReg, Mode: 0644}}, map[string]string{name: "root:x:0:0"})
+		if _, err := newArtifactLayer(archive, "/verdaccio/storage/lodash", logger.WithRequest("")); err == nil {
+			t.Errorf("entry %s out of the artifact path is accepted", name)
+		}
+	}
+
+	if _, err := newArtifactLayer(tarOf(t, nil, nil), "/pypi", logger.WithRequest("")); err == nil {
+		t.Error("empty archive is accepted")
+	}
+}
+
+func TestAppendLayerToConfig(t *testing.T) {
+	base := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"maintainer":"verdaccio"}},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:base"]},"history":[{"created_by":"base"}],"custom":1}`)
+	labels := ownerLabels(registryTypeNpm)
+	labels["io.chameleon.request-id"] = "abc"
+
+	config, err := appendLayerToConfig(base, "sha256:layer", "/verdaccio/storage/lodash", reproducibleLabels(labels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Built again later
+	labels[labelCreated] = "1"
+	again, err := appendLayerToConfig(base, "sha256:layer", "/verdaccio/storage/lodash", reproducibleLabels(labels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digestOf(config) != digestOf(again) {
+		t.Error("config digest is changed by the labels of the build")
+	}
+
+	image := struct {
+		Config struct {
+			Labels map[string]string
+		} `json:"config"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []map[string]string `json:"history"`
+		Custom  int                 `json:"custom"`
+	}{}
+	if err := json.Unmarshal(config, &image); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"maintainer": "verdaccio", labelOwner: labelOwnerValue, labelRegistryType: registryTypeNpm}
+	if len(image.Config.Labels) != len(want) {
+		t.Errorf("labels = %v, want %v", image.Config.Labels, want)
+	}
+	for k, v := range want {
+		if image.Config.Labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, image.Config.Labels[k], v)
+		}
+	}
+	if strings.Join(image.RootFS.DiffIDs, ",") != "sha256:base,sha256:layer" {
+		t.Errorf("diff_ids = %v", image.RootFS.DiffIDs)
+	}
+	if len(image.History) != 2 || image.History[1]["created_by"] != "chameleon: add /verdaccio/storage/lodash" {
+		t.Errorf("history = %v", image.History)
+	}
+	if image.Custom != 1 {
+		t.Error("unknown field of base config is dropped")
+	}
+}
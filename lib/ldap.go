@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"registry-factory/logger"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	defaultLDAPUserFilter     = "(uid=%s)"
+	defaultLDAPEmailAttribute = "mail"
+	defaultLDAPGroupFilter    = "(member=%s)"
+	defaultLDAPGroupAttribute = "cn"
+	defaultLDAPTimeout        = 10 //seconds
+)
+
+//LDAPProvider verifies the password by binding as the user and looks up the groups of user
+type LDAPProvider struct {
+	config *LDAPConfig
+}
+
+//NewLDAPProvider ...
+func NewLDAPProvider(config *LDAPConfig) *LDAPProvider {
+	return &LDAPProvider{config: config}
+}
+
+//Name of the provider
+func (lp *LDAPProvider) Name() string {
+	return identityProviderLDAP
+}
+
+//Authenticate the user with LDAP bind
+func (lp *LDAPProvider) Authenticate(username, password string) (*Identity, error) {
+	//Unauthenticated bind succeeds with the empty password
+	if len(username) == 0 || len(password) == 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	conn, err := lp.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := lp.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lp.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, lp.config.Timeout, false,
+		fmt.Sprintf(lp.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", lp.config.EmailAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		//Not found or ambiguous
+		return nil, ErrUnauthenticated
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrUnauthenticated
+		}
+		return nil, err
+	}
+
+	//Search the groups as the service account
+	if err := lp.bindService(conn); err != nil {
+		return nil, err
+	}
+	groups, err := conn.Search(ldap.NewSearchRequest(
+		lp.config.GroupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, lp.config.Timeout, false,
+		fmt.Sprintf(lp.config.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{lp.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Provider: identityProviderLDAP,
+		Username: username,
+		Email:    entry.GetAttributeValue(lp.config.EmailAttribute),
+		Groups:   make([]string, 0, len(groups.Entries)),
+	}
+	for _, g := range groups.Entries {
+		if name := g.GetAttributeValue(lp.config.GroupAttribute); len(name) > 0 {
+			identity.Groups = append(identity.Groups, name)
+		}
+	}
+	logger.Infof("LDAP user %s is authenticated with groups %v", username, identity.Groups)
+
+	return identity, nil
+}
+
+func (lp *LDAPProvider) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: lp.config.Insecure}
+	conn, err := ldap.DialURL(lp.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Duration(lp.config.Timeout) * time.Second)
+
+	if lp.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (lp *LDAPProvider) bindService(conn *ldap.Conn) error {
+	if len(lp.config.BindDN) == 0 {
+		return conn.UnauthenticatedBind("")
+	}
+
+	return conn.Bind(lp.config.BindDN, lp.config.BindPassword)
+}
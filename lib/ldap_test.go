@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+//ldapStub serves the simple bind and search of a tiny directory
+type ldapStub struct {
+	lock sync.Mutex
+	//Passwords of the DNs
+	passwords map[string]string
+	//Entries returned by the search filters
+	entries map[string][]*ldap.Entry
+	binds   []string
+}
+
+func newLDAPStub(t *testing.T) (*ldapStub, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	stub := &ldapStub{
+		passwords: make(map[string]string),
+		entries:   make(map[string][]*ldap.Entry),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+
+	return stub, "ldap://" + listener.Addr().String()
+}
+
+func (ls *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			ls.lock.Lock()
+			ls.binds = append(ls.binds, dn)
+			expected, ok := ls.passwords[dn]
+			ls.lock.Unlock()
+
+			code := int64(ldap.LDAPResultSuccess)
+			if len(dn) > 0 && (!ok || expected != password) {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapResult(msgID, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				conn.Write(ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+			ls.lock.Lock()
+			entries := ls.entries[strings.ToLower(filter)]
+			ls.lock.Unlock()
+			for _, e := range entries {
+				conn.Write(ldapEntry(msgID, e).Bytes())
+			}
+			conn.Write(ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (ls *ldapStub) bindCount() int {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	return len(ls.binds)
+}
+
+//ldapMessage wraps the protocol op, the children are encoded on appending so the op must be complete
+func ldapMessage(msgID int64, op *ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	envelope.AppendChild(op)
+
+	return envelope
+}
+
+func ldapResult(msgID int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+
+	return ldapMessage(msgID, op)
+}
+
+func ldapEntry(msgID int64, entry *ldap.Entry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "objectName"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, a := range entry.Attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.Name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range a.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+
+	return ldapMessage(msgID, op)
+}
+
+func newTestLDAPConfig(t *testing.T) (*ldapStub, *LDAPConfig) {
+	stub, url := newLDAPStub(t)
+	stub.passwords["cn=svc,dc=example,dc=com"] = "svc-secret"
+	stub.passwords["uid=alice,ou=people,dc=example,dc=com"] = "alice-secret"
+	stub.entries["(uid=alice)"] = []*ldap.Entry{
+		ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{"mail": {"alice@example.com"}}),
+	}
+	//Ambiguous user
+	stub.entries["(uid=bob)"] = []*ldap.Entry{
+		ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", nil),
+		ldap.NewEntry("uid=bob,ou=contractors,dc=example,dc=com", nil),
+	}
+	stub.entries["(member=uid=alice,ou=people,dc=example,dc=com)"] = []*ldap.Entry{
+		ldap.NewEntry("cn=devs,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"devs"}}),
+		ldap.NewEntry("cn=ops,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"ops"}}),
+	}
+
+	return stub, &LDAPConfig{
+		Enabled:        true,
+		URL:            url,
+		BindDN:         "cn=svc,dc=example,dc=com",
+		BindPassword:   "svc-secret",
+		BaseDN:         "dc=example,dc=com",
+		UserFilter:     defaultLDAPUserFilter,
+		EmailAttribute: defaultLDAPEmailAttribute,
+		GroupBaseDN:    "ou=groups,dc=example,dc=com",
+		GroupFilter:    defaultLDAPGroupFilter,
+		GroupAttribute: defaultLDAPGroupAttribute,
+		Timeout:        5,
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	_, config := newTestLDAPConfig(t)
+	provider := NewLDAPProvider(config)
+
+	identity, err := provider.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if identity.Provider != identityProviderLDAP || identity.Username != "alice" || identity.Email != "alice@example.com" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if strings.Join(identity.Groups, ",") != "devs,ops" {
+		t.Errorf("groups = %v, want [devs ops]", identity.Groups)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "alice", "guess"},
+		{"empty password", "alice", ""},
+		{"unknown user", "mallory", "secret"},
+		{"ambiguous user", "bob", "secret"},
+		{"filter injection", "*", "alice-secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := provider.Authenticate(tc.username, tc.password); err != ErrUnauthenticated {
+				t.Errorf("Authenticate() error = %v, want %v", err, ErrUnauthenticated)
+			}
+		})
+	}
+}
+
+func TestLDAPServiceBindFailure(t *testing.T) {
+	_, config := newTestLDAPConfig(t)
+	config.BindPassword = "expired"
+
+	//It's not the user to blame
+	if _, err := NewLDAPProvider(config).Authenticate("alice", "alice-secret"); err == nil || err == ErrUnauthenticated {
+		t.Errorf("Authenticate() error = %v, want the bind error", err)
+	}
+}
+
+func TestLoginWithLDAP(t *testing.T) {
+	newTestAPIHandler(t)
+	stub, config := newTestLDAPConfig(t)
+	Config.Identity.LDAP = config
+	auth := NewAuthenticator(NewMemoryStateStore())
+	if err := auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := auth.Login("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if user.Provider != identityProviderLDAP || strings.Join(user.Groups, ",") != "devs,ops" {
+		t.Errorf("user = %+v", user)
+	}
+
+	//Cached, the directory is not hit again
+	binds := stub.bindCount()
+	if _, err := auth.Login("alice", "alice-secret"); err != nil {
+		t.Fatalf("Login() error = %v on the cached login", err)
+	}
+	if stub.bindCount() != binds {
+		t.Errorf("cached login binds the directory again")
+	}
+
+	if _, err := auth.Login("alice", "guess"); err != ErrUnauthenticated {
+		t.Errorf("Login() error = %v with the wrong password", err)
+	}
+}
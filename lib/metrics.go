@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"registry-factory/metrics"
+	"strconv"
+	"time"
+)
+
+const (
+	//metricsPath is scraped by Prometheus
+	metricsPath = "/metrics"
+
+	scheduleWarm = "warm"
+	scheduleCold = "cold"
+
+	destroyReasonIdle     = "idle"
+	destroyReasonEvicted  = "evicted"
+	destroyReasonDead     = "dead"
+	destroyReasonOutdated = "outdated"
+	destroyReasonUnready  = "unready"
+	destroyReasonShutdown = "shutdown"
+	destroyReasonOrphan   = "orphan"
+	destroyReasonForced   = "forced"
+
+	imageGCSweeper    = "sweeper"
+	imageGCReconciler = "reconciler"
+)
+
+//The metrics of the proxy, scheduler, runtimes and builds
+var (
+	metricRequests = metrics.NewCounter("chameleon_requests_total",
+		"Registry requests served by the proxy.", "registry_type", "command", "status")
+	metricRequestDuration = metrics.NewHistogram("chameleon_request_duration_seconds",
+		"Latency of the registry requests served by the proxy.", nil, "registry_type", "command", "status")
+	metricSchedules = metrics.NewCounter("chameleon_schedules_total",
+		"Scheduled runtimes, warm ones are reused from the pool and cold ones are started.", "registry_type", "kind")
+	metricRuntimeStart = metrics.NewHistogram("chameleon_runtime_start_duration_seconds",
+		"Latency of starting the runtime containers.", nil, "registry_type")
+	metricRuntimeReadiness = metrics.NewHistogram("chameleon_runtime_readiness_duration_seconds",
+		"Latency of the started runtimes becoming ready.", nil, "registry_type", "ready")
+	metricRuntimes = metrics.NewGauge("chameleon_runtimes",
+		"Runtimes in the pool by status.", "registry_type", "status")
+	metricRuntimesDestroyed = metrics.NewCounter("chameleon_runtimes_destroyed_total",
+		"Destroyed runtimes by the reason.", "registry_type", "reason")
+	metricBuildDuration = metrics.NewHistogram("chameleon_build_duration_seconds",
+		"Duration of building (and pushing) the package images.", nil, "registry_type", "kind")
+	metricBuildFailures = metrics.NewCounter("chameleon_build_failures_total",
+		"Failed attempts of building (and pushing) the package images.", "registry_type", "kind")
+	metricImageStoreSize = metrics.NewGauge("chameleon_image_store_images",
+		"Reusable session images in the image store.")
+	metricImageGC = metrics.NewCounter("chameleon_image_gc_total",
+		"Images removed by the garbage collection.", "collector", "outcome")
+)
+
+//observeRequest records the served registry request
+func observeRequest(meta RequestMeta, status int, started time.Time) {
+	registryType := meta.RegistryType
+	if !meta.HasHit || len(registryType) == 0 {
+		registryType = "none"
+	}
+	command := meta.Metadata["command"]
+	if len(command) == 0 {
+		command = "none"
+	}
+	code := strconv.Itoa(status)
+
+	metricRequests.Inc(registryType, command, code)
+	metricRequestDuration.Observe(time.Since(started).Seconds(), registryType, command, code)
+}
+
+//observeBuild records the build attempt of the policy
+func observeBuild(policy *BuildPolicy, started time.Time, err error) {
+	kind := auditCommandBuild
+	if policy.NeedPush {
+		kind = auditCommandPush
+	}
+
+	metricBuildDuration.Observe(time.Since(started).Seconds(), policy.RegistryType, kind)
+	if err != nil {
+		metricBuildFailures.Inc(policy.RegistryType, kind)
+	}
+}
+
+//observeImageGC records the image removed by the garbage collection
+func observeImageGC(collector string, err error) {
+	outcome := "removed"
+	if err != nil {
+		outcome = "failed"
+	}
+
+	metricImageGC.Inc(collector, outcome)
+}
+
+//collectPoolMetrics refreshes the gauges of the runtimes and images on every scrape
+func (s *Scheduler) collectPoolMetrics() {
+	metricRuntimes.OnCollect(func(g *metrics.GaugeVec) {
+		for _, r := range s.pool.Live() {
+			status := "idle"
+			if r.InFlight > 0 {
+				status = "serving"
+			}
+			g.Add(1, r.RegistryType, status)
+		}
+	})
+	metricImageStoreSize.OnCollect(func(g *metrics.GaugeVec) {
+		g.Set(float64(s.imageStore.Size()))
+	})
+}
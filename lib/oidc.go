@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOIDCUsernameClaim = "preferred_username"
+	defaultOIDCGroupsClaim   = "groups"
+	defaultOIDCPollInterval  = 5 //seconds
+
+	grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+var (
+	//ErrLoginPending is returned when the user has not finished the login
+	ErrLoginPending = errors.New("login is pending")
+	//ErrLoginNotFound is returned when the login session does not exist or is expired
+	ErrLoginNotFound = errors.New("login session not found")
+)
+
+//oidcDiscovery is the part of the openid configuration of issuer
+type oidcDiscovery struct {
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	UserinfoEndpoint            string `json:"userinfo_endpoint"`
+}
+
+//DeviceLogin is the login session of the device code flow
+type DeviceLogin struct {
+	ID                      string `json:"id"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	//Seconds between the polls
+	Interval   int   `json:"interval"`
+	ExpireTime int64 `json:"expire_time"`
+	deviceCode string
+}
+
+//OIDCProvider logs in the users with the device code flow of the OIDC issuer,
+//the identity is read from the userinfo endpoint with the issued access token.
+type OIDCProvider struct {
+	config    *OIDCConfig
+	client    *http.Client
+	lock      *sync.Mutex
+	discovery *oidcDiscovery
+	logins    map[string]*DeviceLogin
+}
+
+//NewOIDCProvider ...
+func NewOIDCProvider(config *OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.Insecure},
+			},
+		},
+		lock:   new(sync.Mutex),
+		logins: make(map[string]*DeviceLogin),
+	}
+}
+
+//StartLogin requests the device code from the issuer
+func (op *OIDCProvider) StartLogin() (*DeviceLogin, error) {
+	discovery, err := op.discover()
+	if err != nil {
+		return nil, err
+	}
+	if len(discovery.DeviceAuthorizationEndpoint) == 0 {
+		return nil, errors.New("device code flow is not supported by the oidc issuer")
+	}
+
+	res := &struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{}
+	form := op.clientForm()
+	form.Set("scope", strings.Join(op.config.Scopes, " "))
+	if err := op.postForm(discovery.DeviceAuthorizationEndpoint, form, res); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	if res.Interval <= 0 {
+		res.Interval = defaultOIDCPollInterval
+	}
+	login := &DeviceLogin{
+		ID:                      hex.EncodeToString(buf),
+		UserCode:                res.UserCode,
+		VerificationURI:         res.VerificationURI,
+		VerificationURIComplete: res.VerificationURIComplete,
+		Interval:                res.Interval,
+		ExpireTime:              time.Now().Unix() + int64(res.ExpiresIn),
+		deviceCode:              res.DeviceCode,
+	}
+
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	now := time.Now().Unix()
+	for k, v := range op.logins {
+		if now >= v.ExpireTime {
+			delete(op.logins, k)
+		}
+	}
+	op.logins[login.ID] = login
+
+	return login, nil
+}
+
+//GetLogin gets the login session
+func (op *OIDCProvider) GetLogin(ID string) (*DeviceLogin, error) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	login, ok := op.logins[ID]
+	if !ok || time.Now().Unix() >= login.ExpireTime {
+		delete(op.logins, ID)
+		return nil, ErrLoginNotFound
+	}
+
+	return login, nil
+}
+
+//PollLogin checks whether the user has finished the login,
+//ErrLoginPending is returned with the seconds to poll again if not.
+func (op *OIDCProvider) PollLogin(ID string) (*Identity, int, error) {
+	login, err := op.GetLogin(ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	discovery, err := op.discover()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res := &struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}{}
+	form := op.clientForm()
+	form.Set("grant_type", grantTypeDeviceCode)
+	form.Set("device_code", login.deviceCode)
+	if err := op.postForm(discovery.TokenEndpoint, form, res); err != nil && len(res.Error) == 0 {
+		return nil, 0, err
+	}
+
+	switch res.Error {
+	case "":
+	case "authorization_pending":
+		return nil, login.Interval, ErrLoginPending
+	case "slow_down":
+		op.lock.Lock()
+		login.Interval += 5
+		op.lock.Unlock()
+		return nil, login.Interval, ErrLoginPending
+	default:
+		//access_denied or expired_token
+		op.lock.Lock()
+		delete(op.logins, ID)
+		op.lock.Unlock()
+		return nil, 0, fmt.Errorf("oidc login failed: %s", res.Error)
+	}
+
+	op.lock.Lock()
+	delete(op.logins, ID)
+	op.lock.Unlock()
+
+	identity, err := op.userinfo(discovery.UserinfoEndpoint, res.AccessToken)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return identity, 0, nil
+}
+
+//userinfo reads the identity from the userinfo endpoint
+func (op *OIDCProvider) userinfo(endpoint, accessToken string) (*Identity, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	claims := make(map[string]interface{})
+	if err := op.do(req, &claims); err != nil {
+		return nil, err
+	}
+
+	username, _ := claims[op.config.UsernameClaim].(string)
+	if len(username) == 0 {
+		return nil, fmt.Errorf("no claim %s in the userinfo", op.config.UsernameClaim)
+	}
+	email, _ := claims["email"].(string)
+
+	identity := &Identity{
+		Provider: identityProviderOIDC,
+		Username: username,
+		Email:    email,
+		Groups:   make([]string, 0),
+	}
+	switch groups := claims[op.config.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = append(identity.Groups, groups)
+	}
+
+	return identity, nil
+}
+
+//discover the endpoints of issuer, it's cached once succeeded
+func (op *OIDCProvider) discover() (*oidcDiscovery, error) {
+	op.lock.Lock()
+	discovery := op.discovery
+	op.lock.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(op.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery = &oidcDiscovery{}
+	if err := op.do(req, discovery); err != nil {
+		return nil, err
+	}
+	if len(discovery.TokenEndpoint) == 0 || len(discovery.UserinfoEndpoint) == 0 {
+		return nil, errors.New("no token or userinfo endpoint of the oidc issuer")
+	}
+
+	op.lock.Lock()
+	op.discovery = discovery
+	op.lock.Unlock()
+
+	return discovery, nil
+}
+
+func (op *OIDCProvider) clientForm() url.Values {
+	form := url.Values{}
+	form.Set("client_id", op.config.ClientID)
+	if len(op.config.ClientSecret) > 0 {
+		form.Set("client_secret", op.config.ClientSecret)
+	}
+
+	return form
+}
+
+//postForm posts the form and decodes the JSON response, the error response is decoded too
+func (op *OIDCProvider) postForm(endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	return op.do(req, v)
+}
+
+func (op *OIDCProvider) do(req *http.Request, v interface{}) error {
+	res, err := op.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	//The errors of oauth are JSON too
+	decodeErr := json.Unmarshal(data, v)
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("oidc issuer responded %d to %s: %s", res.StatusCode, req.URL.Path, strings.TrimSpace(string(data)))
+	}
+
+	return decodeErr
+}
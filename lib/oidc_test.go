@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeIssuer serves the discovery, device authorization, token and userinfo endpoints of an OIDC issuer
+type fakeIssuer struct {
+	lock sync.Mutex
+	url  string
+	//Token endpoint answers the errors in order, then the access token
+	pending  []string
+	claims   map[string]interface{}
+	noDevice bool
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	fi := &fakeIssuer{
+		claims: map[string]interface{}{
+			"sub":                "248289761001",
+			"preferred_username": "carol",
+			"email":              "carol@example.com",
+			"groups":             []string{"devs", "release"},
+		},
+	}
+	server := httptest.NewServer(fi)
+	t.Cleanup(server.Close)
+	fi.url = server.URL
+
+	return fi
+}
+
+func (fi *fakeIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		discovery := map[string]string{
+			"issuer":            fi.url,
+			"token_endpoint":    fi.url + "/token",
+			"userinfo_endpoint": fi.url + "/userinfo",
+		}
+		if !fi.noDevice {
+			discovery["device_authorization_endpoint"] = fi.url + "/device"
+		}
+		json.NewEncoder(w).Encode(discovery)
+	case "/device":
+		if r.PostFormValue("client_id") != "chameleon" || r.PostFormValue("scope") != "openid groups" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":               "device-code-1",
+			"user_code":                 "WDJB-MJHT",
+			"verification_uri":          fi.url + "/activate",
+			"verification_uri_complete": fi.url + "/activate?user_code=WDJB-MJHT",
+			"expires_in":                600,
+			"interval":                  1,
+		})
+	case "/token":
+		if r.PostFormValue("grant_type") != grantTypeDeviceCode || r.PostFormValue("device_code") != "device-code-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if len(fi.pending) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fi.pending[0]})
+			fi.pending = fi.pending[1:]
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-token-1", "token_type": "Bearer", "expires_in": 3600})
+	case "/userinfo":
+		if r.Header.Get("Authorization") != "Bearer access-token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(fi.claims)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestOIDCProvider(fi *fakeIssuer) *OIDCProvider {
+	return NewOIDCProvider(&OIDCConfig{
+		Enabled:       true,
+		Issuer:        fi.url + "/",
+		ClientID:      "chameleon",
+		Scopes:        []string{"openid", "groups"},
+		UsernameClaim: defaultOIDCUsernameClaim,
+		GroupsClaim:   defaultOIDCGroupsClaim,
+	})
+}
+
+func TestOIDCDeviceLogin(t *testing.T) {
+	fi := newFakeIssuer(t)
+	fi.pending = []string{"authorization_pending", "slow_down"}
+	provider := newTestOIDCProvider(fi)
+
+	login, err := provider.StartLogin()
+	if err != nil {
+		t.Fatalf("StartLogin() error = %v", err)
+	}
+	if login.UserCode != "WDJB-MJHT" || !strings.HasSuffix(login.VerificationURI, "/activate") || login.Interval != 1 {
+		t.Errorf("login = %+v", login)
+	}
+
+	if _, interval, err := provider.PollLogin(login.ID); err != ErrLoginPending || interval != 1 {
+		t.Fatalf("PollLogin() = %d, %v, want pending", interval, err)
+	}
+	//Slow down adds 5 seconds to the interval
+	if _, interval, err := provider.PollLogin(login.ID); err != ErrLoginPending || interval != 6 {
+		t.Fatalf("PollLogin() = %d, %v, want pending with slowed down interval", interval, err)
+	}
+
+	identity, _, err := provider.PollLogin(login.ID)
+	if err != nil {
+		t.Fatalf("PollLogin() error = %v", err)
+	}
+	if identity.Provider != identityProviderOIDC || identity.Username != "carol" || identity.Email != "carol@example.com" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if strings.Join(identity.Groups, ",") != "devs,release" {
+		t.Errorf("groups = %v, want [devs release]", identity.Groups)
+	}
+
+	//The session is done
+	if _, _, err := provider.PollLogin(login.ID); err != ErrLoginNotFound {
+		t.Errorf("PollLogin() error = %v after login, want %v", err, ErrLoginNotFound)
+	}
+}
+
+func TestOIDCDeviceLoginDenied(t *testing.T) {
+	fi := newFakeIssuer(t)
+	fi.pending = []string{"access_denied"}
+	provider := newTestOIDCProvider(fi)
+
+	login, err := provider.StartLogin()
+	if err != nil {
+		t.Fatalf("StartLogin() error = %v", err)
+	}
+	if _, _, err := provider.PollLogin(login.ID); err == nil || err == ErrLoginPending {
+		t.Fatalf("PollLogin() error = %v, want denied", err)
+	}
+	if _, err := provider.GetLogin(login.ID); err != ErrLoginNotFound {
+		t.Errorf("denied login is kept: %v", err)
+	}
+}
+
+func TestOIDCUserinfoClaims(t *testing.T) {
+	fi := newFakeIssuer(t)
+	fi.claims = map[string]interface{}{"preferred_username": "dave", "groups": "ops"}
+	provider := newTestOIDCProvider(fi)
+
+	login, err := provider.StartLogin()
+	if err != nil {
+		t.Fatalf("StartLogin() error = %v", err)
+	}
+	identity, _, err := provider.PollLogin(login.ID)
+	if err != nil {
+		t.Fatalf("PollLogin() error = %v", err)
+	}
+	//A single group may be a string
+	if identity.Username != "dave" || strings.Join(identity.Groups, ",") != "ops" {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	fi.lock.Lock()
+	fi.claims = map[string]interface{}{"sub": "248289761001"}
+	fi.lock.Unlock()
+	login, err = provider.StartLogin()
+	if err != nil {
+		t.Fatalf("StartLogin() error = %v", err)
+	}
+	if _, _, err := provider.PollLogin(login.ID); err == nil {
+		t.Error("PollLogin() succeeded without the username claim")
+	}
+}
+
+func TestOIDCWithoutDeviceFlow(t *testing.T) {
+	fi := newFakeIssuer(t)
+	fi.noDevice = true
+
+	if _, err := newTestOIDCProvider(fi).StartLogin(); err == nil {
+		t.Error("StartLogin() succeeded with the issuer not supporting the device code flow")
+	}
+}
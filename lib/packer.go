@@ -1,10 +1,13 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"registry-factory/client"
+	"registry-factory/logger"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //Packer ...
@@ -12,67 +15,114 @@ type Packer struct {
 	hostOn    string
 	docker    *client.DockerClient
 	harbor    string
-	namespace string
+	provision *HarborProvisioner
+	layers    *LayerBuilder
+	artifacts *ArtifactBuilder
 }
 
 //NewPacker ...
-func NewPacker(dockerdHost string, dockerdPort uint, harborHost string) *Packer {
+func NewPacker(dockerdHost string, dockerdPort uint, harborHost string, provision *HarborProvisioner) *Packer {
 	dHost := ""
 	if dockerdPort > 0 {
 		dHost = fmt.Sprintf("tcp://%s:%d", dockerdHost, dockerdPort)
 	}
 
-	return &Packer{
-		hostOn: dockerdHost,
-		docker: &client.DockerClient{
-			Host: dHost,
-		},
-		harbor: harborHost,
+	docker := &client.DockerClient{
+		Host: dHost,
 	}
-}
+	registry := newHarborRegistry(provision.RepositoryCredential)
 
-//SetNamespace ...
-func (p *Packer) SetNamespace(ns string) {
-	if len(ns) > 0 {
-		p.namespace = ns
+	return &Packer{
+		hostOn:    dockerdHost,
+		docker:    docker,
+		harbor:    harborHost,
+		provision: provision,
+		layers:    NewLayerBuilder(docker, harborHost, registry),
+		artifacts: NewArtifactBuilder(docker, harborHost, registry),
 	}
 }
 
-//Build ...
-func (p *Packer) Build(baseContainer string, image, tag string) error {
+//Build the image with the published artifacts in the base container and push it to the harbor namespace.
+//By default the whole container is snapshotted with docker commit,
+//the 'layer' builder only adds the artifacts as a new layer on the base image instead.
+//In the artifact mode, the package files are pushed as an OCI artifact rather than an image.
+//The logs of build carry the ID of the publishing request.
+func (p *Packer) Build(ctx context.Context, baseContainer string, registryType, namespace, image, tag string, labels map[string]string, requestID string) (err error) {
+	ctx, span := startSpan(ctx, "Packer.Build",
+		attribute.String("base_container", baseContainer),
+		attribute.String("namespace", namespace),
+		attribute.String("image", image),
+		attribute.String("tag", tag),
+	)
+	defer func() { endSpan(span, err) }()
+
 	if len(baseContainer) == 0 {
 		return errors.New("empty base container")
 	}
+	if len(namespace) == 0 {
+		return errors.New("empty namespace")
+	}
 
 	newTag := tag
 	if len(newTag) == 0 {
 		newTag = "latest"
 	}
 
-	fullNamespace := fmt.Sprintf("%s/%s/%s", p.harbor, p.namespace, image)
-	if err := p.docker.Commit(baseContainer, fullNamespace, newTag); err != nil {
+	//Create the missing project on the first publish
+	if err := p.provision.EnsureNamespace(namespace); err != nil {
+		return fmt.Errorf("provision harbor namespace %s error: %s", namespace, err)
+	}
+
+	if Config.Build.Mode == packageModeArtifact {
+		return p.artifacts.Build(ctx, baseContainer, registryType, namespace, image, newTag, requestID)
+	}
+
+	if Config.Build.Builder == builderLayer {
+		return p.layers.Build(ctx, baseContainer, registryType, namespace, image, newTag, labels, requestID)
+	}
+
+	docker := p.docker.WithRequest(requestID)
+	if Config.Harbor.Robot.Enabled {
+		//Logged in with the robot account of namespace, not shared with the builds of other namespaces
+		docker.ConfigDir = robotDockerConfig(namespace)
+	}
+	fullNamespace := fmt.Sprintf("%s/%s/%s", p.harbor, namespace, image)
+	err = traceStep(ctx, "docker commit", func() error {
+		return docker.Commit(baseContainer, fullNamespace, newTag, labels)
+	})
+	if err != nil {
 		return err
 	}
 
 	//login
-	if err := p.docker.Login(Config.Dockerd.Admin, Config.Dockerd.Password, p.harbor); err != nil {
+	username, password := p.provision.Credential(namespace)
+	err = traceStep(ctx, "docker login", func() error {
+		return docker.Login(username, password, p.harbor)
+	})
+	if err != nil {
 		return err
 	}
 	backendImage := fmt.Sprintf("%s:%s", fullNamespace, newTag)
-	if err := p.docker.Push(backendImage); err != nil {
+	err = traceStep(ctx, "docker push", func() error {
+		return docker.Push(backendImage)
+	})
+	if err != nil {
 		return err
 	}
 
 	//Just try to remove local image
-	if err := p.docker.RMImage(backendImage); err != nil {
-		log.Printf("rm image error: %s\n", err)
+	rmErr := traceStep(ctx, "docker rmi", func() error {
+		return docker.RMImage(backendImage)
+	})
+	if rmErr != nil {
+		logger.WithRequest(requestID).Infof("rm image error: %s", rmErr)
 	}
 
 	return nil
 }
 
 //BuildLocal ...
-func (p *Packer) BuildLocal(baseContainer string, image, tag string) error {
+func (p *Packer) BuildLocal(ctx context.Context, baseContainer string, image, tag string, labels map[string]string, requestID string) error {
 	if len(baseContainer) == 0 {
 		return errors.New("empty base container")
 	}
@@ -81,7 +131,9 @@ func (p *Packer) BuildLocal(baseContainer string, image, tag string) error {
 	if len(newTag) == 0 {
 		newTag = "latest"
 	}
-	return p.docker.Commit(baseContainer, image, newTag)
+	return traceStep(ctx, "docker commit", func() error {
+		return p.docker.WithRequest(requestID).Commit(baseContainer, image, newTag, labels)
+	})
 }
 
 //RMImage remove the specified image
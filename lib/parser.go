@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"registry-factory/logger"
 	"strconv"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -24,6 +27,8 @@ type RequestMeta struct {
 	RegistryType string
 	HasHit       bool
 	Metadata     map[string]string
+	//ID of the inbound request, see X-Request-ID
+	RequestID string
 }
 
 type npmPackMeta struct {
@@ -58,7 +63,7 @@ func PipParser(req *http.Request) (RequestMeta, error) {
 				}
 				pkg = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
 			}
-			fmt.Printf("DEBUG: PIP install pkg: %s\n", pkg)
+			logger.Debugf("PIP install pkg: %s", pkg)
 			meta.RegistryType = registryTypePip
 			meta.HasHit = true
 			meta.Metadata = map[string]string{
@@ -154,6 +159,9 @@ type parserWrapper struct {
 
 //Parse ...
 func (pc *ParserChain) Parse(req *http.Request) (RequestMeta, error) {
+	_, span := startSpan(req.Context(), "ParserChain.Parse")
+	defer span.End()
+
 	if pc.head == nil {
 		return RequestMeta{}, errors.New("no parsers")
 	}
@@ -165,6 +173,10 @@ func (pc *ParserChain) Parse(req *http.Request) (RequestMeta, error) {
 			errs = append(errs, err.Error())
 		} else {
 			if meta.HasHit {
+				span.SetAttributes(
+					attribute.String("registry_type", meta.RegistryType),
+					attribute.String("command", meta.Metadata["command"]),
+				)
 				if len(meta.Metadata["full_command"]) > 0 {
 					pc.commandList.Log(meta.Metadata["full_command"])
 				}
@@ -177,6 +189,7 @@ func (pc *ParserChain) Parse(req *http.Request) (RequestMeta, error) {
 	}
 
 	//No hit
+	span.SetAttributes(attribute.Bool("hit", false))
 	return RequestMeta{}, fmt.Errorf("%s:%s", "no hit", strings.Join(errs, ";"))
 }
 
@@ -1,26 +1,45 @@
 package lib
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"registry-factory/logger"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	idleThreshold     = 300 //seconds
-	statusServing     = "serving"
-	statusIdle        = "Idle"
-	statusDestroyed   = "Destroyed"
-	maxLenOfDestroyed = 100
+	defaultIdleThreshold = 300 //seconds
+	statusServing        = "serving"
+	statusIdle           = "Idle"
+	statusDestroyed      = "Destroyed"
+	statusCrashed        = "Crashed"
+	maxLenOfDestroyed    = 100
 )
 
+//ErrRuntimeNotFound is returned when no runtime in the pool has the ID
+var ErrRuntimeNotFound = errors.New("runtime not found")
+
 //Runtime ...
 type Runtime struct {
-	ID         string      `json:"id"`
-	Target     ProxyTarget `json:"target"`
-	ActiveTime int64       `json:"active_time"`
-	Status     string      `json:"status"`
-	Image      string      `json:"container_image"`
+	ID           string      `json:"id"`
+	Target       ProxyTarget `json:"target"`
+	ActiveTime   int64       `json:"active_time"`
+	Status       string      `json:"status"`
+	Image        string      `json:"container_image"`
+	RegistryType string      `json:"registry_type"`
+	//Number of the requests being served
+	InFlight int `json:"in_flight"`
+	//Number of the requests served
+	Hits        uint64 `json:"hits"`
+	CreatedTime int64  `json:"created_time"`
+	//Pinned runtime is never evicted
+	Pinned bool `json:"pinned"`
+	//Stale runtime runs an outdated image, it's destroyed once it's idle
+	Stale bool `json:"stale"`
 }
 
 //RuntimePool ...
@@ -28,27 +47,49 @@ type RuntimePool struct {
 	pool          map[string]*Runtime
 	destroyedOnes []*Runtime
 	destroyedPtr  uint16
+	crashes       map[string]int
+	idleThreshold int64
+	ttls          map[string]int64
+	pinnedImages  map[string]bool
+	store         StateStore
 	lock          *sync.RWMutex
+	//pending writes of the runtimes (nil to delete) by keys, they're persisted out of the pool lock
+	pending     map[string]*Runtime
+	pendingLock *sync.Mutex
+	flushLock   *sync.Mutex
+	closed      bool
+	wake        chan struct{}
+	done        chan struct{}
 }
 
 //NewRuntimePool ...
-func NewRuntimePool() *RuntimePool {
-	return &RuntimePool{
+//ttls are the max lifetimes of runtimes per registry type,
+//runtimes of the pinned images are never evicted.
+func NewRuntimePool(idleThreshold int64, ttls map[string]int64, pinnedImages []string, store StateStore) *RuntimePool {
+	pinned := make(map[string]bool)
+	for _, image := range pinnedImages {
+		pinned[image] = true
+	}
+
+	rp := &RuntimePool{
+		idleThreshold: idleThreshold,
+		ttls:          ttls,
+		pinnedImages:  pinned,
+		store:         store,
 		pool:          make(map[string]*Runtime),
 		destroyedOnes: make([]*Runtime, 0, maxLenOfDestroyed),
 		destroyedPtr:  0,
+		crashes:       make(map[string]int),
 		lock:          new(sync.RWMutex),
+		pending:       make(map[string]*Runtime),
+		pendingLock:   new(sync.Mutex),
+		flushLock:     new(sync.Mutex),
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
 	}
-}
-
-//Index ...
-func (rp *RuntimePool) Index(key string) (*Runtime, bool) {
-	rp.lock.RLock()
-	defer rp.lock.RUnlock()
+	go rp.writeBehind()
 
-	r, ok := rp.pool[key]
-
-	return r, ok
+	return rp
 }
 
 //Put ...
@@ -62,11 +103,65 @@ func (rp *RuntimePool) Put(key string, r *Runtime) error {
 
 	//Set status
 	r.Status = statusServing
+	r.InFlight = 1
+	r.Hits = 1
+	r.CreatedTime = time.Now().Unix()
+	if rp.pinnedImages[r.Image] {
+		r.Pinned = true
+	}
 	rp.pool[key] = r
+	rp.persist(key, r)
 
 	return nil
 }
 
+//Adopt the running runtime found on the docker daemon as an idle one
+func (rp *RuntimePool) Adopt(key string, r *Runtime) error {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if _, ok := rp.pool[key]; ok {
+		return fmt.Errorf("%s existing", key)
+	}
+
+	r.Status = statusIdle
+	r.InFlight = 0
+	if r.CreatedTime == 0 {
+		r.CreatedTime = time.Now().Unix()
+	}
+	if rp.pinnedImages[r.Image] {
+		r.Pinned = true
+	}
+	rp.pool[key] = r
+	rp.persist(key, r)
+
+	return nil
+}
+
+//Load the runtimes from the state store, they're treated as idle ones
+func (rp *RuntimePool) Load() (map[string]*Runtime, error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	loaded := make(map[string]*Runtime)
+	err := rp.store.List(bucketRuntimes, func(key string, data []byte) error {
+		r := &Runtime{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return err
+		}
+
+		//No request is being served after restarting
+		r.Status = statusIdle
+		r.InFlight = 0
+		rp.pool[key] = r
+		loaded[key] = r
+
+		return nil
+	})
+
+	return loaded, err
+}
+
 //Use ...
 func (rp *RuntimePool) Use(key string) (*Runtime, error) {
 	rp.lock.Lock()
@@ -77,87 +172,463 @@ func (rp *RuntimePool) Use(key string) (*Runtime, error) {
 		//Update active time
 		r.ActiveTime = time.Now().Unix()
 		r.Status = statusServing
+		r.InFlight++
+		r.Hits++
+		rp.persist(key, r)
 		return r, nil
 	}
 
 	return r, fmt.Errorf("%s not existing", key)
 }
 
-//Remove ...
-//NOT used yet
-func (rp *RuntimePool) Remove(prefix, ID string) error {
+//Garbages removes the idle and outdated runtimes from pool and returns them with their keys
+func (rp *RuntimePool) Garbages() map[string]*Runtime {
 	rp.lock.Lock()
 	defer rp.lock.Unlock()
 
-	if _, ok := rp.pool[giveMeKey(prefix, ID)]; ok {
-		delete(rp.pool, giveMeKey(prefix, ID))
+	garbages := make(map[string]*Runtime)
+	now := time.Now().Unix()
+	for k, v := range rp.pool {
+		if v.Status != statusIdle || (v.Pinned && !v.Stale) {
+			continue
+		}
+
+		ttl, hasTTL := rp.ttls[v.RegistryType]
+		if v.Stale || now >= v.ActiveTime+rp.idleThreshold || (hasTTL && ttl > 0 && now >= v.CreatedTime+ttl) {
+			//Garbage
+			garbages[k] = v
+			rp.destroy(k, v)
+		}
 	}
 
-	return nil
+	return garbages
 }
 
-//Garbages ...
-func (rp *RuntimePool) Garbages() []*Runtime {
+//Victims evicts at most count idle runtimes of the registry type (any type if it's empty)
+//in the order of the eviction policy, they're returned with their keys
+func (rp *RuntimePool) Victims(policy EvictionPolicy, count int, registryType string) map[string]*Runtime {
 	rp.lock.Lock()
 	defer rp.lock.Unlock()
 
-	var garbages []*Runtime
-	now := time.Now().Unix()
+	if count <= 0 {
+		return nil
+	}
+
+	keys := make([]string, 0)
 	for k, v := range rp.pool {
-		if v.Status == statusIdle && now >= v.ActiveTime+idleThreshold {
-			//Garbage
-			garbages = append(garbages, v)
-			delete(rp.pool, k) //removed from pool
-
-			v.Status = statusDestroyed
-			//Keep in the destroyed list for a while
-			if len(rp.destroyedOnes) < maxLenOfDestroyed {
-				rp.destroyedOnes = append(rp.destroyedOnes, v)
-			} else {
-				//override
-				if rp.destroyedPtr < maxLenOfDestroyed {
-					rp.destroyedOnes[rp.destroyedPtr] = v
-				} else {
-					//back to the start
-					rp.destroyedPtr = 0
-					rp.destroyedOnes[rp.destroyedPtr] = v
-				}
-
-				rp.destroyedPtr++
+		if v.Status == statusIdle && !v.Pinned && (len(registryType) == 0 || v.RegistryType == registryType) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return policy.Before(rp.pool[keys[i]], rp.pool[keys[j]])
+	})
+
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+
+	victims := make(map[string]*Runtime, len(keys))
+	for _, k := range keys {
+		v := rp.pool[k]
+		victims[k] = v
+		rp.destroy(k, v)
+	}
+
+	return victims
+}
+
+//Expire the matched runtimes, the idle ones are removed from pool and returned with their keys,
+//the serving ones are marked stale and swept as garbages once they're idle.
+func (rp *RuntimePool) Expire(match func(r *Runtime) bool) map[string]*Runtime {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	expired := make(map[string]*Runtime)
+	for k, v := range rp.pool {
+		if !match(v) {
+			continue
+		}
+
+		if v.Status == statusIdle {
+			expired[k] = v
+			rp.destroy(k, v)
+			continue
+		}
+
+		v.Stale = true
+		rp.persist(k, v)
+	}
+
+	return expired
+}
+
+//PinByID pins or unpins the runtime with the container ID, returns a copy of the runtime
+func (rp *RuntimePool) PinByID(ID string, pinned bool) (Runtime, error) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for k, v := range rp.pool {
+		if v.ID == ID {
+			v.Pinned = pinned
+			rp.persist(k, v)
+			return *v, nil
+		}
+	}
+
+	return Runtime{}, ErrRuntimeNotFound
+}
+
+//Size returns the number of runtimes in the pool
+func (rp *RuntimePool) Size() int {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+
+	return len(rp.pool)
+}
+
+//Destroy removes the runtime with the key from pool
+func (rp *RuntimePool) Destroy(key string) (*Runtime, bool) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	r, ok := rp.pool[key]
+	if !ok {
+		return nil, false
+	}
+
+	rp.destroy(key, r)
+
+	return r, true
+}
+
+//DestroyByID removes the runtime with the container ID from pool even if it's serving, returns its key
+func (rp *RuntimePool) DestroyByID(ID string) (string, *Runtime, bool) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for k, v := range rp.pool {
+		if v.ID == ID {
+			rp.destroy(k, v)
+			return k, v, true
+		}
+	}
+
+	return "", nil, false
+}
+
+//Restore the removed runtime whose container is failed to destroy, it fails if the key is taken meanwhile
+func (rp *RuntimePool) Restore(key string, r *Runtime) error {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if _, ok := rp.pool[key]; ok {
+		return fmt.Errorf("%s existing", key)
+	}
+
+	for i, v := range rp.destroyedOnes {
+		if v == r {
+			rp.destroyedOnes = append(rp.destroyedOnes[:i], rp.destroyedOnes[i+1:]...)
+			if int(rp.destroyedPtr) > i {
+				rp.destroyedPtr--
 			}
+			break
 		}
 	}
+	r.Status = statusIdle
+	if r.InFlight > 0 {
+		r.Status = statusServing
+	}
+	rp.pool[key] = r
+	rp.persist(key, r)
 
-	return garbages
+	return nil
+}
+
+//Evict the runtime with the key as it's crashed
+func (rp *RuntimePool) Evict(key string) (*Runtime, bool) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	r, ok := rp.pool[key]
+	if !ok {
+		return nil, false
+	}
+
+	rp.evict(key, r)
+
+	return r, true
 }
 
-//GetAll runtimes as a list
-func (rp *RuntimePool) GetAll() []*Runtime {
+//EvictByID evicts the runtime with the container ID as it's crashed
+func (rp *RuntimePool) EvictByID(ID string) (*Runtime, bool) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	for k, v := range rp.pool {
+		if v.ID == ID {
+			rp.evict(k, v)
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+//Live returns the copies of the runtimes in the pool with their keys
+func (rp *RuntimePool) Live() map[string]*Runtime {
 	rp.lock.RLock()
 	defer rp.lock.RUnlock()
 
-	list := make([]*Runtime, 0)
+	live := make(map[string]*Runtime)
+	for k, v := range rp.pool {
+		r := *v
+		live[k] = &r
+	}
+
+	return live
+}
+
+//Crashes returns the crash counts per image
+func (rp *RuntimePool) Crashes() map[string]int {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+
+	crashes := make(map[string]int)
+	for k, v := range rp.crashes {
+		crashes[k] = v
+	}
+
+	return crashes
+}
+
+//GetAll runtimes as a list of copies
+func (rp *RuntimePool) GetAll() []Runtime {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+
+	list := make([]Runtime, 0)
 	for _, v := range rp.pool {
-		list = append(list, v)
+		list = append(list, *v)
 	}
 
 	for _, v := range rp.destroyedOnes {
-		list = append(list, v)
+		list = append(list, *v)
 	}
 
 	return list
 }
 
-//SetIdle ...
-func (rp *RuntimePool) SetIdle(key string) {
+//Query returns the copies of the runtimes matched by the filter, including the destroyed ones.
+//The runtimes are in the order of the creation, newest first, and paged by the offset and limit of filter.
+//Returns the page and the total number of the matched runtimes.
+func (rp *RuntimePool) Query(filter *RuntimeFilter) ([]Runtime, int) {
+	rp.lock.RLock()
+	matched := make([]Runtime, 0)
+	for _, v := range rp.pool {
+		if filter.match(v) {
+			matched = append(matched, *v)
+		}
+	}
+	for _, v := range rp.destroyedOnes {
+		if filter.match(v) {
+			matched = append(matched, *v)
+		}
+	}
+	rp.lock.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedTime != matched[j].CreatedTime {
+			return matched[i].CreatedTime > matched[j].CreatedTime
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	total := len(matched)
+	if filter.Offset >= total {
+		return []Runtime{}, total
+	}
+	matched = matched[filter.Offset:]
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+
+	return matched, total
+}
+
+//Hold the runtime to keep it serving, e.g: used as a base container of build
+func (rp *RuntimePool) Hold(key string) {
 	rp.lock.Lock()
 	defer rp.lock.Unlock()
 
 	if runtime, ok := rp.pool[key]; ok {
-		runtime.Status = statusIdle
+		runtime.InFlight++
+		runtime.Status = statusServing
+		rp.persist(key, runtime)
 	}
 }
 
-func giveMeKey(prefix, ID string) string {
-	return fmt.Sprintf("%s:%s", prefix, ID)
+//Release the runtime used by a request, it becomes idle once no request is using it
+func (rp *RuntimePool) Release(key string) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if runtime, ok := rp.pool[key]; ok {
+		if runtime.InFlight > 0 {
+			runtime.InFlight--
+		}
+		if runtime.InFlight == 0 {
+			runtime.Status = statusIdle
+			//Idle time counts from now
+			runtime.ActiveTime = time.Now().Unix()
+		}
+		rp.persist(key, runtime)
+	}
+}
+
+func (rp *RuntimePool) destroy(key string, r *Runtime) {
+	delete(rp.pool, key) //removed from pool
+	rp.forget(key)
+	r.Status = statusDestroyed
+	rp.keepDestroyed(r)
+}
+
+func (rp *RuntimePool) evict(key string, r *Runtime) {
+	delete(rp.pool, key)
+	rp.forget(key)
+	r.Status = statusCrashed
+	rp.crashes[r.Image]++
+	rp.keepDestroyed(r)
+}
+
+//Flush the pending writes to the state store, the writes of a key are coalesced to the latest one
+func (rp *RuntimePool) Flush() {
+	rp.flushLock.Lock()
+	defer rp.flushLock.Unlock()
+
+	rp.pendingLock.Lock()
+	pending := rp.pending
+	rp.pending = make(map[string]*Runtime)
+	rp.pendingLock.Unlock()
+
+	for key, r := range pending {
+		if r == nil {
+			if err := rp.store.Delete(bucketRuntimes, key); err != nil {
+				logger.Errorf("Failed to delete runtime %s from state store: %s", key, err)
+			}
+			continue
+		}
+		if err := rp.store.Put(bucketRuntimes, key, r); err != nil {
+			logger.Errorf("Failed to persist runtime %s: %s", key, err)
+		}
+	}
+}
+
+//Close stops writing behind and flushes the pending writes,
+//the later writes are flushed at once, e.g: destroying the runtimes at shutdown.
+func (rp *RuntimePool) Close() {
+	rp.pendingLock.Lock()
+	if rp.closed {
+		rp.pendingLock.Unlock()
+		return
+	}
+	rp.closed = true
+	rp.pendingLock.Unlock()
+
+	close(rp.done)
+	rp.Flush()
+}
+
+//writeBehind flushes the pending writes in background, so the requests are not serialized on disk I/O
+func (rp *RuntimePool) writeBehind() {
+	for {
+		select {
+		case <-rp.wake:
+			rp.Flush()
+		case <-rp.done:
+			return
+		}
+	}
+}
+
+//persist writes the snapshot of runtime to the state store behind
+func (rp *RuntimePool) persist(key string, r *Runtime) {
+	snapshot := *r
+	rp.writeLater(key, &snapshot)
+}
+
+//forget removes the runtime from the state store behind
+func (rp *RuntimePool) forget(key string) {
+	rp.writeLater(key, nil)
+}
+
+func (rp *RuntimePool) writeLater(key string, r *Runtime) {
+	rp.pendingLock.Lock()
+	rp.pending[key] = r
+	closed := rp.closed
+	rp.pendingLock.Unlock()
+
+	if closed {
+		rp.Flush()
+		return
+	}
+	select {
+	case rp.wake <- struct{}{}:
+	default:
+		//Flushing soon
+	}
+}
+
+//keepDestroyed keeps the removed runtime in the destroyed list for a while
+func (rp *RuntimePool) keepDestroyed(r *Runtime) {
+	if len(rp.destroyedOnes) < maxLenOfDestroyed {
+		rp.destroyedOnes = append(rp.destroyedOnes, r)
+		return
+	}
+
+	//override
+	if rp.destroyedPtr >= maxLenOfDestroyed {
+		//back to the start
+		rp.destroyedPtr = 0
+	}
+	rp.destroyedOnes[rp.destroyedPtr] = r
+	rp.destroyedPtr++
+}
+
+//RuntimeFilter selects the runtimes, the empty fields match all
+type RuntimeFilter struct {
+	ID           string
+	Status       string
+	RegistryType string
+	//Image with tag, or all the tags of image if the tag is missing
+	Image  string
+	Offset int
+	Limit  int
+}
+
+//RuntimePage is a page of the queried runtimes
+type RuntimePage struct {
+	//Total number of the matched runtimes
+	Total    int       `json:"total"`
+	Offset   int       `json:"offset"`
+	Limit    int       `json:"limit"`
+	Runtimes []Runtime `json:"runtimes"`
+}
+
+func (f *RuntimeFilter) match(r *Runtime) bool {
+	if len(f.ID) > 0 && r.ID != f.ID {
+		return false
+	}
+	//The status of the serving runtimes is in lower case
+	if len(f.Status) > 0 && !strings.EqualFold(r.Status, f.Status) {
+		return false
+	}
+	if len(f.RegistryType) > 0 && r.RegistryType != f.RegistryType {
+		return false
+	}
+	if len(f.Image) > 0 && r.Image != f.Image && !strings.HasPrefix(r.Image, f.Image+":") {
+		return false
+	}
+
+	return true
 }
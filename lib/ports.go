@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPortMin   = 30000
+	defaultPortMax   = 65530
+	portProbeTimeout = 200 * time.Millisecond
+)
+
+//ErrNoFreePort is returned when all the ports in the range are leased or in use
+var ErrNoFreePort = errors.New("no free port on host")
+
+//PortAllocator leases the host ports to the runtimes.
+//The leased ports are tracked per host and probed before given out.
+type PortAllocator struct {
+	lock   *sync.Mutex
+	min    int
+	max    int
+	rand   *rand.Rand
+	leases map[string]map[int]bool
+	probe  func(host string, port int) bool
+}
+
+//NewPortAllocator ...
+func NewPortAllocator(min, max int) *PortAllocator {
+	return &PortAllocator{
+		lock:   new(sync.Mutex),
+		min:    min,
+		max:    max,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		leases: make(map[string]map[int]bool),
+		probe:  isPortInUse,
+	}
+}
+
+//Lease a free port on the host
+func (pa *PortAllocator) Lease(host string) (int, error) {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+
+	leased, ok := pa.leases[host]
+	if !ok {
+		leased = make(map[int]bool)
+		pa.leases[host] = leased
+	}
+
+	size := pa.max - pa.min + 1
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid port range %d-%d", pa.min, pa.max)
+	}
+
+	//Start from a random offset and scan the whole range
+	start := pa.rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := pa.min + (start+i)%size
+		if leased[port] {
+			continue
+		}
+
+		if pa.probe(host, port) {
+			continue
+		}
+
+		leased[port] = true
+		return port, nil
+	}
+
+	return 0, ErrNoFreePort
+}
+
+//Reserve the port already used by a runtime on the host
+func (pa *PortAllocator) Reserve(host string, port int) {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+
+	leased, ok := pa.leases[host]
+	if !ok {
+		leased = make(map[int]bool)
+		pa.leases[host] = leased
+	}
+	leased[port] = true
+}
+
+//Release the ports leased on the host
+func (pa *PortAllocator) Release(host string, ports ...int) {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+
+	leased, ok := pa.leases[host]
+	if !ok {
+		return
+	}
+
+	for _, port := range ports {
+		delete(leased, port)
+	}
+}
+
+//Leased returns the number of ports leased on the host
+func (pa *PortAllocator) Leased(host string) int {
+	pa.lock.Lock()
+	defer pa.lock.Unlock()
+
+	return len(pa.leases[host])
+}
+
+//isPortInUse checks whether something is listening on the port of host
+func isPortInUse(host string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", port)), portProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"net"
+	"testing"
+)
+
+//withProbe makes the ports in use on the host without listening on them
+func withProbe(pa *PortAllocator, inUse map[int]bool) *PortAllocator {
+	pa.probe = func(host string, port int) bool { return inUse[port] }
+
+	return pa
+}
+
+func TestPortLease(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		min      int
+		max      int
+		inUse    map[int]bool
+		reserved []int
+		leased   []int
+	}{
+		{"whole range", 30000, 30002, nil, nil, []int{30000, 30001, 30002}},
+		{"in use", 30000, 30003, map[int]bool{30001: true, 30003: true}, nil, []int{30000, 30002}},
+		{"reserved", 30000, 30002, nil, []int{30002}, []int{30000, 30001}},
+		{"single port", 30000, 30000, nil, nil, []int{30000}},
+		{"all in use", 30000, 30001, map[int]bool{30000: true, 30001: true}, nil, []int{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pa := withProbe(NewPortAllocator(tc.min, tc.max), tc.inUse)
+			for _, port := range tc.reserved {
+				pa.Reserve("127.0.0.1", port)
+			}
+
+			leased := map[int]bool{}
+			for range tc.leased {
+				port, err := pa.Lease("127.0.0.1")
+				if err != nil {
+					t.Fatalf("Lease() error = %v", err)
+				}
+				if leased[port] {
+					t.Fatalf("port %d is leased twice", port)
+				}
+				leased[port] = true
+			}
+			for _, port := range tc.leased {
+				if !leased[port] {
+					t.Errorf("port %d is not leased, got %v", port, leased)
+				}
+			}
+
+			//Exhausted
+			if _, err := pa.Lease("127.0.0.1"); err != ErrNoFreePort {
+				t.Errorf("Lease() error = %v, want %v", err, ErrNoFreePort)
+			}
+			if n := pa.Leased("127.0.0.1"); n != len(tc.leased)+len(tc.reserved) {
+				t.Errorf("%d ports leased, want %d", n, len(tc.leased)+len(tc.reserved))
+			}
+		})
+	}
+}
+
+func TestPortRelease(t *testing.T) {
+	pa := withProbe(NewPortAllocator(30000, 30001), nil)
+	first, err := pa.Lease("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pa.Lease("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Leased per host
+	if _, err := pa.Lease("10.0.0.2"); err != nil {
+		t.Errorf("Lease() on another host error = %v", err)
+	}
+
+	pa.Release("10.0.0.1", first)
+	if port, err := pa.Lease("10.0.0.1"); err != nil || port != first {
+		t.Errorf("Lease() = %d, %v, want the released port %d", port, err, first)
+	}
+
+	pa.Release("10.0.0.1", first, second)
+	//Unknown host and ports are ignored
+	pa.Release("10.0.0.3", first)
+	pa.Release("10.0.0.1", 40000)
+	if n := pa.Leased("10.0.0.1"); n != 0 {
+		t.Errorf("%d ports leased after release, want 0", n)
+	}
+	if n := pa.Leased("10.0.0.2"); n != 1 {
+		t.Errorf("%d ports leased on another host, want 1", n)
+	}
+}
+
+func TestPortInvalidRange(t *testing.T) {
+	pa := withProbe(NewPortAllocator(30001, 30000), nil)
+	if _, err := pa.Lease("127.0.0.1"); err == nil || err == ErrNoFreePort {
+		t.Errorf("Lease() error = %v, want the invalid range", err)
+	}
+}
+
+func TestIsPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	if !isPortInUse("127.0.0.1", port) {
+		t.Errorf("listening port %d is not in use", port)
+	}
+
+	l.Close()
+	if isPortInUse("127.0.0.1", port) {
+		t.Errorf("closed port %d is in use", port)
+	}
+
+	//Skipped by the lease
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port = l.Addr().(*net.TCPAddr).Port
+	pa := NewPortAllocator(port, port)
+	if _, err := pa.Lease("127.0.0.1"); err != ErrNoFreePort {
+		t.Errorf("Lease() error = %v, want the listening port skipped", err)
+	}
+}
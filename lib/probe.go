@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"registry-factory/client"
+	"time"
+)
+
+const (
+	probeTypeHTTP = "http"
+	probeTypeTCP  = "tcp"
+	probeTypeExec = "exec"
+
+	defaultProbePeriod   = 1  //seconds
+	defaultProbeDeadline = 30 //seconds
+)
+
+//ProbeConfig defines how to check the readiness of the runtimes
+type ProbeConfig struct {
+	//http, tcp or exec
+	Type string `yaml:"type"`
+	//For http probe
+	Path           string `yaml:"path"`
+	ExpectedStatus int    `yaml:"expected_status"`
+	//For exec probe
+	Command []string `yaml:"command"`
+	//seconds
+	InitialDelay int `yaml:"initial_delay"`
+	Period       int `yaml:"period"`
+	Deadline     int `yaml:"deadline"`
+}
+
+//Validate the probe config and fill the defaults
+func (pc *ProbeConfig) Validate(defaultPath string) error {
+	if len(pc.Type) == 0 {
+		pc.Type = probeTypeHTTP
+	}
+
+	switch pc.Type {
+	case probeTypeHTTP:
+		if len(pc.Path) == 0 {
+			pc.Path = defaultPath
+		}
+		if pc.ExpectedStatus == 0 {
+			pc.ExpectedStatus = http.StatusOK
+		}
+	case probeTypeTCP:
+	case probeTypeExec:
+		if len(pc.Command) == 0 {
+			return errors.New("exec probe requires a command")
+		}
+	default:
+		return fmt.Errorf("probe type '%s' is not supported", pc.Type)
+	}
+
+	if pc.InitialDelay < 0 {
+		return errors.New("probe initial delay should not be negative")
+	}
+
+	if pc.Period <= 0 {
+		pc.Period = defaultProbePeriod
+	}
+
+	if pc.Deadline <= 0 {
+		pc.Deadline = defaultProbeDeadline
+	}
+
+	return nil
+}
+
+//Prober checks whether the runtime is ready
+type Prober struct {
+	config     *ProbeConfig
+	docker     *client.DockerClient
+	httpClient *http.Client
+}
+
+//NewProber ...
+func NewProber(config *ProbeConfig, docker *client.DockerClient) *Prober {
+	return &Prober{
+		config: config,
+		docker: docker,
+		httpClient: &http.Client{
+			Timeout: time.Duration(config.Period) * time.Second,
+		},
+	}
+}
+
+//WaitReady blocks until the runtime is ready or the deadline is reached
+func (p *Prober) WaitReady(ctx context.Context, runtimeID, host string, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.config.Deadline)*time.Second)
+	defer cancel()
+
+	if p.config.InitialDelay > 0 {
+		select {
+		case <-time.After(time.Duration(p.config.InitialDelay) * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("runtime %s is not ready: %s", runtimeID, ctx.Err())
+		}
+	}
+
+	tk := time.NewTicker(time.Duration(p.config.Period) * time.Second)
+	defer tk.Stop()
+
+	var lastErr error
+	for {
+		if lastErr = p.check(runtimeID, host, port); lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-tk.C:
+		case <-ctx.Done():
+			return fmt.Errorf("runtime %s is not ready in %d seconds: %s", runtimeID, p.config.Deadline, lastErr)
+		}
+	}
+}
+
+func (p *Prober) check(runtimeID, host string, port int) error {
+	switch p.config.Type {
+	case probeTypeTCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", port)), time.Duration(p.config.Period)*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case probeTypeExec:
+		return p.docker.Exec(runtimeID, p.config.Command)
+	default:
+		url := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, fmt.Sprintf("%d", port)), p.config.Path)
+		res, err := p.httpClient.Get(url)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != p.config.ExpectedStatus {
+			return fmt.Errorf("checking %s: expect %d but got %s", url, p.config.ExpectedStatus, res.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,421 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"registry-factory/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bucketBindings = "bindings"
+
+	roleReader     = "reader"
+	rolePublisher  = "publisher"
+	roleMaintainer = "maintainer"
+	roleAdmin      = "admin"
+)
+
+var (
+	//ErrBindingNotFound is returned when the role binding does not exist
+	ErrBindingNotFound = errors.New("role binding not found")
+	//ErrBindingFromConfig is returned when deleting the binding bootstrapped from the config
+	ErrBindingFromConfig = errors.New("role binding is from the config")
+)
+
+//roleRanks orders the roles, the higher one includes the lower ones
+var roleRanks = map[string]int{
+	roleReader:     1,
+	rolePublisher:  2,
+	roleMaintainer: 3,
+	roleAdmin:      4,
+}
+
+//RoleBinding grants the role to the user or the group in the scope,
+//the empty scope fields match anything.
+type RoleBinding struct {
+	ID    string `json:"id"`
+	Role  string `json:"role"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	//npm or pip
+	RegistryType string `json:"registry_type,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	//Glob of the package names, e.g: @team/*
+	Package string `json:"package,omitempty"`
+	//Bootstrapped from the config
+	FromConfig  bool  `json:"from_config"`
+	CreatedTime int64 `json:"created_time"`
+}
+
+//Resource is what the request acts on, the management API is the empty one
+type Resource struct {
+	RegistryType string
+	Namespace    string
+	Package      string
+}
+
+//RBAC keeps the role bindings and resolves the roles of users on the resources
+type RBAC struct {
+	lock     *sync.RWMutex
+	bindings map[string]*RoleBinding
+	store    StateStore
+}
+
+//NewRBAC ...
+func NewRBAC(store StateStore) *RBAC {
+	return &RBAC{
+		lock:     new(sync.RWMutex),
+		bindings: make(map[string]*RoleBinding),
+		store:    store,
+	}
+}
+
+//Load the role bindings from the state store, the bindings in config replace the bootstrapped ones
+func (rb *RBAC) Load() error {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	err := rb.store.List(bucketBindings, func(key string, data []byte) error {
+		binding := &RoleBinding{}
+		if err := json.Unmarshal(data, binding); err != nil {
+			return err
+		}
+		rb.bindings[key] = binding
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for ID, b := range rb.bindings {
+		if b.FromConfig {
+			delete(rb.bindings, ID)
+			rb.deleteBinding(ID)
+		}
+	}
+	for i, c := range Config.RBAC.Bindings {
+		binding := c.binding()
+		binding.ID = fmt.Sprintf("config-%d", i)
+		binding.FromConfig = true
+		binding.CreatedTime = time.Now().Unix()
+		rb.bindings[binding.ID] = binding
+		rb.persistBinding(binding)
+	}
+
+	return nil
+}
+
+//AddBinding validates and adds the role binding
+func (rb *RBAC) AddBinding(binding *RoleBinding) (*RoleBinding, error) {
+	if err := validateBinding(binding); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	b := *binding
+	b.ID = hex.EncodeToString(buf)
+	b.FromConfig = false
+	b.CreatedTime = time.Now().Unix()
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	rb.bindings[b.ID] = &b
+	rb.persistBinding(&b)
+
+	return &b, nil
+}
+
+//Bindings lists the role bindings, filtered by the user or group if it's not empty
+func (rb *RBAC) Bindings(user, group string) []*RoleBinding {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	bindings := make([]*RoleBinding, 0, len(rb.bindings))
+	for _, b := range rb.bindings {
+		if (len(user) > 0 && b.User != user) || (len(group) > 0 && b.Group != group) {
+			continue
+		}
+		binding := *b
+		bindings = append(bindings, &binding)
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].CreatedTime != bindings[j].CreatedTime {
+			return bindings[i].CreatedTime < bindings[j].CreatedTime
+		}
+		return bindings[i].ID < bindings[j].ID
+	})
+
+	return bindings
+}
+
+//DeleteBinding deletes the role binding, the ones from the config can't be deleted
+func (rb *RBAC) DeleteBinding(ID string) error {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	binding, ok := rb.bindings[ID]
+	if !ok {
+		return ErrBindingNotFound
+	}
+	if binding.FromConfig {
+		return ErrBindingFromConfig
+	}
+	delete(rb.bindings, ID)
+	rb.deleteBinding(ID)
+
+	return nil
+}
+
+//DeleteUserBindings deletes the bindings of the deleted user
+func (rb *RBAC) DeleteUserBindings(user string) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	for ID, b := range rb.bindings {
+		if b.User == user && !b.FromConfig {
+			delete(rb.bindings, ID)
+			rb.deleteBinding(ID)
+		}
+	}
+}
+
+//Role returns the highest role granted to the user or its groups on the resource, empty if none
+func (rb *RBAC) Role(user string, groups []string, res Resource) string {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	granted := ""
+	for _, b := range rb.bindings {
+		if roleRanks[b.Role] > roleRanks[granted] && b.matches(user, groups, res) {
+			granted = b.Role
+		}
+	}
+
+	return granted
+}
+
+func (rb *RBAC) persistBinding(binding *RoleBinding) {
+	if err := rb.store.Put(bucketBindings, binding.ID, binding); err != nil {
+		logger.Errorf("Failed to persist role binding %s: %s", binding.ID, err)
+	}
+}
+
+func (rb *RBAC) deleteBinding(ID string) {
+	if err := rb.store.Delete(bucketBindings, ID); err != nil {
+		logger.Errorf("Failed to delete role binding %s from state store: %s", ID, err)
+	}
+}
+
+//matches checks the subject and scope of binding
+func (b *RoleBinding) matches(user string, groups []string, res Resource) bool {
+	if len(b.User) > 0 {
+		if b.User != user {
+			return false
+		}
+	} else if !containsString(groups, b.Group) {
+		return false
+	}
+
+	if len(b.RegistryType) > 0 && b.RegistryType != res.RegistryType {
+		return false
+	}
+	if len(b.Namespace) > 0 && b.Namespace != res.Namespace {
+		return false
+	}
+	if len(b.Package) > 0 {
+		//Package scoped bindings never match the requests of no package, e.g: search
+		if len(res.Package) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(b.Package, res.Package); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validateBinding(binding *RoleBinding) error {
+	if _, ok := roleRanks[binding.Role]; !ok {
+		return fmt.Errorf("invalid role '%s'", binding.Role)
+	}
+	if (len(binding.User) == 0) == (len(binding.Group) == 0) {
+		return errors.New("either user or group is required by role binding")
+	}
+	switch binding.RegistryType {
+	case "", registryTypeNpm, registryTypePip:
+	default:
+		return fmt.Errorf("invalid registry type '%s' of role binding", binding.RegistryType)
+	}
+	if _, err := path.Match(binding.Package, ""); err != nil {
+		return fmt.Errorf("invalid package glob '%s': %s", binding.Package, err)
+	}
+
+	return nil
+}
+
+//requiredRole returns the role required by the parsed request, the higher one of the method and path
+//and the command. The command is told by the client in the Referer header, so it never lowers the role.
+func requiredRole(method string, meta RequestMeta) string {
+	role := roleReader
+	if meta.RegistryType == registryTypeNpm {
+		switch meta.Metadata["command"] {
+		case "publish":
+			role = rolePublisher
+		case "unpublish", "deprecate", "dist-tag", "owner", "access":
+			role = roleMaintainer
+		}
+	}
+
+	if byRequest := requestRole(method, meta); roleRanks[byRequest] > roleRanks[role] {
+		return byRequest
+	}
+
+	return role
+}
+
+//requestRole returns the role required by the method and path of request,
+//the writes need publisher and the deletes and changes of the package metadata need maintainer
+func requestRole(method string, meta RequestMeta) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return roleReader
+	}
+	if meta.RegistryType != registryTypeNpm {
+		return rolePublisher
+	}
+
+	p := strings.SplitN(meta.Metadata["path"], "?", 2)[0]
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	//Logging in and auditing are done by any users
+	for _, prefix := range []string{"/-/user/", "/-/v1/login", "/-/npm/v1/security/"} {
+		if strings.HasPrefix(p, prefix) {
+			return roleReader
+		}
+	}
+	if method == http.MethodDelete || strings.Contains(p, "/-rev/") {
+		return roleMaintainer
+	}
+	//e.g: /-/package/name/dist-tags/latest, /-/package/name/access or /-/team/org/team/package
+	if strings.HasPrefix(p, "/-/") {
+		return roleMaintainer
+	}
+
+	return rolePublisher
+}
+
+//resourceOf returns the registry namespace and package of the parsed request
+func resourceOf(meta RequestMeta, registry *RegistryConfig) Resource {
+	res := Resource{
+		RegistryType: meta.RegistryType,
+		Namespace:    registry.Namespace,
+	}
+	switch meta.RegistryType {
+	case registryTypeNpm:
+		res.Package = npmPackageOf(meta.Metadata["path"])
+	case registryTypePip:
+		res.Package = meta.Metadata["package"]
+	}
+
+	return res
+}
+
+//npmPackageOf parses the package name from the request path, e.g:
+///@scope%2fname, /name/-/name-1.0.0.tgz or /-/package/name/dist-tags
+func npmPackageOf(rawPath string) string {
+	p := strings.SplitN(rawPath, "?", 2)[0]
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "/"), "-/package/")
+	if len(p) == 0 || strings.HasPrefix(p, "-/") {
+		return ""
+	}
+
+	segments := strings.Split(p, "/")
+	if strings.HasPrefix(p, "@") && len(segments) > 1 {
+		return segments[0] + "/" + segments[1]
+	}
+
+	return segments[0]
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+//migrateUserPermissions converts the namespace permissions of the stored users (schema 1) to role bindings
+func migrateUserPermissions(store StateStore) error {
+	roles := map[string]string{
+		"read":    roleReader,
+		"publish": rolePublisher,
+	}
+
+	users := make(map[string][]byte)
+	err := store.List(bucketUsers, func(key string, data []byte) error {
+		//Only valid in the transaction of bolt
+		users[key] = append([]byte(nil), data...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for username, data := range users {
+		stored := &struct {
+			Permissions map[string]string `json:"permissions"`
+		}{}
+		if err := json.Unmarshal(data, stored); err != nil {
+			return err
+		}
+		for ns, perm := range stored.Permissions {
+			role, ok := roles[perm]
+			if !ok {
+				continue
+			}
+			binding := &RoleBinding{
+				ID:          fmt.Sprintf("migrated-%s-%s", username, ns),
+				Role:        role,
+				User:        username,
+				Namespace:   ns,
+				CreatedTime: time.Now().Unix(),
+			}
+			if err := store.Put(bucketBindings, binding.ID, binding); err != nil {
+				return err
+			}
+		}
+
+		//Drop the permissions of the stored user
+		user := &User{}
+		if err := json.Unmarshal(data, user); err != nil {
+			return err
+		}
+		if err := store.Put(bucketUsers, username, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRequiredRole(t *testing.T) {
+	for _, tc := range []struct {
+		method       string
+		registryType string
+		path         string
+		command      string
+		role         string
+	}{
+		{http.MethodGet, registryTypeNpm, "/lodash", "install", roleReader},
+		{http.MethodGet, registryTypeNpm, "/-/package/lodash/dist-tags", "dist-tag", roleMaintainer},
+		{http.MethodHead, registryTypeNpm, "/lodash", "", roleReader},
+		{http.MethodPut, registryTypeNpm, "/lodash", "publish", rolePublisher},
+		{http.MethodPut, registryTypeNpm, "/@team%2flodash", "", rolePublisher},
+		{http.MethodPut, registryTypeNpm, "/-/user/org.couchdb.user:alice", "adduser", roleReader},
+		{http.MethodPost, registryTypeNpm, "/-/npm/v1/security/audits/quick", "audit", roleReader},
+		//The command is told by the client
+		{http.MethodPut, registryTypeNpm, "/lodash/-rev/3-abc", "publish", roleMaintainer},
+		{http.MethodPut, registryTypeNpm, "/@team%2flodash/-rev/3-abc", "", roleMaintainer},
+		{http.MethodDelete, registryTypeNpm, "/lodash/-/lodash-4.17.21.tgz/-rev/3-abc", "publish", roleMaintainer},
+		{http.MethodDelete, registryTypeNpm, "/lodash", "install", roleMaintainer},
+		{http.MethodPut, registryTypeNpm, "/-/package/lodash/dist-tags/latest", "publish", roleMaintainer},
+		{http.MethodPost, registryTypeNpm, "/-/package/lodash/access", "install", roleMaintainer},
+		{http.MethodPut, registryTypeNpm, "/-/team/org/devs/package", "", roleMaintainer},
+		{http.MethodGet, registryTypePip, "/simple/requests/", "install", roleReader},
+		{http.MethodPost, registryTypePip, "/", "", rolePublisher},
+	} {
+		meta := RequestMeta{
+			RegistryType: tc.registryType,
+			HasHit:       true,
+			Metadata:     map[string]string{"path": tc.path, "command": tc.command},
+		}
+		if role := requiredRole(tc.method, meta); role != tc.role {
+			t.Errorf("%s %s (%s): role = %s, want %s", tc.method, tc.path, tc.command, role, tc.role)
+		}
+	}
+}
+
+func TestAuthorizeSpoofedCommand(t *testing.T) {
+	h := newTestAPIHandler(t)
+	Config.Auth.Enabled = true
+	Config.NpmRegistry.PublishAuth = "Basic cnVudGltZTpydW50aW1l"
+	hash, err := bcrypt.GenerateFromPassword([]byte("passw0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Auth.Users = []*UserConfig{{Username: "bob", PasswordHash: string(hash)}}
+	Config.RBAC.Bindings = []*RoleBindingConfig{{Role: rolePublisher, User: "bob", RegistryType: registryTypeNpm, Namespace: "npm"}}
+	if err := h.auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ps := &ProxyServer{auth: h.auth, audit: h.audit}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"publish", http.MethodPut, "/lodash", true},
+		{"unpublish", http.MethodDelete, "/lodash/-rev/3-abc", false},
+		{"dist-tag", http.MethodPut, "/-/package/lodash/dist-tags/latest", false},
+		{"deprecate", http.MethodPut, "/lodash/-rev/3-abc", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.Header.Set("User-Agent", "npm/8.19.2 node/v18.12.1")
+			//Spoofed, the publisher can publish
+			r.Header.Set("Referer", "publish")
+			r.SetBasicAuth("bob", "passw0rd")
+			meta, err := NpmParser(r)
+			if err != nil || !meta.HasHit {
+				t.Fatalf("NpmParser() = %+v, %v", meta, err)
+			}
+
+			_, err = ps.authorize(r, meta)
+			if tc.allowed {
+				if err != nil {
+					t.Fatalf("authorize() error = %v", err)
+				}
+				if r.Header.Get("Authorization") != Config.NpmRegistry.PublishAuth {
+					t.Error("request is not sent with the publish auth")
+				}
+				return
+			}
+			if _, ok := err.(*AuthError); !ok {
+				t.Fatalf("authorize() error = %v, want denied", err)
+			}
+			if r.Header.Get("Authorization") == Config.NpmRegistry.PublishAuth {
+				t.Error("denied request is sent with the publish auth")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"fmt"
+	"registry-factory/client"
+	"registry-factory/logger"
+	"strconv"
+	"time"
+)
+
+const (
+	labelOwner        = "io.chameleon.owner"
+	labelRegistryType = "io.chameleon.registry-type"
+	labelReuseKey     = "io.chameleon.reuse-key"
+	labelImage        = "io.chameleon.image"
+	labelCreated      = "io.chameleon.created"
+	labelOwnerValue   = "chameleon"
+
+	defaultReconcileInterval = 300   //seconds
+	defaultStaleImageAge     = 86400 //seconds
+)
+
+//ownerLabels are the labels of the objects created by chameleon
+func ownerLabels(registryType string) map[string]string {
+	return map[string]string{
+		labelOwner:        labelOwnerValue,
+		labelRegistryType: registryType,
+		labelCreated:      fmt.Sprintf("%d", time.Now().Unix()),
+	}
+}
+
+//runtimeLabels are the labels of the runtime containers
+func runtimeLabels(registryType, reuseKey, image string) map[string]string {
+	labels := ownerLabels(registryType)
+	labels[labelImage] = image
+	if len(reuseKey) > 0 {
+		labels[labelReuseKey] = reuseKey
+	}
+
+	return labels
+}
+
+//reconcileLoop reconciles the labelled objects on the docker daemon periodically
+func (s *Scheduler) reconcileLoop() {
+	defer func() {
+		logger.Infof("Reconciler exit")
+		s.doneChan <- struct{}{}
+	}()
+
+	tk := time.NewTicker(time.Duration(Config.Reconcile.Interval) * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-tk.C:
+			if err := s.Reconcile(); err != nil {
+				logger.Errorf("Reconcile error: %s", err)
+			}
+		case <-s.ctx.Done():
+			return
+		case <-s.exitChan:
+			return
+		}
+	}
+}
+
+//Reconcile the runtime pool with the labelled containers and images on the docker daemon.
+//The healthy containers are adopted into the pool, the orphans and stale images are removed.
+func (s *Scheduler) Reconcile() error {
+	owner := fmt.Sprintf("%s=%s", labelOwner, labelOwnerValue)
+	//Taken before listing, the runtimes put into pool afterwards are not taken as gone from the daemon
+	live := s.pool.Live()
+	containers, err := s.executor.docker.ListContainers(owner)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, r := range live {
+		known[r.ID] = true
+	}
+	//Nor are their containers taken as orphans
+	for _, r := range s.pool.Live() {
+		known[r.ID] = true
+	}
+
+	onDaemon := make(map[string]bool)
+	adopted, removed := 0, 0
+	for _, c := range containers {
+		onDaemon[c.ID] = true
+		if known[c.ID] || s.starting(c) {
+			continue
+		}
+
+		if r, key, ok := s.adoptable(c, live); ok {
+			if err := s.pool.Adopt(key, r); err == nil {
+				s.admission.Occupy(r.RegistryType)
+				if err := s.executor.Adopt(r.ID, r.Target); err != nil {
+					logger.Warnf("Failed to adopt ports of runtime %s: %s", r.ID, err)
+				}
+				live[key] = r
+				adopted++
+				continue
+			}
+		}
+
+		//Orphan
+		if err := s.executor.docker.Destroy(c.ID); err != nil {
+			logger.Warnf("Failed to remove orphan container %s: %s", c.ID, err)
+			continue
+		}
+		metricRuntimesDestroyed.Inc(c.Labels[labelRegistryType], destroyReasonOrphan)
+		removed++
+	}
+
+	//Runtimes in pool but gone from the daemon, by ID as the key may be taken by a new runtime meanwhile
+	for _, r := range live {
+		if onDaemon[r.ID] {
+			continue
+		}
+		if evicted, ok := s.pool.EvictByID(r.ID); ok {
+			s.recycle(evicted)
+		}
+	}
+
+	//Stale committed images
+	images, err := s.executor.docker.ListImages(owner)
+	if err != nil {
+		return err
+	}
+	staleImages := 0
+	for _, image := range images {
+		theImage := fmt.Sprintf("%s:%s", image.Repository, image.Tag)
+		if _, ok := s.imageStore.Get(theImage); ok {
+			continue
+		}
+		if time.Since(image.Created) < time.Duration(Config.Reconcile.StaleImageAge)*time.Second {
+			continue
+		}
+		err := s.packer.RMImage(theImage)
+		observeImageGC(imageGCReconciler, err)
+		if err != nil {
+			logger.Warnf("Failed to remove stale image %s: %s", theImage, err)
+			continue
+		}
+		staleImages++
+	}
+
+	logger.Infof("Reconciled: %d containers adopted, %d orphan containers and %d stale images removed", adopted, removed, staleImages)
+
+	return nil
+}
+
+//starting checks whether the container may be still starting and not put into the pool yet
+func (s *Scheduler) starting(c client.Container) bool {
+	created, err := strconv.ParseInt(c.Labels[labelCreated], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	grace := Config.NpmRegistry.Readiness.Deadline
+	if Config.PipRegistry.Readiness.Deadline > grace {
+		grace = Config.PipRegistry.Readiness.Deadline
+	}
+	grace += Config.NpmRegistry.Readiness.InitialDelay + Config.PipRegistry.Readiness.InitialDelay
+
+	return time.Now().Unix() < created+int64(grace)
+}
+
+//adoptable checks whether the labelled container can be adopted back into the pool
+func (s *Scheduler) adoptable(c client.Container, live map[string]*Runtime) (*Runtime, string, bool) {
+	if !c.Running {
+		return nil, "", false
+	}
+
+	registryType := c.Labels[labelRegistryType]
+	if registryType != registryTypeNpm && registryType != registryTypePip {
+		return nil, "", false
+	}
+
+	key := c.Labels[labelReuseKey]
+	if len(key) == 0 {
+		key = fmt.Sprintf("%s:%s", registryType, c.ID)
+	}
+	if _, taken := live[key]; taken {
+		return nil, "", false
+	}
+
+	//Runtimes only serve on the 1st bound port
+	hostPort := 0
+	for _, p := range c.Ports {
+		hostPort = p
+		break
+	}
+	if hostPort == 0 {
+		return nil, "", false
+	}
+
+	created, _ := strconv.ParseInt(c.Labels[labelCreated], 10, 64)
+	return &Runtime{
+		ID:           c.ID,
+		Target:       (ProxyTarget)(fmt.Sprintf("%s:%d", s.executor.hostOn, hostPort)),
+		ActiveTime:   time.Now().Unix(),
+		Image:        c.Labels[labelImage],
+		RegistryType: registryType,
+		CreatedTime:  created,
+	}, key, true
+}
@@ -2,19 +2,20 @@ package lib
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"registry-factory/client/harbor"
+	"registry-factory/logger"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	npmUserSessionTimeout = 3600 //seconds
+	defaultLivenessPeriod = 15   //seconds
 )
 
 //ProxyTarget ...
@@ -26,62 +27,166 @@ type Scheduler struct {
 	imageStore *ImageStore
 	executor   *Executor
 	packer     *Packer
+	harbor     *HarborProvisioner
+	existence  *ExistenceCache
+	admission  *AdmissionController
+	eviction   EvictionPolicy
 	ctx        context.Context
 	drivers    map[string]ScheduleDriver
 	exitChan   chan struct{}
 	doneChan   chan struct{}
+	loops      int
+	//starts are the runtimes being started by the reuse keys, closed once they're put into pool
+	starts    map[string]chan struct{}
+	startLock *sync.Mutex
 }
 
 //NewScheduler ...
-func NewScheduler(ctx context.Context) *Scheduler {
-	return &Scheduler{
-		pool:       NewRuntimePool(),
-		imageStore: NewImageStore(),
+func NewScheduler(ctx context.Context, store StateStore) *Scheduler {
+	s := &Scheduler{
+		pool: NewRuntimePool(
+			int64(Config.Scheduler.IdleThreshold),
+			map[string]int64{
+				registryTypeNpm: int64(Config.NpmRegistry.TTL),
+				registryTypePip: int64(Config.PipRegistry.TTL),
+			},
+			Config.Eviction.PinnedImages,
+			store,
+		),
+		imageStore: NewImageStore(store),
+		existence:  NewExistenceCache(int64(Config.Harbor.ExistenceTTL)),
 		executor:   NewExecutor(Config.Dockerd.Host, Config.Dockerd.Port, Config.Harbor.Host),
-		packer:     NewPacker(Config.Dockerd.Host, Config.Dockerd.Port, Config.Harbor.Host),
-		ctx:        ctx,
-		exitChan:   make(chan struct{}, 1),
-		doneChan:   make(chan struct{}, 1),
+		admission: NewAdmissionController(
+			Config.Scheduler.MaxRuntimes,
+			map[string]int{
+				registryTypeNpm: Config.NpmRegistry.MaxRuntimes,
+				registryTypePip: Config.PipRegistry.MaxRuntimes,
+			},
+			Config.Scheduler.QueueSize,
+			time.Duration(Config.Scheduler.QueueTimeout)*time.Second,
+		),
+		ctx:       ctx,
+		exitChan:  make(chan struct{}, 1),
+		doneChan:  make(chan struct{}, 1),
+		starts:    make(map[string]chan struct{}),
+		startLock: new(sync.Mutex),
+	}
+	s.admission.SetReclaimer(s.reclaim)
+	s.harbor = NewHarborProvisioner(store, s.loginRobot)
+	s.packer = NewPacker(Config.Dockerd.Host, Config.Dockerd.Port, Config.Harbor.Host, s.harbor)
+
+	return s
+}
+
+//Restore the runtimes and images from the state store
+func (s *Scheduler) Restore() error {
+	//Logged in before the runtimes are restored, so they're not recycled as the credential changes
+	if err := s.harbor.Load(); err != nil {
+		return err
+	}
+
+	if err := s.imageStore.Load(); err != nil {
+		return err
+	}
+
+	runtimes, err := s.pool.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range runtimes {
+		s.admission.Occupy(r.RegistryType)
+		if err := s.executor.Adopt(r.ID, r.Target); err != nil {
+			logger.Warnf("Failed to adopt runtime %s: %s", r.ID, err)
+		}
+	}
+	logger.Infof("Restore %d runtimes from state store", len(runtimes))
+
+	//Catch up with the docker daemon
+	if err := s.Reconcile(); err != nil {
+		logger.Errorf("Reconcile error: %s", err)
 	}
+
+	return nil
 }
 
 //Start ...
 func (s *Scheduler) Start() {
+	//Validated with the config
+	s.eviction, _ = NewEvictionPolicy(Config.Eviction.Policy)
+
+	//Admin credential is only used here, the robot accounts are used afterwards
+	s.harbor.Bootstrap(Config.NpmRegistry.Namespace, Config.PipRegistry.Namespace)
+
 	go s.sweepRuntimes()
 	go s.sweepImages()
+	go s.checkLiveness()
+	go s.watchDeaths()
+	go s.reconcileLoop()
+	go s.rotateRobots()
+	s.loops = 6
 
-	registryAPI := fmt.Sprintf("%s://%s/api", Config.Harbor.Protocol, Config.Harbor.Host)
 	s.drivers = make(map[string]ScheduleDriver)
-	s.drivers[registryTypeNpm] = NewNpmScheduleDriver(registryAPI, Config.NpmRegistry.Namespace)
-	s.drivers[registryTypePip] = NewPipScheduleDriver(registryAPI, Config.PipRegistry.Namespace)
+	s.drivers[registryTypeNpm] = NewNpmScheduleDriver(s.namespaceClient(Config.NpmRegistry.Namespace), s.existence, Config.NpmRegistry.Namespace)
+	s.drivers[registryTypePip] = NewPipScheduleDriver(s.namespaceClient(Config.PipRegistry.Namespace), Config.PipRegistry.Namespace)
+
+	s.collectPoolMetrics()
+
+	logger.Infof("Scheduler is started")
+}
+
+//namespaceClient creates the harbor client with the credential of namespace
+func (s *Scheduler) namespaceClient(namespace string) *harbor.Client {
+	return newHarborClient(func() (string, string) {
+		return s.harbor.Credential(namespace)
+	})
+}
+
+//loginRobot logs in harbor with the robot account of namespace for pulling the images of runtimes
+func (s *Scheduler) loginRobot(namespace, username, password string) {
+	if err := s.executor.Login(namespace, username, password); err != nil {
+		logger.Errorf("Failed to login harbor with robot account of namespace %s: %s", namespace, err)
+	}
+
+	//The artifact servers fetch with the credential given at start
+	s.recycleArtifactServers(namespace)
+}
+
+//rotateRobots rotates the robot accounts periodically
+func (s *Scheduler) rotateRobots() {
+	defer func() {
+		logger.Infof("Robot rotator exit")
+		s.doneChan <- struct{}{}
+	}()
+
+	tk := time.NewTicker(time.Duration(Config.Harbor.Robot.RotateInterval) * time.Second)
+	defer tk.Stop()
 
-	log.Println("Scheduler is started")
+	for {
+		select {
+		case <-tk.C:
+			s.harbor.Rotate()
+		case <-s.ctx.Done():
+			return
+		case <-s.exitChan:
+			return
+		}
+	}
 }
 
 func (s *Scheduler) sweepRuntimes() {
 	defer func() {
-		log.Println("Runtime sweeper exit")
+		logger.Infof("Runtime sweeper exit")
 		s.doneChan <- struct{}{}
 	}()
 
-	tk := time.NewTicker(30 * time.Second)
+	tk := time.NewTicker(time.Duration(Config.Eviction.SweepInterval) * time.Second)
 	defer tk.Stop()
 
 	for {
 		select {
 		case <-tk.C:
-			//Garbage collection
-			garbages := s.pool.Garbages()
-			if len(garbages) > 0 {
-				for _, v := range garbages {
-					//Clear
-					if err := s.executor.Destroy(v.ID); err != nil {
-						log.Fatalf("garbage collection %s error: %s\n", v.ID, err)
-					} else {
-						log.Printf("Destroy container instance: %s\n", v.ID)
-					}
-				}
-			}
+			s.CollectGarbages()
 		case <-s.ctx.Done():
 			return
 		case <-s.exitChan:
@@ -90,9 +195,89 @@ func (s *Scheduler) sweepRuntimes() {
 	}
 }
 
+//CollectGarbages destroys the idle and outdated runtimes and evicts more under pressure,
+//returns the IDs of the destroyed runtimes.
+func (s *Scheduler) CollectGarbages() []string {
+	//Garbage collection
+	destroyed := s.destroyRuntimes(s.pool.Garbages(), destroyReasonIdle)
+	//Evict more under pressure
+	if excess := s.pressure(); excess > 0 {
+		victims := s.pool.Victims(s.eviction, excess, "")
+		logger.Infof("Evict %d runtimes under pressure with policy %s", len(victims), s.eviction.Name())
+		destroyed = append(destroyed, s.destroyRuntimes(victims, destroyReasonEvicted)...)
+	}
+
+	return destroyed
+}
+
+//destroyRuntimes destroys the runtimes removed from pool, the ones failed to destroy are restored with their slots.
+//Returns the IDs of the destroyed ones.
+func (s *Scheduler) destroyRuntimes(runtimes map[string]*Runtime, reason string) []string {
+	destroyed := make([]string, 0, len(runtimes))
+	for k, v := range runtimes {
+		//Clear
+		if err := s.executor.Destroy(v.ID); err != nil {
+			logger.Errorf("garbage collection %s error: %s", v.ID, err)
+			s.restore(k, v)
+			continue
+		}
+		logger.Infof("Destroy container instance: %s", v.ID)
+		metricRuntimesDestroyed.Inc(v.RegistryType, reason)
+		s.admission.Release(v.RegistryType)
+		destroyed = append(destroyed, v.ID)
+	}
+
+	return destroyed
+}
+
+//reclaim evicts an idle runtime of the registry type (any type if it's empty) to admit a new one
+func (s *Scheduler) reclaim(registryType string) bool {
+	if s.eviction == nil {
+		//Not started
+		return false
+	}
+
+	victims := s.pool.Victims(s.eviction, 1, registryType)
+	if len(victims) == 0 {
+		return false
+	}
+	for _, v := range victims {
+		logger.Infof("Evict idle runtime %s with policy %s to admit a new one", v.ID, s.eviction.Name())
+	}
+
+	return len(s.destroyRuntimes(victims, destroyReasonEvicted)) > 0
+}
+
+//pressure returns how many runtimes should be evicted to relieve the pressure
+func (s *Scheduler) pressure() int {
+	excess := 0
+	live := s.pool.Size()
+	if max := Config.Eviction.MaxRuntimes; max > 0 && live > max {
+		excess = live - max
+	}
+
+	if watermark := Config.Eviction.MemoryWatermark; watermark > 0 && live > 0 {
+		usage, err := s.executor.MemoryUsage()
+		if err != nil {
+			logger.Warnf("Failed to get memory usage: %s", err)
+			return excess
+		}
+
+		if usage > watermark {
+			//Evict the share of runtimes over the watermark
+			n := int(float64(live)*(usage-watermark)/usage) + 1
+			if n > excess {
+				excess = n
+			}
+		}
+	}
+
+	return excess
+}
+
 func (s *Scheduler) sweepImages() {
 	defer func() {
-		log.Println("Image sweeper exit")
+		logger.Infof("Image sweeper exit")
 		s.doneChan <- struct{}{}
 	}()
 
@@ -106,9 +291,42 @@ func (s *Scheduler) sweepImages() {
 			if len(images) > 0 {
 				for _, image := range images {
 					theImage := fmt.Sprintf("%s:%s", image.Name, image.Tag)
-					if err := s.packer.RMImage(theImage); err != nil {
-						log.Printf("Failed to sweep outdated image '%s' with error:%s\n", theImage, err)
+					err := s.packer.RMImage(theImage)
+					if err != nil {
+						logger.Warnf("Failed to sweep outdated image '%s' with error:%s", theImage, err)
 					}
+					observeImageGC(imageGCSweeper, err)
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		case <-s.exitChan:
+			return
+		}
+	}
+}
+
+//checkLiveness checks the runtimes in the pool periodically
+func (s *Scheduler) checkLiveness() {
+	defer func() {
+		logger.Infof("Liveness checker exit")
+		s.doneChan <- struct{}{}
+	}()
+
+	tk := time.NewTicker(time.Duration(Config.Scheduler.LivenessPeriod) * time.Second)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-tk.C:
+			for key, r := range s.pool.Live() {
+				alive, err := s.executor.IsAlive(r.ID)
+				if err != nil {
+					logger.Warnf("Failed to check liveness of runtime %s: %s", r.ID, err)
+					continue
+				}
+				if !alive {
+					s.ReportFailure(key)
 				}
 			}
 		case <-s.ctx.Done():
@@ -119,36 +337,99 @@ func (s *Scheduler) sweepImages() {
 	}
 }
 
+//watchDeaths evicts the runtimes once their containers die
+func (s *Scheduler) watchDeaths() {
+	defer func() {
+		logger.Infof("Death watcher exit")
+		s.doneChan <- struct{}{}
+	}()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	for {
+		deaths, err := s.executor.Deaths(ctx)
+		if err != nil {
+			logger.Warnf("Failed to watch the runtime events: %s", err)
+		} else {
+			if exit := s.evictDeaths(deaths); exit {
+				return
+			}
+		}
+
+		//Stream is broken, re-watch later
+		select {
+		case <-time.After(5 * time.Second):
+		case <-s.ctx.Done():
+			return
+		case <-s.exitChan:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) evictDeaths(deaths <-chan string) bool {
+	for {
+		select {
+		case ID, ok := <-deaths:
+			if !ok {
+				return false
+			}
+			if r, ok := s.pool.EvictByID(ID); ok {
+				s.recycle(r)
+			}
+		case <-s.ctx.Done():
+			return true
+		case <-s.exitChan:
+			return true
+		}
+	}
+}
+
 //Stop scheduler
 func (s *Scheduler) Stop() {
-	defer log.Println("Scheduler is stopped")
-	//Stop 1st loop
-	s.exitChan <- struct{}{}
-	<-s.doneChan
-	//Stop 2nd loop
-	s.exitChan <- struct{}{}
-	<-s.doneChan
+	defer logger.Infof("Scheduler is stopped")
+	for i := 0; i < s.loops; i++ {
+		s.exitChan <- struct{}{}
+		<-s.doneChan
+	}
+	//The runtimes destroyed afterwards are persisted at once
+	s.pool.Close()
 }
 
 //Schedule ...
-func (s *Scheduler) Schedule(meta RequestMeta) (ServeEnvironment, error) {
+func (s *Scheduler) Schedule(ctx context.Context, meta RequestMeta) (_ ServeEnvironment, err error) {
+	ctx, span := startSpan(ctx, "Scheduler.Schedule", attribute.String("registry_type", meta.RegistryType))
+	defer func() { endSpan(span, err) }()
+
 	driver, ok := s.drivers[meta.RegistryType]
 	if !ok {
 		return ServeEnvironment{}, fmt.Errorf("registry type %s not support", meta.RegistryType)
 	}
 
-	policy := driver.Schedule(meta)
-	if len(policy.ReuseIdentity) > 0 {
+	log := logger.WithRequest(meta.RequestID)
+	policy := driver.Schedule(ctx, meta)
+	if policy == nil {
+		//Not a command the driver knows, serve it with the base image of the registry
+		if policy = defaultPolicy(meta.RegistryType); policy == nil {
+			return ServeEnvironment{}, fmt.Errorf("no runtime for the %s request", meta.RegistryType)
+		}
+	}
+	s.withArtifactCredential(policy)
+	policy.RequestID = meta.RequestID
+	if policy.Rebuild != nil {
+		policy.Rebuild.RequestID = meta.RequestID
+	}
+	for len(policy.ReuseIdentity) > 0 {
 		key := fmt.Sprintf("%s:%s", meta.RegistryType, policy.ReuseIdentity)
-		_, yes := s.pool.Index(key)
-		if yes {
-			r, err := s.pool.Use(key)
-			if err != nil {
-				return ServeEnvironment{}, err
-			}
-			log.Printf("Reuse %s: %s\n", r.ID, r.Target)
+		if r, err := s.pool.Use(key); err == nil {
+			log.Infof("Reuse %s: %s", r.ID, r.Target)
+			metricSchedules.Inc(meta.RegistryType, scheduleWarm)
+			span.SetAttributes(attribute.String("kind", scheduleWarm), attribute.String("runtime", r.ID))
 			if policy.Rebuild != nil {
 				policy.Rebuild.BaseContainer = r.ID
+				policy.Rebuild.RegistryType = meta.RegistryType
+				policy.Rebuild.InstanceKey = key
 			}
 			return ServeEnvironment{
 				Target:      r.Target,
@@ -156,20 +437,43 @@ func (s *Scheduler) Schedule(meta RequestMeta) (ServeEnvironment, error) {
 				InstanceKey: key,
 			}, nil
 		}
+
+		//The parallel requests of a session wait for the runtime started by the first one
+		started, first := s.startOnce(key)
+		if first {
+			defer s.finishStart(key, started)
+			break
+		}
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return ServeEnvironment{}, ctx.Err()
+		}
+	}
+
+	//Create, wait for a free slot first
+	if err := s.admission.Acquire(ctx, meta.RegistryType); err != nil {
+		return ServeEnvironment{}, err
 	}
 
-	//Create
-	s.executor.SetNamespace(policy.Namespace)
 	imageKey := fmt.Sprintf("%s:%s", policy.Image, policy.SessionTag)
 	if _, ok := s.imageStore.Get(imageKey); ok {
 		policy.Tag = policy.SessionTag
 	}
-	env, err := s.executor.Exec(policy)
+	reuseKey := ""
+	if len(policy.ReuseIdentity) > 0 {
+		reuseKey = fmt.Sprintf("%s:%s", meta.RegistryType, policy.ReuseIdentity)
+	}
+	policy.Labels = runtimeLabels(meta.RegistryType, reuseKey, fmt.Sprintf("%s:%s", policy.Image, policy.Tag))
+	span.SetAttributes(attribute.String("kind", scheduleCold))
+	env, err := s.executor.Exec(ctx, policy)
 	if err != nil {
+		s.admission.Release(meta.RegistryType)
 		return ServeEnvironment{}, err
 	}
 
-	log.Printf("Start new service instance: %s\n", env.RuntimeID)
+	log.Infof("Start new service instance: %s", env.RuntimeID)
+	metricSchedules.Inc(meta.RegistryType, scheduleCold)
 
 	key := env.RuntimeID //Just for garbage collection
 	if len(policy.ReuseIdentity) > 0 {
@@ -178,18 +482,31 @@ func (s *Scheduler) Schedule(meta RequestMeta) (ServeEnvironment, error) {
 	key = fmt.Sprintf("%s:%s", meta.RegistryType, key)
 
 	r := &Runtime{
-		ID:         env.RuntimeID,
-		Target:     env.Target,
-		ActiveTime: time.Now().Unix(),
-		Image:      fmt.Sprintf("%s:%s", policy.Image, policy.Tag),
+		ID:           env.RuntimeID,
+		Target:       env.Target,
+		ActiveTime:   time.Now().Unix(),
+		Image:        fmt.Sprintf("%s:%s", policy.Image, policy.Tag),
+		RegistryType: meta.RegistryType,
 	}
 	if err := s.pool.Put(key, r); err != nil {
-		//let's see if problem will appear
-		log.Printf("Pool error: %s\n", err)
+		//Lost the race, e.g: to the runtime of the session adopted by the reconciler, serve with the winner
+		log.Warnf("Pool error: %s, destroy the new runtime %s", err, env.RuntimeID)
+		if err := s.executor.Destroy(env.RuntimeID); err != nil {
+			log.Warnf("Failed to destroy runtime %s: %s", env.RuntimeID, err)
+		}
+		s.admission.Release(meta.RegistryType)
+
+		winner, err := s.pool.Use(key)
+		if err != nil {
+			return ServeEnvironment{}, err
+		}
+		env.RuntimeID, env.Target = winner.ID, winner.Target
 	}
 
 	if policy.Rebuild != nil {
 		policy.Rebuild.BaseContainer = env.RuntimeID
+		policy.Rebuild.RegistryType = meta.RegistryType
+		policy.Rebuild.InstanceKey = key
 	}
 	return ServeEnvironment{
 		Target:      env.Target,
@@ -198,8 +515,32 @@ func (s *Scheduler) Schedule(meta RequestMeta) (ServeEnvironment, error) {
 	}, nil
 }
 
+//startOnce returns the channel closed when the runtime of the reuse key is started,
+//and whether the caller is the first one which should start it.
+func (s *Scheduler) startOnce(key string) (chan struct{}, bool) {
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+
+	if started, ok := s.starts[key]; ok {
+		return started, false
+	}
+	started := make(chan struct{})
+	s.starts[key] = started
+
+	return started, true
+}
+
+//finishStart wakes up the requests waiting for the runtime of the reuse key, started or not
+func (s *Scheduler) finishStart(key string, started chan struct{}) {
+	s.startLock.Lock()
+	defer s.startLock.Unlock()
+
+	delete(s.starts, key)
+	close(started)
+}
+
 //Rebuild ...
-func (s *Scheduler) Rebuild(policy *BuildPolicy) error {
+func (s *Scheduler) Rebuild(ctx context.Context, policy *BuildPolicy) error {
 	if policy == nil {
 		return errors.New("nil build policy")
 	}
@@ -212,29 +553,205 @@ func (s *Scheduler) Rebuild(policy *BuildPolicy) error {
 		return errors.New("no base container for build")
 	}
 
+	started := time.Now()
+	labels := ownerLabels(policy.RegistryType)
 	if policy.NeedPush {
-		s.packer.SetNamespace(policy.Namespace)
-		return s.packer.Build(policy.BaseContainer, policy.Image, policy.Tag)
+		err := s.packer.Build(ctx, policy.BaseContainer, policy.RegistryType, policy.Namespace, policy.Image, policy.Tag, labels, policy.RequestID)
+		observeBuild(policy, started, err)
+		if err != nil {
+			return err
+		}
+		//Don't wait for the webhook to see the pushed one
+		s.existence.Invalidate(policy.Namespace, policy.Image, policy.Tag)
+
+		return nil
+	}
+
+	err := s.packer.BuildLocal(ctx, policy.BaseContainer, policy.Image, policy.Tag, labels, policy.RequestID)
+	observeBuild(policy, started, err)
+
+	return err
+}
+
+//ImageDigest gets the digest of the image pushed to harbor
+func (s *Scheduler) ImageDigest(namespace, image, tag string) (string, error) {
+	artifact, err := s.namespaceClient(namespace).GetArtifact(namespace, image, tag)
+	if err != nil {
+		return "", err
 	}
 
-	return s.packer.BuildLocal(policy.BaseContainer, policy.Image, policy.Tag)
+	return artifact.Digest, nil
+}
+
+//HoldRuntime keeps the instance serving until it's freed
+func (s *Scheduler) HoldRuntime(key string) {
+	s.pool.Hold(key)
 }
 
-//FreeRuntime mark the instance as idle
+//FreeRuntime releases the instance used by a served request,
+//the instance becomes idle when no request is using it
 func (s *Scheduler) FreeRuntime(key string) error {
-	go func() {
-		<-time.After(2 * time.Second)
-		s.pool.SetIdle(key)
-	}()
+	s.pool.Release(key)
+
+	return nil
+}
+
+//ReportFailure evicts the runtime with the key which is found dead
+func (s *Scheduler) ReportFailure(key string) {
+	if r, ok := s.pool.Evict(key); ok {
+		s.recycle(r)
+	}
+}
+
+//recycle the evicted runtime
+func (s *Scheduler) recycle(r *Runtime) {
+	logger.Infof("Runtime %s (%s) is dead, evicted from pool", r.ID, r.Image)
+	if err := s.executor.Destroy(r.ID); err != nil {
+		logger.Warnf("Failed to remove dead runtime %s: %s", r.ID, err)
+	} else {
+		metricRuntimesDestroyed.Inc(r.RegistryType, destroyReasonDead)
+	}
+	s.admission.Release(r.RegistryType)
+}
+
+//RefreshImage drops the cached existence of the image in harbor and recycles the runtimes running it,
+//all the tags are refreshed if tag is empty. Returns the IDs of the recycled runtimes.
+func (s *Scheduler) RefreshImage(namespace, image, tag string) []string {
+	s.existence.Invalidate(namespace, image, tag)
+	if len(image) == 0 {
+		return nil
+	}
+
+	target := fmt.Sprintf("%s:%s", image, tag)
+	expired := s.pool.Expire(func(r *Runtime) bool {
+		registry := registryConfigOf(r.RegistryType)
+		if registry == nil || registry.Namespace != namespace {
+			return false
+		}
+		if len(tag) == 0 {
+			return strings.HasPrefix(r.Image, target)
+		}
+		return r.Image == target
+	})
+
+	return s.recycleOutdated(expired)
+}
+
+//recycleOutdated destroys the expired runtimes, returns their IDs
+func (s *Scheduler) recycleOutdated(expired map[string]*Runtime) []string {
+	recycled := make([]string, 0, len(expired))
+	for k, r := range expired {
+		logger.Infof("Runtime %s (%s) is outdated, recycled", r.ID, r.Image)
+		if err := s.executor.Destroy(r.ID); err != nil {
+			logger.Warnf("Failed to remove outdated runtime %s: %s", r.ID, err)
+			//Swept as a garbage later
+			r.Stale = true
+			s.restore(k, r)
+			continue
+		}
+		metricRuntimesDestroyed.Inc(r.RegistryType, destroyReasonOutdated)
+		s.admission.Release(r.RegistryType)
+		recycled = append(recycled, r.ID)
+	}
+
+	return recycled
+}
+
+//GetCrashes get the crash counts per image
+func (s *Scheduler) GetCrashes() map[string]int {
+	return s.pool.Crashes()
+}
+
+//RuntimeIDs returns the IDs of the runtimes in the pool
+func (s *Scheduler) RuntimeIDs() []string {
+	IDs := make([]string, 0)
+	for _, r := range s.pool.Live() {
+		IDs = append(IDs, r.ID)
+	}
+
+	return IDs
+}
+
+//DestroyAll destroys all the runtimes in the pool, returns the destroyed and failed ones
+func (s *Scheduler) DestroyAll() ([]string, []string) {
+	destroyed := make([]string, 0)
+	failed := make([]string, 0)
+	for _, r := range s.pool.Live() {
+		//Kept in the pool and the state store, so it's adopted or removed on the next start
+		if err := s.executor.Destroy(r.ID); err != nil {
+			logger.Warnf("Failed to destroy runtime %s: %s", r.ID, err)
+			failed = append(failed, r.ID)
+			continue
+		}
+		if _, _, ok := s.pool.DestroyByID(r.ID); ok {
+			s.admission.Release(r.RegistryType)
+			metricRuntimesDestroyed.Inc(r.RegistryType, destroyReasonShutdown)
+		}
+		destroyed = append(destroyed, r.ID)
+	}
+
+	return destroyed, failed
+}
+
+//QueryRuntimes returns the page of the runtimes matched by the filter and the total number of the matched ones
+func (s *Scheduler) QueryRuntimes(filter *RuntimeFilter) ([]Runtime, int) {
+	return s.pool.Query(filter)
+}
+
+//GetRuntime get the runtime with the container ID, it may be destroyed
+func (s *Scheduler) GetRuntime(ID string) (Runtime, error) {
+	runtimes, _ := s.pool.Query(&RuntimeFilter{ID: ID, Limit: 1})
+	if len(runtimes) == 0 {
+		return Runtime{}, ErrRuntimeNotFound
+	}
+
+	return runtimes[0], nil
+}
+
+//DestroyRuntime destroys the runtime with the container ID even if it's serving requests.
+//It's removed from pool before the container, so its death is not taken as a crash,
+//and it's restored with its slot if the container is failed to destroy.
+func (s *Scheduler) DestroyRuntime(ID string) error {
+	key, r, ok := s.pool.DestroyByID(ID)
+	if !ok {
+		return ErrRuntimeNotFound
+	}
+	if err := s.executor.Destroy(ID); err != nil {
+		s.restore(key, r)
+		return fmt.Errorf("destroy runtime %s error: %s", ID, err)
+	}
+
+	s.admission.Release(r.RegistryType)
+	logger.Infof("Runtime %s (%s) is destroyed by force", r.ID, r.Image)
+	metricRuntimesDestroyed.Inc(r.RegistryType, destroyReasonForced)
 
 	return nil
 }
 
+//restore the removed runtime whose container is failed to destroy, with its slot.
+//The container is left to the reconciler if the key is taken by a new runtime meanwhile.
+func (s *Scheduler) restore(key string, r *Runtime) {
+	if err := s.pool.Restore(key, r); err != nil {
+		logger.Warnf("Container %s of runtime is left to the reconciler: %s", r.ID, err)
+		s.admission.Release(r.RegistryType)
+	}
+}
+
+//PinRuntime pins or unpins the runtime with the container ID, the pinned runtime is never evicted
+func (s *Scheduler) PinRuntime(ID string, pinned bool) (Runtime, error) {
+	return s.pool.PinByID(ID, pinned)
+}
+
 //GetRuntimes get all runtimes including the destroyed ones
-func (s *Scheduler) GetRuntimes() []*Runtime {
+func (s *Scheduler) GetRuntimes() []Runtime {
 	return s.pool.GetAll()
 }
 
+//GetAdmissionStats get the stats of the admission queue
+func (s *Scheduler) GetAdmissionStats() AdmissionStats {
+	return s.admission.Stats()
+}
+
 //StoreImage ...
 func (s *Scheduler) StoreImage(image, tag string) {
 	s.imageStore.Put(image, tag)
@@ -258,6 +775,10 @@ type SchedulePolicy struct {
 	Rebuild       *BuildPolicy
 	EnvVars       map[string]string
 	Namespace     string
+	Readiness     *ProbeConfig
+	Labels        map[string]string
+	//ID of the request which schedules the runtime
+	RequestID string
 }
 
 //BuildPolicy ...
@@ -268,57 +789,59 @@ type BuildPolicy struct {
 	NeedPush      bool   `json:"need_push"`
 	Namespace     string `json:"namespace"`
 	NeedStore     bool   `json:"need_store"`
+	RegistryType  string `json:"registry_type"`
+	//Rebuild before the response is returned to the client
+	Sync bool `json:"sync"`
+	//Pool key of the base container
+	InstanceKey string `json:"instance_key"`
+	//Publisher of the package for auditing
+	Username   string `json:"username,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	//ID of the publishing request, attached to the logs of the build
+	RequestID string `json:"request_id,omitempty"`
+	//W3C traceparent of the publishing request, the build continues its trace
+	TraceParent string `json:"trace_parent,omitempty"`
 }
 
-//Encode ...
-func (bp *BuildPolicy) Encode() (string, error) {
-	bytes, err := json.Marshal(bp)
-	if err != nil {
-		return "", err
-	}
-
-	return base64.StdEncoding.EncodeToString(bytes), nil
+//ScheduleDriver ...
+type ScheduleDriver interface {
+	//Schedule ...
+	Schedule(ctx context.Context, meta RequestMeta) *SchedulePolicy
 }
 
-//Decode ...
-func (bp *BuildPolicy) Decode(data string) error {
-	bytes, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		return err
+//defaultPolicy runs the base image of the registry, nil if the registry has none
+func defaultPolicy(registryType string) *SchedulePolicy {
+	registry := registryConfigOf(registryType)
+	if registry == nil || len(registry.BaseImage) == 0 {
+		return nil
 	}
-	return json.Unmarshal(bytes, bp)
-}
 
-//ScheduleDriver ...
-type ScheduleDriver interface {
-	//Schedule ...
-	Schedule(meta RequestMeta) *SchedulePolicy
+	return &SchedulePolicy{
+		Image:      registry.BaseImage,
+		Tag:        registry.BaseImageTag,
+		UseHub:     true,
+		BoundPorts: []int{80},
+		Namespace:  registry.Namespace,
+		Readiness:  registry.Readiness,
+	}
 }
 
 //PipScheduleDriver ...
 type PipScheduleDriver struct {
-	registryAPI       string
+	harbor            *harbor.Client
 	registryNamespace string
-	httpClient        *http.Client
 }
 
 //NewPipScheduleDriver ...
-func NewPipScheduleDriver(registryAPI, registryNamespace string) *PipScheduleDriver {
+func NewPipScheduleDriver(harborAPI *harbor.Client, registryNamespace string) *PipScheduleDriver {
 	return &PipScheduleDriver{
-		registryAPI:       registryAPI,
+		harbor:            harborAPI,
 		registryNamespace: registryNamespace,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
-		},
 	}
 }
 
 //Schedule ...
-func (psd *PipScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
+func (psd *PipScheduleDriver) Schedule(ctx context.Context, meta RequestMeta) *SchedulePolicy {
 	if !meta.HasHit || meta.RegistryType != registryTypePip {
 		return nil
 	}
@@ -333,40 +856,39 @@ func (psd *PipScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
 			ReuseIdentity: meta.Metadata["package"],
 			EnvVars:       map[string]string{"PYPI_EXTRA": "--disable-fallback", "PYPI_ROOT": "/pypi"},
 			Namespace:     psd.registryNamespace,
+			Readiness:     Config.PipRegistry.Readiness,
+		}
+		//Packages are artifacts fetched by the shared server
+		if Config.Build.Mode == packageModeArtifact {
+			useArtifactServer(policy, registryTypePip)
 		}
 		return policy
 
 	}
 
-	log.Printf("Unknown command for pip package: %s\n", meta.Metadata["command"])
+	logger.WithRequest(meta.RequestID).Infof("Unknown command for pip package: %s", meta.Metadata["command"])
 
 	return nil
 }
 
 //NpmScheduleDriver ...
 type NpmScheduleDriver struct {
-	registryAPI       string
+	harbor            *harbor.Client
+	existence         *ExistenceCache
 	registryNamespace string
-	httpClient        *http.Client
 }
 
 //NewNpmScheduleDriver ...
-func NewNpmScheduleDriver(registryAPI, registryNamespace string) *NpmScheduleDriver {
+func NewNpmScheduleDriver(harborAPI *harbor.Client, existence *ExistenceCache, registryNamespace string) *NpmScheduleDriver {
 	return &NpmScheduleDriver{
-		registryAPI:       registryAPI,
+		harbor:            harborAPI,
+		existence:         existence,
 		registryNamespace: registryNamespace,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
-		},
 	}
 }
 
 //Schedule ...
-func (nsd *NpmScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
+func (nsd *NpmScheduleDriver) Schedule(ctx context.Context, meta RequestMeta) *SchedulePolicy {
 	if !meta.HasHit || len(meta.Metadata) == 0 || meta.RegistryType != registryTypeNpm {
 		return nil
 	}
@@ -383,6 +905,7 @@ func (nsd *NpmScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
 			Namespace: nsd.registryNamespace,
 		},
 		Namespace: nsd.registryNamespace,
+		Readiness: Config.NpmRegistry.Readiness,
 	}
 
 	//If has reuseIdentity
@@ -398,10 +921,13 @@ func (nsd *NpmScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
 		extraInfo := meta.Metadata["extra"]
 		repo := strings.TrimPrefix(requestPath, "/")
 		tag := strings.TrimSpace(strings.TrimPrefix(extraInfo, repo+"@"))
-		if checkImageExisting(nsd.registryAPI, nsd.registryNamespace, repo, tag, nsd.httpClient) {
+		switch nsd.existence.Lookup(ctx, nsd.harbor, nsd.registryNamespace, repo, tag) {
+		case packageKindImage:
 			policy.Image = repo
 			policy.Tag = tag
 			policy.UseHub = false
+		case packageKindArtifact:
+			useArtifactServer(policy, registryTypeNpm)
 		}
 		policy.Rebuild = nil
 	}
@@ -418,12 +944,14 @@ func (nsd *NpmScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
 	if command == "publish" {
 		repo := strings.TrimPrefix(requestPath, "/")
 		tag := meta.Metadata["extra"]
-		log.Printf("PUBLISH: %s@%s", repo, tag)
-		if checkImageExisting(nsd.registryAPI, nsd.registryNamespace, repo, tag, nsd.httpClient) {
+		logger.WithRequest(meta.RequestID).Infof("PUBLISH: %s@%s", repo, tag)
+		//The existing artifact is not runnable, publish it on the base image
+		if nsd.existence.Lookup(ctx, nsd.harbor, nsd.registryNamespace, repo, tag) == packageKindImage {
 			policy.Image = repo
 			policy.Tag = tag
 			policy.UseHub = false
-		} else {
+		} else if !Config.Auth.Enabled {
+			//Credential is kept in the session image without the auth
 			sessionTag := meta.Metadata["basic_auth"]
 			if len(sessionTag) > 0 {
 				policy.SessionTag = sessionTag
@@ -432,24 +960,8 @@ func (nsd *NpmScheduleDriver) Schedule(meta RequestMeta) *SchedulePolicy {
 		policy.Rebuild.Image = strings.TrimPrefix(requestPath, "/")
 		policy.Rebuild.Tag = meta.Metadata["extra"]
 		policy.Rebuild.NeedPush = true
+		policy.Rebuild.Sync = Config.NpmRegistry.SyncPublish
 	}
 
 	return policy
 }
-
-func checkImageExisting(registryAPI, registryNamespace, image, tag string, client *http.Client) bool {
-	url := fmt.Sprintf("%s%s%s%s%s%s%s", registryAPI, "/repositories/", registryNamespace, "/", image, "/tags/", tag)
-	resp, err := client.Get(url)
-	if err == nil {
-		if resp.StatusCode == http.StatusOK {
-			log.Printf("Image %s:%s existing\n", image, tag)
-			return true
-		}
-
-		log.Printf("Image %s:%s not existing\n", image, tag)
-		return false
-	}
-
-	log.Printf("Failed to Check image %s:%s existing: %s\n", image, tag, err)
-	return false
-}
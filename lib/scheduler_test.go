@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"context"
+	"testing"
+)
+
+func TestScheduleUnknownCommand(t *testing.T) {
+	h := newTestAPIHandler(t)
+	s := h.scheduler
+	s.drivers = map[string]ScheduleDriver{registryTypePip: NewPipScheduleDriver(nil, "pip")}
+
+	//No base image of pip to fall back to
+	meta := RequestMeta{RegistryType: registryTypePip, HasHit: true, Metadata: map[string]string{"command": "list"}}
+	if _, err := s.Schedule(context.Background(), meta); err == nil {
+		t.Error("Schedule() succeeded without a runtime for the command")
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	newTestAPIHandler(t)
+	Config.NpmRegistry.BaseImage = "stevenzou/npm-registry"
+	Config.NpmRegistry.BaseImageTag = "latest"
+
+	policy := defaultPolicy(registryTypeNpm)
+	if policy == nil {
+		t.Fatal("defaultPolicy() = nil with the base image of npm")
+	}
+	if policy.Image != "stevenzou/npm-registry" || policy.Tag != "latest" || !policy.UseHub || policy.Namespace != "npm" {
+		t.Errorf("policy = %+v", policy)
+	}
+	if policy.Rebuild != nil {
+		t.Error("default policy rebuilds the runtime")
+	}
+
+	if policy := defaultPolicy(registryTypePip); policy != nil {
+		t.Errorf("defaultPolicy() = %+v without the base image of pip", policy)
+	}
+}
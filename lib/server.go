@@ -1,47 +1,116 @@
 package lib
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"registry-factory/logger"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	//requestIDHeader carries the ID correlating the logs of request, it's created if the client doesn't send one
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
 )
 
 //ProxyServer serves the requests
 type ProxyServer struct {
-	server     *http.Server
-	proxy      *httputil.ReverseProxy
-	context    context.Context
-	reqParser  *ParserChain
-	scheduler  *Scheduler
-	apiHandler *APIHandler
+	server      *http.Server
+	proxy       *httputil.ReverseProxy
+	context     context.Context
+	reqParser   *ParserChain
+	scheduler   *Scheduler
+	apiHandler  *APIHandler
+	authHandler *AuthHandler
+	auth        *Authenticator
+	audit       *AuditTrail
+	buildQueue  *BuildQueue
+	draining    int32
+	store       StateStore
+	commandList *CommandList
+	//Flush the spans on stopping
+	shutdownTracing func(context.Context) error
 }
 
 //NewProxyServer create new server instance
-func NewProxyServer(ctx context.Context) *ProxyServer {
-	commandList := NewCommandList()
-	scheduler := NewScheduler(ctx)
+func NewProxyServer(ctx context.Context) (*ProxyServer, error) {
+	if err := logger.Configure(Config.Logging.Level, Config.Logging.Format); err != nil {
+		return nil, err
+	}
+	//The reuse key label picks the runtime of the npm session as the Npm-Session header does
+	redact := Config.Logging.Redact
+	logger.SetRules(logger.Rules{
+		Headers:     redact.Headers,
+		QueryParams: redact.QueryParams,
+		Args:        redact.Args,
+		BodyFields:  redact.BodyFields,
+		EnvVars:     redact.EnvVars,
+		Labels:      []string{labelReuseKey},
+	})
+
+	shutdownTracing, err := initTracing(ctx, Config.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewStateStore(Config.State)
+	if err != nil {
+		return nil, err
+	}
+
+	commandList := NewCommandList(store)
+	scheduler := NewScheduler(ctx, store)
+	auth := NewAuthenticator(store)
+	audit := NewAuditTrail(store)
 	apiHandler := &APIHandler{
 		scheduler:   scheduler,
 		commandList: commandList,
+		auth:        auth,
+		audit:       audit,
 	}
 	parser := &ParserChain{
 		commandList: commandList,
 	}
 
-	return &ProxyServer{
-		apiHandler: apiHandler,
-		scheduler:  scheduler,
-		context:    ctx,
-		reqParser:  parser,
+	ps := &ProxyServer{
+		apiHandler:  apiHandler,
+		authHandler: &AuthHandler{auth: auth},
+		auth:        auth,
+		audit:       audit,
+		scheduler:   scheduler,
+		context:     ctx,
+		reqParser:   parser,
+		store:       store,
+		commandList: commandList,
+
+		shutdownTracing: shutdownTracing,
 	}
+	ps.buildQueue = NewBuildQueue(store, ps.rebuild, scheduler.HoldRuntime, func(key string) {
+		scheduler.FreeRuntime(key)
+	})
+	apiHandler.buildQueue = ps.buildQueue
+	apiHandler.webhook = NewHarborWebhook(scheduler, store)
+
+	return ps, nil
 }
 
 //Start the proxy server
@@ -50,6 +119,30 @@ func (ps *ProxyServer) Start() error {
 		return err
 	}
 
+	//Reload the state
+	if err := ps.commandList.Load(); err != nil {
+		return err
+	}
+	if err := ps.apiHandler.webhook.Load(); err != nil {
+		return err
+	}
+	if err := ps.auth.Load(); err != nil {
+		return err
+	}
+	if err := ps.audit.Load(); err != nil {
+		return err
+	}
+	if verification, err := ps.audit.Verify(); err != nil || !verification.Valid {
+		logger.Errorf("Audit log is broken: %+v %v", verification, err)
+	}
+	if err := ps.scheduler.Restore(); err != nil {
+		return err
+	}
+	//After the runtimes restored as the jobs hold their base containers
+	if err := ps.buildQueue.Start(); err != nil {
+		return err
+	}
+
 	ps.scheduler.Start()
 
 	if ps.proxy == nil {
@@ -68,158 +161,516 @@ func (ps *ProxyServer) Start() error {
 				InsecureSkipVerify: true,
 			},
 		}
-		ps.proxy = &httputil.ReverseProxy{
-			Transport: t,
-			Director: func(req *http.Request) {
-				log.Printf("INCOMING REQ: %s %s\n", req.Method, req.URL.String())
-				//Log sessions
-				session := []string{}
-				for _, c := range req.Cookies() {
-					session = append(session, c.String())
+		ps.proxy = ps.newProxy(&tracingTransport{next: t})
+	}
+
+	if ps.server == nil {
+		ps.server = &http.Server{
+			Addr: fmt.Sprintf("%s:%d", Config.Host, Config.Port),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				//Propagated to the runtimes and returned to the client
+				requestID := requestIDOf(r)
+				r.Header.Set(requestIDHeader, requestID)
+				w.Header().Set(requestIDHeader, requestID)
+
+				if r.URL.Path == metricsPath {
+					ps.apiHandler.ServeMetrics(w, r)
+					return
+				}
+				if ps.apiHandler.IsMatchedRequests(r) {
+					ps.apiHandler.ServeHTTP(w, r)
+					return
 				}
-				//For npm
-				npmSession := req.Header.Get("Npm-Session")
-				if len(npmSession) > 0 {
-					session = append(session, fmt.Sprintf("%s:%s", "Npm-Session", npmSession))
+				if ps.authHandler.IsMatchedRequests(r) {
+					ps.authHandler.ServeHTTP(w, r)
+					return
 				}
-				log.Printf("SESSION: %s\n", strings.Join(session, "; "))
-				log.Printf("HEADER: %#-v\n", req.Header)
+				ps.serve(w, r)
+			}),
+		}
+	}
 
-				//Parse request
-				if ps.reqParser != nil {
-					meta, err := ps.reqParser.Parse(req)
-					if err != nil {
-						log.Printf("[ERROR]: Parse error: %s\n", err)
-						return
-					}
+	return ps.server.ListenAndServe()
+}
 
-					if meta.HasHit {
-						var rawTarget string
-						if meta.RegistryType == registryTypeNpm || meta.RegistryType == registryTypePip {
-							env, err := ps.scheduler.Schedule(meta)
-							if err != nil {
-								log.Printf("[ERROR]: schedule error: %s\n", err)
-								return
-							}
-							rawTarget = fmt.Sprintf("%s%s", "http://", env.Target)
-
-							if env.Rebuild != nil {
-								h, err := env.Rebuild.Encode()
-								if err != nil {
-									log.Printf("[ERROR]: set rebuild header failed: %s", err)
-									return
-								}
-								req.Header.Set("registry-factory", h)
-							}
-
-							//Set instance key for status updating
-							if len(env.InstanceKey) > 0 {
-								req.Header.Set("instance-key", env.InstanceKey)
-							}
-						} else {
-							//Treat as management/harbor
-							rawTarget = fmt.Sprintf("%s://%s", Config.Harbor.Protocol, Config.Harbor.Host)
-						}
+//newProxy forwards the routed requests to the runtimes with the transport and rebuilds the packages on success
+func (ps *ProxyServer) newProxy(transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(req *http.Request) {
+			//The request has been routed before proxying, see route()
+		},
 
-						target, err := url.Parse(rawTarget)
-						if err != nil {
-							log.Printf("[ERROR]: Url parse error: %s\n", err)
-							return
-						}
-						targetQuery := target.RawQuery
-						req.URL.Scheme = target.Scheme
-						req.URL.Host = target.Host
-						req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-						if targetQuery == "" || req.URL.RawQuery == "" {
-							req.URL.RawQuery = targetQuery + req.URL.RawQuery
-						} else {
-							req.URL.RawQuery = targetQuery + req.URL.RawQuery
-						}
-						if _, ok := req.Header["User-Agent"]; !ok {
-							// explicitly disable User-Agent so it's not set to default value
-							req.Header.Set("User-Agent", "")
+		ModifyResponse: func(res *http.Response) error {
+			log := requestLogger(res.Request)
+			log.Infof("RESPONSE: %s", res.Status)
+			//The runtime is released in serve() after the body is copied
+			if res.StatusCode >= http.StatusOK && res.StatusCode <= http.StatusAccepted {
+				//Kept in the state of the inbound request, never in the headers the client can forge
+				state, ok := res.Request.Context().Value(proxyStateKey{}).(*proxyState)
+				if ok && state.rebuild != nil {
+					rebuildPolicy := state.rebuild
+					if rebuildPolicy.Sync {
+						//Make sure the package is pushed before the client sees success
+						log.Infof("Rebuild image synchronously: %s:%s (%s)", rebuildPolicy.Image, rebuildPolicy.Tag, rebuildPolicy.BaseContainer)
+						if err := ps.rebuild(rebuildPolicy); err != nil {
+							return replaceWithError(res, rebuildPolicy.RegistryType, err)
 						}
+						return nil
+					}
 
-						log.Printf("PROXY TO: %s\n", req.URL.String())
+					//Use async way to improve pref, this may cause inconsistent case
+					//client get success code
+					//but the package image may not be pushed to harbor,
+					//the queue keeps retrying until it's pushed or dead
+					job, err := ps.buildQueue.Enqueue(rebuildPolicy)
+					if err != nil {
+						log.Errorf("Failed to enqueue rebuild of %s:%s: %s", rebuildPolicy.Image, rebuildPolicy.Tag, err)
+						return nil
 					}
+					log.Infof("Rebuild image (base container): %s (%s) is %s", job.ID, rebuildPolicy.BaseContainer, job.Status)
 				}
-				//do nothing
-			},
+			}
 
-			ModifyResponse: func(res *http.Response) error {
-				log.Printf("RESPONSE: %s\n", res.Status)
-				//Request served
-				//Do not care the response status code
-				instanceKey := res.Request.Header.Get("instance-key")
-				if len(instanceKey) > 0 {
-					//delay several seconds
-					go func() {
-						time.Sleep(5 * time.Second)
-						ps.scheduler.FreeRuntime(instanceKey)
-					}()
-				}
-				if res.StatusCode >= http.StatusOK && res.StatusCode <= http.StatusAccepted {
-					rebuildPolicyHeader := res.Request.Header.Get("registry-factory")
-					if len(rebuildPolicyHeader) > 0 {
-						//Use async way to improve pref, this may cause inconsistent case
-						//client get success code
-						//but the package image may not be pushed to harbor
-						go func() {
-							rebuildPolicy := &BuildPolicy{}
-							err := rebuildPolicy.Decode(rebuildPolicyHeader)
-							if err != nil {
-								log.Printf("[ERROR]: Failed to decode rebuild policy with error:%s\n", err)
-							}
-
-							log.Printf("Rebuild image (base container): %s:%s (%s)\n", rebuildPolicy.Image, rebuildPolicy.Tag, rebuildPolicy.BaseContainer)
-
-							if err := ps.scheduler.Rebuild(rebuildPolicy); err != nil {
-								log.Printf("[ERROR]: Failed to rebuild image: %s:%s\n", rebuildPolicy.Image, rebuildPolicy.Tag)
-							}
-
-							//Store image for future use
-							if rebuildPolicy.NeedStore {
-								ps.scheduler.StoreImage(rebuildPolicy.Image, rebuildPolicy.Tag)
-								log.Printf("Store image: %s:%s\n", rebuildPolicy.Image, rebuildPolicy.Tag)
-							}
-						}()
-					}
+			return nil
+		},
+
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			requestLogger(req).Errorf("proxy error: %s", err)
+			if errors.Is(err, context.Canceled) || req.Context().Err() != nil {
+				//The client hung up, the runtime is not to blame
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			//The runtime may be dead, replace it and retry once
+			state, ok := req.Context().Value(proxyStateKey{}).(*proxyState)
+			if ok && len(state.instanceKey) > 0 && state.retryable() {
+				state.retried = true
+				ps.scheduler.ReportFailure(state.instanceKey)
+				if err := ps.retry(w, state); err == nil {
+					return
 				}
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
 
-				return nil
-			},
+//rebuild the package image with the policy, every attempt is audited
+func (ps *ProxyServer) rebuild(rebuildPolicy *BuildPolicy) error {
+	event := &AuditEvent{
+		Username:     rebuildPolicy.Username,
+		RemoteAddr:   rebuildPolicy.RemoteAddr,
+		RegistryType: rebuildPolicy.RegistryType,
+		Namespace:    rebuildPolicy.Namespace,
+		Command:      auditCommandBuild,
+		Package:      rebuildPolicy.Image,
+		Version:      rebuildPolicy.Tag,
+		Outcome:      auditOutcomeSucceeded,
+	}
+	if rebuildPolicy.NeedPush {
+		event.Command = auditCommandPush
+	}
+	defer ps.audit.Append(event)
+
+	//Continues the trace of the publishing request, even in the async build
+	ctx, span := startSpan(rebuildPolicy.traceContext(), "rebuild",
+		attribute.String("image", rebuildPolicy.Image),
+		attribute.String("tag", rebuildPolicy.Tag),
+		attribute.Bool("push", rebuildPolicy.NeedPush),
+		attribute.String("request_id", rebuildPolicy.RequestID),
+	)
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	log := logger.WithRequest(rebuildPolicy.RequestID)
+	if err = ps.scheduler.Rebuild(ctx, rebuildPolicy); err != nil {
+		log.Errorf("Failed to rebuild image: %s:%s: %s", rebuildPolicy.Image, rebuildPolicy.Tag, err)
+		event.Outcome = auditOutcomeFailed
+		event.Reason = err.Error()
+		return err
+	}
+
+	if rebuildPolicy.NeedPush {
+		digest, err := ps.scheduler.ImageDigest(rebuildPolicy.Namespace, rebuildPolicy.Image, rebuildPolicy.Tag)
+		if err != nil {
+			log.Errorf("Failed to get digest of image %s:%s: %s", rebuildPolicy.Image, rebuildPolicy.Tag, err)
 		}
+		event.Digest = digest
 	}
 
-	if ps.server == nil {
-		ps.server = &http.Server{
-			Addr: fmt.Sprintf("%s:%d", Config.Host, Config.Port),
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if ps.apiHandler.IsMatchedRequests(r) {
-					ps.apiHandler.ServeHTTP(w, r)
-					return
-				}
-				ps.proxy.ServeHTTP(w, r)
-			}),
+	//Store image for future use
+	if rebuildPolicy.NeedStore {
+		ps.scheduler.StoreImage(rebuildPolicy.Image, rebuildPolicy.Tag)
+		log.Infof("Store image: %s:%s", rebuildPolicy.Image, rebuildPolicy.Tag)
+	}
+
+	return nil
+}
+
+//replaceWithError replaces the backend response with an error the registry client can show
+func replaceWithError(res *http.Response, registryType string, err error) error {
+	if res.Body != nil {
+		res.Body.Close()
+	}
+
+	var body []byte
+	if registryType == registryTypeNpm {
+		//npm shows the 'error' field
+		body, _ = json.Marshal(map[string]string{
+			"error": fmt.Sprintf("package is not published to registry: %s", err),
+		})
+		res.Header.Set("Content-Type", "application/json")
+	} else {
+		body = []byte(fmt.Sprintf("package is not published to registry: %s\n", err))
+		res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	res.StatusCode = http.StatusBadGateway
+	res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("ETag")
+
+	return nil
+}
+
+//serve routes and proxies the request
+func (ps *ProxyServer) serve(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ps.draining) == 1 {
+		//Stop accepting new work
+		w.Header().Set("Retry-After", strconv.Itoa(Config.Shutdown.DrainTimeout))
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	started := time.Now()
+	//Continue the trace of client if it has
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "ProxyServer.serve",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("request_id", r.Header.Get(requestIDHeader)),
+		),
+	)
+	r = r.WithContext(ctx)
+	state := &proxyState{original: *r.URL}
+	r = r.WithContext(context.WithValue(r.Context(), proxyStateKey{}, state))
+	state.inbound = r
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		//Request is done, the body is copied or failed
+		for _, key := range state.usedKeys {
+			ps.scheduler.FreeRuntime(key)
+		}
+		observeRequest(state.meta, recorder.status, started)
+		span.SetAttributes(
+			attribute.String("registry_type", state.meta.RegistryType),
+			attribute.String("command", state.meta.Metadata["command"]),
+			attribute.Int("http.status_code", recorder.status),
+		)
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
 		}
+		span.End()
+	}()
+
+	if err := ps.route(r, state); err != nil {
+		if busy, ok := err.(*BusyError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(busy.RetryAfter))
+			http.Error(recorder, busy.Error(), http.StatusServiceUnavailable)
+			ps.auditRequest(r, state, http.StatusServiceUnavailable)
+			return
+		}
+		if authErr, ok := err.(*AuthError); ok {
+			//Audited as denied
+			writeAuthError(recorder, authErr)
+			return
+		}
+		//Other errors: there is no target to forward the request to
+		status := http.StatusBadGateway
+		if !state.meta.HasHit {
+			//Not a request of the supported registries
+			status = http.StatusNotFound
+		}
+		writeRouteError(recorder, state.meta.RegistryType, status, err)
+		ps.auditRequest(r, state, status)
+		return
 	}
+	ps.proxy.ServeHTTP(recorder, r)
+	ps.auditRequest(r, state, recorder.status)
+}
 
-	return ps.server.ListenAndServe()
+//writeRouteError writes the failure of routing the request to the registry client
+func writeRouteError(w http.ResponseWriter, registryType string, status int, err error) {
+	if registryType == registryTypeNpm {
+		npmError(w, status, err)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+//auditRequest appends the served package operation to the audit log
+func (ps *ProxyServer) auditRequest(req *http.Request, state *proxyState, status int) {
+	meta := state.meta
+	registry := registryConfigOf(meta.RegistryType)
+	if !meta.HasHit || registry == nil {
+		return
+	}
+
+	res := resourceOf(meta, registry)
+	username, remoteAddr := state.caller()
+	event := &AuditEvent{
+		Username:     username,
+		RemoteAddr:   remoteAddr,
+		Method:       req.Method,
+		Path:         state.original.Path,
+		RegistryType: res.RegistryType,
+		Namespace:    res.Namespace,
+		Command:      meta.Metadata["command"],
+		Package:      res.Package,
+		Version:      versionOf(meta),
+		Outcome:      auditOutcomeSucceeded,
+		Status:       status,
+	}
+	if status >= http.StatusBadRequest {
+		event.Outcome = auditOutcomeFailed
+		event.Reason = http.StatusText(status)
+	}
+
+	ps.audit.Append(event)
+}
+
+//retry the request with a fresh runtime
+func (ps *ProxyServer) retry(w http.ResponseWriter, state *proxyState) error {
+	req := state.inbound
+	original := state.original
+	req.URL = &original
+	state.rebuild = nil
+
+	requestLogger(req).Infof("Retry %s %s with a fresh runtime", req.Method, logger.URL(req.URL))
+	if err := ps.dispatch(req, state); err != nil {
+		return err
+	}
+	ps.proxy.ServeHTTP(w, req)
+
+	return nil
+}
+
+//route parses the request, schedules the runtime and rewrites the request to the target
+func (ps *ProxyServer) route(req *http.Request, state *proxyState) error {
+	log := requestLogger(req)
+	log.Request(req)
+
+	//Parse request
+	if ps.reqParser != nil {
+		meta, err := ps.reqParser.Parse(req)
+		if err != nil {
+			log.Errorf("Parse error: %s", err)
+			return err
+		}
+		meta.RequestID = req.Header.Get(requestIDHeader)
+		state.meta = meta
+
+		//Before scheduling any runtime
+		principal, err := ps.authorize(req, meta)
+		if err != nil {
+			return err
+		}
+		state.principal = principal
+
+		return ps.dispatch(req, state)
+	}
+
+	return nil
+}
+
+//authorize checks the role of the caller on the namespace and package of the parsed request,
+//the denials are recorded in the audit trail. The principal is nil if it's anonymous or auth is disabled.
+func (ps *ProxyServer) authorize(req *http.Request, meta RequestMeta) (*Principal, error) {
+	registry := registryConfigOf(meta.RegistryType)
+	if !Config.Auth.Enabled || !meta.HasHit || registry == nil {
+		return nil, nil
+	}
+
+	res := resourceOf(meta, registry)
+	role := requiredRole(req.Method, meta)
+	principal, err := ps.auth.Authenticate(req)
+	if err == nil {
+		err = ps.auth.Authorize(principal, role, res)
+	}
+	if err != nil {
+		requestLogger(req).Errorf("Deny %s %s: %s", req.Method, logger.URL(req.URL), err)
+		ps.audit.Deny(req, principal, role, res, err)
+		return nil, &AuthError{Cause: err, RegistryType: meta.RegistryType}
+	}
+
+	//The runtimes know nothing about the tokens, publish with the user of runtime instead
+	req.Header.Del("Authorization")
+	if role != roleReader && len(registry.PublishAuth) > 0 {
+		req.Header.Set("Authorization", registry.PublishAuth)
+	}
+
+	return principal, nil
+}
+
+//dispatch schedules the runtime for the parsed request and rewrites the request to the target
+func (ps *ProxyServer) dispatch(req *http.Request, state *proxyState) error {
+	meta := state.meta
+	log := logger.WithRequest(meta.RequestID)
+	if meta.HasHit {
+		var rawTarget string
+		if meta.RegistryType == registryTypeNpm || meta.RegistryType == registryTypePip {
+			env, err := ps.scheduler.Schedule(req.Context(), meta)
+			if err != nil {
+				log.Errorf("schedule error: %s", err)
+				return err
+			}
+			rawTarget = fmt.Sprintf("%s%s", "http://", env.Target)
+
+			if env.Rebuild != nil {
+				//Who publishes it, for auditing the build
+				env.Rebuild.Username, env.Rebuild.RemoteAddr = state.caller()
+				env.Rebuild.injectTrace(req.Context())
+				state.rebuild = env.Rebuild
+			}
+
+			//Keep instance key for status updating
+			if len(env.InstanceKey) > 0 {
+				state.instanceKey = env.InstanceKey
+				state.usedKeys = append(state.usedKeys, env.InstanceKey)
+			}
+		} else {
+			//Treat as management/harbor
+			rawTarget = fmt.Sprintf("%s://%s", Config.Harbor.Protocol, Config.Harbor.Host)
+		}
+
+		target, err := url.Parse(rawTarget)
+		if err != nil {
+			log.Errorf("Url parse error: %s", err)
+			return err
+		}
+		targetQuery := target.RawQuery
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if targetQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+
+		log.Infof("PROXY TO: %s", logger.URL(req.URL))
+	}
+
+	return nil
 }
 
-//Stop the proxy server
-func (ps *ProxyServer) Stop() error {
+//Stop the proxy server.
+//New requests are rejected, the in-flight requests and pending builds
+//are waited until the drain deadline, then the runtimes are cleaned up.
+func (ps *ProxyServer) Stop() (*ShutdownReport, error) {
 	if ps.server == nil {
-		return errors.New("No server existing")
+		return nil, errors.New("No server existing")
+	}
+
+	report := &ShutdownReport{}
+	atomic.StoreInt32(&ps.draining, 1)
+	deadline := time.Now().Add(time.Duration(Config.Shutdown.DrainTimeout) * time.Second)
+
+	//Wait in-flight proxies
+	ctx, cancel := context.WithDeadline(ps.context, deadline)
+	defer cancel()
+	err := ps.server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		report.RequestsAborted = true
 	}
 
+	//Wait running builds, the pending ones are resumed after restart
+	report.PendingBuilds = ps.buildQueue.Stop(time.Until(deadline))
+
 	//Stop scheduler
 	ps.scheduler.Stop()
 
-	ctx, cancel := context.WithTimeout(ps.context, 30*time.Second)
-	defer cancel()
+	if Config.Shutdown.KeepRuntimes {
+		report.KeptRuntimes = ps.scheduler.RuntimeIDs()
+	} else {
+		report.DestroyedRuntimes, report.FailedRuntimes = ps.scheduler.DestroyAll()
+	}
+
+	//Flush the spans before the deadline
+	ctx, cancelFlush := context.WithDeadline(context.Background(), deadline.Add(5*time.Second))
+	defer cancelFlush()
+	if flushErr := ps.shutdownTracing(ctx); flushErr != nil {
+		logger.Warnf("Failed to shutdown tracing: %s", flushErr)
+	}
+
+	ps.audit.Close()
+	if closeErr := ps.store.Close(); closeErr != nil {
+		logger.Warnf("Failed to close state store: %s", closeErr)
+	}
+
+	return report, err
+}
+
+//proxyStateKey is the context key of proxyState
+type proxyStateKey struct{}
+
+//proxyState keeps the routing state of the inbound request for retrying
+type proxyState struct {
+	inbound  *http.Request
+	original url.URL
+	meta     RequestMeta
+	retried  bool
+	//Authenticated caller, nil if it's anonymous
+	principal *Principal
+	//Rebuild of the runtime once it responds success
+	rebuild *BuildPolicy
+	//Instance key of the current runtime
+	instanceKey string
+	//All the runtimes used by the request, they're released when it's done
+	usedKeys []string
+}
+
+//statusRecorder keeps the status code written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-	return ps.server.Shutdown(ctx)
+//WriteHeader ...
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+//Unwrap lets the reverse proxy flush the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+//caller returns the authenticated username (empty if anonymous) and the peer address of the inbound request,
+//they're never taken from the headers.
+func (st *proxyState) caller() (string, string) {
+	username := ""
+	if st.principal != nil {
+		username = st.principal.Username
+	}
+
+	return username, st.inbound.RemoteAddr
+}
+
+//retryable returns true if the request is not retried and can be replayed
+func (st *proxyState) retryable() bool {
+	return !st.retried && st.inbound != nil && st.inbound.ContentLength == 0
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -233,3 +684,36 @@ func singleJoiningSlash(a, b string) string {
 	}
 	return a + b
 }
+
+//requestIDOf returns the valid X-Request-ID of the request or a new one
+func requestIDOf(req *http.Request) string {
+	if requestID := req.Header.Get(requestIDHeader); validRequestID(requestID) {
+		return requestID
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+//validRequestID checks the propagated ID is short and safe to log
+func validRequestID(ID string) bool {
+	if len(ID) == 0 || len(ID) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range ID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//requestLogger returns the logger with the ID of the inbound or proxied request
+func requestLogger(req *http.Request) *logger.Entry {
+	return logger.WithRequest(req.Header.Get(requestIDHeader))
+}
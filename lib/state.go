@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	stateDriverMemory = "memory"
+	stateDriverBolt   = "bolt"
+
+	bucketMeta     = "meta"
+	bucketRuntimes = "runtimes"
+	bucketImages   = "images"
+	bucketCommands = "commands"
+	bucketWebhooks = "webhooks"
+	bucketAudit    = "audit"
+	bucketRobots   = "robots"
+
+	keySchemaVersion = "schema_version"
+
+	//Bump it and add a migration when the layout of stored state is changed
+	stateSchemaVersion = 3
+)
+
+//stateMigrations upgrade the stored state from the version (key) to the next one
+var stateMigrations = map[int]func(store StateStore) error{
+	1: migrateUserPermissions,
+	2: chainAuditEvents,
+}
+
+//errStopListing stops ListReverse without an error
+var errStopListing = errors.New("stop listing")
+
+//StateStore persists the state of runtimes, images and commands
+type StateStore interface {
+	//Put the value (JSON encoded) with the key in the bucket
+	Put(bucket, key string, value interface{}) error
+
+	//Delete the key from the bucket
+	Delete(bucket, key string) error
+
+	//List all the items in the bucket in the order of keys
+	List(bucket string, fn func(key string, data []byte) error) error
+
+	//ListReverse lists the items with the keys before the key (all if it's empty) in the reverse order of keys,
+	//fn returns errStopListing to stop early
+	ListReverse(bucket, before string, fn func(key string, data []byte) error) error
+
+	//Close the store
+	Close() error
+}
+
+//NewStateStore creates the state store by the config and upgrades the schema
+func NewStateStore(config *StateConfig) (StateStore, error) {
+	var store StateStore
+	switch config.Driver {
+	case stateDriverMemory, "":
+		store = NewMemoryStateStore()
+	case stateDriverBolt:
+		boltStore, err := NewBoltStateStore(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		store = boltStore
+	default:
+		return nil, fmt.Errorf("state driver '%s' is not supported", config.Driver)
+	}
+
+	if err := upgradeSchema(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func upgradeSchema(store StateStore) error {
+	version := 0
+	err := store.List(bucketMeta, func(key string, data []byte) error {
+		if key == keySchemaVersion {
+			return json.Unmarshal(data, &version)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Fresh store
+	if version == 0 {
+		return store.Put(bucketMeta, keySchemaVersion, stateSchemaVersion)
+	}
+
+	if version > stateSchemaVersion {
+		return fmt.Errorf("state schema version %d is newer than the supported %d", version, stateSchemaVersion)
+	}
+
+	for ; version < stateSchemaVersion; version++ {
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return fmt.Errorf("no migration of state schema version %d", version)
+		}
+		if err := migrate(store); err != nil {
+			return fmt.Errorf("migrate state schema version %d error: %s", version, err)
+		}
+		if err := store.Put(bucketMeta, keySchemaVersion, version+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//MemoryStateStore keeps the state in memory, nothing survives a restart
+type MemoryStateStore struct {
+	lock    *sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+//NewMemoryStateStore ...
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		lock:    new(sync.RWMutex),
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+//Put ...
+func (ms *MemoryStateStore) Put(bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	b, ok := ms.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		ms.buckets[bucket] = b
+	}
+	b[key] = data
+
+	return nil
+}
+
+//Delete ...
+func (ms *MemoryStateStore) Delete(bucket, key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if b, ok := ms.buckets[bucket]; ok {
+		delete(b, key)
+	}
+
+	return nil
+}
+
+//List ...
+func (ms *MemoryStateStore) List(bucket string, fn func(key string, data []byte) error) error {
+	ms.lock.RLock()
+	b := ms.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	items := make(map[string][]byte, len(b))
+	for k, v := range b {
+		items[k] = v
+	}
+	ms.lock.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, items[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//ListReverse ...
+func (ms *MemoryStateStore) ListReverse(bucket, before string, fn func(key string, data []byte) error) error {
+	ms.lock.RLock()
+	b := ms.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	items := make(map[string][]byte, len(b))
+	for k, v := range b {
+		if len(before) == 0 || k < before {
+			keys = append(keys, k)
+			items[k] = v
+		}
+	}
+	ms.lock.RUnlock()
+
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, k := range keys {
+		if err := fn(k, items[k]); err != nil {
+			if err == errStopListing {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Close ...
+func (ms *MemoryStateStore) Close() error {
+	return nil
+}
+
+//BoltStateStore keeps the state in an embedded bbolt database
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+//NewBoltStateStore ...
+func NewBoltStateStore(path string) (*BoltStateStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("empty state db path")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStateStore{db: db}, nil
+}
+
+//Put ...
+func (bs *BoltStateStore) Put(bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), data)
+	})
+}
+
+//Delete ...
+func (bs *BoltStateStore) Delete(bucket, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+//List ...
+func (bs *BoltStateStore) List(bucket string, fn func(key string, data []byte) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+//ListReverse ...
+func (bs *BoltStateStore) ListReverse(bucket, before string, fn func(key string, data []byte) error) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.Last()
+		if len(before) > 0 {
+			//Seek to the first key at or after it, then step back
+			if k, _ = c.Seek([]byte(before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil; k, v = c.Prev() {
+			if err := fn(string(k), v); err != nil {
+				if err == errStopListing {
+					return nil
+				}
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//Close ...
+func (bs *BoltStateStore) Close() error {
+	return bs.db.Close()
+}
+
+//sequenceKey makes the keys sorted in the order of sequence
+func sequenceKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func parseSequenceKey(key string) uint64 {
+	seq, _ := strconv.ParseUint(key, 10, 64)
+	return seq
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"registry-factory/logger"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "registry-factory"
+
+	defaultTracingEndpoint    = "localhost:4318"
+	defaultTracingServiceName = "chameleon"
+)
+
+var (
+	//tracer starts the spans, they're not recorded until the tracing is enabled
+	tracer = otel.Tracer(tracerName)
+	//propagator carries the trace context in the W3C traceparent header,
+	//it's used even if the tracing is disabled to keep the incoming traces of clients
+	propagator = propagation.TraceContext{}
+)
+
+//initTracing installs the tracer provider exporting the spans over OTLP/HTTP by the config.
+//The returned func flushes the pending spans and shuts the provider down.
+func initTracing(ctx context.Context, config *TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if len(config.URLPath) > 0 {
+		options = append(options, otlptracehttp.WithURLPath(config.URLPath))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter error: %s", err)
+	}
+
+	return installTracerProvider(exporter, config), nil
+}
+
+//installTracerProvider installs the provider batching the spans to the exporter, e.g:
+//the in-memory one of go.opentelemetry.io/otel/sdk/trace/tracetest in the tests.
+func installTracerProvider(exporter sdktrace.SpanExporter, config *TracingConfig) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Infof("Tracing is exported to %s", config.Endpoint)
+
+	return provider.Shutdown
+}
+
+//startSpan starts the internal span as the child of the one in the context
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+//endSpan records the error of the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//traceStep runs the step in the child span of the one in the context
+func traceStep(ctx context.Context, name string, step func() error) error {
+	_, span := startSpan(ctx, name)
+	err := step()
+	endSpan(span, err)
+
+	return err
+}
+
+//tracingTransport traces the round trips to the runtimes and propagates the trace context to them
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+//RoundTrip ...
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "proxy round-trip",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", logger.URL(req.URL)),
+		),
+	)
+	//The request of round trip should not be modified
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := tt.next.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+		if res.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, res.Status)
+		}
+	}
+	endSpan(span, err)
+
+	return res, err
+}
+
+//injectTrace keeps the trace context of the request in the policy to continue it in the rebuild
+func (bp *BuildPolicy) injectTrace(ctx context.Context) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	bp.TraceParent = carrier.Get("traceparent")
+}
+
+//traceContext returns the context carrying the trace of the request which made the policy
+func (bp *BuildPolicy) traceContext() context.Context {
+	carrier := propagation.MapCarrier{"traceparent": bp.TraceParent}
+
+	return propagator.Extract(context.Background(), carrier)
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//sessionDriver reuses the runtime of the npm session and rebuilds it synchronously
+type sessionDriver struct{}
+
+func (sessionDriver) Schedule(ctx context.Context, meta RequestMeta) *SchedulePolicy {
+	return &SchedulePolicy{
+		ReuseIdentity: meta.Metadata["session"],
+		Rebuild:       &BuildPolicy{Image: "lodash", Tag: "4.17.21", NeedPush: true, Sync: true},
+	}
+}
+
+func TestTraceRequestToBuild(t *testing.T) {
+	//The tracer of package is bound to the first provider installed, so only this test installs one
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := installTracerProvider(exporter, &TracingConfig{ServiceName: defaultTracingServiceName, SampleRatio: 1})
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	h := newTestAPIHandler(t)
+	s := h.scheduler
+	s.drivers = map[string]ScheduleDriver{registryTypeNpm: sessionDriver{}}
+	//No namespace to push to, the build fails
+	s.packer = &Packer{}
+
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer runtime.Close()
+	s.pool.Put("npm:session-1", &Runtime{ID: "runtime-1", Target: ProxyTarget(strings.TrimPrefix(runtime.URL, "http://"))})
+
+	store := NewMemoryStateStore()
+	commandList := NewCommandList(store)
+	ps := &ProxyServer{
+		scheduler:   s,
+		auth:        h.auth,
+		audit:       h.audit,
+		reqParser:   &ParserChain{commandList: commandList},
+		commandList: commandList,
+	}
+	if err := ps.reqParser.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ps.proxy = ps.newProxy(&tracingTransport{next: http.DefaultTransport})
+
+	r := httptest.NewRequest(http.MethodPut, "/lodash", nil)
+	r.Header.Set("User-Agent", "npm/8.19.2 node/v18.12.1")
+	r.Header.Set("Referer", "publish")
+	r.Header.Set("Npm-Session", "session-1")
+	w := httptest.NewRecorder()
+	ps.serve(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d of the failed build: %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+
+	if err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	for _, name := range []string{"ProxyServer.serve", "ParserChain.Parse", "Scheduler.Schedule", "proxy round-trip", "rebuild", "Packer.Build"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("span %s is not exported, got %v", name, spans)
+		}
+	}
+
+	request := spans["ProxyServer.serve"]
+	if request.Parent.IsValid() || request.SpanKind != trace.SpanKindServer {
+		t.Errorf("request span is not the root server span: %+v", request)
+	}
+	for child, parent := range map[string]string{
+		"ParserChain.Parse":  "ProxyServer.serve",
+		"Scheduler.Schedule": "ProxyServer.serve",
+		"proxy round-trip":   "ProxyServer.serve",
+		"rebuild":            "ProxyServer.serve",
+		"Packer.Build":       "rebuild",
+	} {
+		span := spans[child]
+		if span.SpanContext.TraceID() != request.SpanContext.TraceID() {
+			t.Errorf("span %s is not in the trace of the request", child)
+		}
+		if span.Parent.SpanID() != spans[parent].SpanContext.SpanID() {
+			t.Errorf("parent of span %s is not %s", child, parent)
+		}
+	}
+
+	//The error is recorded by endSpan
+	build := spans["Packer.Build"]
+	if build.Status.Code != codes.Error || build.Status.Description != "empty namespace" {
+		t.Errorf("build status = %+v, want the error", build.Status)
+	}
+	if len(build.Events) != 1 || build.Events[0].Name != "exception" {
+		t.Errorf("build events = %+v, want the recorded error", build.Events)
+	}
+	if spans["rebuild"].Status.Code != codes.Error || request.Status.Code != codes.Error {
+		t.Errorf("failed build is not reported by the rebuild and request spans")
+	}
+	if spans["Scheduler.Schedule"].Status.Code == codes.Error {
+		t.Errorf("schedule status = %+v, want it ok", spans["Scheduler.Schedule"].Status)
+	}
+}
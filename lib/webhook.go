@@ -0,0 +1,258 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"registry-factory/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxWebhookEvents = 200
+
+	webhookEventPush          = "push"
+	webhookEventDelete        = "delete"
+	webhookEventScanCompleted = "scan_completed"
+	webhookEventReplication   = "replication"
+)
+
+//webhookEventTypes maps the event types of harbor v2 and v1 to the handled ones
+var webhookEventTypes = map[string]string{
+	"PUSH_ARTIFACT":      webhookEventPush,
+	"DELETE_ARTIFACT":    webhookEventDelete,
+	"SCANNING_COMPLETED": webhookEventScanCompleted,
+	"REPLICATION":        webhookEventReplication,
+	"pushImage":          webhookEventPush,
+	"deleteImage":        webhookEventDelete,
+	"scanningCompleted":  webhookEventScanCompleted,
+	"replication":        webhookEventReplication,
+}
+
+//WebhookEvent is the harbor event received by the webhook
+type WebhookEvent struct {
+	Type string `json:"type"`
+	//Event type sent by harbor
+	HarborType string `json:"harbor_type"`
+	Operator   string `json:"operator"`
+	OccurAt    int64  `json:"occur_at"`
+	Namespace  string `json:"namespace"`
+	//Repositories (without namespace) and their tags, empty tags means all of them
+	Repositories map[string][]string `json:"repositories"`
+	//Runtimes recycled for the event
+	Recycled     []string `json:"recycled"`
+	ReceivedTime int64    `json:"received_time"`
+}
+
+//harborWebhookPayload is the payload posted by harbor, v1 (1.9+) and v2 share the layout
+type harborWebhookPayload struct {
+	Type      string `json:"type"`
+	OccurAt   int64  `json:"occur_at"`
+	Operator  string `json:"operator"`
+	EventData struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"repository"`
+		Replication *struct {
+			SrcResource struct {
+				Namespace string `json:"namespace"`
+			} `json:"src_resource"`
+			DestResource struct {
+				Namespace string `json:"namespace"`
+			} `json:"dest_resource"`
+			SuccessfulArtifacts []struct {
+				//e.g: alpine [1 item(s) in total]
+				NameTag string `json:"name_tag"`
+			} `json:"successful_artifact"`
+		} `json:"replication"`
+	} `json:"event_data"`
+}
+
+//HarborWebhook receives the events of harbor to keep the runtimes and cached lookups up to date
+//when the package images are changed in harbor directly, the received events are recorded.
+type HarborWebhook struct {
+	scheduler *Scheduler
+	events    []*WebhookEvent
+	lock      *sync.RWMutex
+	store     StateStore
+	//Sequence of the first and next event in store
+	first uint64
+	next  uint64
+}
+
+//NewHarborWebhook ...
+func NewHarborWebhook(scheduler *Scheduler, store StateStore) *HarborWebhook {
+	return &HarborWebhook{
+		scheduler: scheduler,
+		events:    make([]*WebhookEvent, 0),
+		lock:      new(sync.RWMutex),
+		store:     store,
+	}
+}
+
+//Load the recorded events from the state store
+func (hw *HarborWebhook) Load() error {
+	hw.lock.Lock()
+	defer hw.lock.Unlock()
+
+	seqs := make([]string, 0)
+	events := make([]*WebhookEvent, 0)
+	err := hw.store.List(bucketWebhooks, func(key string, data []byte) error {
+		event := &WebhookEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return err
+		}
+		seqs = append(seqs, key)
+		events = append(events, event)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Keys are sorted by sequence
+	hw.events = events
+	hw.first, hw.next = 0, 0
+	if len(seqs) > 0 {
+		hw.first = parseSequenceKey(seqs[0])
+		hw.next = parseSequenceKey(seqs[len(seqs)-1]) + 1
+	}
+
+	return nil
+}
+
+//Receive handles the payload posted by harbor, nil event is returned if the event type is not handled
+func (hw *HarborWebhook) Receive(data []byte) (*WebhookEvent, error) {
+	payload := &harborWebhookPayload{}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return nil, err
+	}
+
+	eventType, ok := webhookEventTypes[payload.Type]
+	if !ok {
+		logger.Infof("Harbor webhook event %s is ignored", payload.Type)
+		return nil, nil
+	}
+
+	event, err := parseWebhookEvent(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(event.Repositories) == 0 {
+		//Not sure what are changed
+		hw.scheduler.RefreshImage(event.Namespace, "", "")
+	}
+	//Scanning changes nothing of the images, only the cached lookups are dropped
+	for repo, tags := range event.Repositories {
+		if len(tags) == 0 {
+			tags = []string{""}
+		}
+		for _, tag := range tags {
+			if eventType == webhookEventScanCompleted {
+				hw.scheduler.existence.Invalidate(event.Namespace, repo, tag)
+				continue
+			}
+			event.Recycled = append(event.Recycled, hw.scheduler.RefreshImage(event.Namespace, repo, tag)...)
+		}
+	}
+
+	logger.Infof("Harbor webhook event %s of namespace %s received, %d runtimes recycled", payload.Type, event.Namespace, len(event.Recycled))
+	hw.record(event)
+
+	return event, nil
+}
+
+//Events returns the recorded events, filtered by the type if it's not empty
+func (hw *HarborWebhook) Events(eventType string) []*WebhookEvent {
+	hw.lock.RLock()
+	defer hw.lock.RUnlock()
+
+	events := make([]*WebhookEvent, 0)
+	for _, e := range hw.events {
+		if len(eventType) == 0 || e.Type == eventType {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+func (hw *HarborWebhook) record(event *WebhookEvent) {
+	hw.lock.Lock()
+	defer hw.lock.Unlock()
+
+	if len(hw.events) >= maxWebhookEvents {
+		hw.events = append(hw.events[:0:0], hw.events[1:]...)
+		if err := hw.store.Delete(bucketWebhooks, sequenceKey(hw.first)); err != nil {
+			logger.Errorf("Failed to delete webhook event from state store: %s", err)
+		}
+		hw.first++
+	}
+	hw.events = append(hw.events, event)
+
+	if err := hw.store.Put(bucketWebhooks, sequenceKey(hw.next), event); err != nil {
+		logger.Errorf("Failed to persist webhook event: %s", err)
+	}
+	hw.next++
+}
+
+func parseWebhookEvent(eventType string, payload *harborWebhookPayload) (*WebhookEvent, error) {
+	event := &WebhookEvent{
+		Type:         eventType,
+		HarborType:   payload.Type,
+		Operator:     payload.Operator,
+		OccurAt:      payload.OccurAt,
+		Repositories: make(map[string][]string),
+		Recycled:     make([]string, 0),
+		ReceivedTime: time.Now().Unix(),
+	}
+
+	if eventType == webhookEventReplication {
+		replication := payload.EventData.Replication
+		if replication == nil {
+			return nil, errors.New("no replication in the event")
+		}
+		event.Namespace = replication.DestResource.Namespace
+		//The replicated tags are unknown
+		for _, a := range replication.SuccessfulArtifacts {
+			repo := strings.TrimSpace(strings.SplitN(a.NameTag, " [", 2)[0])
+			repo = strings.TrimPrefix(repo, replication.SrcResource.Namespace+"/")
+			if len(repo) > 0 {
+				event.Repositories[repo] = nil
+			}
+		}
+	} else {
+		repository := payload.EventData.Repository
+		event.Namespace = repository.Namespace
+		if len(repository.Name) > 0 {
+			tags := make([]string, 0)
+			for _, r := range payload.EventData.Resources {
+				if len(r.Tag) == 0 {
+					//Untagged artifact is deleted, refresh all the tags
+					tags = nil
+					break
+				}
+				tags = append(tags, r.Tag)
+			}
+			if len(tags) == 0 {
+				tags = nil
+			}
+			event.Repositories[repository.Name] = tags
+		}
+	}
+
+	if len(event.Namespace) == 0 {
+		return nil, errors.New("no namespace in the event")
+	}
+
+	return event, nil
+}
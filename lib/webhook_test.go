@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	samplePushPayload = `{
+  "type": "PUSH_ARTIFACT",
+  "occur_at": 1586922308,
+  "operator": "admin",
+  "event_data": {
+    "resources": [{
+      "digest": "sha256:8a9e9863dbb6e10edb5adfe917c00da84e1700fa76e7ed02476aa6e6fb8ee0d8",
+      "tag": "4.17.21",
+      "resource_url": "harbor.local/npm/lodash:4.17.21"
+    }],
+    "repository": {
+      "date_created": 1586922308,
+      "name": "lodash",
+      "namespace": "npm",
+      "repo_full_name": "npm/lodash",
+      "repo_type": "private"
+    }
+  }
+}`
+	sampleV1DeletePayload = `{
+  "type": "deleteImage",
+  "occur_at": 1586922308,
+  "operator": "admin",
+  "event_data": {
+    "resources": [{"digest": "sha256:8a9e", "tag": "", "resource_url": "harbor.local/npm/lodash"}],
+    "repository": {"name": "lodash", "namespace": "npm", "repo_full_name": "npm/lodash"}
+  }
+}`
+	sampleReplicationPayload = `{
+  "type": "REPLICATION",
+  "occur_at": 1586922308,
+  "operator": "MANUAL",
+  "event_data": {
+    "replication": {
+      "src_resource": {"namespace": "upstream"},
+      "dest_resource": {"namespace": "npm"},
+      "successful_artifact": [{"type": "image", "status": "Success", "name_tag": "upstream/lodash [1 item(s) in total]"}]
+    }
+  }
+}`
+	sampleQuotaPayload = `{"type": "QUOTA_EXCEED", "occur_at": 1586922308, "operator": "", "event_data": {}}`
+)
+
+func newTestAPIHandler(t *testing.T) *APIHandler {
+	Config = &Configuration{
+		Harbor:      &HarborConfig{},
+		NpmRegistry: &RegistryConfig{Namespace: "npm"},
+		PipRegistry: &RegistryConfig{Namespace: "pip"},
+		Auth:        &AuthConfig{},
+		Identity:    &IdentityConfig{LDAP: &LDAPConfig{}, OIDC: &OIDCConfig{}},
+		RBAC:        &RBACConfig{},
+		Audit:       &AuditConfig{Syslog: &SyslogConfig{}},
+		Eviction:    &EvictionConfig{},
+	}
+
+	store := NewMemoryStateStore()
+	scheduler := &Scheduler{
+		pool:      NewRuntimePool(0, nil, nil, store),
+		existence: NewExistenceCache(defaultExistenceTTL),
+		admission: NewAdmissionController(0, nil, defaultQueueSize, time.Second),
+	}
+	t.Cleanup(scheduler.pool.Close)
+
+	return &APIHandler{
+		scheduler: scheduler,
+		webhook:   NewHarborWebhook(scheduler, store),
+		auth:      NewAuthenticator(store),
+		audit:     NewAuditTrail(store),
+	}
+}
+
+//withAdmin bootstraps the admin user with the password
+func withAdmin(t *testing.T, h *APIHandler, password string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Auth.Users = []*UserConfig{{Username: "admin", PasswordHash: string(hash)}}
+	Config.RBAC.Bindings = []*RoleBindingConfig{{Role: roleAdmin, User: "admin"}}
+	if err := h.auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func postWebhook(h *APIHandler, payload string, header func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, managementAPIStats+"/webhooks/harbor", strings.NewReader(payload))
+	if header != nil {
+		header(r)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestHarborWebhookSecret(t *testing.T) {
+	h := newTestAPIHandler(t)
+	Config.Auth.Enabled = true
+	Config.Harbor.WebhookSecret = "Bearer s3cret"
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no secret", "", http.StatusUnauthorized},
+		{"wrong secret", "Bearer guess", http.StatusUnauthorized},
+		{"secret prefix", "Bearer s3cre", http.StatusUnauthorized},
+		{"valid secret", "Bearer s3cret", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postWebhook(h, samplePushPayload, func(r *http.Request) {
+				if len(tc.header) > 0 {
+					r.Header.Set("Authorization", tc.header)
+				}
+			})
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHarborWebhookWithoutSecret(t *testing.T) {
+	h := newTestAPIHandler(t)
+	Config.Auth.Enabled = true
+	withAdmin(t, h, "passw0rd")
+
+	if w := postWebhook(h, samplePushPayload, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous webhook status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	//The secret of harbor is not taken as a credential
+	w := postWebhook(h, samplePushPayload, func(r *http.Request) { r.Header.Set("Authorization", "") })
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("empty auth header status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = postWebhook(h, samplePushPayload, func(r *http.Request) { r.SetBasicAuth("admin", "wrong") })
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = postWebhook(h, samplePushPayload, func(r *http.Request) { r.SetBasicAuth("admin", "passw0rd") })
+	if w.Code != http.StatusOK {
+		t.Errorf("admin webhook status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	//Not checked at all without auth
+	Config.Auth.Enabled = false
+	if w := postWebhook(h, samplePushPayload, nil); w.Code != http.StatusOK {
+		t.Errorf("webhook status = %d without auth, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestHarborWebhookPayloads(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		payload      string
+		status       int
+		eventType    string
+		repositories map[string][]string
+		//Cached lookups dropped by the event
+		invalidated []string
+		kept        []string
+	}{
+		{
+			name:         "push",
+			payload:      samplePushPayload,
+			status:       http.StatusOK,
+			eventType:    webhookEventPush,
+			repositories: map[string][]string{"lodash": {"4.17.21"}},
+			invalidated:  []string{"lodash:4.17.21"},
+			kept:         []string{"lodash:4.17.20", "express:4.17.21"},
+		},
+		{
+			name:         "v1 delete untagged",
+			payload:      sampleV1DeletePayload,
+			status:       http.StatusOK,
+			eventType:    webhookEventDelete,
+			repositories: map[string][]string{"lodash": nil},
+			invalidated:  []string{"lodash:4.17.21", "lodash:4.17.20"},
+			kept:         []string{"express:4.17.21"},
+		},
+		{
+			name:         "replication",
+			payload:      sampleReplicationPayload,
+			status:       http.StatusOK,
+			eventType:    webhookEventReplication,
+			repositories: map[string][]string{"lodash": nil},
+			invalidated:  []string{"lodash:4.17.21", "lodash:4.17.20"},
+			kept:         []string{"express:4.17.21"},
+		},
+		{
+			name:    "ignored type",
+			payload: sampleQuotaPayload,
+			status:  http.StatusOK,
+			kept:    []string{"lodash:4.17.21", "lodash:4.17.20", "express:4.17.21"},
+		},
+		{
+			name:    "malformed",
+			payload: `{"type": "PUSH_ARTIFACT"`,
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "no namespace",
+			payload: `{"type": "PUSH_ARTIFACT", "event_data": {"repository": {"name": "lodash"}}}`,
+			status:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestAPIHandler(t)
+			existence := h.scheduler.existence
+			for _, key := range []string{"lodash:4.17.21", "lodash:4.17.20", "express:4.17.21"} {
+				existence.entries["npm/"+key] = &existenceEntry{kind: packageKindImage, expireTime: time.Now().Unix() + 60}
+			}
+
+			w := postWebhook(h, tc.payload, nil)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body.String())
+			}
+
+			if len(tc.eventType) > 0 {
+				event := &WebhookEvent{}
+				if err := json.Unmarshal(w.Body.Bytes(), event); err != nil {
+					t.Fatalf("invalid event %q: %s", w.Body.String(), err)
+				}
+				if event.Type != tc.eventType || event.Namespace != "npm" {
+					t.Errorf("event type = %s, namespace = %s", event.Type, event.Namespace)
+				}
+				if !equalRepositories(event.Repositories, tc.repositories) {
+					t.Errorf("event repositories = %v, want %v", event.Repositories, tc.repositories)
+				}
+				if events := h.webhook.Events(tc.eventType); len(events) != 1 {
+					t.Errorf("%d events recorded, want 1", len(events))
+				}
+			} else if events := h.webhook.Events(""); len(events) != 0 {
+				t.Errorf("%d events recorded, want none", len(events))
+			}
+
+			for _, key := range tc.invalidated {
+				if _, ok := existence.entries["npm/"+key]; ok {
+					t.Errorf("cached lookup of %s is not invalidated", key)
+				}
+			}
+			for _, key := range tc.kept {
+				if _, ok := existence.entries["npm/"+key]; !ok {
+					t.Errorf("cached lookup of %s is invalidated", key)
+				}
+			}
+		})
+	}
+}
+
+func equalRepositories(got, want map[string][]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for repo, tags := range want {
+		gotTags, ok := got[repo]
+		if !ok || strings.Join(gotTags, ",") != strings.Join(tags, ",") {
+			return false
+		}
+	}
+
+	return true
+}
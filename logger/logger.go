@@ -0,0 +1,282 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//maxBodyLen is the max size of the JSON bodies logged
+	maxBodyLen = 4096
+
+	//FormatText is the human readable line with the fields appended
+	FormatText = "text"
+	//FormatLogfmt is the key=value line
+	FormatLogfmt = "logfmt"
+	//FormatJSON is one JSON object per line
+	FormatJSON = "json"
+
+	//RequestIDField is the field of the request correlation ID
+	RequestIDField = "request_id"
+)
+
+//Level of the log lines
+type Level int
+
+//The levels in order
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+//ParseLevel parses the level name
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("log level '%s' is not supported", name)
+}
+
+var (
+	lock                     = new(sync.Mutex)
+	output         io.Writer = os.Stderr
+	minLevel                 = LevelInfo
+	format                   = FormatText
+	root                     = &Entry{}
+	loggingFormats           = map[string]bool{FormatText: true, FormatLogfmt: true, FormatJSON: true}
+)
+
+//Configure sets the min level and the format of the log lines
+func Configure(level, lineFormat string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if !loggingFormats[lineFormat] {
+		return fmt.Errorf("log format '%s' is not supported", lineFormat)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	minLevel = l
+	format = lineFormat
+
+	return nil
+}
+
+//Entry writes the log lines with its fields
+type Entry struct {
+	fields map[string]string
+}
+
+//With returns the root entry with the field
+func With(key string, value interface{}) *Entry {
+	return root.With(key, value)
+}
+
+//WithRequest returns the entry with the request ID, the root entry if the ID is empty
+func WithRequest(requestID string) *Entry {
+	return root.WithRequest(requestID)
+}
+
+//With returns the copy of entry with the field
+func (e *Entry) With(key string, value interface{}) *Entry {
+	fields := make(map[string]string, len(e.fields)+1)
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	fields[key] = fmt.Sprint(value)
+
+	return &Entry{fields: fields}
+}
+
+//WithRequest returns the copy of entry with the request ID
+func (e *Entry) WithRequest(requestID string) *Entry {
+	if len(requestID) == 0 {
+		return e
+	}
+
+	return e.With(RequestIDField, requestID)
+}
+
+//Debugf ...
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	e.write(LevelDebug, format, v...)
+}
+
+//Infof ...
+func (e *Entry) Infof(format string, v ...interface{}) {
+	e.write(LevelInfo, format, v...)
+}
+
+//Warnf ...
+func (e *Entry) Warnf(format string, v ...interface{}) {
+	e.write(LevelWarn, format, v...)
+}
+
+//Errorf ...
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	e.write(LevelError, format, v...)
+}
+
+//Fatalf logs the error and exits
+func (e *Entry) Fatalf(format string, v ...interface{}) {
+	e.write(LevelError, format, v...)
+	os.Exit(1)
+}
+
+//Request logs the inbound request, its session, headers and the small JSON body are logged at debug level.
+//The secrets are redacted by the rules.
+func (e *Entry) Request(req *http.Request) {
+	e.Infof("INCOMING REQ: %s %s", req.Method, URL(req.URL))
+	if !enabled(LevelDebug) {
+		return
+	}
+
+	session := []string{}
+	cookieRedacted := currentRules().headers["cookie"]
+	for _, c := range req.Cookies() {
+		if cookieRedacted {
+			session = append(session, fmt.Sprintf("%s=%s", c.Name, Redacted))
+			continue
+		}
+		session = append(session, c.String())
+	}
+	//For npm
+	if npmSession := req.Header.Get("Npm-Session"); len(npmSession) > 0 {
+		if currentRules().headers["npm-session"] {
+			npmSession = Redacted
+		}
+		session = append(session, fmt.Sprintf("%s:%s", "Npm-Session", npmSession))
+	}
+	e.Debugf("SESSION: %s", strings.Join(session, "; "))
+	e.Debugf("HEADER: %#-v", Headers(req.Header))
+
+	if req.Body == nil || req.ContentLength <= 0 || req.ContentLength > maxBodyLen ||
+		!strings.Contains(req.Header.Get("Content-Type"), "json") {
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	e.Debugf("BODY: %s", Body(data))
+}
+
+//Command logs the command line (name and arguments) with the secrets redacted
+func (e *Entry) Command(argv []string) {
+	e.Debugf("command: %s", Args(argv))
+}
+
+//Debugf logs with the root entry
+func Debugf(format string, v ...interface{}) {
+	root.write(LevelDebug, format, v...)
+}
+
+//Infof logs with the root entry
+func Infof(format string, v ...interface{}) {
+	root.write(LevelInfo, format, v...)
+}
+
+//Warnf logs with the root entry
+func Warnf(format string, v ...interface{}) {
+	root.write(LevelWarn, format, v...)
+}
+
+//Errorf logs with the root entry
+func Errorf(format string, v ...interface{}) {
+	root.write(LevelError, format, v...)
+}
+
+//Fatalf logs the error with the root entry and exits
+func Fatalf(format string, v ...interface{}) {
+	root.Fatalf(format, v...)
+}
+
+func enabled(level Level) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return level >= minLevel
+}
+
+func (e *Entry) write(level Level, msgFormat string, v ...interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if level < minLevel {
+		return
+	}
+
+	now := time.Now()
+	msg := strings.TrimRight(fmt.Sprintf(msgFormat, v...), "\n")
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	switch format {
+	case FormatJSON:
+		line := map[string]string{
+			"time":  now.UTC().Format(time.RFC3339Nano),
+			"level": levelNames[level],
+			"msg":   msg,
+		}
+		for k, v := range e.fields {
+			if _, ok := line[k]; !ok {
+				line[k] = v
+			}
+		}
+		data, _ := json.Marshal(line)
+		buf.Write(data)
+	case FormatLogfmt:
+		fmt.Fprintf(buf, "time=%s level=%s msg=%s", now.UTC().Format(time.RFC3339Nano), levelNames[level], logfmtValue(msg))
+		for _, k := range keys {
+			fmt.Fprintf(buf, " %s=%s", k, logfmtValue(e.fields[k]))
+		}
+	default:
+		fmt.Fprintf(buf, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(levelNames[level]), msg)
+		for _, k := range keys {
+			fmt.Fprintf(buf, " %s=%s", k, logfmtValue(e.fields[k]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	output.Write(buf.Bytes())
+}
+
+//logfmtValue quotes the value if it has spaces, quotes or equal signs
+func logfmtValue(v string) string {
+	if len(v) == 0 || strings.ContainsAny(v, " \t\n\r\"=") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
@@ -0,0 +1,237 @@
+package logger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Redacted replaces the secret values
+const Redacted = "REDACTED"
+
+//Rules tells what are redacted, the names are case insensitive
+type Rules struct {
+	//Header names
+	Headers []string
+	//Query parameter names
+	QueryParams []string
+	//Command flags whose values are redacted, e.g: --password
+	Args []string
+	//JSON field names at any depth
+	BodyFields []string
+	//Parts of the env var names whose values are redacted from the -e and --env flags, e.g: PASSWORD
+	EnvVars []string
+	//Label keys whose values are redacted from the -l and --label flags
+	Labels []string
+}
+
+//defaultRules are always applied
+var defaultRules = Rules{
+	//Npm-Session picks the runtime of the session
+	Headers:     []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "Npm-Otp", "Npm-Session"},
+	QueryParams: []string{"token", "access_token", "password", "secret", "client_secret"},
+	Args:        []string{"--password", "--token", "--secret"},
+	BodyFields:  []string{"password", "token", "secret", "client_secret", "_auth", "_password"},
+	EnvVars:     []string{"password", "token", "secret", "credential", "_auth"},
+}
+
+var (
+	rulesLock = new(sync.RWMutex)
+	rules     = compile(Rules{})
+)
+
+//compiledRules are the lowercase name sets
+type compiledRules struct {
+	headers     map[string]bool
+	queryParams map[string]bool
+	args        map[string]bool
+	bodyFields  map[string]bool
+	envVars     map[string]bool
+	labels      map[string]bool
+}
+
+//SetRules sets the rules applied in addition to the default ones
+func SetRules(extra Rules) {
+	compiled := compile(extra)
+
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+
+	rules = compiled
+}
+
+func currentRules() *compiledRules {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+
+	return rules
+}
+
+func compile(extra Rules) *compiledRules {
+	return &compiledRules{
+		headers:     nameSet(defaultRules.Headers, extra.Headers),
+		queryParams: nameSet(defaultRules.QueryParams, extra.QueryParams),
+		args:        nameSet(defaultRules.Args, extra.Args),
+		bodyFields:  nameSet(defaultRules.BodyFields, extra.BodyFields),
+		envVars:     nameSet(defaultRules.EnvVars, extra.EnvVars),
+		labels:      nameSet(defaultRules.Labels, extra.Labels),
+	}
+}
+
+func nameSet(lists ...[]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, name := range list {
+			set[strings.ToLower(name)] = true
+		}
+	}
+
+	return set
+}
+
+//Headers returns the copy of headers with the secret values redacted
+func Headers(h http.Header) http.Header {
+	r := currentRules()
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		if r.headers[strings.ToLower(name)] {
+			redacted[name] = []string{Redacted}
+			continue
+		}
+		redacted[name] = append([]string(nil), values...)
+	}
+
+	return redacted
+}
+
+//URL returns the URL with the secret query parameters and the user password redacted
+func URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	r := currentRules()
+	redacted := *u
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			redacted.User = url.UserPassword(u.User.Username(), Redacted)
+		}
+	}
+	if len(u.RawQuery) > 0 {
+		query := u.Query()
+		changed := false
+		for name := range query {
+			if r.queryParams[strings.ToLower(name)] {
+				query[name] = []string{Redacted}
+				changed = true
+			}
+		}
+		if changed {
+			redacted.RawQuery = query.Encode()
+		}
+	}
+
+	return redacted.String()
+}
+
+//Args returns the copy of command arguments with the values of secret flags redacted,
+//both '--flag value' and '--flag=value' are handled, so are the secret env vars of '-e NAME=value'
+//and the labels of '--label key=value'.
+func Args(args []string) []string {
+	r := currentRules()
+	redacted := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if isPairFlag(arg) && i+1 < len(args) {
+			redacted = append(redacted, arg, r.redactPair(arg, args[i+1]))
+			i++
+			continue
+		}
+		pair := strings.SplitN(arg, "=", 2)
+		if len(pair) == 2 && isPairFlag(pair[0]) {
+			redacted = append(redacted, pair[0]+"="+r.redactPair(pair[0], pair[1]))
+			continue
+		}
+		if len(pair) == 2 && r.args[strings.ToLower(pair[0])] {
+			redacted = append(redacted, pair[0]+"="+Redacted)
+			continue
+		}
+		redacted = append(redacted, arg)
+		if r.args[strings.ToLower(arg)] && i+1 < len(args) {
+			redacted = append(redacted, Redacted)
+			i++
+		}
+	}
+
+	return redacted
+}
+
+//isPairFlag tells the flags taking NAME=value
+func isPairFlag(arg string) bool {
+	return isEnvFlag(arg) || arg == "-l" || arg == "--label"
+}
+
+func isEnvFlag(arg string) bool {
+	return arg == "-e" || arg == "--env"
+}
+
+//redactPair redacts the value of NAME=value if the env var name contains any of the rules,
+//or the label key is one of them
+func (r *compiledRules) redactPair(flag, value string) string {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 {
+		return value
+	}
+	name := strings.ToLower(pair[0])
+	if !isEnvFlag(flag) {
+		if r.labels[name] {
+			return pair[0] + "=" + Redacted
+		}
+		return value
+	}
+	for part := range r.envVars {
+		if strings.Contains(name, part) {
+			return pair[0] + "=" + Redacted
+		}
+	}
+
+	return value
+}
+
+//Body returns the JSON body with the secret fields redacted,
+//the body is replaced with its size if it's not JSON.
+func Body(data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "<" + strconv.Itoa(len(data)) + " bytes>"
+	}
+
+	redacted, err := json.Marshal(redactValue(currentRules(), v))
+	if err != nil {
+		return "<" + strconv.Itoa(len(data)) + " bytes>"
+	}
+
+	return string(redacted)
+}
+
+func redactValue(r *compiledRules, v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if r.bodyFields[strings.ToLower(k)] {
+				value[k] = Redacted
+				continue
+			}
+			value[k] = redactValue(r, field)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(r, item)
+		}
+	}
+
+	return v
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
 	"os"
 	"os/signal"
 	"registry-factory/lib"
+	"registry-factory/logger"
 	"syscall"
 )
 
@@ -16,14 +16,17 @@ func main() {
 
 	//Load config
 	if err := lib.Config.Load(*yamlFile); err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%s", err)
 	}
 
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	s := lib.NewProxyServer(ctx)
+	s, err := lib.NewProxyServer(ctx)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
 	done := make(chan error, 1)
 	go func() {
 		if err := s.Start(); err != nil {
@@ -31,21 +34,25 @@ func main() {
 		}
 	}()
 
-	log.Printf("Server is listening at %s:%d...\n", lib.Config.Host, lib.Config.Port)
-	defer log.Println("Server is shutdown")
+	logger.Infof("Server is listening at %s:%d...", lib.Config.Host, lib.Config.Port)
+	defer logger.Infof("Server is shutdown")
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, os.Kill)
 
 	select {
 	case err := <-done:
-		log.Fatalf("Server error: %s\n", err)
+		logger.Fatalf("Server error: %s", err)
 	case <-ctx.Done():
-		log.Println("ctx done!")
+		logger.Infof("ctx done!")
 	case <-sig:
-		log.Println("Gracefully shutting down the server...")
-		if err := s.Stop(); err != nil {
-			log.Printf("Failed to shutdown server with error: %s\n", err)
+		logger.Infof("Gracefully shutting down the server...")
+		report, err := s.Stop()
+		if err != nil {
+			logger.Warnf("Failed to shutdown server with error: %s", err)
+		}
+		if report != nil {
+			logger.Infof("Shutdown report: %s", report)
 		}
 	}
 }
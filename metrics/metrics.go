@@ -0,0 +1,340 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//ContentType of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//DefaultBuckets are the upper bounds (seconds) of histograms, from the fast requests to the slow builds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+//collector writes its samples in the Prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	lock       *sync.RWMutex
+	names      []string
+	collectors map[string]collector
+}{
+	lock:       new(sync.RWMutex),
+	collectors: make(map[string]collector),
+}
+
+//register the collector with the name, the later one replaces the existing
+func register(name string, c collector) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if _, ok := registry.collectors[name]; !ok {
+		registry.names = append(registry.names, name)
+		sort.Strings(registry.names)
+	}
+	registry.collectors[name] = c
+}
+
+//Write all the registered metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for _, name := range registry.names {
+		registry.collectors[name].write(buf)
+	}
+
+	return buf.Flush()
+}
+
+//Handler serves the registered metrics to the Prometheus scrapes
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		Write(w)
+	})
+}
+
+//desc is the name, help and label names of the metric
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+//key joins the label values to index the series, the missing values are empty
+func (d *desc) key(labelValues []string) (string, []string) {
+	values := make([]string, len(d.labels))
+	copy(values, labelValues)
+
+	return strings.Join(values, "\xff"), values
+}
+
+//series is the value of the label values
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+//vec keeps the series of a counter or gauge
+type vec struct {
+	desc
+	lock   *sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		lock:   new(sync.Mutex),
+		series: make(map[string]*series),
+	}
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	key, values := v.key(labelValues)
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: values}
+		v.series[key] = s
+	}
+	s.value += delta
+}
+
+func (v *vec) set(value float64, labelValues []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	key, values := v.key(labelValues)
+	v.series[key] = &series{labelValues: values, value: value}
+}
+
+func (v *vec) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.header(w)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelPairs(v.labels, s.labelValues, "", ""), formatFloat(s.value))
+	}
+}
+
+//CounterVec is the monotonic counter partitioned by the labels
+type CounterVec struct {
+	*vec
+}
+
+//NewCounter registers the counter with the label names
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	register(name, c)
+
+	return c
+}
+
+//Inc the counter of the label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+//Add the non-negative delta to the counter of the label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.add(delta, labelValues)
+}
+
+//GaugeVec is the value going up and down partitioned by the labels
+type GaugeVec struct {
+	*vec
+	collect func(g *GaugeVec)
+}
+
+//NewGauge registers the gauge with the label names
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+	register(name, g)
+
+	return g
+}
+
+//Set the gauge of the label values
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.set(value, labelValues)
+}
+
+//Add the delta to the gauge of the label values
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+//OnCollect sets the func refreshing the gauge on every scrape, the series are reset before calling it
+func (g *GaugeVec) OnCollect(collect func(g *GaugeVec)) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.collect = collect
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.lock.Lock()
+	collect := g.collect
+	if collect != nil {
+		g.series = make(map[string]*series)
+	}
+	g.lock.Unlock()
+
+	if collect != nil {
+		collect(g)
+	}
+	g.vec.write(w)
+}
+
+//histogramSeries is the bucket counts, sum and count of the label values
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+//HistogramVec counts the observations in buckets partitioned by the labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    *sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+//NewHistogram registers the histogram with the bucket upper bounds, DefaultBuckets if it's nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: bounds,
+		lock:    new(sync.Mutex),
+		series:  make(map[string]*histogramSeries),
+	}
+	register(name, h)
+
+	return h
+}
+
+//Observe the value of the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key, values := h.key(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.header(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labelValues, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, s.labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+//labelPairs formats {name="value",...} with the extra pair if its name is not empty
+func labelPairs(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch values := m.(type) {
+	case map[string]*series:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSeries:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}